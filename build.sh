@@ -8,12 +8,15 @@ go get -u github.com/jmespath/go-jmespath
 go get -u github.com/go-ini/ini
 go get -u github.com/hashicorp/golang-lru
 go get -u gopkg.in/yaml.v2
+go get -u github.com/gorilla/websocket
+go get -u golang.org/x/crypto/ssh/terminal
 
 modules=(jvshim ssmple overrun)
 for module in "${modules[@]}"; do
   pushd "$module"
   go fmt
   go build
+  go test
   popd
 done
 
@@ -0,0 +1,728 @@
+/*
+ * Copyright 2018 Mark Adamcin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const NoOptPrefix = "--no-"
+
+const SourceFlag = "flag"
+
+const EnvOptionPrefix = "OVERRUN_"
+
+const (
+	OptionSwitch = iota
+	OptionValue  = iota
+	OptionList   = iota
+)
+
+// the long options that may be given default values by OVERRUN_* environment variables. --count is excluded because
+// OVERRUN_COUNT is set in the environment of fan-out tasks. --since, --until and --follow are excluded because they
+// only make sense for a single invocation of the logs subcommand, and --name and --cron for a single schedule.
+var optionKinds = map[string]int{
+	"--profile":                 OptionValue,
+	"--region":                  OptionValue,
+	"--role-arn":                OptionValue,
+	"--role-session-name":       OptionValue,
+	"--external-id":             OptionValue,
+	"--mfa-serial":              OptionValue,
+	"--duration":                OptionValue,
+	"--endpoint-url":            OptionValue,
+	"--ecs-endpoint":            OptionValue,
+	"--ec2-endpoint":            OptionValue,
+	"--logs-endpoint":           OptionValue,
+	"--no-waiter-delay":         OptionSwitch,
+	"--task-def":                OptionValue,
+	"--task-def-file":           OptionValue,
+	"--deregister":              OptionSwitch,
+	"--cluster":                 OptionValue,
+	"--targets":                 OptionValue,
+	"--parallel-targets":        OptionSwitch,
+	"--container-name":          OptionValue,
+	"--cpu":                     OptionValue,
+	"--mem":                     OptionValue,
+	"--mem-res":                 OptionValue,
+	"--commands-file":           OptionValue,
+	"--parallel":                OptionValue,
+	"--env":                     OptionList,
+	"--env-file":                OptionList,
+	"--env-s3":                  OptionList,
+	"--resource-requirement":    OptionList,
+	"--tag":                     OptionList,
+	"--propagate-tags":          OptionValue,
+	"--group":                   OptionValue,
+	"--enable-ecs-managed-tags": OptionSwitch,
+	"--reference-id":            OptionValue,
+	"--capacity-provider":       OptionList,
+	"--dry-run":                 OptionSwitch,
+	"--emit":                    OptionValue,
+	"--stream-log":              OptionSwitch,
+	"--wait":                    OptionSwitch,
+	"--wait-healthy":            OptionSwitch,
+	"--health-timeout":          OptionValue,
+	"--enable-execute-command":  OptionSwitch,
+	"--interactive":             OptionSwitch,
+	"--stdin":                   OptionSwitch,
+	"--staging":                 OptionValue,
+	"--artifact":                OptionList,
+	"--log-format":              OptionValue,
+	"--log-fields":              OptionValue,
+	"--log-filter":              OptionValue,
+	"--log-file":                OptionValue,
+	"--log-json":                OptionSwitch,
+	"--price-table":             OptionValue,
+	"--schedule-role":           OptionValue,
+	"--exec-role":               OptionValue,
+	"--task-role":               OptionValue,
+	"--shell":                   OptionValue,
+	"--fargate":                 OptionList,
+	"--fargate:sg":              OptionList,
+	"--fargate:vpc":             OptionList,
+	"--fargate:ip":              OptionSwitch,
+	"--fargate:net":             OptionList,
+	"--fargate:host":            OptionList,
+}
+
+// the options that only apply to a subcommand, and are rejected on the command line of any other. They may still be
+// given by presets, which are shared by every subcommand.
+var commandOptions = map[string]string{
+	"--since":         "logs",
+	"--until":         "logs",
+	"--follow":        "logs",
+	"--name":          "schedule",
+	"--cron":          "schedule",
+	"--schedule-role": "schedule",
+}
+
+// the list options that take one value each time they are repeated.
+var repeatedOptions = map[string]bool{
+	"--env":                  true,
+	"--env-file":             true,
+	"--env-s3":               true,
+	"--resource-requirement": true,
+	"--capacity-provider":    true,
+	"--artifact":             true,
+	"--tag":                  true,
+}
+
+// EnvOptionName returns the name of the environment variable for a long option, such as OVERRUN_FARGATE_NET for
+// --fargate:net.
+func EnvOptionName(opt string) string {
+	name := strings.ToUpper(strings.TrimPrefix(opt, "--"))
+	name = strings.Replace(name, "-", "_", -1)
+	name = strings.Replace(name, ":", "_", -1)
+	return EnvOptionPrefix + name
+}
+
+// envOptionArgs converts the value of an option's environment variable into arguments. Switches accept true or false,
+// and a switch named with --no-, like --no-waiter-delay, is given false by its positive form. Options that take several
+// values, like --fargate:net and --env, accept a whitespace-separated list. false is also accepted by --shell and the
+// --fargate options to select their --no- forms.
+func envOptionArgs(opt string, kind int, value string) ([]string, error) {
+	noOpt := NoOptPrefix + strings.TrimPrefix(opt, "--")
+	if strings.HasPrefix(opt, NoOptPrefix) {
+		noOpt = "--" + strings.TrimPrefix(opt, NoOptPrefix)
+	}
+	switch kind {
+	case OptionSwitch:
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: expected true or false, got %s", EnvOptionName(opt), value)
+		}
+		if enabled {
+			return []string{opt}, nil
+		}
+		return []string{noOpt}, nil
+	case OptionList:
+		if enabled, err := strconv.ParseBool(value); err == nil && strings.HasPrefix(opt, "--fargate") {
+			if enabled {
+				return []string{opt}, nil
+			}
+			return []string{noOpt}, nil
+		}
+		values := strings.Fields(value)
+		if repeatedOptions[opt] {
+			var args []string
+			for _, v := range values {
+				args = append(args, opt, v)
+			}
+			return args, nil
+		}
+		return append([]string{opt}, values...), nil
+	default:
+		if opt == "--shell" && value == "false" {
+			return []string{noOpt}, nil
+		}
+		return []string{opt, value}, nil
+	}
+}
+
+func envOptionNames() []string {
+	var opts []string
+	for opt := range optionKinds {
+		opts = append(opts, opt)
+	}
+	sort.Strings(opts)
+	return opts
+}
+
+// ParseEnv applies a layer of arguments for each OVERRUN_* environment variable that is set to a non-empty value.
+func (p *ArgParser) ParseEnv() {
+	for _, opt := range envOptionNames() {
+		name := EnvOptionName(opt)
+		value, ok := os.LookupEnv(name)
+		if !ok || len(strings.TrimSpace(value)) == 0 {
+			continue
+		}
+		args, err := envOptionArgs(opt, optionKinds[opt], strings.TrimSpace(value))
+		if err != nil {
+			log.Fatal(err)
+		}
+		p.Parse("env "+name, args)
+	}
+}
+
+func PrintEnvOptions(w io.Writer) {
+	for _, opt := range envOptionNames() {
+		fmt.Fprintf(w, "  %-30s: %s\n", EnvOptionName(opt), opt)
+	}
+}
+
+// short and alternate option names, mapped to the long name that identifies the option.
+var optionAliases = map[string]string{
+	"-h":                "--help",
+	"-p":                "--profile",
+	"-r":                "--region",
+	"-t":                "--task-def",
+	"--task-definition": "--task-def",
+	"-c":                "--cluster",
+	"-n":                "--container-name",
+	"-x":                "--dry-run",
+	"-w":                "--wait",
+	"-l":                "--stream-log",
+	"-e":                "--env",
+	"-F":                "--follow",
+	"-f":                "--fargate",
+	"-f:ip":             "--fargate:ip",
+	"-f:vpc":            "--fargate:vpc",
+	"-f:net":            "--fargate:net",
+	"-f:host":           "--fargate:host",
+	"-f:sg":             "--fargate:sg",
+}
+
+// ArgParser builds ParsedArgs from successive layers of arguments, such as a preset followed by the command line.
+// Options given in a later layer override those given in an earlier layer. Options that accumulate values, like
+// --cluster, are reset by their first occurrence in a later layer, except for --env, which merges by variable name.
+type ArgParser struct {
+	prefs ParsedArgs
+
+	envOverrides []string
+
+	tagOverrides []string
+
+	source string
+
+	given string
+
+	seen map[string]bool
+
+	// the source of the layer in which each option was last given.
+	Sources map[string]string
+
+	// the values given for each option, in order, for reporting effective settings.
+	Values map[string][]string
+
+	// the form in which each option was last given, such as --no-shell for --shell.
+	Spelling map[string]string
+
+	// long option names in the order they were first given.
+	Order []string
+
+	// accept arguments that are not options, such as the task ID given to a subcommand, rather than failing.
+	AllowPositional bool
+
+	// the arguments that are not options, when AllowPositional is true.
+	Positional []string
+
+	// the subcommand whose arguments are parsed, such as logs, or empty to run tasks.
+	Command string
+}
+
+func NewArgParser() *ArgParser {
+	return &ArgParser{
+		prefs:    ParsedArgs{FilterMode: FilterModeCluster, Parallel: 1, HealthTimeout: DefaultHealthTimeout},
+		Sources:  make(map[string]string),
+		Values:   make(map[string][]string),
+		Spelling: make(map[string]string)}
+}
+
+func (p *ArgParser) fatalf(format string, v ...interface{}) {
+	if p.source != SourceFlag {
+		format = p.source + ": " + format
+	}
+	log.Fatalf(format, v...)
+}
+
+// record notes the values given for an option. Returns true for the first occurrence of the option in the current
+// layer, which signals that accumulated values from earlier layers should be discarded.
+func (p *ArgParser) record(opt string, values ...string) bool {
+	if _, ok := p.Sources[opt]; !ok {
+		p.Order = append(p.Order, opt)
+	}
+	first := !p.seen[opt]
+	p.seen[opt] = true
+	p.Spelling[opt] = p.given
+	if opt == "--env" || opt == "--env-file" || opt == "--tag" {
+		// values merge across layers, so report every layer that contributed.
+		if first && len(p.Sources[opt]) > 0 {
+			p.Sources[opt] = p.Sources[opt] + ", " + p.source
+		} else {
+			p.Sources[opt] = p.source
+		}
+	} else {
+		p.Sources[opt] = p.source
+		if first {
+			p.Values[opt] = nil
+		}
+	}
+	p.Values[opt] = append(p.Values[opt], values...)
+	return first
+}
+
+// value reads and records the value following the option at args[*i].
+func (p *ArgParser) value(opt string, args []string, i *int) (string, bool) {
+	if *i+1 >= len(args) {
+		p.fatalf("Missing value for option: \"%s\"", opt)
+	}
+	*i++
+	return args[*i], p.record(opt, args[*i])
+}
+
+func (p *ArgParser) intValue(opt string, args []string, i *int) int64 {
+	val, _ := p.value(opt, args, i)
+	ival, err := strconv.ParseInt(val, 10, 64)
+	if err != nil {
+		p.fatalf("Invalid %s value: %s", opt, err)
+	}
+	return ival
+}
+
+// durationValue parses a duration like 90s or 5m, or a number of seconds.
+func (p *ArgParser) durationValue(opt string, args []string, i *int) time.Duration {
+	val, _ := p.value(opt, args, i)
+	duration, err := time.ParseDuration(val)
+	if err != nil {
+		seconds, serr := strconv.Atoi(val)
+		if serr != nil {
+			p.fatalf("Invalid %s value: %s", opt, err)
+		}
+		duration = time.Duration(seconds) * time.Second
+	}
+	return duration
+}
+
+func (p *ArgParser) flag(opt string, isNoOpt bool) bool {
+	p.record(opt)
+	return !isNoOpt
+}
+
+func readFilterArgs(defaultFilter *string, optToEnd ...string) (int, []ec2.Filter) {
+	var filters []ec2.Filter
+	for _, optArg := range optToEnd {
+		valid, filter := ParseEc2Filter(optArg, defaultFilter)
+		if valid {
+			filters = append(filters, filter)
+		} else {
+			break
+		}
+	}
+	return len(filters), filters
+}
+
+// filters reads and records the filter arguments following the option at args[*i].
+func (p *ArgParser) filters(opt string, defaultFilter *string, args []string, i *int) ([]ec2.Filter, bool) {
+	parsed, filters := readFilterArgs(defaultFilter, args[*i+1:]...)
+	first := p.record(opt, args[*i+1:*i+1+parsed]...)
+	*i = *i + parsed
+	return filters, first
+}
+
+// Parse applies a layer of arguments from the named source.
+func (p *ArgParser) Parse(source string, args []string) {
+	p.source = source
+	p.seen = make(map[string]bool)
+	prefs := &p.prefs
+
+ArgLoop:
+	for i := 0; i < len(args); i++ {
+		opt := args[i]
+		isNoOpt := strings.HasPrefix(opt, NoOptPrefix)
+		if isNoOpt {
+			opt = "--" + strings.TrimPrefix(opt, NoOptPrefix)
+		}
+		if alias, ok := optionAliases[opt]; ok {
+			opt = alias
+		}
+		p.given = opt
+		if isNoOpt {
+			p.given = NoOptPrefix + strings.TrimPrefix(opt, "--")
+		}
+
+		if command, ok := commandOptions[opt]; ok && command != p.Command && p.source == SourceFlag {
+			usage()
+			p.fatalf("%s is only accepted by the %s subcommand", args[i], command)
+		}
+
+		if strings.HasPrefix(opt, "--fargate:") {
+			prefs.LaunchFargate = true
+		}
+
+		switch opt {
+		case "--profile":
+			prefs.AwsProfile, _ = p.value(opt, args, &i)
+		case "--region":
+			val, first := p.value(opt, args, &i)
+			if first {
+				prefs.AwsRegions = nil
+			}
+			prefs.AwsRegions = append(prefs.AwsRegions, SplitList(val)...)
+		case "--role-arn":
+			prefs.RoleArn, _ = p.value(opt, args, &i)
+		case "--role-session-name":
+			prefs.RoleSessionName, _ = p.value(opt, args, &i)
+		case "--external-id":
+			prefs.ExternalId, _ = p.value(opt, args, &i)
+		case "--mfa-serial":
+			prefs.MfaSerial, _ = p.value(opt, args, &i)
+		case "--duration":
+			prefs.RoleDuration = p.durationValue(opt, args, &i)
+		case "--endpoint-url":
+			prefs.EndpointUrl, _ = p.value(opt, args, &i)
+		case "--ecs-endpoint":
+			prefs.EcsEndpoint, _ = p.value(opt, args, &i)
+		case "--ec2-endpoint":
+			prefs.Ec2Endpoint, _ = p.value(opt, args, &i)
+		case "--logs-endpoint":
+			prefs.LogsEndpoint, _ = p.value(opt, args, &i)
+		case "--waiter-delay":
+			prefs.NoWaiterDelay = !p.flag(opt, isNoOpt)
+		case "--task-def":
+			prefs.TaskDef, _ = p.value(opt, args, &i)
+		case "--task-def-file":
+			prefs.TaskDefFile, _ = p.value(opt, args, &i)
+		case "--deregister":
+			prefs.DeregisterTaskDef = p.flag(opt, isNoOpt)
+		case "--cluster":
+			val, first := p.value(opt, args, &i)
+			if first {
+				prefs.Clusters = nil
+			}
+			prefs.Clusters = append(prefs.Clusters, SplitList(val)...)
+		case "--targets":
+			prefs.TargetsFile, _ = p.value(opt, args, &i)
+		case "--parallel-targets":
+			prefs.ParallelTargets = p.flag(opt, isNoOpt)
+		case "--container-name":
+			prefs.ContainerName, _ = p.value(opt, args, &i)
+		case "--cpu":
+			prefs.Cpu = p.intValue(opt, args, &i)
+		case "--mem":
+			prefs.Memory = p.intValue(opt, args, &i)
+		case "--mem-res":
+			prefs.MemoryReservation = p.intValue(opt, args, &i)
+		case "--count":
+			prefs.Count = int(p.intValue(opt, args, &i))
+			if prefs.Count < 1 {
+				p.fatalf("Invalid count value: %d", prefs.Count)
+			}
+		case "--commands-file":
+			prefs.CommandsFile, _ = p.value(opt, args, &i)
+		case "--parallel":
+			prefs.Parallel = int(p.intValue(opt, args, &i))
+			if prefs.Parallel < 1 {
+				p.fatalf("Invalid parallel value: %d", prefs.Parallel)
+			}
+		case "--env":
+			raw, _ := p.value(opt, args, &i)
+			val, err := ValidateEnv(raw)
+			if err != nil {
+				p.fatalf("%s", err)
+			} else {
+				p.envOverrides = append(p.envOverrides, val)
+			}
+		case "--env-file":
+			filename, _ := p.value(opt, args, &i)
+			vals, err := ParseEnvFile(filename)
+			if err != nil {
+				p.fatalf("%s", err)
+			} else {
+				p.envOverrides = append(p.envOverrides, vals...)
+			}
+		case "--env-s3":
+			val, first := p.value(opt, args, &i)
+			if first {
+				prefs.EnvironmentFiles = nil
+			}
+			object, err := ParseS3ObjectArn(val)
+			if err != nil {
+				p.fatalf("%s", err)
+			}
+			prefs.EnvironmentFiles = append(prefs.EnvironmentFiles, object)
+		case "--resource-requirement":
+			val, first := p.value(opt, args, &i)
+			if first {
+				prefs.ResourceRequirements = nil
+			}
+			requirement, err := ParseResourceRequirement(val)
+			if err != nil {
+				p.fatalf("%s", err)
+			}
+			prefs.ResourceRequirements = append(prefs.ResourceRequirements, requirement)
+		case "--tag":
+			raw, _ := p.value(opt, args, &i)
+			val, err := ValidateTag(raw)
+			if err != nil {
+				p.fatalf("%s", err)
+			} else {
+				p.tagOverrides = append(p.tagOverrides, val)
+			}
+		case "--propagate-tags":
+			val, _ := p.value(opt, args, &i)
+			propagate, err := ParsePropagateTags(val)
+			if err != nil {
+				p.fatalf("%s", err)
+			}
+			prefs.PropagateTags = propagate
+		case "--group":
+			prefs.Group, _ = p.value(opt, args, &i)
+		case "--enable-ecs-managed-tags":
+			prefs.EnableEcsManagedTags = p.flag(opt, isNoOpt)
+		case "--reference-id":
+			prefs.ReferenceId, _ = p.value(opt, args, &i)
+		case "--capacity-provider":
+			val, first := p.value(opt, args, &i)
+			if first {
+				prefs.CapacityProviders = nil
+			}
+			provider, err := ParseCapacityProvider(val)
+			if err != nil {
+				p.fatalf("%s", err)
+			}
+			prefs.CapacityProviders = append(prefs.CapacityProviders, provider)
+		case "--dry-run":
+			prefs.DryRun = p.flag(opt, isNoOpt)
+		case "--emit":
+			prefs.Emit, _ = p.value(opt, args, &i)
+			if !ValidEmitFormat(prefs.Emit) {
+				p.fatalf("Invalid emit format: %s. Valid formats: %s", prefs.Emit, EmitFormats)
+			}
+		case "--stream-log":
+			prefs.StreamLog = p.flag(opt, isNoOpt)
+		case "--wait":
+			prefs.WaitStopped = p.flag(opt, isNoOpt)
+		case "--wait-healthy":
+			prefs.WaitHealthy = p.flag(opt, isNoOpt)
+		case "--health-timeout":
+			prefs.HealthTimeout = p.durationValue(opt, args, &i)
+		case "--enable-execute-command":
+			prefs.EnableExecuteCommand = p.flag(opt, isNoOpt)
+		case "--interactive":
+			prefs.Interactive = p.flag(opt, isNoOpt)
+		case "--stdin":
+			prefs.Stdin = p.flag(opt, isNoOpt)
+		case "--staging":
+			prefs.StagingUrl, _ = p.value(opt, args, &i)
+		case "--artifact":
+			val, first := p.value(opt, args, &i)
+			if first {
+				prefs.Artifacts = nil
+			}
+			artifact, err := ParseArtifactSpec(val)
+			if err != nil {
+				p.fatalf("%s", err)
+			}
+			prefs.Artifacts = append(prefs.Artifacts, artifact)
+		case "--log-format":
+			prefs.LogFormat, _ = p.value(opt, args, &i)
+			if !ValidLogFormat(prefs.LogFormat) {
+				p.fatalf("Invalid log format: %s. Valid formats: %s", prefs.LogFormat, LogFormats)
+			}
+		case "--log-fields":
+			val, _ := p.value(opt, args, &i)
+			prefs.LogFields = SplitList(val)
+		case "--log-filter":
+			prefs.LogFilter, _ = p.value(opt, args, &i)
+		case "--log-file":
+			prefs.LogFile, _ = p.value(opt, args, &i)
+		case "--log-json":
+			prefs.LogJSON = p.flag(opt, isNoOpt)
+		case "--price-table":
+			prefs.PriceTable, _ = p.value(opt, args, &i)
+		case "--since":
+			prefs.LogsSince, _ = p.value(opt, args, &i)
+		case "--until":
+			prefs.LogsUntil, _ = p.value(opt, args, &i)
+		case "--follow":
+			prefs.LogsFollow = p.flag(opt, isNoOpt)
+		case "--name":
+			prefs.ScheduleName, _ = p.value(opt, args, &i)
+		case "--cron":
+			prefs.ScheduleExpression, _ = p.value(opt, args, &i)
+		case "--schedule-role":
+			prefs.ScheduleRoleArn, _ = p.value(opt, args, &i)
+		case "--help":
+			usage()
+			os.Exit(0)
+		case "--exec-role":
+			prefs.ExecRoleArn, _ = p.value(opt, args, &i)
+		case "--task-role":
+			prefs.TaskRoleArn, _ = p.value(opt, args, &i)
+		case "--shell":
+			prefs.NoShell = isNoOpt
+			if isNoOpt {
+				p.flag(opt, isNoOpt)
+			} else {
+				prefs.ShellPrefix, _ = p.value(opt, args, &i)
+			}
+		case "--fargate":
+			prefs.LaunchFargate = !isNoOpt
+			filters, first := p.filters(opt, nil, args, &i)
+			if first {
+				prefs.AnyFilters = nil
+			}
+			prefs.AnyFilters = append(prefs.AnyFilters, filters...)
+		case "--fargate:sg":
+			prefs.DoFilterSgs = !isNoOpt
+			filters, first := p.filters(opt, aws.String(FilterTagName), args, &i)
+			if first {
+				prefs.VpcSgFilters = nil
+			}
+			prefs.VpcSgFilters = append(prefs.VpcSgFilters, filters...)
+		case "--fargate:vpc":
+			prefs.DoFilterVpc = !isNoOpt
+			filters, first := p.filters(opt, aws.String(FilterTagName), args, &i)
+			if first {
+				prefs.VpcFilters = nil
+			}
+			prefs.VpcFilters = append(prefs.VpcFilters, filters...)
+		case "--fargate:ip":
+			prefs.NetPublicIp = p.flag(opt, isNoOpt)
+		case "--fargate:net":
+			prefs.FilterMode = FilterModeNetwork
+			filters, first := p.filters(opt, aws.String(FilterTagName), args, &i)
+			if first {
+				prefs.VpcNetFilters = nil
+			}
+			prefs.VpcNetFilters = append(prefs.VpcNetFilters, filters...)
+		case "--fargate:host":
+			prefs.FilterMode = FilterModeHost
+			filters, first := p.filters(opt, aws.String(FilterTagName), args, &i)
+			if first {
+				prefs.VpcHostFilters = nil
+			}
+			prefs.VpcHostFilters = append(prefs.VpcHostFilters, filters...)
+		case "--":
+			prefs.OverridesCmd = true
+			prefs.CmdOverride = append([]string{}, args[i+1:]...)
+			p.record(opt, prefs.CmdOverride...)
+			break ArgLoop
+		default:
+			if p.AllowPositional && !strings.HasPrefix(args[i], "-") {
+				p.Positional = append(p.Positional, args[i])
+				continue
+			}
+			usage()
+			p.fatalf("Invalid option: \"%s\"", args[i])
+		}
+	}
+}
+
+// Args returns the ParsedArgs accumulated from all layers.
+func (p *ArgParser) Args() ParsedArgs {
+	prefs := p.prefs
+	prefs.Environment = ConvertKVStringsToMap(p.envOverrides)
+	prefs.Tags = ConvertKVStringsToMap(p.tagOverrides)
+	return prefs
+}
+
+// SplitPresetNames separates @name preset references from the remaining arguments. Arguments following -- are never
+// treated as preset references.
+func SplitPresetNames(args []string) ([]string, []string) {
+	var names []string
+	var rest []string
+	for i, arg := range args {
+		if arg == "--" {
+			rest = append(rest, args[i:]...)
+			break
+		} else if strings.HasPrefix(arg, "@") && len(arg) > 1 {
+			names = append(names, strings.TrimPrefix(arg, "@"))
+		} else {
+			rest = append(rest, arg)
+		}
+	}
+	return names, rest
+}
+
+// loadArgs parses the command line arguments on top of OVERRUN_* environment variables, which are parsed on top of any
+// presets that the command line references.
+func loadArgs(command string, args []string) *ArgParser {
+	parser := NewArgParser()
+	parser.Command = command
+	return loadArgsInto(parser, args)
+}
+
+// loadCommandArgs loads the arguments of a subcommand, which may include positional arguments.
+func loadCommandArgs(command string, args []string) *ArgParser {
+	parser := NewArgParser()
+	parser.Command = command
+	parser.AllowPositional = true
+	return loadArgsInto(parser, args)
+}
+
+func loadArgsInto(parser *ArgParser, args []string) *ArgParser {
+	names, rest := SplitPresetNames(args)
+	if len(names) > 0 {
+		presets, err := LoadPresets()
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, name := range names {
+			presetArgs, err := presets.Args(name)
+			if err != nil {
+				log.Fatal(err)
+			}
+			parser.Parse("preset @"+name, presetArgs)
+		}
+	}
+	parser.ParseEnv()
+	parser.Parse(SourceFlag, rest)
+	if parser.prefs.LogJSON {
+		EnableLogJSON(os.Stderr)
+	}
+	return parser
+}
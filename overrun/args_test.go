@@ -0,0 +1,301 @@
+/*
+ * Copyright 2018 Mark Adamcin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"os"
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withEnv sets the OVERRUN_* variables for the duration of a test, clearing any others from the environment, and
+// returns a function that restores the environment.
+func withEnv(vars map[string]string) func() {
+	saved := make(map[string]string)
+	for _, pair := range os.Environ() {
+		kv := strings.SplitN(pair, "=", 2)
+		if strings.HasPrefix(kv[0], EnvOptionPrefix) {
+			saved[kv[0]] = kv[1]
+			os.Unsetenv(kv[0])
+		}
+	}
+	for name, value := range vars {
+		os.Setenv(name, value)
+	}
+	return func() {
+		for name := range vars {
+			os.Unsetenv(name)
+		}
+		for name, value := range saved {
+			os.Setenv(name, value)
+		}
+	}
+}
+
+// parseTestArgs parses the command line arguments on top of the OVERRUN_* variables.
+func parseTestArgs(env map[string]string, args ...string) *ArgParser {
+	return parseCommandTestArgs("", env, args...)
+}
+
+// parseCommandTestArgs parses the command line arguments of a subcommand on top of the OVERRUN_* variables.
+func parseCommandTestArgs(command string, env map[string]string, args ...string) *ArgParser {
+	defer withEnv(env)()
+	parser := NewArgParser()
+	parser.Command = command
+	parser.ParseEnv()
+	parser.Parse(SourceFlag, args)
+	return parser
+}
+
+func filter(name string, values ...string) ec2.Filter {
+	return ec2.Filter{Name: aws.String(name), Values: values}
+}
+
+func TestParseArgs(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		args []string
+		// applied to the defaults of NewArgParser to give the expected result.
+		want func(prefs *ParsedArgs)
+	}{
+		{
+			name: "defaults",
+			want: func(prefs *ParsedArgs) {},
+		},
+		{
+			name: "short options and command",
+			args: []string{"-c", "main", "-t", "app:3", "-n", "web", "-w", "--", "echo", "hello world"},
+			want: func(prefs *ParsedArgs) {
+				prefs.Clusters = []string{"main"}
+				prefs.TaskDef = "app:3"
+				prefs.ContainerName = "web"
+				prefs.WaitStopped = true
+				prefs.OverridesCmd = true
+				prefs.CmdOverride = []string{"echo", "hello world"}
+			},
+		},
+		{
+			name: "clusters and regions are lists",
+			args: []string{"-c", "a,b", "--cluster", "c", "-r", "us-east-1,us-west-2"},
+			want: func(prefs *ParsedArgs) {
+				prefs.Clusters = []string{"a", "b", "c"}
+				prefs.AwsRegions = []string{"us-east-1", "us-west-2"}
+			},
+		},
+		{
+			name: "flag replaces environment value",
+			env:  map[string]string{"OVERRUN_CLUSTER": "staging", "OVERRUN_TASK_DEF": "app"},
+			args: []string{"-c", "main"},
+			want: func(prefs *ParsedArgs) {
+				prefs.Clusters = []string{"main"}
+				prefs.TaskDef = "app"
+			},
+		},
+		{
+			name: "environment merges with flags",
+			env:  map[string]string{"OVERRUN_ENV": "A=1 B=2", "OVERRUN_TAG": "team=data"},
+			args: []string{"-e", "B=3", "--tag", "ci=true"},
+			want: func(prefs *ParsedArgs) {
+				prefs.Environment = map[string]string{"A": "1", "B": "3"}
+				prefs.Tags = map[string]string{"team": "data", "ci": "true"}
+			},
+		},
+		{
+			name: "no- prefix disables environment switch",
+			env:  map[string]string{"OVERRUN_STREAM_LOG": "true"},
+			args: []string{"--no-stream-log"},
+			want: func(prefs *ParsedArgs) {},
+		},
+		{
+			name: "sizes",
+			args: []string{"--cpu", "256", "--mem", "512", "--mem-res", "128"},
+			want: func(prefs *ParsedArgs) {
+				prefs.Cpu = 256
+				prefs.Memory = 512
+				prefs.MemoryReservation = 128
+			},
+		},
+		{
+			name: "fargate filters",
+			args: []string{"--fargate", "tag:env=prod", "--fargate:net", "private", "subnet-1", "--fargate:sg", "sg-1",
+				"--fargate:ip"},
+			want: func(prefs *ParsedArgs) {
+				prefs.LaunchFargate = true
+				prefs.AnyFilters = []ec2.Filter{filter("tag:env", "prod")}
+				prefs.FilterMode = FilterModeNetwork
+				prefs.VpcNetFilters = []ec2.Filter{filter(FilterTagName, "private"), filter(FilterSubnetId, "subnet-1")}
+				prefs.DoFilterSgs = true
+				prefs.VpcSgFilters = []ec2.Filter{filter(FilterSecurityGroupId, "sg-1")}
+				prefs.NetPublicIp = true
+			},
+		},
+		{
+			name: "fargate host mode",
+			args: []string{"--fargate:host", "Name=instance-id,Values=i-1,i-2", "--fargate:vpc", "vpc-1"},
+			want: func(prefs *ParsedArgs) {
+				prefs.LaunchFargate = true
+				prefs.FilterMode = FilterModeHost
+				prefs.VpcHostFilters = []ec2.Filter{filter(FilterInstanceId, "i-1", "i-2")}
+				prefs.DoFilterVpc = true
+				prefs.VpcFilters = []ec2.Filter{filter(FilterVpcId, "vpc-1")}
+			},
+		},
+		{
+			name: "run task members",
+			args: []string{"--propagate-tags", "task_definition", "--group", "batch", "--enable-ecs-managed-tags",
+				"--reference-id", "deploy-42", "--enable-execute-command"},
+			want: func(prefs *ParsedArgs) {
+				prefs.PropagateTags = ecs.PropagateTagsTaskDefinition
+				prefs.Group = "batch"
+				prefs.EnableEcsManagedTags = true
+				prefs.ReferenceId = "deploy-42"
+				prefs.EnableExecuteCommand = true
+			},
+		},
+		{
+			name: "environment files and resource requirements",
+			args: []string{"--env-s3", "arn:aws:s3:::config/app.env", "--resource-requirement", "GPU=1"},
+			want: func(prefs *ParsedArgs) {
+				prefs.EnvironmentFiles = []S3Object{{Arn: "arn:aws:s3:::config/app.env", Bucket: "config", Key: "app.env"}}
+				prefs.ResourceRequirements = []ResourceRequirement{{Type: "GPU", Value: "1"}}
+			},
+		},
+		{
+			name: "capacity providers",
+			env:  map[string]string{"OVERRUN_CAPACITY_PROVIDER": "FARGATE"},
+			args: []string{"--capacity-provider", "FARGATE_SPOT:3", "--capacity-provider", "FARGATE:1:2"},
+			want: func(prefs *ParsedArgs) {
+				prefs.CapacityProviders = []CapacityProvider{{Name: "FARGATE_SPOT", Weight: 3}, {Name: "FARGATE", Weight: 1, Base: 2}}
+			},
+		},
+		{
+			name: "assume role",
+			env:  map[string]string{"OVERRUN_ROLE_ARN": "arn:aws:iam::123456789012:role/deploy"},
+			args: []string{"--external-id", "ci", "--mfa-serial", "arn:aws:iam::123456789012:mfa/jdoe", "--duration", "3600"},
+			want: func(prefs *ParsedArgs) {
+				prefs.RoleArn = "arn:aws:iam::123456789012:role/deploy"
+				prefs.ExternalId = "ci"
+				prefs.MfaSerial = "arn:aws:iam::123456789012:mfa/jdoe"
+				prefs.RoleDuration = time.Hour
+			},
+		},
+		{
+			name: "endpoints",
+			env:  map[string]string{"OVERRUN_LOGS_ENDPOINT": "http://localhost:5000", "OVERRUN_NO_WAITER_DELAY": "true"},
+			args: []string{"--endpoint-url", "http://localhost:4566"},
+			want: func(prefs *ParsedArgs) {
+				prefs.EndpointUrl = "http://localhost:4566"
+				prefs.LogsEndpoint = "http://localhost:5000"
+				prefs.NoWaiterDelay = true
+			},
+		},
+		{
+			name: "waiter delay restored",
+			env:  map[string]string{"OVERRUN_NO_WAITER_DELAY": "true"},
+			args: []string{"--waiter-delay"},
+			want: func(prefs *ParsedArgs) {},
+		},
+		{
+			name: "fan-out",
+			args: []string{"--count", "4", "--parallel", "2"},
+			want: func(prefs *ParsedArgs) {
+				prefs.Count = 4
+				prefs.Parallel = 2
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := parseTestArgs(test.env, test.args...).Args()
+			want := NewArgParser().Args()
+			test.want(&want)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got\n%+v\nwant\n%+v", got, want)
+			}
+		})
+	}
+}
+
+func TestParseArgsSources(t *testing.T) {
+	parser := parseTestArgs(map[string]string{"OVERRUN_ENV": "A=1", "OVERRUN_CLUSTER": "staging"},
+		"-e", "B=2", "-c", "main")
+	if got, want := parser.Sources["--env"], "env OVERRUN_ENV, flag"; got != want {
+		t.Errorf("--env source: got %q, want %q", got, want)
+	}
+	if got, want := parser.Sources["--cluster"], SourceFlag; got != want {
+		t.Errorf("--cluster source: got %q, want %q", got, want)
+	}
+	if got, want := parser.Values["--cluster"], []string{"main"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("--cluster values: got %q, want %q", got, want)
+	}
+}
+
+// TestCommandOptions rejects options of a subcommand given to another in a child process, which exits.
+func TestCommandOptions(t *testing.T) {
+	if opt := os.Getenv("GO_TEST_COMMAND_OPTION"); len(opt) > 0 {
+		parseTestArgs(nil, "-c", "main", opt, "1h")
+		return
+	}
+	for _, test := range []struct{ opt, command string }{{"-F", "logs"}, {"--cron", "schedule"}} {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestCommandOptions$")
+		cmd.Env = append(os.Environ(), "GO_TEST_COMMAND_OPTION="+test.opt)
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		if err := cmd.Run(); err == nil {
+			t.Errorf("%s was accepted outside the %s subcommand", test.opt, test.command)
+		} else if want := test.opt + " is only accepted by the " + test.command + " subcommand"; !strings.Contains(stderr.String(), want) {
+			t.Errorf("got %q, want %q", stderr.String(), want)
+		}
+	}
+
+	if prefs := parseCommandTestArgs("logs", nil, "-F", "--since", "1h").Args(); !prefs.LogsFollow || prefs.LogsSince != "1h" {
+		t.Errorf("logs options were not parsed: %+v", prefs)
+	}
+	// presets are shared by every subcommand.
+	parser := NewArgParser()
+	parser.Parse("preset @tail", []string{"--follow"})
+	if !parser.Args().LogsFollow {
+		t.Error("--follow was not parsed from a preset")
+	}
+}
+
+func TestSplitPresetNames(t *testing.T) {
+	tests := []struct {
+		args  []string
+		names []string
+		rest  []string
+	}{
+		{[]string{"@db", "-c", "main"}, []string{"db"}, []string{"-c", "main"}},
+		{[]string{"-c", "main", "--", "echo", "@db"}, nil, []string{"-c", "main", "--", "echo", "@db"}},
+		{[]string{"@", "@a", "@b"}, []string{"a", "b"}, []string{"@"}},
+	}
+	for _, test := range tests {
+		names, rest := SplitPresetNames(test.args)
+		if !reflect.DeepEqual(names, test.names) || !reflect.DeepEqual(rest, test.rest) {
+			t.Errorf("SplitPresetNames(%q): got %q, %q, want %q, %q", test.args, names, rest, test.names, test.rest)
+		}
+	}
+}
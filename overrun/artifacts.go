@@ -0,0 +1,193 @@
+/*
+ * Copyright 2018 Mark Adamcin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const EnvOverrunArtifactUrl = "OVERRUN_ARTIFACT_URL"
+
+// how long the presigned upload URL of a task's artifacts remains valid, which must cover the whole run of the task.
+const ArtifactUrlExpiry = 12 * time.Hour
+
+// the archive written inside the container before it is uploaded.
+const ArtifactArchivePath = "/tmp/overrun-artifacts.tar.gz"
+
+// ArtifactSpec maps a path inside the container to a local path, given as --artifact /container/path:local/path.
+type ArtifactSpec struct {
+	ContainerPath string
+	LocalPath     string
+}
+
+func ParseArtifactSpec(spec string) (ArtifactSpec, error) {
+	parts := strings.SplitN(spec, ":", 2)
+	if len(parts) != 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+		return ArtifactSpec{}, errors.New("invalid artifact, expected /container/path:local/path: " + spec)
+	}
+	return ArtifactSpec{ContainerPath: parts[0], LocalPath: parts[1]}, nil
+}
+
+// member returns the name under which the container path is stored in the archive.
+func (a ArtifactSpec) member() string {
+	return strings.TrimPrefix(path.Clean(a.ContainerPath), "/")
+}
+
+// wrapArtifacts runs the script, then archives the artifact paths and uploads the archive to the presigned URL in
+// OVERRUN_ARTIFACT_URL using curl, exiting with the script's exit code either way. Absolute paths are archived
+// relative to /, and relative paths relative to the working directory.
+func wrapArtifacts(script string, artifacts []ArtifactSpec) string {
+	args := []string{"-czf", ArtifactArchivePath}
+	for _, artifact := range artifacts {
+		if path.IsAbs(artifact.ContainerPath) {
+			args = append(args, "-C", "/")
+		} else {
+			args = append(args, "-C", `"$PWD"`)
+		}
+		args = append(args, ShellQuote(artifact.member()))
+	}
+	return "( " + script + " ); rc=$?; tar " + strings.Join(args, " ") +
+		`; curl -fsS -X PUT -T ` + ArtifactArchivePath + ` "$` + EnvOverrunArtifactUrl + `"` +
+		` || echo "overrun: failed to upload artifacts" >&2; exit $rc`
+}
+
+// artifactKey names the staged archive of a job's task on a target.
+func artifactKey(ctx *ExecutionContext, job *TaskJob) string {
+	return "artifacts/" + strings.Replace(ctx.Target.String(), "@", "_", -1) + "/" + strconv.Itoa(job.Index) + ".tar.gz"
+}
+
+// prepareArtifacts returns a copy of the job whose command uploads its artifacts to the staging location, along with
+// the key of the upload.
+func prepareArtifacts(prefs *ParsedArgs, ctx *ExecutionContext, job *TaskJob) (*TaskJob, string, error) {
+	if len(job.Script) == 0 {
+		return nil, "", errors.New("--artifact requires a command after -- or a --commands-file")
+	}
+	key := ctx.Staging.ObjectKey(artifactKey(ctx, job))
+	url := "<presigned url>"
+	if !prefs.DryRun {
+		key = ctx.Staging.Key(artifactKey(ctx, job))
+		presigned, err := ctx.Staging.PresignPut(key, ArtifactUrlExpiry)
+		if err != nil {
+			return nil, "", err
+		}
+		url = presigned
+	}
+
+	wrapped := *job
+	wrapped.Environment = make(map[string]string, len(job.Environment)+1)
+	for k, v := range job.Environment {
+		wrapped.Environment[k] = v
+	}
+	wrapped.Environment[EnvOverrunArtifactUrl] = url
+	wrapped.Script = wrapArtifacts(job.Script, prefs.Artifacts)
+	wrapped.Command = shellCommand(prefs, wrapped.Script)
+	return &wrapped, key, nil
+}
+
+// artifactLocalPath returns the local path for an artifact. When the invocation runs more than one task, each task's
+// artifacts are kept apart in subdirectories named for the target and the job index.
+func artifactLocalPath(prefs *ParsedArgs, ctx *ExecutionContext, job *TaskJob, artifact ArtifactSpec) string {
+	local := artifact.LocalPath
+	if len(ctx.Label) > 0 {
+		local = filepath.Join(local, ctx.Target.String())
+	}
+	if prefs.IsFanOut() {
+		local = filepath.Join(local, strconv.Itoa(job.Index))
+	}
+	return local
+}
+
+// fetchArtifacts downloads the archive uploaded by the task and extracts each artifact to its local path.
+func fetchArtifacts(prefs *ParsedArgs, ctx *ExecutionContext, job *TaskJob, key string) error {
+	body, err := ctx.Staging.Download(key)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	return extractArtifacts(prefs, ctx, job, body)
+}
+
+// extractArtifacts extracts each artifact from the gzipped archive to its local path.
+func extractArtifacts(prefs *ParsedArgs, ctx *ExecutionContext, job *TaskJob, body io.Reader) error {
+	gz, err := gzip.NewReader(body)
+	if err != nil {
+		return fmt.Errorf("failed to read artifacts archive: %s", err)
+	}
+	archive := tar.NewReader(gz)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("failed to read artifacts archive: %s", err)
+		}
+
+		name := path.Clean(strings.TrimPrefix(header.Name, "./"))
+		for _, artifact := range prefs.Artifacts {
+			member := artifact.member()
+			var rest string
+			if name == member {
+				rest = ""
+			} else if strings.HasPrefix(name, member+"/") {
+				rest = strings.TrimPrefix(name, member+"/")
+			} else {
+				continue
+			}
+			if rest == ".." || strings.HasPrefix(rest, "../") || strings.Contains(rest, "/../") {
+				return errors.New("refusing to extract artifact outside of its local path: " + header.Name)
+			}
+			local := filepath.Join(artifactLocalPath(prefs, ctx, job, artifact), filepath.FromSlash(rest))
+			if err := extractEntry(archive, header, local); err != nil {
+				return err
+			}
+			if header.Typeflag != tar.TypeDir {
+				log.Printf("%s%sFetched artifact %s.\n", ctx.Label, job.Label, local)
+			}
+			break
+		}
+	}
+}
+
+func extractEntry(archive *tar.Reader, header *tar.Header, local string) error {
+	switch header.Typeflag {
+	case tar.TypeDir:
+		return os.MkdirAll(local, 0755)
+	case tar.TypeReg, tar.TypeRegA:
+		if err := os.MkdirAll(filepath.Dir(local), 0755); err != nil {
+			return err
+		}
+		fh, err := os.OpenFile(local, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(header.Mode).Perm()|0600)
+		if err != nil {
+			return err
+		}
+		defer fh.Close()
+		_, err = io.Copy(fh, archive)
+		return err
+	}
+	// links and special files are skipped.
+	return nil
+}
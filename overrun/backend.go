@@ -0,0 +1,282 @@
+/*
+ * Copyright 2018 Mark Adamcin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"time"
+)
+
+// The ECS, EC2 and CloudWatch Logs operations that overrun uses to run tasks are reached through the interfaces in
+// this file, so that the same code can run against the AWS APIs or against an in-memory fake in tests.
+
+// EcsAPI holds the ECS operations used to resolve task definitions and run tasks.
+type EcsAPI interface {
+	DescribeTaskDefinition(input *ecs.DescribeTaskDefinitionInput) (*ecs.DescribeTaskDefinitionOutput, error)
+
+	RegisterTaskDefinition(input *ecs.RegisterTaskDefinitionInput) (*ecs.RegisterTaskDefinitionOutput, error)
+
+	DeregisterTaskDefinition(input *ecs.DeregisterTaskDefinitionInput) (*ecs.DeregisterTaskDefinitionOutput, error)
+
+	ListTaskDefinitions(input *ecs.ListTaskDefinitionsInput) (*ecs.ListTaskDefinitionsOutput, error)
+
+	DescribeServices(input *ecs.DescribeServicesInput) (*ecs.DescribeServicesOutput, error)
+
+	DescribeClusters(input *ecs.DescribeClustersInput) (*ecs.DescribeClustersOutput, error)
+
+	ListContainerInstances(input *ecs.ListContainerInstancesInput) (*ecs.ListContainerInstancesOutput, error)
+
+	DescribeContainerInstances(input *ecs.DescribeContainerInstancesInput) (*ecs.DescribeContainerInstancesOutput, error)
+
+	// RunTask sends the RunTask request with the extra members merged into its body.
+	RunTask(input *ecs.RunTaskInput, extras JSONMembers) (*ecs.RunTaskOutput, error)
+
+	DescribeTasks(input *ecs.DescribeTasksInput) (*ecs.DescribeTasksOutput, error)
+
+	StopTask(input *ecs.StopTaskInput) (*ecs.StopTaskOutput, error)
+
+	WaitUntilTasksRunning(input *ecs.DescribeTasksInput) error
+
+	WaitUntilTasksStopped(input *ecs.DescribeTasksInput) error
+
+	// WaitUntilTasksHealthy waits until the tasks meet the health condition, failing once any is UNHEALTHY or stopped, or
+	// the timeout passes.
+	WaitUntilTasksHealthy(input *ecs.DescribeTasksInput, condition HealthCondition, timeout time.Duration) error
+
+	// ContainerRuntimeIds returns the Docker ID of each started container of the task, by container name.
+	ContainerRuntimeIds(cluster *string, taskArn string) (map[string]string, error)
+
+	// TaskCapacity returns the capacity provider and CPU architecture of the task.
+	TaskCapacity(cluster *string, taskArn string) (string, string, error)
+
+	// ExecuteCommand starts an ECS Exec session in a container of a running task.
+	ExecuteCommand(input *ExecuteCommandInput) (*ExecuteCommandOutput, error)
+}
+
+// Ec2API holds the EC2 queries used to construct awsvpc network configurations.
+type Ec2API interface {
+	DescribeVpcs(input *ec2.DescribeVpcsInput) (*ec2.DescribeVpcsOutput, error)
+
+	DescribeSubnets(input *ec2.DescribeSubnetsInput) (*ec2.DescribeSubnetsOutput, error)
+
+	DescribeSecurityGroups(input *ec2.DescribeSecurityGroupsInput) (*ec2.DescribeSecurityGroupsOutput, error)
+
+	DescribeInstances(input *ec2.DescribeInstancesInput) (*ec2.DescribeInstancesOutput, error)
+}
+
+// LogsAPI holds the CloudWatch Logs operations used to tail and print container logs.
+type LogsAPI interface {
+	CreateLogGroup(input *cloudwatchlogs.CreateLogGroupInput) (*cloudwatchlogs.CreateLogGroupOutput, error)
+
+	CreateLogStream(input *cloudwatchlogs.CreateLogStreamInput) (*cloudwatchlogs.CreateLogStreamOutput, error)
+
+	DescribeLogStreams(input *cloudwatchlogs.DescribeLogStreamsInput) (*cloudwatchlogs.DescribeLogStreamsOutput, error)
+
+	FilterLogEvents(input *cloudwatchlogs.FilterLogEventsInput) (*cloudwatchlogs.FilterLogEventsOutput, error)
+}
+
+// Backend creates the API clients for an AWS config.
+type Backend interface {
+	Ecs(cfg aws.Config) EcsAPI
+
+	Ec2(cfg aws.Config) Ec2API
+
+	Logs(cfg aws.Config) LogsAPI
+}
+
+// AwsBackend creates clients that call the AWS APIs.
+type AwsBackend struct {
+	// poll task state without delay in the ECS waiters, for emulators.
+	NoWaiterDelay bool
+}
+
+func (b AwsBackend) Ecs(cfg aws.Config) EcsAPI {
+	var waiterOpts []aws.WaiterOption
+	healthDelay := HealthPollInterval
+	if b.NoWaiterDelay {
+		waiterOpts = append(waiterOpts, aws.WithWaiterDelay(aws.ConstantWaiterDelay(0)))
+		healthDelay = 0
+	}
+	return awsEcs{ecs.New(cfg), waiterOpts, healthDelay}
+}
+
+func (AwsBackend) Ec2(cfg aws.Config) Ec2API {
+	return awsEc2{ec2.New(cfg)}
+}
+
+func (AwsBackend) Logs(cfg aws.Config) LogsAPI {
+	return awsLogs{cloudwatchlogs.New(cfg)}
+}
+
+type awsEcs struct {
+	client *ecs.ECS
+
+	waiterOpts []aws.WaiterOption
+
+	// delay between describing tasks while waiting for them to become healthy.
+	healthDelay time.Duration
+}
+
+func (s awsEcs) DescribeTaskDefinition(input *ecs.DescribeTaskDefinitionInput) (*ecs.DescribeTaskDefinitionOutput, error) {
+	return s.client.DescribeTaskDefinitionRequest(input).Send()
+}
+
+func (s awsEcs) RegisterTaskDefinition(input *ecs.RegisterTaskDefinitionInput) (*ecs.RegisterTaskDefinitionOutput, error) {
+	return s.client.RegisterTaskDefinitionRequest(input).Send()
+}
+
+func (s awsEcs) DeregisterTaskDefinition(input *ecs.DeregisterTaskDefinitionInput) (*ecs.DeregisterTaskDefinitionOutput, error) {
+	return s.client.DeregisterTaskDefinitionRequest(input).Send()
+}
+
+func (s awsEcs) ListTaskDefinitions(input *ecs.ListTaskDefinitionsInput) (*ecs.ListTaskDefinitionsOutput, error) {
+	return s.client.ListTaskDefinitionsRequest(input).Send()
+}
+
+func (s awsEcs) DescribeServices(input *ecs.DescribeServicesInput) (*ecs.DescribeServicesOutput, error) {
+	return s.client.DescribeServicesRequest(input).Send()
+}
+
+func (s awsEcs) DescribeClusters(input *ecs.DescribeClustersInput) (*ecs.DescribeClustersOutput, error) {
+	return s.client.DescribeClustersRequest(input).Send()
+}
+
+func (s awsEcs) ListContainerInstances(input *ecs.ListContainerInstancesInput) (*ecs.ListContainerInstancesOutput, error) {
+	return s.client.ListContainerInstancesRequest(input).Send()
+}
+
+func (s awsEcs) DescribeContainerInstances(input *ecs.DescribeContainerInstancesInput) (*ecs.DescribeContainerInstancesOutput, error) {
+	return s.client.DescribeContainerInstancesRequest(input).Send()
+}
+
+func (s awsEcs) RunTask(input *ecs.RunTaskInput, extras JSONMembers) (*ecs.RunTaskOutput, error) {
+	req := s.client.RunTaskRequest(input)
+	req.ApplyOptions(WithJSONMembers(extras))
+	return req.Send()
+}
+
+func (s awsEcs) DescribeTasks(input *ecs.DescribeTasksInput) (*ecs.DescribeTasksOutput, error) {
+	return s.client.DescribeTasksRequest(input).Send()
+}
+
+func (s awsEcs) StopTask(input *ecs.StopTaskInput) (*ecs.StopTaskOutput, error) {
+	return s.client.StopTaskRequest(input).Send()
+}
+
+func (s awsEcs) WaitUntilTasksRunning(input *ecs.DescribeTasksInput) error {
+	return s.client.WaitUntilTasksRunningWithContext(aws.BackgroundContext(), input, s.waiterOpts...)
+}
+
+func (s awsEcs) WaitUntilTasksStopped(input *ecs.DescribeTasksInput) error {
+	return s.client.WaitUntilTasksStoppedWithContext(aws.BackgroundContext(), input, s.waiterOpts...)
+}
+
+// WaitUntilTasksHealthy polls the tasks, since the waiters of the vendored SDK cannot select the overridden container
+// by name.
+func (s awsEcs) WaitUntilTasksHealthy(input *ecs.DescribeTasksInput, condition HealthCondition, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(aws.BackgroundContext(), timeout)
+	defer cancel()
+	for {
+		inCpy := *input
+		req := s.client.DescribeTasksRequest(&inCpy)
+		req.SetContext(ctx)
+		output, err := req.Send()
+		if err != nil {
+			return err
+		} else if done, err := condition.Check(output); done {
+			return err
+		}
+		if err := aws.SleepWithContext(ctx, s.healthDelay); err != nil {
+			return err
+		}
+	}
+}
+
+func (s awsEcs) ContainerRuntimeIds(cluster *string, taskArn string) (map[string]string, error) {
+	return ContainerRuntimeIds(s.client, cluster, taskArn)
+}
+
+func (s awsEcs) TaskCapacity(cluster *string, taskArn string) (string, string, error) {
+	return TaskCapacity(s.client, cluster, taskArn)
+}
+
+func (s awsEcs) ExecuteCommand(input *ExecuteCommandInput) (*ExecuteCommandOutput, error) {
+	return ExecuteCommand(s.client, input)
+}
+
+type awsEc2 struct {
+	client *ec2.EC2
+}
+
+func (s awsEc2) DescribeVpcs(input *ec2.DescribeVpcsInput) (*ec2.DescribeVpcsOutput, error) {
+	return s.client.DescribeVpcsRequest(input).Send()
+}
+
+func (s awsEc2) DescribeSubnets(input *ec2.DescribeSubnetsInput) (*ec2.DescribeSubnetsOutput, error) {
+	return s.client.DescribeSubnetsRequest(input).Send()
+}
+
+func (s awsEc2) DescribeSecurityGroups(input *ec2.DescribeSecurityGroupsInput) (*ec2.DescribeSecurityGroupsOutput, error) {
+	return s.client.DescribeSecurityGroupsRequest(input).Send()
+}
+
+func (s awsEc2) DescribeInstances(input *ec2.DescribeInstancesInput) (*ec2.DescribeInstancesOutput, error) {
+	return s.client.DescribeInstancesRequest(input).Send()
+}
+
+type awsLogs struct {
+	client *cloudwatchlogs.CloudWatchLogs
+}
+
+func (s awsLogs) CreateLogGroup(input *cloudwatchlogs.CreateLogGroupInput) (*cloudwatchlogs.CreateLogGroupOutput, error) {
+	return s.client.CreateLogGroupRequest(input).Send()
+}
+
+func (s awsLogs) CreateLogStream(input *cloudwatchlogs.CreateLogStreamInput) (*cloudwatchlogs.CreateLogStreamOutput, error) {
+	return s.client.CreateLogStreamRequest(input).Send()
+}
+
+func (s awsLogs) DescribeLogStreams(input *cloudwatchlogs.DescribeLogStreamsInput) (*cloudwatchlogs.DescribeLogStreamsOutput, error) {
+	return s.client.DescribeLogStreamsRequest(input).Send()
+}
+
+func (s awsLogs) FilterLogEvents(input *cloudwatchlogs.FilterLogEventsInput) (*cloudwatchlogs.FilterLogEventsOutput, error) {
+	return s.client.FilterLogEventsRequest(input).Send()
+}
+
+func (inv *Invocation) backend() Backend {
+	if inv == nil || inv.Backend == nil {
+		return AwsBackend{}
+	}
+	return inv.Backend
+}
+
+// connect creates the ECS and EC2 clients of the context for its AWS config.
+func (ctx *ExecutionContext) connect() {
+	backend := ctx.Invocation.backend()
+	ctx.Ecs = backend.Ecs(*ctx.AwsConfig)
+	ctx.Ec2 = backend.Ec2(*ctx.AwsConfig)
+}
+
+// LogsClient returns a CloudWatch Logs client for the region of the log group.
+func (ctx *ExecutionContext) LogsClient(loc *AwslogsLocation) LogsAPI {
+	return LogsClient(ctx.Invocation.backend(), *ctx.AwsConfig, loc)
+}
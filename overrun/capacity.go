@@ -0,0 +1,67 @@
+/*
+ * Copyright 2018 Mark Adamcin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// CapacityProvider is an item of the capacity provider strategy of a task, given as name[:weight[:base]].
+type CapacityProvider struct {
+	Name string
+
+	Weight int64
+
+	Base int64
+}
+
+func ParseCapacityProvider(spec string) (CapacityProvider, error) {
+	parts := strings.Split(spec, ":")
+	provider := CapacityProvider{Name: parts[0], Weight: 1}
+	invalid := fmt.Errorf("invalid capacity provider %s. Expected name[:weight[:base]], such as FARGATE_SPOT:3", spec)
+	if len(parts) > 3 || len(provider.Name) == 0 {
+		return CapacityProvider{}, invalid
+	}
+	var err error
+	if len(parts) > 1 {
+		if provider.Weight, err = strconv.ParseInt(parts[1], 10, 64); err != nil || provider.Weight < 0 {
+			return CapacityProvider{}, invalid
+		}
+	}
+	if len(parts) > 2 {
+		if provider.Base, err = strconv.ParseInt(parts[2], 10, 64); err != nil || provider.Base < 0 {
+			return CapacityProvider{}, invalid
+		}
+	}
+	return provider, nil
+}
+
+// capacityProviderStrategy returns the capacityProviderStrategy member of RunTask, which the vendored SDK cannot
+// express.
+func capacityProviderStrategy(providers []CapacityProvider) JSONMembers {
+	var strategy []interface{}
+	for _, provider := range providers {
+		item := JSONMembers{"capacityProvider": provider.Name, "weight": provider.Weight}
+		if provider.Base > 0 {
+			item["base"] = provider.Base
+		}
+		strategy = append(strategy, item)
+	}
+	return JSONMembers{"capacityProviderStrategy": strategy}
+}
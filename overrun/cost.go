@@ -0,0 +1,233 @@
+/*
+ * Copyright 2018 Mark Adamcin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"io/ioutil"
+	"math"
+	"strconv"
+	"time"
+)
+
+const (
+	ArchitectureX86 = "x86_64"
+	ArchitectureArm = "arm64"
+)
+
+// the capacity provider that runs tasks on spare Fargate capacity at a discount.
+const CapacityProviderFargateSpot = "FARGATE_SPOT"
+
+// Fargate bills each second from the start of the image pull until the task stops, with a one-minute minimum.
+const FargateMinimumBilledSeconds = 60
+
+// DefaultFargatePrices holds the Fargate Linux prices per hour in USD for some regions, by architecture. Spot prices
+// change with demand, so those are typical values. Use --price-table to supply other regions or current prices.
+const DefaultFargatePrices = `{
+  "us-east-1": {
+    "onDemand": {"x86_64": {"vcpuHour": 0.04048, "gbHour": 0.004445}, "arm64": {"vcpuHour": 0.03238, "gbHour": 0.00356}},
+    "spot": {"x86_64": {"vcpuHour": 0.01334053, "gbHour": 0.00146489}}
+  },
+  "us-east-2": {
+    "onDemand": {"x86_64": {"vcpuHour": 0.04048, "gbHour": 0.004445}, "arm64": {"vcpuHour": 0.03238, "gbHour": 0.00356}},
+    "spot": {"x86_64": {"vcpuHour": 0.01334053, "gbHour": 0.00146489}}
+  },
+  "us-west-1": {
+    "onDemand": {"x86_64": {"vcpuHour": 0.04656, "gbHour": 0.00511}, "arm64": {"vcpuHour": 0.03725, "gbHour": 0.00409}},
+    "spot": {"x86_64": {"vcpuHour": 0.01534338, "gbHour": 0.00168393}}
+  },
+  "us-west-2": {
+    "onDemand": {"x86_64": {"vcpuHour": 0.04048, "gbHour": 0.004445}, "arm64": {"vcpuHour": 0.03238, "gbHour": 0.00356}},
+    "spot": {"x86_64": {"vcpuHour": 0.01334053, "gbHour": 0.00146489}}
+  },
+  "eu-west-1": {
+    "onDemand": {"x86_64": {"vcpuHour": 0.04048, "gbHour": 0.004445}, "arm64": {"vcpuHour": 0.03238, "gbHour": 0.00356}},
+    "spot": {"x86_64": {"vcpuHour": 0.01334053, "gbHour": 0.00146489}}
+  },
+  "eu-central-1": {
+    "onDemand": {"x86_64": {"vcpuHour": 0.04656, "gbHour": 0.00511}, "arm64": {"vcpuHour": 0.03725, "gbHour": 0.00409}},
+    "spot": {"x86_64": {"vcpuHour": 0.01534338, "gbHour": 0.00168393}}
+  },
+  "ap-northeast-1": {
+    "onDemand": {"x86_64": {"vcpuHour": 0.05056, "gbHour": 0.00553}, "arm64": {"vcpuHour": 0.04045, "gbHour": 0.00442}},
+    "spot": {"x86_64": {"vcpuHour": 0.01666155, "gbHour": 0.00182233}}
+  },
+  "ap-southeast-2": {
+    "onDemand": {"x86_64": {"vcpuHour": 0.04856, "gbHour": 0.00532}, "arm64": {"vcpuHour": 0.03885, "gbHour": 0.00426}},
+    "spot": {"x86_64": {"vcpuHour": 0.01600248, "gbHour": 0.00175313}}
+  }
+}`
+
+// FargateRate is the price of one vCPU and one GB of memory for an hour.
+type FargateRate struct {
+	VcpuHour float64 `json:"vcpuHour"`
+
+	GbHour float64 `json:"gbHour"`
+}
+
+// RegionPrices holds the rates of a region by architecture.
+type RegionPrices struct {
+	OnDemand map[string]FargateRate `json:"onDemand"`
+
+	Spot map[string]FargateRate `json:"spot"`
+}
+
+// PriceTable holds the Fargate prices of each region.
+type PriceTable map[string]RegionPrices
+
+func mergeRates(dst map[string]FargateRate, src map[string]FargateRate) map[string]FargateRate {
+	if dst == nil {
+		dst = make(map[string]FargateRate)
+	}
+	for arch, rate := range src {
+		dst[arch] = rate
+	}
+	return dst
+}
+
+// LoadPriceTable returns the default price table, with the regions and architectures of the JSON file at path, if any,
+// replacing the defaults.
+func LoadPriceTable(path string) (PriceTable, error) {
+	prices := PriceTable{}
+	if err := json.Unmarshal([]byte(DefaultFargatePrices), &prices); err != nil {
+		return nil, err
+	}
+	if len(path) == 0 {
+		return prices, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	overrides := PriceTable{}
+	if err := json.Unmarshal(data, &overrides); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	for region, override := range overrides {
+		regionPrices := prices[region]
+		regionPrices.OnDemand = mergeRates(regionPrices.OnDemand, override.OnDemand)
+		regionPrices.Spot = mergeRates(regionPrices.Spot, override.Spot)
+		prices[region] = regionPrices
+	}
+	return prices, nil
+}
+
+// Rate returns the rate for the region, architecture and capacity.
+func (p PriceTable) Rate(region string, architecture string, spot bool) (FargateRate, error) {
+	capacity := "On-Demand"
+	rates := p[region].OnDemand
+	if spot {
+		capacity = "Spot"
+		rates = p[region].Spot
+	}
+	rate, ok := rates[architecture]
+	if !ok {
+		return rate, fmt.Errorf("no Fargate %s price for %s in %s", capacity, architecture, region)
+	}
+	return rate, nil
+}
+
+// CostEstimate is the estimated cost of a stopped Fargate task.
+type CostEstimate struct {
+	Region string `json:"region"`
+
+	Architecture string `json:"architecture"`
+
+	Spot bool `json:"spot"`
+
+	Vcpu float64 `json:"vcpu"`
+
+	MemoryGb float64 `json:"memoryGb"`
+
+	BilledSeconds int64 `json:"billedSeconds"`
+
+	Cost float64 `json:"cost"`
+}
+
+func (e *CostEstimate) String() string {
+	capacity := "On-Demand"
+	if e.Spot {
+		capacity = "Spot"
+	}
+	return fmt.Sprintf("$%.4f (%g vCPU, %g GB, %ds billed, %s %s in %s)", e.Cost, e.Vcpu, e.MemoryGb, e.BilledSeconds,
+		e.Architecture, capacity, e.Region)
+}
+
+// BilledSeconds returns the billed duration of a Fargate task, from the start of its image pull until it stopped,
+// rounded up to the second, with the one-minute minimum. Returns false if the task never began pulling its image.
+func BilledSeconds(task *ecs.Task) (int64, bool) {
+	if task.PullStartedAt == nil || task.StoppedAt == nil {
+		return 0, false
+	}
+	seconds := int64(math.Ceil(task.StoppedAt.Sub(*task.PullStartedAt).Seconds()))
+	if seconds < FargateMinimumBilledSeconds {
+		seconds = FargateMinimumBilledSeconds
+	}
+	return seconds, true
+}
+
+// EstimateCost estimates the cost of a stopped Fargate task from its task-level cpu and memory. Returns nil if the
+// task was not billed.
+func EstimateCost(prices PriceTable, region string, task *ecs.Task, architecture string, spot bool) (*CostEstimate, error) {
+	seconds, billed := BilledSeconds(task)
+	if !billed {
+		return nil, nil
+	}
+	cpu, err := strconv.ParseFloat(aws.StringValue(task.Cpu), 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid task cpu: %s", aws.StringValue(task.Cpu))
+	}
+	memory, err := strconv.ParseFloat(aws.StringValue(task.Memory), 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid task memory: %s", aws.StringValue(task.Memory))
+	}
+	if len(architecture) == 0 {
+		architecture = ArchitectureX86
+	}
+	rate, err := prices.Rate(region, architecture, spot)
+	if err != nil {
+		return nil, err
+	}
+
+	estimate := CostEstimate{
+		Region:        region,
+		Architecture:  architecture,
+		Spot:          spot,
+		Vcpu:          cpu / 1024,
+		MemoryGb:      memory / 1024,
+		BilledSeconds: seconds}
+	hours := float64(seconds) / float64(time.Hour/time.Second)
+	estimate.Cost = (estimate.Vcpu*rate.VcpuHour + estimate.MemoryGb*rate.GbHour) * hours
+	return &estimate, nil
+}
+
+// estimateTaskCost estimates the cost of a stopped task, if it ran on Fargate.
+func estimateTaskCost(ctx *ExecutionContext, task *ecs.Task) (*CostEstimate, error) {
+	if task.LaunchType != ecs.LaunchTypeFargate {
+		return nil, nil
+	}
+	capacityProvider, architecture, err := ctx.Ecs.TaskCapacity(&ctx.Target.Cluster, aws.StringValue(task.TaskArn))
+	if err != nil {
+		return nil, err
+	}
+	return EstimateCost(ctx.Prices, ctx.AwsConfig.Region, task, architecture,
+		capacityProvider == CapacityProviderFargateSpot)
+}
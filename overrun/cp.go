@@ -0,0 +1,581 @@
+/*
+ * Copyright 2018 Mark Adamcin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// The cp subcommand copies files through ECS Exec sessions, so that neither S3 nor anything but a shell, base64,
+// sha256sum, dd and tar is needed in the container. Files are sent in chunks of CopyChunkBytes, one session each, as
+// base64 lines typed into the session's terminal, and received as the base64 output of dd. The sha256 of each chunk
+// is checked by the receiving side, and a chunk that does not match is sent again. Chunks are assembled in a temp
+// file, which is moved into place once the sha256 of the whole file matches as well. Directories are copied as tar
+// archives.
+
+// bytes of a file copied by each session.
+const CopyChunkBytes = 1 << 20
+
+// how many times a chunk is copied before giving up.
+const CopyChunkAttempts = 3
+
+// prefix of the lines that the copy scripts report their results with, which cannot occur in base64 data.
+const copyMarker = "overrun-cp:"
+
+// where files sent to a task are assembled.
+const CopyTempDir = "/tmp"
+
+// copyPutChunkScript decodes a chunk from its input and appends it to the temp file, if its sha256 is the one expected
+// and the temp file is as long as the offset of the chunk, which makes sending a chunk again harmless. Arguments: temp
+// file, length of the input, sha256, offset.
+var copyPutChunkScript = strings.Join([]string{
+	`stty -echo 2>/dev/null`,
+	`tmp=$1 n=$2 sum=$3 offset=$4`,
+	`if [ "$offset" = 0 ]; then : > "$tmp"; fi`,
+	`head -c "$n" | base64 -d > "$tmp.chunk" || exit 1`,
+	`set -- $(sha256sum < "$tmp.chunk")`,
+	`size=$(wc -c < "$tmp")`,
+	`if [ "$1" = "$sum" ] && [ "$size" -eq "$offset" ]; then cat "$tmp.chunk" >> "$tmp" && size=$(wc -c < "$tmp"); fi`,
+	`rm -f "$tmp.chunk"`,
+	`echo "` + copyMarker + `chunk $1 $size"`}, "; ")
+
+// copyPutFinishScript checks the sha256 of the temp file, then moves it to the destination, or into the destination
+// when that is a directory. Archives of directories are extracted instead. Arguments: temp file, destination, sha256,
+// file or dir, name of the source, mode of a file.
+var copyPutFinishScript = strings.Join([]string{
+	`tmp=$1 dst=$2 sum=$3 kind=$4 name=$5 mode=$6`,
+	`set -- $(sha256sum < "$tmp")`,
+	`if [ "$1" != "$sum" ]; then rm -f "$tmp"; echo "` + copyMarker + `mismatch $1"; exit 1; fi`,
+	`if [ -d "$dst" ]; then dst="${dst%/}/$name"; fi`,
+	`if [ "$kind" = dir ]; then mkdir -p "$dst" && tar xf "$tmp" -C "$dst"; else mv -f "$tmp" "$dst" && chmod "$mode" "$dst"; fi || { rm -f "$tmp"; exit 1; }`,
+	`rm -f "$tmp"`,
+	`echo "` + copyMarker + `done $dst"`}, "; ")
+
+// copyStatScript reports whether the source is a file or a directory, with the size and sha256 of the file, or of an
+// archive of the directory written to the temp file, and the mode of the file, or 644 without stat. Arguments: source,
+// temp file.
+var copyStatScript = strings.Join([]string{
+	`src=$1 tmp=$2 kind=file`,
+	`if [ -d "$src" ]; then tar cf "$tmp" -C "$src" . || exit 1; kind=dir src=$tmp; elif [ ! -f "$src" ]; then echo "` + copyMarker + `missing"; exit 1; fi`,
+	`size=$(wc -c < "$src")`,
+	`mode=$(stat -c %a "$src" 2>/dev/null) || mode=644`,
+	`set -- $(sha256sum < "$src")`,
+	`echo "` + copyMarker + `stat $kind $size $1 $mode"`}, "; ")
+
+// copyGetChunkScript prints a chunk of a file as base64 between begin and end lines, followed by its sha256. Arguments:
+// file, chunk size, chunk index.
+var copyGetChunkScript = strings.Join([]string{
+	`src=$1 bs=$2 index=$3`,
+	`echo "` + copyMarker + `begin"`,
+	`dd if="$src" bs="$bs" skip="$index" count=1 2>/dev/null | base64`,
+	`echo "` + copyMarker + `end"`,
+	`set -- $(dd if="$src" bs="$bs" skip="$index" count=1 2>/dev/null | sha256sum)`,
+	`echo "` + copyMarker + `sum $1"`}, "; ")
+
+const copyCleanupScript = `rm -f "$1"`
+
+// CopyShell runs a script in the container with the arguments, types the input into its terminal, and returns its
+// output.
+type CopyShell func(script string, args []string, input []byte) (string, error)
+
+// ExecShell returns a CopyShell that runs each script in a new ECS Exec session.
+func ExecShell(ecss EcsAPI, awsCfg aws.Config, cluster *string, task string, container string) CopyShell {
+	return func(script string, args []string, input []byte) (string, error) {
+		words := append([]string{"/bin/sh", "-c", script, "overrun-cp"}, args...)
+		quoted := make([]string, len(words))
+		for i, word := range words {
+			quoted[i] = ShellQuote(word)
+		}
+		execInput := ExecuteCommandInput{
+			Cluster:     cluster,
+			Command:     aws.String(strings.Join(quoted, " ")),
+			Interactive: aws.Bool(true),
+			Task:        &task}
+		if len(container) > 0 {
+			execInput.Container = &container
+		}
+		out, err := executeCommand(ecss, &execInput, 0)
+		if err != nil {
+			return "", err
+		}
+		sessionId := aws.StringValue(out.Session.SessionId)
+		session, err := OpenSession(*out.Session.StreamUrl, *out.Session.TokenValue, sessionId)
+		if err != nil {
+			return "", err
+		}
+		defer terminateSession(awsCfg, sessionId)
+		var output bytes.Buffer
+		session.Stdout = &output
+		session.Stderr = &output
+		if len(input) > 0 {
+			go func() { _, _ = session.Write(input) }()
+		}
+		err = session.Run()
+		return output.String(), err
+	}
+}
+
+// CopyPath is an argument of the cp subcommand: a local path, or task:path.
+type CopyPath struct {
+	// the ID or ARN of the task, when the path is in its container.
+	Task string
+
+	Path string
+}
+
+// ParseCopyPath splits a task:path argument, where the task is an ID or ARN. Arguments without a task before a colon
+// are local paths, so local paths containing a colon can be given as ./a:b.
+func ParseCopyPath(arg string) CopyPath {
+	if strings.HasPrefix(arg, "arn:") {
+		if i := strings.Index(arg, ":task/"); i >= 0 {
+			if j := strings.Index(arg[i+len(":task/"):], ":"); j >= 0 {
+				end := i + len(":task/") + j
+				return CopyPath{Task: arg[:end], Path: arg[end+1:]}
+			}
+		}
+		return CopyPath{Path: arg}
+	}
+	if i := strings.Index(arg, ":"); i > 1 && !strings.ContainsAny(arg[:i], `/\.`) {
+		return CopyPath{Task: arg[:i], Path: arg[i+1:]}
+	}
+	return CopyPath{Path: arg}
+}
+
+func (p CopyPath) IsRemote() bool {
+	return len(p.Task) > 0
+}
+
+func (p CopyPath) String() string {
+	if p.IsRemote() {
+		return p.Task + ":" + p.Path
+	}
+	return p.Path
+}
+
+// copyResult returns the rest of the last line of output that reports the result, or an error that includes the
+// output when there is none.
+func copyResult(output string, result string) (string, error) {
+	prefix := copyMarker + result
+	value, found := "", false
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if line == prefix || strings.HasPrefix(line, prefix+" ") {
+			value, found = strings.TrimPrefix(strings.TrimPrefix(line, prefix), " "), true
+		}
+	}
+	if !found {
+		return "", fmt.Errorf("unexpected output of copy script: %s", strings.TrimSpace(output))
+	}
+	return value, nil
+}
+
+// copyData returns the base64 data printed between the begin and end lines of output, decoded.
+func copyData(output string) ([]byte, error) {
+	begin := strings.Index(output, copyMarker+"begin")
+	end := strings.LastIndex(output, copyMarker+"end")
+	if begin < 0 || end < begin {
+		return nil, fmt.Errorf("unexpected output of copy script: %s", strings.TrimSpace(output))
+	}
+	encoded := strings.Join(strings.Fields(output[begin+len(copyMarker+"begin"):end]), "")
+	return base64.StdEncoding.DecodeString(encoded)
+}
+
+// encodeLines encodes data as base64 in lines of 76 characters, each short enough for a terminal's line buffer.
+func encodeLines(data []byte) []byte {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	var buf bytes.Buffer
+	for len(encoded) > 76 {
+		buf.WriteString(encoded[:76])
+		buf.WriteByte('\n')
+		encoded = encoded[76:]
+	}
+	if len(encoded) > 0 {
+		buf.WriteString(encoded)
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// copyTempName returns a unique name for a temp file in the container.
+func copyTempName() string {
+	suffix := make([]byte, 8)
+	_, _ = rand.Read(suffix)
+	return CopyTempDir + "/overrun-cp-" + hex.EncodeToString(suffix)
+}
+
+// CopyToTask copies a local file or directory to the path in the container, or into it if it is a directory. Returns the
+// path in the container that was written.
+func CopyToTask(shell CopyShell, local string, remote string) (string, error) {
+	info, err := os.Stat(local)
+	if err != nil {
+		return "", err
+	}
+	kind, source := "file", local
+	if info.IsDir() {
+		archive, err := archiveDir(local)
+		if err != nil {
+			return "", err
+		}
+		defer os.Remove(archive)
+		kind, source = "dir", archive
+	}
+	fh, err := os.Open(source)
+	if err != nil {
+		return "", err
+	}
+	defer fh.Close()
+
+	tmp := copyTempName()
+	sent := false
+	defer func() {
+		if sent {
+			_, _ = shell(copyCleanupScript, []string{tmp}, nil)
+		}
+	}()
+	hash := sha256.New()
+	chunk := make([]byte, CopyChunkBytes)
+	for offset := int64(0); ; {
+		n, err := io.ReadFull(fh, chunk)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return "", err
+		} else if n == 0 && offset > 0 {
+			break
+		}
+		hash.Write(chunk[:n])
+		sent = true
+		if err := putChunk(shell, tmp, chunk[:n], offset); err != nil {
+			return "", err
+		}
+		offset += int64(n)
+		if n < len(chunk) {
+			break
+		}
+	}
+
+	args := []string{tmp, remote, hex.EncodeToString(hash.Sum(nil)), kind, filepath.Base(local),
+		strconv.FormatUint(uint64(info.Mode().Perm()), 8)}
+	output, err := shell(copyPutFinishScript, args, nil)
+	if err != nil {
+		return "", err
+	}
+	if mismatch, err := copyResult(output, "mismatch"); err == nil {
+		return "", fmt.Errorf("sha256 of the copy of %s is %s, not %s", local, mismatch, args[2])
+	}
+	written, err := copyResult(output, "done")
+	if err != nil {
+		return "", err
+	}
+	sent = false
+	return written, nil
+}
+
+// putChunk sends a chunk at the offset of the temp file, until its sha256 matches.
+func putChunk(shell CopyShell, tmp string, data []byte, offset int64) error {
+	var err error
+	for attempt := 1; attempt <= CopyChunkAttempts; attempt++ {
+		if err = putChunkOnce(shell, tmp, data, offset); err == nil {
+			return nil
+		}
+		log.Printf("WARNING: attempt %d to copy the chunk at offset %d failed: %s\n", attempt, offset, err)
+	}
+	return err
+}
+
+func putChunkOnce(shell CopyShell, tmp string, data []byte, offset int64) error {
+	sum := sha256Hex(data)
+	input := encodeLines(data)
+	output, err := shell(copyPutChunkScript, []string{tmp, strconv.Itoa(len(input)), sum, strconv.FormatInt(offset, 10)}, input)
+	if err != nil {
+		return err
+	}
+	result, err := copyResult(output, "chunk")
+	if err != nil {
+		return err
+	}
+	want := strconv.FormatInt(offset+int64(len(data)), 10)
+	if fields := strings.Fields(result); len(fields) != 2 || fields[0] != sum || fields[1] != want {
+		return fmt.Errorf("expected sha256 %s and size %s, got %s", sum, want, result)
+	}
+	return nil
+}
+
+// CopyFromTask copies a file or directory in the container to the local path, or into it if it is a directory. Returns
+// the local path that was written.
+func CopyFromTask(shell CopyShell, remote string, local string) (string, error) {
+	tmp := copyTempName()
+	output, err := shell(copyStatScript, []string{remote, tmp}, nil)
+	if err != nil {
+		return "", err
+	}
+	if _, err := copyResult(output, "missing"); err == nil {
+		return "", fmt.Errorf("%s not found in the container", remote)
+	}
+	stat, err := copyResult(output, "stat")
+	if err != nil {
+		return "", err
+	}
+	fields := strings.Fields(stat)
+	if len(fields) != 4 {
+		return "", fmt.Errorf("unexpected output of copy script: %s", stat)
+	}
+	kind, sum := fields[0], fields[2]
+	size, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("unexpected output of copy script: %s", stat)
+	}
+	mode, err := strconv.ParseUint(fields[3], 8, 32)
+	if err != nil {
+		return "", fmt.Errorf("unexpected output of copy script: %s", stat)
+	}
+	source := remote
+	if kind == "dir" {
+		source = tmp
+		defer func() { _, _ = shell(copyCleanupScript, []string{tmp}, nil) }()
+	}
+
+	target := local
+	if info, err := os.Stat(local); err == nil && info.IsDir() {
+		target = filepath.Join(local, path.Base(remote))
+	}
+	fh, err := ioutil.TempFile(filepath.Dir(target), ".overrun-cp-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(fh.Name())
+	defer fh.Close()
+	hash := sha256.New()
+	for index := int64(0); index*CopyChunkBytes < size; index++ {
+		length := size - index*CopyChunkBytes
+		if length > CopyChunkBytes {
+			length = CopyChunkBytes
+		}
+		data, err := getChunk(shell, source, index, length)
+		if err != nil {
+			return "", err
+		}
+		hash.Write(data)
+		if _, err := fh.Write(data); err != nil {
+			return "", err
+		}
+	}
+	if err := fh.Close(); err != nil {
+		return "", err
+	}
+	if actual := hex.EncodeToString(hash.Sum(nil)); actual != sum {
+		return "", fmt.Errorf("sha256 of the copy of %s is %s, not %s", remote, actual, sum)
+	}
+
+	if kind == "dir" {
+		return target, extractDir(fh.Name(), target)
+	}
+	if err := os.Chmod(fh.Name(), os.FileMode(mode).Perm()); err != nil {
+		return "", err
+	}
+	return target, os.Rename(fh.Name(), target)
+}
+
+// getChunk receives the chunk of a file at the index, until its sha256 matches.
+func getChunk(shell CopyShell, source string, index int64, length int64) ([]byte, error) {
+	var err error
+	for attempt := 1; attempt <= CopyChunkAttempts; attempt++ {
+		var data []byte
+		if data, err = getChunkOnce(shell, source, index, length); err == nil {
+			return data, nil
+		}
+		log.Printf("WARNING: attempt %d to copy chunk %d failed: %s\n", attempt, index, err)
+	}
+	return nil, err
+}
+
+func getChunkOnce(shell CopyShell, source string, index int64, length int64) ([]byte, error) {
+	output, err := shell(copyGetChunkScript, []string{source, strconv.Itoa(CopyChunkBytes), strconv.FormatInt(index, 10)}, nil)
+	if err != nil {
+		return nil, err
+	}
+	data, err := copyData(output)
+	if err != nil {
+		return nil, err
+	}
+	sum, err := copyResult(output, "sum")
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) != length || sha256Hex(data) != sum {
+		return nil, fmt.Errorf("expected %d bytes with sha256 %s, got %d bytes with sha256 %s", length, sum, len(data),
+			sha256Hex(data))
+	}
+	return data, nil
+}
+
+// extractDir extracts a tar archive of the contents of a directory into the target directory.
+func extractDir(archivePath string, target string) error {
+	fh, err := os.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return err
+	}
+	archive := tar.NewReader(fh)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("failed to read archive: %s", err)
+		}
+		name := path.Clean(strings.TrimPrefix(header.Name, "./"))
+		if name == "." {
+			continue
+		} else if name == ".." || strings.HasPrefix(name, "../") || path.IsAbs(name) {
+			return errors.New("refusing to extract outside of the target directory: " + header.Name)
+		}
+		if err := extractEntry(archive, header, filepath.Join(target, filepath.FromSlash(name))); err != nil {
+			return err
+		}
+	}
+}
+
+// cpCommand runs the cp subcommand, which copies a file or directory into or out of a container of a running task.
+func cpCommand(args []string) {
+	parser := loadCommandArgs("cp", args)
+	prefs := parser.Args()
+	if len(parser.Positional) != 2 {
+		usage()
+		log.Fatal("Specify a source and a destination, one of them as task:path.")
+	} else if len(prefs.Clusters) > 1 || len(prefs.AwsRegions) > 1 {
+		log.Fatal("Specify at most one --cluster and one --region.")
+	}
+	src, dst := ParseCopyPath(parser.Positional[0]), ParseCopyPath(parser.Positional[1])
+	remote := src
+	if dst.IsRemote() {
+		remote = dst
+	}
+	if src.IsRemote() == dst.IsRemote() {
+		log.Fatal("Specify either the source or the destination as task:path.")
+	} else if len(remote.Path) == 0 {
+		log.Fatalf("Specify a path in the container after %s:", remote.Task)
+	}
+
+	awsCfg := loadAwsConfig(&prefs)
+	if len(prefs.AwsRegions) > 0 {
+		awsCfg.Region = prefs.AwsRegions[0]
+	}
+	var cluster *string
+	if len(prefs.Clusters) > 0 {
+		cluster = &prefs.Clusters[0]
+	}
+	if prefs.DryRun {
+		log.Printf("Would copy %s to %s.\n", src, dst)
+		os.Exit(0)
+	}
+
+	ecss := AwsBackend{NoWaiterDelay: prefs.NoWaiterDelay}.Ecs(awsCfg)
+	shell := ExecShell(ecss, awsCfg, cluster, remote.Task, prefs.ContainerName)
+	var written string
+	var err error
+	if dst.IsRemote() {
+		written, err = CopyToTask(shell, src.Path, dst.Path)
+	} else {
+		written, err = CopyFromTask(shell, src.Path, dst.Path)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Copied %s to %s.\n", src, written)
+}
+
+// archiveDir writes a tar archive of the contents of a directory to a temp file.
+func archiveDir(dir string) (string, error) {
+	fh, err := ioutil.TempFile("", "overrun-cp-")
+	if err != nil {
+		return "", err
+	}
+	archive := tar.NewWriter(fh)
+	err = filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, file)
+		if err != nil || rel == "." {
+			return err
+		}
+		var link string
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(file); err != nil {
+				return err
+			}
+		} else if !info.IsDir() && !info.Mode().IsRegular() {
+			// sockets, devices and pipes are skipped.
+			return nil
+		}
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(rel)
+		if info.IsDir() {
+			header.Name += "/"
+		}
+		if err := archive.WriteHeader(header); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		src, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		_, err = io.Copy(archive, src)
+		return err
+	})
+	if err == nil {
+		err = archive.Close()
+	}
+	if closeErr := fh.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(fh.Name())
+		return "", err
+	}
+	return fh.Name(), nil
+}
@@ -0,0 +1,188 @@
+/*
+ * Copyright 2018 Mark Adamcin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseCopyPath(t *testing.T) {
+	tests := []struct {
+		arg  string
+		want CopyPath
+	}{
+		{arg: "./seed.sql", want: CopyPath{Path: "./seed.sql"}},
+		{arg: "0123abcd:/tmp/seed.sql", want: CopyPath{Task: "0123abcd", Path: "/tmp/seed.sql"}},
+		{arg: "0123abcd:", want: CopyPath{Task: "0123abcd"}},
+		{
+			arg:  "arn:aws:ecs:us-east-1:123456789012:task/main/0123abcd:/tmp/seed.sql",
+			want: CopyPath{Task: "arn:aws:ecs:us-east-1:123456789012:task/main/0123abcd", Path: "/tmp/seed.sql"},
+		},
+		{arg: "./a:b", want: CopyPath{Path: "./a:b"}},
+		{arg: "C:\\seed.sql", want: CopyPath{Path: "C:\\seed.sql"}},
+	}
+	for _, test := range tests {
+		t.Run(test.arg, func(t *testing.T) {
+			if got := ParseCopyPath(test.arg); got != test.want {
+				t.Errorf("got %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+// localShell runs copy scripts with the local sh, standing in for a container.
+func localShell(t *testing.T) CopyShell {
+	for _, tool := range []string{"sh", "base64", "sha256sum", "dd", "head", "tar", "stat"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s is required: %s", tool, err)
+		}
+	}
+	return func(script string, args []string, input []byte) (string, error) {
+		cmd := exec.Command("sh", append([]string{"-c", script, "overrun-cp"}, args...)...)
+		cmd.Stdin = bytes.NewReader(input)
+		output, _ := cmd.CombinedOutput()
+		return string(output), nil
+	}
+}
+
+func TestCopyFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "overrun-cp-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	shell := localShell(t)
+	// corrupt the first attempt to send each chunk, which must be sent again.
+	corrupted := make(map[string]bool)
+	flaky := func(script string, args []string, input []byte) (string, error) {
+		if script == copyPutChunkScript && !corrupted[args[3]] {
+			corrupted[args[3]] = true
+			input = append([]byte("AAAA"), input[4:]...)
+		}
+		return shell(script, args, input)
+	}
+
+	data := make([]byte, CopyChunkBytes*2+CopyChunkBytes/2)
+	rand.New(rand.NewSource(1)).Read(data)
+	local := filepath.Join(dir, "seed.sql")
+	if err := ioutil.WriteFile(local, data, 0640); err != nil {
+		t.Fatal(err)
+	}
+	remoteDir := filepath.Join(dir, "container")
+	if err := os.Mkdir(remoteDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	written, err := CopyToTask(flaky, local, remoteDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(remoteDir, "seed.sql"); written != want {
+		t.Errorf("wrote %s, want %s", written, want)
+	}
+	if len(corrupted) != 3 {
+		t.Errorf("sent %d chunks, want 3", len(corrupted))
+	}
+	if info, err := os.Stat(written); err != nil || info.Mode().Perm() != 0640 {
+		t.Errorf("copy has mode %v, want 0640: %v", info.Mode().Perm(), err)
+	}
+
+	back := filepath.Join(dir, "back.sql")
+	if written, err = CopyFromTask(shell, written, back); err != nil {
+		t.Fatal(err)
+	}
+	copied, err := ioutil.ReadFile(written)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(copied, data) {
+		t.Error("file copied back differs from the original")
+	}
+	if info, err := os.Stat(written); err != nil || info.Mode().Perm() != 0640 {
+		t.Errorf("copy has mode %v, want 0640: %v", info.Mode().Perm(), err)
+	}
+
+	// an executable stays executable when copied back.
+	script := filepath.Join(remoteDir, "migrate.sh")
+	if err := ioutil.WriteFile(script, []byte("#!/bin/sh\necho migrated\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if written, err = CopyFromTask(shell, script, dir); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(written); err != nil || info.Mode().Perm() != 0755 {
+		t.Errorf("copy has mode %v, want 0755: %v", info.Mode().Perm(), err)
+	}
+
+	if _, err := CopyFromTask(shell, filepath.Join(remoteDir, "missing.sql"), back); err == nil ||
+		!strings.Contains(err.Error(), "not found") {
+		t.Errorf("got error %v, want not found", err)
+	}
+}
+
+func TestCopyDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "overrun-cp-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	shell := localShell(t)
+
+	fixtures := filepath.Join(dir, "fixtures")
+	files := map[string]string{"users.csv": "id,name\n1,a\n", "nested/orders.csv": "id\n", "empty.txt": ""}
+	for name, content := range files {
+		file := filepath.Join(fixtures, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	remote := filepath.Join(dir, "container", "srv")
+	if _, err := CopyToTask(shell, fixtures, remote); err != nil {
+		t.Fatal(err)
+	}
+	local := filepath.Join(dir, "local")
+	if err := os.Mkdir(local, 0755); err != nil {
+		t.Fatal(err)
+	}
+	written, err := CopyFromTask(shell, remote, local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(local, "srv"); written != want {
+		t.Errorf("wrote %s, want %s", written, want)
+	}
+	for name, content := range files {
+		copied, err := ioutil.ReadFile(filepath.Join(written, filepath.FromSlash(name)))
+		if err != nil {
+			t.Error(err)
+		} else if string(copied) != content {
+			t.Errorf("got %q in %s, want %q", copied, name, content)
+		}
+	}
+}
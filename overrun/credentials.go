@@ -0,0 +1,195 @@
+/*
+ * Copyright 2018 Mark Adamcin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// assumed role credentials are refreshed, and cached credentials discarded, this long before they expire.
+const CredentialsExpiryWindow = time.Minute
+
+// role session names are limited to 64 of these characters.
+var invalidSessionNameChars = regexp.MustCompile(`[^\w+=,.@-]`)
+
+// RoleSessionName returns the --role-session-name, which defaults to overrun-$USER so that CloudTrail records who ran
+// the task.
+func RoleSessionName(prefs *ParsedArgs) string {
+	name := prefs.RoleSessionName
+	if len(name) == 0 {
+		user := os.Getenv("USER")
+		if len(user) == 0 {
+			user = os.Getenv("USERNAME")
+		}
+		name = strings.TrimSuffix("overrun-"+user, "-")
+	}
+	name = invalidSessionNameChars.ReplaceAllString(name, "-")
+	if len(name) > 64 {
+		name = name[:64]
+	}
+	return name
+}
+
+// AssumeRoleCredentials returns a provider of the credentials of the --role-arn, assumed with the credentials of the
+// config. The credentials are cached on disk until they expire, so that the MFA token code of --mfa-serial is only
+// prompted for once in the lifetime of a role session.
+func AssumeRoleCredentials(prefs *ParsedArgs, awsCfg aws.Config) aws.CredentialsProvider {
+	provider := stscreds.NewAssumeRoleProvider(sts.New(awsCfg), prefs.RoleArn)
+	provider.RoleSessionName = RoleSessionName(prefs)
+	provider.Duration = prefs.RoleDuration
+	provider.ExpiryWindow = CredentialsExpiryWindow
+	if len(prefs.ExternalId) > 0 {
+		provider.ExternalID = aws.String(prefs.ExternalId)
+	}
+	if len(prefs.MfaSerial) > 0 {
+		provider.SerialNumber = aws.String(prefs.MfaSerial)
+		provider.TokenProvider = PromptMfaToken(prefs.MfaSerial)
+	}
+	return NewCachedCredentialsProvider(provider, credentialsCachePath(prefs))
+}
+
+// PromptMfaToken returns a token provider that prompts on the terminal for the code of the MFA device.
+func PromptMfaToken(serial string) func() (string, error) {
+	return func() (string, error) {
+		if !IsTerminal(os.Stdin) {
+			return "", fmt.Errorf("a terminal is required to prompt for the MFA token code of %s", serial)
+		}
+		fmt.Fprintf(os.Stderr, "MFA token code for %s: ", serial)
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		code := strings.TrimSpace(line)
+		if len(code) == 0 {
+			return "", errors.New("no MFA token code given")
+		}
+		return code, nil
+	}
+}
+
+// credentialsCachePath returns the file in the user cache directory that holds the credentials of a role session.
+// The name is a hash of the settings that affect which credentials are returned.
+func credentialsCachePath(prefs *ParsedArgs) string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	key := strings.Join([]string{prefs.AwsProfile, prefs.EndpointUrl, prefs.RoleArn, RoleSessionName(prefs),
+		prefs.ExternalId, prefs.MfaSerial, prefs.RoleDuration.String()}, "\n")
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(dir, "overrun", "credentials", hex.EncodeToString(sum[:20])+".json")
+}
+
+// CachedCredentialsProvider keeps the credentials of another provider in a file until they expire.
+type CachedCredentialsProvider struct {
+	aws.SafeCredentialsProvider
+
+	Provider aws.CredentialsProvider
+
+	Path string
+}
+
+func NewCachedCredentialsProvider(provider aws.CredentialsProvider, path string) *CachedCredentialsProvider {
+	p := &CachedCredentialsProvider{Provider: provider, Path: path}
+	p.RetrieveFn = p.retrieve
+	return p
+}
+
+// the form of cached credentials.
+type cachedCredentials struct {
+	AccessKeyId     string    `json:"accessKeyId"`
+	SecretAccessKey string    `json:"secretAccessKey"`
+	SessionToken    string    `json:"sessionToken"`
+	Expiration      time.Time `json:"expiration"`
+}
+
+func (p *CachedCredentialsProvider) retrieve() (aws.Credentials, error) {
+	if creds, err := p.read(); err == nil && creds.HasKeys() && !creds.Expired() {
+		return creds, nil
+	}
+	creds, err := p.Provider.Retrieve()
+	if err != nil {
+		return creds, err
+	}
+	if creds.CanExpire {
+		if err := p.write(creds); err != nil {
+			log.Printf("Failed to cache credentials: %s\n", err)
+		}
+	}
+	return creds, nil
+}
+
+func (p *CachedCredentialsProvider) read() (aws.Credentials, error) {
+	data, err := ioutil.ReadFile(p.Path)
+	if err != nil {
+		return aws.Credentials{}, err
+	}
+	var cached cachedCredentials
+	if err := json.Unmarshal(data, &cached); err != nil {
+		return aws.Credentials{}, err
+	}
+	return aws.Credentials{
+		AccessKeyID:     cached.AccessKeyId,
+		SecretAccessKey: cached.SecretAccessKey,
+		SessionToken:    cached.SessionToken,
+		Source:          "overrun credentials cache",
+		CanExpire:       true,
+		Expires:         cached.Expiration}, nil
+}
+
+// write replaces the cache file, readable only by the user, by renaming a complete file over it.
+func (p *CachedCredentialsProvider) write(creds aws.Credentials) error {
+	data, err := json.Marshal(cachedCredentials{
+		AccessKeyId:     creds.AccessKeyID,
+		SecretAccessKey: creds.SecretAccessKey,
+		SessionToken:    creds.SessionToken,
+		Expiration:      creds.Expires})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p.Path), 0700); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(p.Path), filepath.Base(p.Path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), p.Path)
+}
@@ -0,0 +1,105 @@
+/*
+ * Copyright 2018 Mark Adamcin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRoleSessionName(t *testing.T) {
+	user := os.Getenv("USER")
+	defer os.Setenv("USER", user)
+
+	tests := []struct {
+		user string
+		name string
+		want string
+	}{
+		{user: "jdoe", want: "overrun-jdoe"},
+		{user: "DOMAIN\\j doe", want: "overrun-DOMAIN-j-doe"},
+		{user: "jdoe", name: "deploy@ci", want: "deploy@ci"},
+		{user: strings.Repeat("x", 80), want: "overrun-" + strings.Repeat("x", 56)},
+	}
+	for _, test := range tests {
+		os.Setenv("USER", test.user)
+		if got := RoleSessionName(&ParsedArgs{RoleSessionName: test.name}); got != test.want {
+			t.Errorf("RoleSessionName(%q) with USER=%q: got %q, want %q", test.name, test.user, got, test.want)
+		}
+	}
+}
+
+// countingProvider returns new credentials, expiring after ttl, each time it is asked.
+type countingProvider struct {
+	calls int
+	ttl   time.Duration
+}
+
+func (p *countingProvider) Retrieve() (aws.Credentials, error) {
+	p.calls++
+	return aws.Credentials{
+		AccessKeyID:     fmt.Sprintf("AKIA%d", p.calls),
+		SecretAccessKey: "secret",
+		SessionToken:    "token",
+		CanExpire:       true,
+		Expires:         time.Now().Add(p.ttl)}, nil
+}
+
+func TestCachedCredentialsProvider(t *testing.T) {
+	dir, err := ioutil.TempDir("", "overrun")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "credentials", "role.json")
+
+	source := &countingProvider{ttl: time.Hour}
+	for i := 0; i < 2; i++ {
+		// a new provider for each command, sharing the file.
+		creds, err := NewCachedCredentialsProvider(source, path).Retrieve()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if creds.AccessKeyID != "AKIA1" || creds.SessionToken != "token" {
+			t.Errorf("got credentials %+v, want AKIA1", creds)
+		}
+	}
+	if source.calls != 1 {
+		t.Errorf("got %d calls, want 1", source.calls)
+	}
+	if info, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	} else if info.Mode().Perm() != 0600 {
+		t.Errorf("got mode %s, want -rw-------", info.Mode())
+	}
+
+	expired := &countingProvider{ttl: -time.Minute}
+	for i := 0; i < 2; i++ {
+		if _, err := NewCachedCredentialsProvider(expired, filepath.Join(dir, "expired.json")).Retrieve(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if expired.calls != 2 {
+		t.Errorf("got %d calls for expired credentials, want 2", expired.calls)
+	}
+}
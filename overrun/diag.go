@@ -0,0 +1,187 @@
+/*
+ * Copyright 2018 Mark Adamcin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// overrun's own diagnostics go to stderr through the log package. With --log-json, the output of the log package is
+// replaced by a JSONLogWriter, which writes one JSON object per event. Events about a task are logged as a LogEvent,
+// which carries the task's ARN and cluster. Other messages are given a level from their WARNING: or ERROR: prefix, or
+// from being logged by log.Fatal. The log lines of containers, on stdout, are unaffected.
+
+const (
+	LevelInfo    = "info"
+	LevelWarning = "warning"
+	LevelError   = "error"
+)
+
+// the event type of log messages that are not a LogEvent.
+const EventMessage = "message"
+
+// LogEvent is a diagnostic message, with the fields written by --log-json.
+type LogEvent struct {
+	Time string `json:"time"`
+
+	Level string `json:"level"`
+
+	Event string `json:"event"`
+
+	Message string `json:"message"`
+
+	Cluster string `json:"cluster,omitempty"`
+
+	Region string `json:"region,omitempty"`
+
+	// index of the task in a fan-out.
+	Index *int `json:"index,omitempty"`
+
+	TaskArn string `json:"taskArn,omitempty"`
+
+	TaskDefinition string `json:"taskDefinition,omitempty"`
+
+	ExitCode *int `json:"exitCode,omitempty"`
+
+	Reason string `json:"reason,omitempty"`
+
+	Cost *CostEstimate `json:"cost,omitempty"`
+
+	// addresses of the containers of a healthy task.
+	Endpoints []string `json:"endpoints,omitempty"`
+
+	// prefix of the message in text form, which identifies the target and job.
+	label string
+}
+
+// the writer installed by EnableLogJSON, or nil when logging text.
+var jsonLog *JSONLogWriter
+
+// EnableLogJSON replaces the output of the log package with a JSONLogWriter.
+func EnableLogJSON(out io.Writer) {
+	jsonLog = &JSONLogWriter{Out: out}
+	log.SetFlags(0)
+	log.SetOutput(jsonLog)
+}
+
+// TaskEvent returns an event about the task of a job on the target of the context. The job may be nil.
+func TaskEvent(ctx *ExecutionContext, job *TaskJob, event string, taskArn string) LogEvent {
+	e := LogEvent{Level: LevelInfo, Event: event, Cluster: ctx.Target.Cluster, TaskArn: taskArn, label: ctx.Label}
+	if ctx.AwsConfig != nil {
+		e.Region = ctx.AwsConfig.Region
+	}
+	if job != nil {
+		e.label += job.Label
+		if len(job.Label) > 0 {
+			index := job.Index
+			e.Index = &index
+		}
+	}
+	return e
+}
+
+// Printf logs the event with the formatted message. Text output prefixes the message with the label of the event, and
+// the level unless it is info.
+func (e LogEvent) Printf(format string, v ...interface{}) {
+	e.Message = fmt.Sprintf(format, v...)
+	if jsonLog != nil {
+		jsonLog.WriteEvent(e)
+		return
+	}
+	prefix := e.label
+	if e.Level != LevelInfo {
+		prefix += strings.ToUpper(e.Level) + ": "
+	}
+	log.Println(prefix + e.Message)
+}
+
+// Warning logs the event at the warning level.
+func (e LogEvent) Warning(format string, v ...interface{}) {
+	e.Level = LevelWarning
+	e.Printf(format, v...)
+}
+
+// Error logs the event at the error level.
+func (e LogEvent) Error(format string, v ...interface{}) {
+	e.Level = LevelError
+	e.Printf(format, v...)
+}
+
+// Emit logs the event only with --log-json, for events whose text form is printed elsewhere, if at all.
+func (e LogEvent) Emit() {
+	if jsonLog != nil {
+		jsonLog.WriteEvent(e)
+	}
+}
+
+// JSONLogWriter writes each line it is given by the log package as a JSON message event.
+type JSONLogWriter struct {
+	sync.Mutex
+	Out io.Writer
+}
+
+var levelPrefix = regexp.MustCompile(`^([^:]* )?(WARNING|ERROR): `)
+
+func (w *JSONLogWriter) Write(p []byte) (int, error) {
+	e := LogEvent{Level: LevelInfo, Event: EventMessage, Message: strings.TrimSuffix(string(p), "\n")}
+	if loggedByFatal() {
+		e.Level = LevelError
+	} else if match := levelPrefix.FindStringSubmatch(e.Message); match != nil {
+		e.Level = strings.ToLower(match[2])
+		e.Message = match[1] + e.Message[len(match[0]):]
+	}
+	if err := w.WriteEvent(e); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// WriteEvent writes the event as a single line of JSON, timestamped now.
+func (w *JSONLogWriter) WriteEvent(e LogEvent) error {
+	e.Time = time.Now().UTC().Format(time.RFC3339Nano)
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	w.Lock()
+	defer w.Unlock()
+	_, err = w.Out.Write(append(data, '\n'))
+	return err
+}
+
+// loggedByFatal returns true when the line being written was logged by log.Fatal, log.Fatalf or log.Fatalln, which
+// exit once it is written.
+func loggedByFatal() bool {
+	pcs := make([]uintptr, 16)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(3, pcs)])
+	for {
+		frame, more := frames.Next()
+		if strings.HasPrefix(frame.Function, "log.Fatal") {
+			return true
+		} else if !more {
+			return false
+		}
+	}
+}
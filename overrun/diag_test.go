@@ -0,0 +1,143 @@
+/*
+ * Copyright 2018 Mark Adamcin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+// captureLog sends the output of the log package, as text or JSON, to the buffer until the returned function is called.
+func captureLog(out *bytes.Buffer, logJSON bool) func() {
+	flags := log.Flags()
+	if logJSON {
+		EnableLogJSON(out)
+	} else {
+		log.SetFlags(0)
+		log.SetOutput(out)
+	}
+	return func() {
+		jsonLog = nil
+		log.SetFlags(flags)
+		log.SetOutput(os.Stderr)
+	}
+}
+
+func decodeEvents(t *testing.T, out *bytes.Buffer) []LogEvent {
+	var events []LogEvent
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var e LogEvent
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("%s: %s", err, line)
+		}
+		events = append(events, e)
+	}
+	return events
+}
+
+func TestJSONLogWriter(t *testing.T) {
+	tests := []struct {
+		line    string
+		level   string
+		message string
+	}{
+		{"Uploaded 12 bytes of stdin.", LevelInfo, "Uploaded 12 bytes of stdin."},
+		{"WARNING: log stream not found", LevelWarning, "log stream not found"},
+		{"main@us-east-1 [2] ERROR: failed", LevelError, "main@us-east-1 [2] failed"},
+		{"Task stopped: WARNING: not a prefix", LevelInfo, "Task stopped: WARNING: not a prefix"},
+		{"Effective settings\n  --cluster main", LevelInfo, "Effective settings\n  --cluster main"},
+	}
+	for _, test := range tests {
+		var out bytes.Buffer
+		restore := captureLog(&out, true)
+		log.Println(test.line)
+		restore()
+		events := decodeEvents(t, &out)
+		if len(events) != 1 {
+			t.Fatalf("%q: got %d events, want 1", test.line, len(events))
+		}
+		e := events[0]
+		if e.Level != test.level || e.Event != EventMessage || e.Message != test.message || len(e.Time) == 0 {
+			t.Errorf("%q: got %+v, want %s %q", test.line, e, test.level, test.message)
+		}
+	}
+}
+
+func TestTaskEvent(t *testing.T) {
+	ctx := &ExecutionContext{AwsConfig: &aws.Config{Region: "us-east-1"}, Target: Target{Cluster: "main"},
+		Label: "main "}
+	job := &TaskJob{Index: 2, Label: "[2] "}
+	arn := "arn:aws:ecs:us-east-1:123456789012:task/main/abc"
+
+	var text bytes.Buffer
+	restore := captureLog(&text, false)
+	TaskEvent(ctx, job, "task-submitted", arn).Printf("Submitted task %s.", arn)
+	TaskEvent(ctx, nil, "cost-estimate", arn).Warning("cannot estimate cost")
+	TaskEvent(ctx, nil, "task-stopped", arn).Emit()
+	restore()
+	if want := "main [2] Submitted task " + arn + ".\nmain WARNING: cannot estimate cost\n"; text.String() != want {
+		t.Errorf("got text %q, want %q", text.String(), want)
+	}
+
+	var out bytes.Buffer
+	restore = captureLog(&out, true)
+	TaskEvent(ctx, job, "task-submitted", arn).Printf("Submitted task %s.", arn)
+	stopped := TaskEvent(ctx, nil, "task-stopped", arn)
+	exitCode := 3
+	stopped.ExitCode = &exitCode
+	stopped.Cost = &CostEstimate{Region: "us-east-1", Cost: 0.01}
+	stopped.Emit()
+	restore()
+	events := decodeEvents(t, &out)
+	if len(events) != 2 {
+		t.Fatalf("got %d events, want 2", len(events))
+	}
+	submitted := events[0]
+	if submitted.Event != "task-submitted" || submitted.Message != "Submitted task "+arn+"." ||
+		submitted.Cluster != "main" || submitted.Region != "us-east-1" || submitted.TaskArn != arn ||
+		submitted.Index == nil || *submitted.Index != 2 {
+		t.Errorf("unexpected event: %+v", submitted)
+	}
+	if e := events[1]; e.ExitCode == nil || *e.ExitCode != 3 || e.Cost == nil || e.Cost.Cost != 0.01 {
+		t.Errorf("unexpected event: %+v", e)
+	}
+}
+
+// TestLogFatalJSON logs a fatal error in a child process, which exits.
+func TestLogFatalJSON(t *testing.T) {
+	if os.Getenv("GO_TEST_LOG_FATAL") == "1" {
+		EnableLogJSON(os.Stderr)
+		log.Fatalf("Specify the ID or ARN of a single task.")
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestLogFatalJSON$")
+	cmd.Env = append(os.Environ(), "GO_TEST_LOG_FATAL=1")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err == nil {
+		t.Fatal("log.Fatalf did not exit")
+	}
+	events := decodeEvents(t, &stderr)
+	if len(events) != 1 || events[0].Level != LevelError {
+		t.Errorf("got events %+v, want one error", events)
+	}
+}
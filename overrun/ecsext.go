@@ -0,0 +1,290 @@
+/*
+ * Copyright 2018 Mark Adamcin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/awserr"
+	"github.com/aws/aws-sdk-go-v2/private/protocol/json/jsonutil"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"io/ioutil"
+	"strings"
+)
+
+// The ECS API has grown members and operations that are missing from the vendored aws-sdk-go-v2 release. The types in
+// this file describe only what overrun needs, and are sent through the same client handlers as the generated
+// operations, so that signing, retries and error unmarshalling behave identically.
+
+// JSONMembers holds request body members that the vendored SDK cannot express.
+type JSONMembers map[string]interface{}
+
+// mergeJSON merges src into dst. Objects are merged by key, and arrays are merged element by element, so that a member
+// can be added to the first container override by merging {"overrides": {"containerOverrides": [{...}]}}.
+func mergeJSON(dst interface{}, src interface{}) interface{} {
+	switch s := src.(type) {
+	case map[string]interface{}:
+		if d, ok := dst.(map[string]interface{}); ok {
+			for k, v := range s {
+				d[k] = mergeJSON(d[k], v)
+			}
+			return d
+		}
+	case []interface{}:
+		if d, ok := dst.([]interface{}); ok {
+			for i, v := range s {
+				if i < len(d) {
+					d[i] = mergeJSON(d[i], v)
+				} else {
+					d = append(d, v)
+				}
+			}
+			return d
+		}
+	}
+	return src
+}
+
+// generic round-trips members through encoding/json so that nested values have the uniform types expected by mergeJSON.
+func (m JSONMembers) generic() map[string]interface{} {
+	var generic map[string]interface{}
+	data, _ := json.Marshal(m)
+	_ = json.Unmarshal(data, &generic)
+	return generic
+}
+
+// Merge adds members to the receiver, returning the receiver, or a new JSONMembers if the receiver is nil.
+func (m JSONMembers) Merge(members JSONMembers) JSONMembers {
+	if m == nil {
+		m = JSONMembers{}
+	}
+	mergeJSON(map[string]interface{}(m), members.generic())
+	return m
+}
+
+// pascalCase capitalizes the first letter of each object key, recursively.
+func pascalCase(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		converted := make(map[string]interface{}, len(v))
+		for key, elem := range v {
+			if len(key) > 0 {
+				key = strings.ToUpper(key[:1]) + key[1:]
+			}
+			converted[key] = pascalCase(elem)
+		}
+		return converted
+	case []interface{}:
+		for i, elem := range v {
+			v[i] = pascalCase(elem)
+		}
+		return v
+	}
+	return value
+}
+
+// PascalCase converts members named for the ECS API, such as enableExecuteCommand, to the names used by other services
+// for the same members, such as EnableExecuteCommand in the EcsParameters of an EventBridge target.
+func (m JSONMembers) PascalCase() JSONMembers {
+	converted, _ := pascalCase(m.generic()).(map[string]interface{})
+	return JSONMembers(converted)
+}
+
+func (m JSONMembers) String() string {
+	data, _ := json.MarshalIndent(m, "", "  ")
+	return string(data)
+}
+
+// WithJSONMembers returns a request option that merges members into the request body after it is built.
+func WithJSONMembers(members JSONMembers) aws.Option {
+	return func(r *aws.Request) {
+		if len(members) == 0 {
+			return
+		}
+		r.Handlers.Build.PushBack(func(r *aws.Request) {
+			if r.Error != nil {
+				return
+			}
+			body, err := ioutil.ReadAll(r.GetBody())
+			if err != nil {
+				r.Error = awserr.New("SerializationError", "failed reading request body", err)
+				return
+			}
+			var generic map[string]interface{}
+			if err := json.Unmarshal(body, &generic); err != nil {
+				r.Error = awserr.New("SerializationError", "failed decoding request body", err)
+				return
+			}
+			merged, err := json.Marshal(mergeJSON(generic, members.generic()))
+			if err != nil {
+				r.Error = awserr.New("SerializationError", "failed encoding request body", err)
+				return
+			}
+			r.SetBufferBody(merged)
+		})
+	}
+}
+
+// sendOperation sends an operation that is missing from the vendored SDK, using locally defined input and output types.
+func sendOperation(client *aws.Client, name string, input interface{}, output interface{}) error {
+	op := &aws.Operation{
+		Name:       name,
+		HTTPMethod: "POST",
+		HTTPPath:   "/",
+	}
+	return client.NewRequest(op, input, output).Send()
+}
+
+// jsonString formats a locally defined input or output as it appears on the wire.
+func jsonString(v interface{}) string {
+	data, err := jsonutil.BuildJSON(v)
+	if err != nil {
+		return err.Error()
+	}
+	var generic interface{}
+	_ = json.Unmarshal(data, &generic)
+	data, _ = json.MarshalIndent(generic, "", "  ")
+	return string(data)
+}
+
+const opExecuteCommand = "ExecuteCommand"
+
+type ExecuteCommandInput struct {
+	_ struct{} `type:"structure"`
+
+	Cluster *string `locationName:"cluster" type:"string"`
+
+	Command *string `locationName:"command" type:"string" required:"true"`
+
+	Container *string `locationName:"container" type:"string"`
+
+	Interactive *bool `locationName:"interactive" type:"boolean" required:"true"`
+
+	Task *string `locationName:"task" type:"string" required:"true"`
+}
+
+func (s ExecuteCommandInput) String() string {
+	return jsonString(s)
+}
+
+type ExecuteCommandSession struct {
+	_ struct{} `type:"structure"`
+
+	SessionId *string `locationName:"sessionId" type:"string"`
+
+	StreamUrl *string `locationName:"streamUrl" type:"string"`
+
+	TokenValue *string `locationName:"tokenValue" type:"string"`
+}
+
+type ExecuteCommandOutput struct {
+	_ struct{} `type:"structure"`
+
+	ClusterArn *string `locationName:"clusterArn" type:"string"`
+
+	ContainerArn *string `locationName:"containerArn" type:"string"`
+
+	ContainerName *string `locationName:"containerName" type:"string"`
+
+	Interactive *bool `locationName:"interactive" type:"boolean"`
+
+	Session *ExecuteCommandSession `locationName:"session" type:"structure"`
+
+	TaskArn *string `locationName:"taskArn" type:"string"`
+}
+
+func ExecuteCommand(s *ecs.ECS, input *ExecuteCommandInput) (*ExecuteCommandOutput, error) {
+	output := ExecuteCommandOutput{}
+	if err := sendOperation(s.Client, opExecuteCommand, input, &output); err != nil {
+		return nil, err
+	}
+	return &output, nil
+}
+
+const opDescribeTasks = "DescribeTasks"
+
+type containerRuntime struct {
+	_ struct{} `type:"structure"`
+
+	Name *string `locationName:"name" type:"string"`
+
+	RuntimeId *string `locationName:"runtimeId" type:"string"`
+}
+
+type taskRuntime struct {
+	_ struct{} `type:"structure"`
+
+	TaskArn *string `locationName:"taskArn" type:"string"`
+
+	Attributes []ecs.Attribute `locationName:"attributes" type:"list"`
+
+	CapacityProviderName *string `locationName:"capacityProviderName" type:"string"`
+
+	Containers []containerRuntime `locationName:"containers" type:"list"`
+}
+
+type describeTasksRuntimeOutput struct {
+	_ struct{} `type:"structure"`
+
+	Tasks []taskRuntime `locationName:"tasks" type:"list"`
+}
+
+func describeTaskRuntime(s *ecs.ECS, cluster *string, taskArn string) (*taskRuntime, error) {
+	input := ecs.DescribeTasksInput{Cluster: cluster, Tasks: []string{taskArn}}
+	output := describeTasksRuntimeOutput{}
+	if err := sendOperation(s.Client, opDescribeTasks, &input, &output); err != nil {
+		return nil, err
+	} else if len(output.Tasks) == 0 {
+		return nil, fmt.Errorf("failed to describe task %s", taskArn)
+	}
+	return &output.Tasks[0], nil
+}
+
+// ContainerRuntimeIds returns the Docker ID of each started container of the task, by container name.
+func ContainerRuntimeIds(s *ecs.ECS, cluster *string, taskArn string) (map[string]string, error) {
+	task, err := describeTaskRuntime(s, cluster, taskArn)
+	if err != nil {
+		return nil, err
+	}
+	runtimeIds := make(map[string]string)
+	for _, container := range task.Containers {
+		if container.Name != nil && container.RuntimeId != nil && len(*container.RuntimeId) > 0 {
+			runtimeIds[*container.Name] = *container.RuntimeId
+		}
+	}
+	return runtimeIds, nil
+}
+
+// the task attribute holding the CPU architecture of a Fargate task.
+const AttributeCpuArchitecture = "ecs.cpu-architecture"
+
+// TaskCapacity returns the name of the capacity provider that ran the task, such as FARGATE_SPOT, which is empty for
+// tasks run with a launch type, and the task's CPU architecture, if reported.
+func TaskCapacity(s *ecs.ECS, cluster *string, taskArn string) (string, string, error) {
+	task, err := describeTaskRuntime(s, cluster, taskArn)
+	if err != nil {
+		return "", "", err
+	}
+	architecture := ""
+	for _, attribute := range task.Attributes {
+		if aws.StringValue(attribute.Name) == AttributeCpuArchitecture {
+			architecture = aws.StringValue(attribute.Value)
+		}
+	}
+	return aws.StringValue(task.CapacityProviderName), architecture, nil
+}
@@ -0,0 +1,296 @@
+/*
+ * Copyright 2018 Mark Adamcin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const EmitDocker = "docker"
+
+var EmitFormats = []string{EmitDocker}
+
+func ValidEmitFormat(format string) bool {
+	for _, valid := range EmitFormats {
+		if format == valid {
+			return true
+		}
+	}
+	return false
+}
+
+// DockerRun is a docker run command line translated from a container definition and its overrides.
+type DockerRun struct {
+	// each option with its value, such as [-e NAME=value].
+	Options [][]string
+
+	Image string
+
+	Args []string
+
+	// features of the task definition that have no docker run equivalent.
+	Warnings []string
+}
+
+func (d *DockerRun) option(words ...string) {
+	d.Options = append(d.Options, words)
+}
+
+func (d *DockerRun) warn(format string, v ...interface{}) {
+	d.Warnings = append(d.Warnings, fmt.Sprintf(format, v...))
+}
+
+// String formats the command with one option per line, quoted for the shell.
+func (d *DockerRun) String() string {
+	lines := []string{"docker run"}
+	for _, words := range d.Options {
+		quoted := make([]string, len(words))
+		for i, word := range words {
+			quoted[i] = ShellQuote(word)
+		}
+		lines = append(lines, strings.Join(quoted, " "))
+	}
+	last := []string{ShellQuote(d.Image)}
+	for _, arg := range d.Args {
+		last = append(last, ShellQuote(arg))
+	}
+	lines = append(lines, strings.Join(last, " "))
+	return strings.Join(lines, " \\\n    ")
+}
+
+// parseTaskSize parses the task-level cpu or memory of a task definition, which ECS reports as a number of cpu units
+// or MiB.
+func parseTaskSize(value *string) (int64, bool) {
+	if value == nil {
+		return 0, false
+	}
+	size, err := strconv.ParseInt(*value, 10, 64)
+	return size, err == nil && size > 0
+}
+
+// TranslateDockerRun translates the container definition, with the overrides that overrun would submit, into a docker
+// run command. interactive allocates a terminal, and stdin keeps stdin open, as overrun's --interactive and --stdin do.
+func TranslateDockerRun(taskDef *ecs.TaskDefinition, container *ecs.ContainerDefinition, overrides *ecs.TaskOverride,
+	interactive bool, stdin bool) *DockerRun {
+	run := DockerRun{Image: aws.StringValue(container.Image)}
+	var override ecs.ContainerOverride
+	for _, cnt := range overrides.ContainerOverrides {
+		if aws.StringValue(cnt.Name) == aws.StringValue(container.Name) {
+			override = cnt
+		}
+	}
+
+	run.option("--rm")
+	if interactive {
+		run.option("-it")
+	} else if stdin {
+		run.option("-i")
+	}
+
+	entryPoint := container.EntryPoint
+	command := container.Command
+	if override.Command != nil {
+		command = override.Command
+	}
+	if len(entryPoint) > 0 {
+		// --entrypoint takes only the executable, so its arguments precede the command.
+		run.option("--entrypoint", entryPoint[0])
+		run.Args = append(append([]string{}, entryPoint[1:]...), command...)
+	} else {
+		run.Args = command
+	}
+
+	environment := make(map[string]string)
+	for _, pair := range container.Environment {
+		environment[aws.StringValue(pair.Name)] = aws.StringValue(pair.Value)
+	}
+	for _, pair := range override.Environment {
+		environment[aws.StringValue(pair.Name)] = aws.StringValue(pair.Value)
+	}
+	var names []string
+	for name := range environment {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		run.option("-e", name+"="+environment[name])
+	}
+
+	memory := container.Memory
+	if override.Memory != nil {
+		memory = override.Memory
+	}
+	memoryReservation := container.MemoryReservation
+	if override.MemoryReservation != nil {
+		memoryReservation = override.MemoryReservation
+	}
+	if memory != nil && *memory > 0 {
+		run.option("--memory", fmt.Sprintf("%dm", *memory))
+	} else if taskMemory, ok := parseTaskSize(taskDef.Memory); ok {
+		run.option("--memory", fmt.Sprintf("%dm", taskMemory))
+	}
+	if memoryReservation != nil && *memoryReservation > 0 {
+		run.option("--memory-reservation", fmt.Sprintf("%dm", *memoryReservation))
+	}
+
+	cpu := container.Cpu
+	if override.Cpu != nil {
+		cpu = override.Cpu
+	}
+	if cpu != nil && *cpu > 0 {
+		run.option("--cpu-shares", strconv.FormatInt(*cpu, 10))
+	}
+	if taskCpu, ok := parseTaskSize(taskDef.Cpu); ok {
+		run.option("--cpus", strconv.FormatFloat(float64(taskCpu)/1024, 'f', -1, 64))
+	}
+
+	for _, ulimit := range container.Ulimits {
+		run.option("--ulimit", fmt.Sprintf("%s=%d:%d", ulimit.Name, aws.Int64Value(ulimit.SoftLimit),
+			aws.Int64Value(ulimit.HardLimit)))
+	}
+	if container.WorkingDirectory != nil {
+		run.option("-w", *container.WorkingDirectory)
+	}
+	if container.User != nil {
+		run.option("-u", *container.User)
+	}
+	if aws.BoolValue(container.ReadonlyRootFilesystem) {
+		run.option("--read-only")
+	}
+	if aws.BoolValue(container.Privileged) {
+		run.option("--privileged")
+	}
+	if params := container.LinuxParameters; params != nil {
+		if aws.BoolValue(params.InitProcessEnabled) {
+			run.option("--init")
+		}
+		if params.SharedMemorySize != nil {
+			run.option("--shm-size", fmt.Sprintf("%dm", *params.SharedMemorySize))
+		}
+	}
+	for _, mapping := range container.PortMappings {
+		hostPort := aws.Int64Value(mapping.HostPort)
+		if hostPort == 0 {
+			hostPort = aws.Int64Value(mapping.ContainerPort)
+		}
+		protocol := ""
+		if len(mapping.Protocol) > 0 && mapping.Protocol != ecs.TransportProtocolTcp {
+			protocol = "/" + string(mapping.Protocol)
+		}
+		run.option("-p", fmt.Sprintf("%d:%d%s", hostPort, aws.Int64Value(mapping.ContainerPort), protocol))
+	}
+
+	if taskDef.NetworkMode == ecs.NetworkModeAwsvpc {
+		run.warn("awsvpc networking is not translated; the container uses the default docker network")
+	}
+	if overrides.TaskRoleArn != nil || taskDef.TaskRoleArn != nil {
+		run.warn("the task role is not assumed; pass AWS credentials to the container with -e")
+	}
+	for _, secret := range container.Secrets {
+		run.warn("secret %s is not set; pass its value with -e %s", aws.StringValue(secret.Name), aws.StringValue(secret.Name))
+	}
+	if container.RepositoryCredentials != nil || strings.Contains(run.Image, ".dkr.ecr.") {
+		run.warn("the image is pulled with the execution role; log in to its registry with docker login first")
+	}
+	if len(container.MountPoints) > 0 || len(container.VolumesFrom) > 0 {
+		run.warn("volumes are not mounted; add -v options for the paths the task needs")
+	}
+	if len(container.Links) > 0 {
+		run.warn("links are not translated")
+	}
+	if len(taskDef.ContainerDefinitions) > 1 {
+		var others []string
+		for _, other := range taskDef.ContainerDefinitions {
+			if aws.StringValue(other.Name) != aws.StringValue(container.Name) {
+				others = append(others, aws.StringValue(other.Name))
+			}
+		}
+		run.warn("only container %s is run; the task's other containers are not: %s", aws.StringValue(container.Name),
+			strings.Join(others, ", "))
+	}
+	return &run
+}
+
+// emitCommand prints the docker run command equivalent to each task that overrun would run, with warnings for the
+// features that are not translated.
+func emitCommand(prefs *ParsedArgs, awsCfg aws.Config, targets []Target) {
+	target := targets[0]
+	if len(targets) > 1 {
+		log.Printf("WARNING: translating the task definition of the first target only: %s\n", target)
+	}
+	cfg := awsCfg.Copy()
+	if len(target.Region) > 0 {
+		cfg.Region = target.Region
+	}
+	ctx := ExecutionContext{
+		AwsConfig:  &cfg,
+		Target:     target,
+		TaskDef:    prefs.TaskDef,
+		Invocation: &Invocation{}}
+	ctx.connect()
+	if err := resolveTaskDefinition(prefs, &ctx); err != nil {
+		log.Fatal(err)
+	}
+
+	// docker attaches the terminal and stdin itself, so the command is not wrapped to relay them.
+	emitPrefs := *prefs
+	if prefs.Interactive {
+		emitPrefs.Interactive = false
+		if !emitPrefs.OverridesCmd {
+			emitPrefs.OverridesCmd = true
+			emitPrefs.CmdOverride = []string{DefaultExecCommand}
+		}
+	}
+	jobs, err := buildJobs(&emitPrefs, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var warnings []string
+	if prefs.LaunchFargate {
+		warnings = append(warnings, "the Fargate launch type and network configuration are not translated")
+	}
+	if len(prefs.Artifacts) > 0 {
+		warnings = append(warnings, "--artifact is not translated; mount the artifact paths with -v instead")
+	}
+	if len(prefs.EnvironmentFiles) > 0 {
+		warnings = append(warnings, "--env-s3 is not translated; download the files and pass them with --env-file")
+	}
+	if len(prefs.ResourceRequirements) > 0 {
+		warnings = append(warnings, "--resource-requirement is not translated")
+	}
+	for i := range jobs {
+		run := TranslateDockerRun(ctx.TaskDefinition, ctx.ContainerDefinition, buildOverrides(&emitPrefs, &ctx, &jobs[i]),
+			prefs.Interactive, prefs.Stdin)
+		if i == 0 {
+			warnings = append(warnings, run.Warnings...)
+		}
+		if len(jobs) > 1 {
+			fmt.Printf("# task %d\n", jobs[i].Index)
+		}
+		fmt.Println(run.String())
+	}
+	for _, warning := range warnings {
+		log.Printf("WARNING: %s\n", warning)
+	}
+}
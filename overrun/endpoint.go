@@ -0,0 +1,100 @@
+/*
+ * Copyright 2018 Mark Adamcin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"net/url"
+)
+
+// EndpointResolver sends requests to the endpoints given by --endpoint-url and the per-service endpoint options, such
+// as those of a local AWS emulator, and resolves every other service with the default resolver.
+type EndpointResolver struct {
+	// endpoint of every service without its own endpoint.
+	URL string
+
+	// endpoints by service endpoints ID, such as ecs.
+	Services map[string]string
+
+	Fallback aws.EndpointResolver
+}
+
+// NewEndpointResolver returns a resolver for the endpoints of the parsed args, or nil when none were given.
+func NewEndpointResolver(prefs *ParsedArgs, fallback aws.EndpointResolver) (*EndpointResolver, error) {
+	services := make(map[string]string)
+	for service, endpoint := range map[string]string{
+		ecs.EndpointsID:            prefs.EcsEndpoint,
+		ec2.EndpointsID:            prefs.Ec2Endpoint,
+		cloudwatchlogs.EndpointsID: prefs.LogsEndpoint} {
+		if len(endpoint) > 0 {
+			services[service] = endpoint
+		}
+	}
+	if len(prefs.EndpointUrl) == 0 && len(services) == 0 {
+		return nil, nil
+	}
+
+	resolver := EndpointResolver{URL: prefs.EndpointUrl, Services: services, Fallback: fallback}
+	if len(resolver.URL) > 0 {
+		if err := checkEndpointUrl(resolver.URL); err != nil {
+			return nil, err
+		}
+	}
+	for _, endpoint := range services {
+		if err := checkEndpointUrl(endpoint); err != nil {
+			return nil, err
+		}
+	}
+	return &resolver, nil
+}
+
+func checkEndpointUrl(endpoint string) error {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return fmt.Errorf("invalid endpoint url %s: %s", endpoint, err)
+	} else if (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+		return fmt.Errorf("invalid endpoint url %s: expected http:// or https:// and a host", endpoint)
+	}
+	return nil
+}
+
+// Endpoint returns the endpoint given for the service, if any.
+func (r *EndpointResolver) Endpoint(service string) string {
+	if endpoint, ok := r.Services[service]; ok {
+		return endpoint
+	}
+	return r.URL
+}
+
+// ResolveEndpoint signs requests to a given endpoint for the region of the config, using the service's default
+// signing name.
+func (r *EndpointResolver) ResolveEndpoint(service, region string) (aws.Endpoint, error) {
+	if endpoint := r.Endpoint(service); len(endpoint) > 0 {
+		return aws.Endpoint{URL: endpoint, SigningRegion: region}, nil
+	}
+	return r.Fallback.ResolveEndpoint(service, region)
+}
+
+// HasCustomEndpoint returns true when the config sends requests for the service to a given endpoint.
+func HasCustomEndpoint(cfg aws.Config, service string) bool {
+	r, ok := cfg.EndpointResolver.(*EndpointResolver)
+	return ok && len(r.Endpoint(service)) > 0
+}
@@ -0,0 +1,113 @@
+/*
+ * Copyright 2018 Mark Adamcin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/endpoints"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"strings"
+	"testing"
+)
+
+func TestEndpointResolver(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		args    []string
+		service string
+		want    string
+		err     string
+	}{
+		{
+			name:    "default",
+			service: "ecs",
+			want:    "https://ecs.us-west-2.amazonaws.com",
+		},
+		{
+			name:    "endpoint url",
+			args:    []string{"--endpoint-url", "http://localhost:4566"},
+			service: "ecs",
+			want:    "http://localhost:4566",
+		},
+		{
+			name:    "service endpoint variable",
+			env:     map[string]string{"OVERRUN_ECS_ENDPOINT": "http://localhost:5000"},
+			args:    []string{"--endpoint-url", "http://localhost:4566"},
+			service: "ecs",
+			want:    "http://localhost:5000",
+		},
+		{
+			name:    "other service uses endpoint url",
+			env:     map[string]string{"OVERRUN_LOGS_ENDPOINT": "http://localhost:5000"},
+			args:    []string{"--endpoint-url", "http://localhost:4566"},
+			service: "ec2",
+			want:    "http://localhost:4566",
+		},
+		{
+			name:    "other service uses default",
+			env:     map[string]string{"OVERRUN_LOGS_ENDPOINT": "http://localhost:5000"},
+			service: "ec2",
+			want:    "https://ec2.us-west-2.amazonaws.com",
+		},
+		{
+			name: "missing scheme",
+			args: []string{"--ec2-endpoint", "localhost:4566"},
+			err:  "invalid endpoint url localhost:4566",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			prefs := parseTestArgs(test.env, test.args...).Args()
+			cfg := aws.Config{Region: "us-west-2", EndpointResolver: endpoints.NewDefaultResolver()}
+			resolver, err := NewEndpointResolver(&prefs, cfg.EndpointResolver)
+			if len(test.err) > 0 {
+				if err == nil || !strings.HasPrefix(err.Error(), test.err) {
+					t.Fatalf("got error %v, want %q", err, test.err)
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if resolver != nil {
+				cfg.EndpointResolver = resolver
+			}
+			endpoint, err := cfg.EndpointResolver.ResolveEndpoint(test.service, cfg.Region)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if endpoint.URL != test.want || endpoint.SigningRegion != "us-west-2" {
+				t.Errorf("got %s signed for %s, want %s signed for us-west-2", endpoint.URL, endpoint.SigningRegion,
+					test.want)
+			}
+			if got, want := newS3Client(cfg).ForcePathStyle, len(prefs.EndpointUrl) > 0; got != want {
+				t.Errorf("got path style %t, want %t", got, want)
+			}
+		})
+	}
+}
+
+func TestHasCustomEndpoint(t *testing.T) {
+	cfg := aws.Config{EndpointResolver: &EndpointResolver{Services: map[string]string{"logs": "http://localhost:4566"}}}
+	if !HasCustomEndpoint(cfg, "logs") {
+		t.Error("logs endpoint was not custom")
+	}
+	if HasCustomEndpoint(cfg, s3.EndpointsID) {
+		t.Error("s3 endpoint was custom")
+	}
+}
@@ -0,0 +1,221 @@
+/*
+ * Copyright 2018 Mark Adamcin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"errors"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/awserr"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+)
+
+// the command run by an exec session when none is given after --.
+const DefaultExecCommand = "/bin/sh"
+
+// how long to retry ExecuteCommand against a newly started task, whose agent may not be ready to accept sessions yet.
+const ExecAgentTimeout = 2 * time.Minute
+
+const ExecAgentRetryDelay = 5 * time.Second
+
+// the container command of an --interactive task, which only needs to outlive the exec session.
+var InteractiveKeepAlive = []string{"sleep", "86400"}
+
+// ExecCommandLine joins the command given after -- into the single command string accepted by ExecuteCommand.
+func ExecCommandLine(prefs *ParsedArgs) string {
+	if !prefs.OverridesCmd || len(prefs.CmdOverride) == 0 {
+		return DefaultExecCommand
+	}
+	quoted := make([]string, len(prefs.CmdOverride))
+	for i, arg := range prefs.CmdOverride {
+		quoted[i] = ShellQuote(arg)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// isAgentNotReady returns true for the error returned by ExecuteCommand when the task was started with execute command
+// enabled, but its agent has not yet registered.
+func isAgentNotReady(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && aerr.Code() == ecs.ErrCodeInvalidParameterException && strings.Contains(aerr.Message(), "agent")
+}
+
+// executeCommand calls ExecuteCommand, retrying for up to agentWait while the task's agent is not ready.
+func executeCommand(ecss EcsAPI, input *ExecuteCommandInput, agentWait time.Duration) (*ExecuteCommandOutput, error) {
+	deadline := time.Now().Add(agentWait)
+	for {
+		out, err := ecss.ExecuteCommand(input)
+		if err == nil {
+			if out.Session == nil || out.Session.StreamUrl == nil || out.Session.TokenValue == nil {
+				return nil, errors.New("ExecuteCommand did not return a session")
+			}
+			return out, nil
+		}
+		if !isAgentNotReady(err) || time.Now().After(deadline) {
+			return nil, err
+		}
+		time.Sleep(ExecAgentRetryDelay)
+	}
+}
+
+// RunExecSession starts an ECS Exec session and attaches it to this process's terminal. Returns the exit code reported
+// by the agent, which interactive sessions usually omit.
+func RunExecSession(ecss EcsAPI, awsCfg aws.Config, input *ExecuteCommandInput, agentWait time.Duration) (int, error) {
+	out, err := executeCommand(ecss, input, agentWait)
+	if err != nil {
+		return 1, err
+	}
+
+	sessionId := aws.StringValue(out.Session.SessionId)
+	log.Printf("Starting session %s in container %s of task %s.\n", sessionId,
+		aws.StringValue(out.ContainerName), aws.StringValue(out.TaskArn))
+	session, err := OpenSession(*out.Session.StreamUrl, *out.Session.TokenValue, sessionId)
+	if err != nil {
+		return 1, err
+	}
+	defer terminateSession(awsCfg, sessionId)
+	session.Stdout = os.Stdout
+	session.Stderr = os.Stderr
+	return AttachTerminal(session)
+}
+
+// terminateSession releases the session on the SSM side. The agent has usually ended it already.
+func terminateSession(awsCfg aws.Config, sessionId string) {
+	input := ssm.TerminateSessionInput{SessionId: &sessionId}
+	_, _ = ssm.New(awsCfg).TerminateSessionRequest(&input).Send()
+}
+
+// AttachTerminal relays stdin to the session until it ends. When stdin is a terminal, it is put into raw mode and its
+// size is sent whenever it changes.
+func AttachTerminal(session *Session) (int, error) {
+	tty := IsTerminal(os.Stdin)
+	if tty {
+		restore, err := MakeRaw(os.Stdin)
+		if err != nil {
+			return 1, err
+		}
+		defer restore()
+		go relayTerminalSize(session)
+	}
+	go relayInput(session, os.Stdin, !tty)
+
+	err := session.Run()
+	if session.ExitCode != nil {
+		return *session.ExitCode, err
+	}
+	return 0, err
+}
+
+func relayTerminalSize(session *Session) {
+	sigs := make(chan os.Signal, 1)
+	NotifyResize(sigs)
+	defer signal.Stop(sigs)
+	for {
+		if cols, rows, err := GetTerminalSize(os.Stdin); err == nil {
+			if session.SetSize(cols, rows) != nil {
+				return
+			}
+		}
+		select {
+		case <-session.Done():
+			return
+		case <-sigs:
+		}
+	}
+}
+
+// relayInput copies input to the session. When input is not a terminal, its end is signaled with ctrl-d, which ends a
+// remote shell reading from the session's pseudo-terminal.
+func relayInput(session *Session, input io.Reader, sendEOT bool) {
+	if _, err := io.Copy(session, input); err == nil && sendEOT {
+		_, _ = session.Write([]byte{4})
+	}
+}
+
+// execCommand runs the exec subcommand, which opens a session with a container of a running task.
+func execCommand(args []string) {
+	parser := loadCommandArgs("exec", args)
+	prefs := parser.Args()
+	if len(parser.Positional) != 1 {
+		usage()
+		log.Fatal("Specify the ID or ARN of a single running task.")
+	} else if len(prefs.Clusters) > 1 || len(prefs.AwsRegions) > 1 {
+		log.Fatal("Specify at most one --cluster and one --region.")
+	}
+
+	awsCfg := loadAwsConfig(&prefs)
+	if len(prefs.AwsRegions) > 0 {
+		awsCfg.Region = prefs.AwsRegions[0]
+	}
+
+	input := ExecuteCommandInput{
+		Command:     aws.String(ExecCommandLine(&prefs)),
+		Interactive: aws.Bool(true),
+		Task:        aws.String(parser.Positional[0])}
+	if len(prefs.Clusters) > 0 {
+		input.Cluster = &prefs.Clusters[0]
+	}
+	if len(prefs.ContainerName) > 0 {
+		input.Container = &prefs.ContainerName
+	}
+
+	if prefs.DryRun {
+		log.Println(input.String())
+		os.Exit(0)
+	}
+
+	ecss := AwsBackend{NoWaiterDelay: prefs.NoWaiterDelay}.Ecs(awsCfg)
+	exitCode, err := RunExecSession(ecss, awsCfg, &input, 0)
+	if err != nil {
+		log.Fatal(err)
+	}
+	os.Exit(exitCode)
+}
+
+// interactWithTask waits for an --interactive task to start, runs the exec session in the overridden container, and
+// stops the task when the session ends.
+func interactWithTask(ctx *ExecutionContext, task *ecs.Task, job *TaskJob) (int, error) {
+	describeInput := ecs.DescribeTasksInput{Cluster: &ctx.Target.Cluster, Tasks: []string{*task.TaskArn}}
+	TaskEvent(ctx, job, "task-waiting", *task.TaskArn).Printf("Waiting for task %s to start.", *task.TaskArn)
+	if err := waitRunning(ctx.Ecs, &describeInput); err != nil {
+		return 1, err
+	}
+
+	input := ExecuteCommandInput{
+		Cluster:     &ctx.Target.Cluster,
+		Command:     aws.String(job.ExecCommand),
+		Container:   ctx.ContainerDefinition.Name,
+		Interactive: aws.Bool(true),
+		Task:        task.TaskArn}
+	exitCode, err := RunExecSession(ctx.Ecs, *ctx.AwsConfig, &input, ExecAgentTimeout)
+
+	stopInput := ecs.StopTaskInput{
+		Cluster: &ctx.Target.Cluster,
+		Reason:  aws.String("overrun interactive session ended"),
+		Task:    task.TaskArn}
+	if _, stopErr := ctx.Ecs.StopTask(&stopInput); stopErr != nil {
+		TaskEvent(ctx, job, "task-stop-failed", *task.TaskArn).Warning("failed to stop task %s: %s", *task.TaskArn, stopErr)
+	} else {
+		TaskEvent(ctx, job, "task-stop-requested", *task.TaskArn).Printf("Stopped task %s.", *task.TaskArn)
+	}
+	return exitCode, err
+}
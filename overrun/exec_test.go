@@ -0,0 +1,56 @@
+/*
+ * Copyright 2018 Mark Adamcin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"testing"
+)
+
+func TestExecuteCommand(t *testing.T) {
+	b := newRunBackend()
+	out, err := b.RunTask(&ecs.RunTaskInput{Cluster: aws.String("main"), TaskDefinition: aws.String("app")}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := ExecuteCommandInput{
+		Cluster:     aws.String("main"),
+		Command:     aws.String(DefaultExecCommand),
+		Container:   aws.String("web"),
+		Interactive: aws.Bool(true),
+		Task:        out.Tasks[0].TaskArn}
+
+	// the agent of a task that is still pending is not ready, and with no wait the error is returned.
+	if _, err := executeCommand(b, &input, 0); err == nil || !isAgentNotReady(err) {
+		t.Errorf("got error %v, want the agent not ready", err)
+	}
+
+	if err := b.WaitUntilTasksRunning(&ecs.DescribeTasksInput{Cluster: input.Cluster, Tasks: []string{*input.Task}}); err != nil {
+		t.Fatal(err)
+	}
+	session, err := executeCommand(b, &input, ExecAgentTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if aws.StringValue(session.ContainerName) != "web" || aws.StringValue(session.Session.TokenValue) == "" {
+		t.Errorf("unexpected session: %+v", session)
+	}
+	if len(b.execs) != 2 || aws.StringValue(b.execs[1].Command) != DefaultExecCommand {
+		t.Errorf("got ExecuteCommand requests %v", b.execs)
+	}
+}
@@ -0,0 +1,811 @@
+/*
+ * Copyright 2018 Mark Adamcin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/awserr"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const fakeAccountArn = "arn:aws:ecs:us-east-1:123456789012:"
+
+// the states that a fake task passes through, one for each time it is described.
+var fakeTaskStates = []string{"PROVISIONING", "PENDING", "RUNNING", "STOPPED"}
+
+// the most describe requests made by a fake waiter before it gives up, as the AWS waiters do after their attempts.
+const fakeWaiterAttempts = 20
+
+// events returned per FilterLogEvents page, small enough that tests exercise pagination.
+const fakeLogsPageSize = 2
+
+// fakeOutcome scripts how a fake task ends.
+type fakeOutcome struct {
+	// exit code of every container, or nil for none.
+	ExitCode *int64
+
+	// reason reported for every container, such as CannotPullContainerError.
+	Reason string
+
+	StoppedReason string
+
+	// stop after PENDING, without reaching RUNNING.
+	StopBeforeRunning bool
+
+	// messages written to the stream of each container with a log configuration, once the task is running.
+	Logs []string
+
+	// health of the task, and of each container with a health check, once the task is running.
+	Health ecs.HealthStatus
+
+	// health of named containers with health checks, in place of Health.
+	ContainerHealth map[string]ecs.HealthStatus
+
+	// number of further times the task stays RUNNING when described, like a server.
+	Running int
+}
+
+type fakeTask struct {
+	task    ecs.Task
+	def     *ecs.TaskDefinition
+	outcome fakeOutcome
+	state   int
+	running int
+}
+
+// fakeRunTask records a RunTask request.
+type fakeRunTask struct {
+	Input  ecs.RunTaskInput
+	Extras JSONMembers
+}
+
+type fakeLogStream struct {
+	name   string
+	events []cloudwatchlogs.FilteredLogEvent
+}
+
+// fakeBackend is an in-memory Backend. Tasks advance one state each time they are described, writing the log events of
+// their outcome to CloudWatch Logs once they are running, and EC2 resources are selected by the common describe
+// filters, including tag filters and wildcards.
+type fakeBackend struct {
+	sync.Mutex
+
+	taskDefs     []*ecs.TaskDefinition
+	taskDefTags  map[string][]ecs.Tag
+	services     map[string]ecs.Service
+	instances    map[string][]ecs.ContainerInstance
+	tasks        map[string]*fakeTask
+	taskOrder    []string
+	runTasks     []fakeRunTask
+	runFailures  [][]ecs.Failure
+	execs        []ExecuteCommandInput
+	clusterCalls int
+	outcomes     []fakeOutcome
+	logGroups    map[string][]*fakeLogStream
+	vpcs         []ec2.Vpc
+	subnets      []ec2.Subnet
+	groups       []ec2.SecurityGroup
+	ec2Instances []ec2.Instance
+	nextId       int
+	clock        time.Time
+}
+
+var _ Backend = (*fakeBackend)(nil)
+var _ EcsAPI = (*fakeBackend)(nil)
+var _ Ec2API = (*fakeBackend)(nil)
+var _ LogsAPI = (*fakeBackend)(nil)
+
+func newFakeBackend() *fakeBackend {
+	return &fakeBackend{
+		taskDefTags: make(map[string][]ecs.Tag),
+		services:    make(map[string]ecs.Service),
+		instances:   make(map[string][]ecs.ContainerInstance),
+		tasks:       make(map[string]*fakeTask),
+		logGroups:   make(map[string][]*fakeLogStream),
+		clock:       time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)}
+}
+
+func (b *fakeBackend) Ecs(cfg aws.Config) EcsAPI {
+	return b
+}
+
+func (b *fakeBackend) Ec2(cfg aws.Config) Ec2API {
+	return b
+}
+
+func (b *fakeBackend) Logs(cfg aws.Config) LogsAPI {
+	return b
+}
+
+func fakeError(code string, format string, v ...interface{}) error {
+	return awserr.New(code, fmt.Sprintf(format, v...), nil)
+}
+
+// tick advances the fake clock, so that each transition happens at a distinct time.
+func (b *fakeBackend) tick(d time.Duration) *time.Time {
+	b.clock = b.clock.Add(d)
+	now := b.clock
+	return &now
+}
+
+// addTaskDefinition registers a revision of the family with the given tags.
+func (b *fakeBackend) addTaskDefinition(def ecs.TaskDefinition, tags ...ecs.Tag) *ecs.TaskDefinition {
+	b.Lock()
+	defer b.Unlock()
+	return b.register(&def, tags)
+}
+
+func (b *fakeBackend) register(def *ecs.TaskDefinition, tags []ecs.Tag) *ecs.TaskDefinition {
+	family := aws.StringValue(def.Family)
+	revision := int64(1)
+	for _, other := range b.taskDefs {
+		if aws.StringValue(other.Family) == family {
+			revision++
+		}
+	}
+	def.Revision = aws.Int64(revision)
+	def.Status = ecs.TaskDefinitionStatusActive
+	def.TaskDefinitionArn = aws.String(fmt.Sprintf("%stask-definition/%s:%d", fakeAccountArn, family, revision))
+	b.taskDefs = append(b.taskDefs, def)
+	b.taskDefTags[*def.TaskDefinitionArn] = tags
+	return def
+}
+
+// taskDefinition finds a revision by ARN, family:revision, or family, which selects the latest active revision.
+func (b *fakeBackend) taskDefinition(name string) *ecs.TaskDefinition {
+	var found *ecs.TaskDefinition
+	for _, def := range b.taskDefs {
+		family := aws.StringValue(def.Family)
+		switch name {
+		case aws.StringValue(def.TaskDefinitionArn), family + ":" + strconv.FormatInt(*def.Revision, 10):
+			return def
+		case family:
+			if def.Status == ecs.TaskDefinitionStatusActive {
+				found = def
+			}
+		}
+	}
+	return found
+}
+
+func (b *fakeBackend) DescribeTaskDefinition(input *ecs.DescribeTaskDefinitionInput) (*ecs.DescribeTaskDefinitionOutput, error) {
+	b.Lock()
+	defer b.Unlock()
+	def := b.taskDefinition(aws.StringValue(input.TaskDefinition))
+	if def == nil {
+		return nil, fakeError(ecs.ErrCodeClientException, "Unable to describe task definition.")
+	}
+	output := ecs.DescribeTaskDefinitionOutput{TaskDefinition: def}
+	for _, field := range input.Include {
+		if field == ecs.TaskDefinitionFieldTags {
+			output.Tags = b.taskDefTags[*def.TaskDefinitionArn]
+		}
+	}
+	return &output, nil
+}
+
+func (b *fakeBackend) RegisterTaskDefinition(input *ecs.RegisterTaskDefinitionInput) (*ecs.RegisterTaskDefinitionOutput, error) {
+	b.Lock()
+	defer b.Unlock()
+	def := b.register(TaskDefinitionFromInput(input), input.Tags)
+	return &ecs.RegisterTaskDefinitionOutput{TaskDefinition: def, Tags: input.Tags}, nil
+}
+
+func (b *fakeBackend) DeregisterTaskDefinition(input *ecs.DeregisterTaskDefinitionInput) (*ecs.DeregisterTaskDefinitionOutput, error) {
+	b.Lock()
+	defer b.Unlock()
+	def := b.taskDefinition(aws.StringValue(input.TaskDefinition))
+	if def == nil {
+		return nil, fakeError(ecs.ErrCodeClientException, "The specified task definition does not exist.")
+	}
+	def.Status = ecs.TaskDefinitionStatusInactive
+	return &ecs.DeregisterTaskDefinitionOutput{TaskDefinition: def}, nil
+}
+
+func (b *fakeBackend) ListTaskDefinitions(input *ecs.ListTaskDefinitionsInput) (*ecs.ListTaskDefinitionsOutput, error) {
+	b.Lock()
+	defer b.Unlock()
+	var arns []string
+	for _, def := range b.taskDefs {
+		if input.FamilyPrefix != nil && !strings.HasPrefix(aws.StringValue(def.Family), *input.FamilyPrefix) {
+			continue
+		}
+		if len(input.Status) > 0 && def.Status != input.Status {
+			continue
+		}
+		arns = append(arns, *def.TaskDefinitionArn)
+	}
+	if input.Sort == ecs.SortOrderDesc {
+		for i, j := 0, len(arns)-1; i < j; i, j = i+1, j-1 {
+			arns[i], arns[j] = arns[j], arns[i]
+		}
+	}
+	return &ecs.ListTaskDefinitionsOutput{TaskDefinitionArns: arns}, nil
+}
+
+func (b *fakeBackend) DescribeServices(input *ecs.DescribeServicesInput) (*ecs.DescribeServicesOutput, error) {
+	b.Lock()
+	defer b.Unlock()
+	output := ecs.DescribeServicesOutput{}
+	for _, name := range input.Services {
+		if service, ok := b.services[aws.StringValue(input.Cluster)+"/"+name]; ok {
+			output.Services = append(output.Services, service)
+		} else {
+			output.Failures = append(output.Failures, ecs.Failure{Arn: aws.String(name), Reason: aws.String("MISSING")})
+		}
+	}
+	return &output, nil
+}
+
+// DescribeClusters describes every cluster, as RunTask accepts every cluster.
+func (b *fakeBackend) DescribeClusters(input *ecs.DescribeClustersInput) (*ecs.DescribeClustersOutput, error) {
+	b.Lock()
+	defer b.Unlock()
+	b.clusterCalls++
+	output := ecs.DescribeClustersOutput{}
+	for _, name := range input.Clusters {
+		cluster := path.Base(name)
+		output.Clusters = append(output.Clusters, ecs.Cluster{
+			ClusterArn:  aws.String(fakeAccountArn + "cluster/" + cluster),
+			ClusterName: aws.String(cluster),
+			Status:      aws.String("ACTIVE")})
+	}
+	return &output, nil
+}
+
+func (b *fakeBackend) ListContainerInstances(input *ecs.ListContainerInstancesInput) (*ecs.ListContainerInstancesOutput, error) {
+	b.Lock()
+	defer b.Unlock()
+	output := ecs.ListContainerInstancesOutput{}
+	for _, instance := range b.instances[aws.StringValue(input.Cluster)] {
+		output.ContainerInstanceArns = append(output.ContainerInstanceArns, *instance.ContainerInstanceArn)
+	}
+	return &output, nil
+}
+
+func (b *fakeBackend) DescribeContainerInstances(input *ecs.DescribeContainerInstancesInput) (*ecs.DescribeContainerInstancesOutput, error) {
+	b.Lock()
+	defer b.Unlock()
+	output := ecs.DescribeContainerInstancesOutput{}
+	for _, arn := range input.ContainerInstances {
+		for _, instance := range b.instances[aws.StringValue(input.Cluster)] {
+			if *instance.ContainerInstanceArn == arn {
+				output.ContainerInstances = append(output.ContainerInstances, instance)
+			}
+		}
+	}
+	return &output, nil
+}
+
+// RunTask starts a task with the next scripted outcome, or fails with the next scripted failures.
+func (b *fakeBackend) RunTask(input *ecs.RunTaskInput, extras JSONMembers) (*ecs.RunTaskOutput, error) {
+	b.Lock()
+	defer b.Unlock()
+	b.runTasks = append(b.runTasks, fakeRunTask{Input: *input, Extras: JSONMembers{}.Merge(extras)})
+	if len(b.runFailures) > 0 {
+		failures := b.runFailures[0]
+		b.runFailures = b.runFailures[1:]
+		return &ecs.RunTaskOutput{Failures: failures}, nil
+	}
+
+	def := b.taskDefinition(aws.StringValue(input.TaskDefinition))
+	if def == nil {
+		return nil, fakeError(ecs.ErrCodeInvalidParameterException, "TaskDefinition not found.")
+	}
+	outcome := fakeOutcome{ExitCode: aws.Int64(0)}
+	if len(b.outcomes) > 0 {
+		outcome = b.outcomes[0]
+		b.outcomes = b.outcomes[1:]
+	}
+
+	b.nextId++
+	cluster := aws.StringValue(input.Cluster)
+	arn := fmt.Sprintf("%stask/%s/%032x", fakeAccountArn, cluster, b.nextId)
+	task := ecs.Task{
+		ClusterArn:        aws.String(fakeAccountArn + "cluster/" + cluster),
+		CreatedAt:         b.tick(time.Second),
+		Cpu:               def.Cpu,
+		DesiredStatus:     aws.String("RUNNING"),
+		Group:             input.Group,
+		LastStatus:        aws.String(fakeTaskStates[0]),
+		LaunchType:        input.LaunchType,
+		Memory:            def.Memory,
+		Overrides:         input.Overrides,
+		Tags:              input.Tags,
+		TaskArn:           aws.String(arn),
+		TaskDefinitionArn: def.TaskDefinitionArn}
+	for _, container := range def.ContainerDefinitions {
+		task.Containers = append(task.Containers, ecs.Container{
+			LastStatus: aws.String("PENDING"),
+			Name:       container.Name,
+			TaskArn:    aws.String(arn)})
+	}
+	b.tasks[arn] = &fakeTask{task: task, def: def, outcome: outcome}
+	b.taskOrder = append(b.taskOrder, arn)
+	return &ecs.RunTaskOutput{Tasks: []ecs.Task{task}}, nil
+}
+
+// advance moves the task to its next state.
+func (b *fakeBackend) advance(t *fakeTask) {
+	if t.state == len(fakeTaskStates)-1 {
+		return
+	} else if fakeTaskStates[t.state] == "RUNNING" && t.running < t.outcome.Running {
+		t.running++
+		return
+	}
+	t.state++
+	if t.outcome.StopBeforeRunning && fakeTaskStates[t.state] == "RUNNING" {
+		t.state++
+	}
+	switch fakeTaskStates[t.state] {
+	case "PENDING":
+		t.task.PullStartedAt = b.tick(time.Second)
+	case "RUNNING":
+		t.task.StartedAt = b.tick(5 * time.Second)
+		for i := range t.task.Containers {
+			t.task.Containers[i].LastStatus = aws.String("RUNNING")
+		}
+		b.attachNetwork(t)
+		if len(t.outcome.Health) > 0 {
+			t.task.HealthStatus = t.outcome.Health
+			for i, container := range t.def.ContainerDefinitions {
+				if health, ok := t.outcome.ContainerHealth[*container.Name]; ok && container.HealthCheck != nil {
+					t.task.Containers[i].HealthStatus = health
+				} else if container.HealthCheck != nil {
+					t.task.Containers[i].HealthStatus = t.outcome.Health
+				}
+			}
+		}
+		b.writeTaskLogs(t)
+	case "STOPPED":
+		b.stop(t, t.outcome.StoppedReason)
+	}
+	t.task.LastStatus = aws.String(fakeTaskStates[t.state])
+}
+
+// attachNetwork gives the containers of an awsvpc task the private IP of an ENI, and binds the port mappings of other
+// tasks to host ports of the first container instance of the cluster.
+func (b *fakeBackend) attachNetwork(t *fakeTask) {
+	id, _ := strconv.ParseInt(path.Base(*t.task.TaskArn), 16, 64)
+	cluster := path.Base(aws.StringValue(t.task.ClusterArn))
+	for i, container := range t.def.ContainerDefinitions {
+		if t.def.NetworkMode == ecs.NetworkModeAwsvpc {
+			t.task.Containers[i].NetworkInterfaces = []ecs.NetworkInterface{
+				{PrivateIpv4Address: aws.String(fmt.Sprintf("10.0.1.%d", id))}}
+			continue
+		}
+		for j, mapping := range container.PortMappings {
+			if len(b.instances[cluster]) > 0 {
+				t.task.ContainerInstanceArn = b.instances[cluster][0].ContainerInstanceArn
+			}
+			hostPort := mapping.HostPort
+			if aws.Int64Value(hostPort) == 0 {
+				hostPort = aws.Int64(int64(32768 + j))
+			}
+			t.task.Containers[i].NetworkBindings = append(t.task.Containers[i].NetworkBindings, ecs.NetworkBinding{
+				BindIP:        aws.String("0.0.0.0"),
+				ContainerPort: mapping.ContainerPort,
+				HostPort:      hostPort,
+				Protocol:      mapping.Protocol})
+		}
+	}
+}
+
+func (b *fakeBackend) stop(t *fakeTask, reason string) {
+	t.state = len(fakeTaskStates) - 1
+	t.task.LastStatus = aws.String("STOPPED")
+	t.task.DesiredStatus = aws.String("STOPPED")
+	t.task.StoppedAt = b.tick(30 * time.Second)
+	if len(reason) > 0 {
+		t.task.StoppedReason = aws.String(reason)
+	} else {
+		t.task.StoppedReason = aws.String("Essential container in task exited")
+	}
+	for i := range t.task.Containers {
+		container := &t.task.Containers[i]
+		container.LastStatus = aws.String("STOPPED")
+		container.ExitCode = t.outcome.ExitCode
+		if len(t.outcome.Reason) > 0 {
+			container.Reason = aws.String(t.outcome.Reason)
+		}
+	}
+}
+
+// runtimeIds names the Docker ID of each container of a task that has started.
+func (b *fakeBackend) runtimeIds(t *fakeTask) map[string]string {
+	if t.task.StartedAt == nil {
+		return nil
+	}
+	ids := make(map[string]string)
+	for _, container := range t.task.Containers {
+		ids[*container.Name] = path.Base(*t.task.TaskArn) + "-" + *container.Name
+	}
+	return ids
+}
+
+func (b *fakeBackend) writeTaskLogs(t *fakeTask) {
+	for i := range t.def.ContainerDefinitions {
+		loc, err := LocateAwslogsForTask(&t.def.ContainerDefinitions[i], &t.task, b.runtimeIds(t))
+		if err != nil {
+			continue
+		}
+		for _, message := range t.outcome.Logs {
+			b.putLogEvent(*loc.LogGroupName, *loc.LogStreamName, message)
+		}
+	}
+}
+
+func (b *fakeBackend) DescribeTasks(input *ecs.DescribeTasksInput) (*ecs.DescribeTasksOutput, error) {
+	b.Lock()
+	defer b.Unlock()
+	output := ecs.DescribeTasksOutput{}
+	for _, arn := range input.Tasks {
+		if t, ok := b.tasks[arn]; ok {
+			b.advance(t)
+			output.Tasks = append(output.Tasks, t.task)
+		} else {
+			output.Failures = append(output.Failures, ecs.Failure{Arn: aws.String(arn), Reason: aws.String("MISSING")})
+		}
+	}
+	return &output, nil
+}
+
+func (b *fakeBackend) StopTask(input *ecs.StopTaskInput) (*ecs.StopTaskOutput, error) {
+	b.Lock()
+	defer b.Unlock()
+	t, ok := b.tasks[aws.StringValue(input.Task)]
+	if !ok {
+		return nil, fakeError(ecs.ErrCodeInvalidParameterException, "The referenced task was not found.")
+	}
+	if aws.StringValue(t.task.LastStatus) != "STOPPED" {
+		b.stop(t, aws.StringValue(input.Reason))
+	}
+	return &ecs.StopTaskOutput{Task: &t.task}, nil
+}
+
+// waitFor describes the tasks until all of them are in the wanted state, failing with the error code of the AWS
+// waiters when a task stops first, or after fakeWaiterAttempts.
+func (b *fakeBackend) waitFor(input *ecs.DescribeTasksInput, want string) error {
+	for attempt := 0; attempt < fakeWaiterAttempts; attempt++ {
+		output, err := b.DescribeTasks(input)
+		if err != nil {
+			return err
+		} else if len(output.Failures) > 0 {
+			return fakeError(aws.WaiterResourceNotReadyErrorCode, "failed waiting for successful resource state")
+		}
+		ready := true
+		for _, task := range output.Tasks {
+			status := aws.StringValue(task.LastStatus)
+			if status == "STOPPED" && want != status {
+				return fakeError(aws.WaiterResourceNotReadyErrorCode, "failed waiting for successful resource state")
+			}
+			ready = ready && status == want
+		}
+		if ready {
+			return nil
+		}
+	}
+	return fakeError(aws.WaiterResourceNotReadyErrorCode, "exceeded wait attempts")
+}
+
+func (b *fakeBackend) WaitUntilTasksRunning(input *ecs.DescribeTasksInput) error {
+	return b.waitFor(input, "RUNNING")
+}
+
+func (b *fakeBackend) WaitUntilTasksStopped(input *ecs.DescribeTasksInput) error {
+	return b.waitFor(input, "STOPPED")
+}
+
+// WaitUntilTasksHealthy describes the tasks until all of them meet the condition, failing when any is UNHEALTHY or
+// stops first, or after fakeWaiterAttempts.
+func (b *fakeBackend) WaitUntilTasksHealthy(input *ecs.DescribeTasksInput, condition HealthCondition, timeout time.Duration) error {
+	for attempt := 0; attempt < fakeWaiterAttempts; attempt++ {
+		output, err := b.DescribeTasks(input)
+		if err != nil {
+			return err
+		} else if done, err := condition.Check(output); done {
+			return err
+		}
+	}
+	return fakeError(aws.WaiterResourceNotReadyErrorCode, "exceeded wait attempts")
+}
+
+func (b *fakeBackend) ContainerRuntimeIds(cluster *string, taskArn string) (map[string]string, error) {
+	b.Lock()
+	defer b.Unlock()
+	t, ok := b.tasks[taskArn]
+	if !ok {
+		return nil, fmt.Errorf("failed to describe task %s", taskArn)
+	}
+	return b.runtimeIds(t), nil
+}
+
+func (b *fakeBackend) TaskCapacity(cluster *string, taskArn string) (string, string, error) {
+	b.Lock()
+	defer b.Unlock()
+	t, ok := b.tasks[taskArn]
+	if !ok {
+		return "", "", fmt.Errorf("failed to describe task %s", taskArn)
+	}
+	if t.task.LaunchType == ecs.LaunchTypeFargate {
+		return "FARGATE", ArchitectureX86, nil
+	}
+	return "", ArchitectureX86, nil
+}
+
+// ExecuteCommand records the request and returns a session once the task is running, failing like ECS while its agent
+// has not yet started.
+func (b *fakeBackend) ExecuteCommand(input *ExecuteCommandInput) (*ExecuteCommandOutput, error) {
+	b.Lock()
+	defer b.Unlock()
+	b.execs = append(b.execs, *input)
+	t, ok := b.tasks[aws.StringValue(input.Task)]
+	if !ok {
+		return nil, fakeError(ecs.ErrCodeInvalidParameterException, "The specified task is not found.")
+	} else if aws.StringValue(t.task.LastStatus) != "RUNNING" {
+		return nil, fakeError(ecs.ErrCodeInvalidParameterException,
+			"The execute command failed because execute command agent isn't running.")
+	}
+	sessionId := fmt.Sprintf("ecs-execute-command-%d", len(b.execs))
+	return &ExecuteCommandOutput{
+		ClusterArn:    t.task.ClusterArn,
+		ContainerName: input.Container,
+		Interactive:   input.Interactive,
+		Session: &ExecuteCommandSession{
+			SessionId:  aws.String(sessionId),
+			StreamUrl:  aws.String("wss://ssmmessages.us-east-1.amazonaws.com/v1/data-channel/" + sessionId),
+			TokenValue: aws.String("token-" + sessionId)},
+		TaskArn: t.task.TaskArn}, nil
+}
+
+// task returns the current state of a task started by RunTask, without advancing it.
+func (b *fakeBackend) task(arn string) ecs.Task {
+	b.Lock()
+	defer b.Unlock()
+	return b.tasks[arn].task
+}
+
+// fakeResource holds the attributes of an EC2 resource by filter name, and its tags.
+type fakeResource struct {
+	attributes map[string][]string
+	tags       []ec2.Tag
+}
+
+// matches applies the describe filters to the resource. Every filter must match one of its values, which may contain
+// the * and ? wildcards.
+func (r fakeResource) matches(filters []ec2.Filter) bool {
+	for _, filter := range filters {
+		name := aws.StringValue(filter.Name)
+		var actual []string
+		switch {
+		case strings.HasPrefix(name, "tag:"):
+			for _, tag := range r.tags {
+				if aws.StringValue(tag.Key) == strings.TrimPrefix(name, "tag:") {
+					actual = append(actual, aws.StringValue(tag.Value))
+				}
+			}
+		case name == "tag-key":
+			for _, tag := range r.tags {
+				actual = append(actual, aws.StringValue(tag.Key))
+			}
+		default:
+			actual = r.attributes[name]
+		}
+		matched := false
+		for _, pattern := range filter.Values {
+			for _, value := range actual {
+				if ok, _ := path.Match(pattern, value); ok {
+					matched = true
+				}
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+func (b *fakeBackend) DescribeVpcs(input *ec2.DescribeVpcsInput) (*ec2.DescribeVpcsOutput, error) {
+	b.Lock()
+	defer b.Unlock()
+	output := ec2.DescribeVpcsOutput{}
+	for _, vpc := range b.vpcs {
+		resource := fakeResource{tags: vpc.Tags, attributes: map[string][]string{
+			"vpc-id": {aws.StringValue(vpc.VpcId)}}}
+		if resource.matches(input.Filters) {
+			output.Vpcs = append(output.Vpcs, vpc)
+		}
+	}
+	return &output, nil
+}
+
+func (b *fakeBackend) DescribeSubnets(input *ec2.DescribeSubnetsInput) (*ec2.DescribeSubnetsOutput, error) {
+	b.Lock()
+	defer b.Unlock()
+	output := ec2.DescribeSubnetsOutput{}
+	for _, subnet := range b.subnets {
+		resource := fakeResource{tags: subnet.Tags, attributes: map[string][]string{
+			"subnet-id":         {aws.StringValue(subnet.SubnetId)},
+			"vpc-id":            {aws.StringValue(subnet.VpcId)},
+			"availability-zone": {aws.StringValue(subnet.AvailabilityZone)}}}
+		if resource.matches(input.Filters) {
+			output.Subnets = append(output.Subnets, subnet)
+		}
+	}
+	return &output, nil
+}
+
+func (b *fakeBackend) DescribeSecurityGroups(input *ec2.DescribeSecurityGroupsInput) (*ec2.DescribeSecurityGroupsOutput, error) {
+	b.Lock()
+	defer b.Unlock()
+	output := ec2.DescribeSecurityGroupsOutput{}
+	for _, group := range b.groups {
+		resource := fakeResource{tags: group.Tags, attributes: map[string][]string{
+			"group-id":   {aws.StringValue(group.GroupId)},
+			"group-name": {aws.StringValue(group.GroupName)},
+			"vpc-id":     {aws.StringValue(group.VpcId)}}}
+		if resource.matches(input.Filters) {
+			output.SecurityGroups = append(output.SecurityGroups, group)
+		}
+	}
+	return &output, nil
+}
+
+func (b *fakeBackend) DescribeInstances(input *ec2.DescribeInstancesInput) (*ec2.DescribeInstancesOutput, error) {
+	b.Lock()
+	defer b.Unlock()
+	output := ec2.DescribeInstancesOutput{}
+	for _, instance := range b.ec2Instances {
+		resource := fakeResource{tags: instance.Tags, attributes: map[string][]string{
+			"instance-id": {aws.StringValue(instance.InstanceId)},
+			"subnet-id":   {aws.StringValue(instance.SubnetId)},
+			"vpc-id":      {aws.StringValue(instance.VpcId)}}}
+		for _, group := range instance.SecurityGroups {
+			resource.attributes["instance.group-id"] = append(resource.attributes["instance.group-id"],
+				aws.StringValue(group.GroupId))
+		}
+		if resource.matches(input.Filters) {
+			output.Reservations = append(output.Reservations, ec2.RunInstancesOutput{Instances: []ec2.Instance{instance}})
+		}
+	}
+	return &output, nil
+}
+
+func (b *fakeBackend) stream(group string, name string) *fakeLogStream {
+	for _, stream := range b.logGroups[group] {
+		if stream.name == name {
+			return stream
+		}
+	}
+	return nil
+}
+
+// putLogEvent appends a message to the stream, creating the group and stream as needed, as the awslogs driver does.
+func (b *fakeBackend) putLogEvent(group string, name string, message string) {
+	stream := b.stream(group, name)
+	if stream == nil {
+		stream = &fakeLogStream{name: name}
+		b.logGroups[group] = append(b.logGroups[group], stream)
+	}
+	b.nextId++
+	timestamp := aws.TimeUnixMilli(*b.tick(time.Millisecond))
+	stream.events = append(stream.events, cloudwatchlogs.FilteredLogEvent{
+		EventId:       aws.String(strconv.Itoa(b.nextId)),
+		IngestionTime: aws.Int64(timestamp),
+		LogStreamName: aws.String(name),
+		Message:       aws.String(message),
+		Timestamp:     aws.Int64(timestamp)})
+}
+
+func (b *fakeBackend) CreateLogGroup(input *cloudwatchlogs.CreateLogGroupInput) (*cloudwatchlogs.CreateLogGroupOutput, error) {
+	b.Lock()
+	defer b.Unlock()
+	group := aws.StringValue(input.LogGroupName)
+	if _, ok := b.logGroups[group]; ok {
+		return nil, fakeError(cloudwatchlogs.ErrCodeResourceAlreadyExistsException, "The specified log group already exists")
+	}
+	b.logGroups[group] = nil
+	return &cloudwatchlogs.CreateLogGroupOutput{}, nil
+}
+
+func (b *fakeBackend) CreateLogStream(input *cloudwatchlogs.CreateLogStreamInput) (*cloudwatchlogs.CreateLogStreamOutput, error) {
+	b.Lock()
+	defer b.Unlock()
+	group := aws.StringValue(input.LogGroupName)
+	if _, ok := b.logGroups[group]; !ok {
+		return nil, fakeError(cloudwatchlogs.ErrCodeResourceNotFoundException, "The specified log group does not exist.")
+	} else if b.stream(group, aws.StringValue(input.LogStreamName)) != nil {
+		return nil, fakeError(cloudwatchlogs.ErrCodeResourceAlreadyExistsException, "The specified log stream already exists")
+	}
+	b.logGroups[group] = append(b.logGroups[group], &fakeLogStream{name: aws.StringValue(input.LogStreamName)})
+	return &cloudwatchlogs.CreateLogStreamOutput{}, nil
+}
+
+func (b *fakeBackend) DescribeLogStreams(input *cloudwatchlogs.DescribeLogStreamsInput) (*cloudwatchlogs.DescribeLogStreamsOutput, error) {
+	b.Lock()
+	defer b.Unlock()
+	streams, ok := b.logGroups[aws.StringValue(input.LogGroupName)]
+	if !ok {
+		return nil, fakeError(cloudwatchlogs.ErrCodeResourceNotFoundException, "The specified log group does not exist.")
+	}
+	output := cloudwatchlogs.DescribeLogStreamsOutput{}
+	for _, stream := range streams {
+		if strings.HasPrefix(stream.name, aws.StringValue(input.LogStreamNamePrefix)) {
+			output.LogStreams = append(output.LogStreams, cloudwatchlogs.LogStream{LogStreamName: aws.String(stream.name)})
+		}
+	}
+	return &output, nil
+}
+
+// FilterLogEvents returns the events of the named streams in time order, fakeLogsPageSize at a time. Filter patterns
+// are matched as plain substrings.
+func (b *fakeBackend) FilterLogEvents(input *cloudwatchlogs.FilterLogEventsInput) (*cloudwatchlogs.FilterLogEventsOutput, error) {
+	b.Lock()
+	defer b.Unlock()
+	streams, ok := b.logGroups[aws.StringValue(input.LogGroupName)]
+	if !ok {
+		return nil, fakeError(cloudwatchlogs.ErrCodeResourceNotFoundException, "The specified log group does not exist.")
+	}
+	var events []cloudwatchlogs.FilteredLogEvent
+	for _, stream := range streams {
+		selected := len(input.LogStreamNames) == 0
+		for _, name := range input.LogStreamNames {
+			selected = selected || name == stream.name
+		}
+		if !selected {
+			continue
+		}
+		for _, event := range stream.events {
+			if input.StartTime != nil && *event.Timestamp < *input.StartTime {
+				continue
+			}
+			if input.EndTime != nil && *event.Timestamp > *input.EndTime {
+				continue
+			}
+			if input.FilterPattern != nil && !strings.Contains(*event.Message, *input.FilterPattern) {
+				continue
+			}
+			events = append(events, event)
+		}
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return *events[i].Timestamp < *events[j].Timestamp
+	})
+
+	start := 0
+	if input.NextToken != nil {
+		start, _ = strconv.Atoi(*input.NextToken)
+	}
+	output := cloudwatchlogs.FilterLogEventsOutput{}
+	if end := start + fakeLogsPageSize; end < len(events) {
+		output.Events = events[start:end]
+		output.NextToken = aws.String(strconv.Itoa(end))
+	} else if start < len(events) {
+		output.Events = events[start:]
+	}
+	return &output, nil
+}
@@ -0,0 +1,176 @@
+/*
+ * Copyright 2018 Mark Adamcin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+)
+
+const EnvOverrunIndex = "OVERRUN_INDEX"
+const EnvOverrunCount = "OVERRUN_COUNT"
+
+// ReadCommandsFile reads one command per line, skipping blank lines and lines starting with '#'.
+func ReadCommandsFile(filename string) ([]string, error) {
+	fh, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+
+	var commands []string
+	scanner := bufio.NewScanner(fh)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) > 0 && !strings.HasPrefix(line, "#") {
+			commands = append(commands, line)
+		}
+	}
+	return commands, scanner.Err()
+}
+
+func jobLabel(index int, count int) string {
+	width := len(strconv.Itoa(count - 1))
+	return fmt.Sprintf("[%*d] ", width, index)
+}
+
+// buildJobs expands the parsed arguments into the list of tasks to run. Fan-out jobs receive OVERRUN_INDEX and
+// OVERRUN_COUNT environment overrides so that each task can select its own shard of work.
+func buildJobs(prefs *ParsedArgs, stdin *StdinInput) ([]TaskJob, error) {
+	if prefs.Interactive {
+		return []TaskJob{{Command: InteractiveKeepAlive, ExecCommand: ExecCommandLine(prefs)}}, nil
+	}
+
+	var command []string
+	var script string
+	if prefs.OverridesCmd {
+		command = constructCommand(prefs)
+		script = commandScript(prefs)
+	}
+
+	if !prefs.IsFanOut() {
+		return wrapJobs(prefs, []TaskJob{{Command: command, Script: script}}, stdin)
+	}
+
+	var commands [][]string
+	var scripts []string
+	if len(prefs.CommandsFile) > 0 {
+		lines, err := ReadCommandsFile(prefs.CommandsFile)
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range lines {
+			commands = append(commands, constructCommandLine(prefs, line))
+			scripts = append(scripts, line)
+		}
+	} else {
+		for i := 0; i < prefs.Count; i++ {
+			commands = append(commands, command)
+			scripts = append(scripts, script)
+		}
+	}
+
+	jobs := make([]TaskJob, len(commands))
+	for i, command := range commands {
+		jobs[i] = TaskJob{
+			Index: i,
+			Label: jobLabel(i, len(commands)),
+			Environment: map[string]string{
+				EnvOverrunIndex: strconv.Itoa(i),
+				EnvOverrunCount: strconv.Itoa(len(commands))},
+			Command: command,
+			Script:  scripts[i]}
+	}
+	return wrapJobs(prefs, jobs, stdin)
+}
+
+// wrapJobs applies the features that wrap the command of each job in a shell script.
+func wrapJobs(prefs *ParsedArgs, jobs []TaskJob, stdin *StdinInput) ([]TaskJob, error) {
+	if stdin != nil {
+		if err := wrapStdin(prefs, jobs, stdin); err != nil {
+			return nil, err
+		}
+	}
+	return jobs, nil
+}
+
+// runJobs runs each job, keeping at most prefs.Parallel tasks in flight. Jobs not yet submitted when SIGINT is received
+// are skipped.
+func runJobs(prefs *ParsedArgs, ctx *ExecutionContext, jobs []TaskJob, tracker *TaskTracker) []TaskResult {
+	results := make([]TaskResult, len(jobs))
+	parallel := prefs.Parallel
+	if parallel < 1 {
+		parallel = 1
+	}
+
+	slots := make(chan struct{}, parallel)
+	var group sync.WaitGroup
+	for i := range jobs {
+		slots <- struct{}{}
+		if tracker.Stopping() {
+			results[i] = TaskResult{Job: &jobs[i], Reason: "skipped after SIGINT", ExitCode: 1}
+			<-slots
+			continue
+		}
+		group.Add(1)
+		go func(i int) {
+			defer group.Done()
+			results[i] = runTask(prefs, ctx, &jobs[i], tracker)
+			<-slots
+		}(i)
+	}
+	group.Wait()
+	return results
+}
+
+// PrintSummary prints a table of task results for each target.
+func PrintSummary(w io.Writer, targetResults []TargetResult) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "TARGET\tINDEX\tTASK\tEXIT\tCOST\tREASON")
+	for _, targetResult := range targetResults {
+		if targetResult.Err != nil {
+			fmt.Fprintf(tw, "%s\t-\t-\t-\t-\t%s\n", targetResult.Target, targetResult.Err)
+		}
+		for _, result := range targetResult.Results {
+			taskId := "-"
+			if len(result.TaskArn) > 0 {
+				arnParts := strings.Split(result.TaskArn, "/")
+				taskId = arnParts[len(arnParts)-1]
+			}
+			reason := result.Reason
+			if result.Err != nil {
+				reason = result.Err.Error()
+			}
+			exit := strconv.Itoa(result.ExitCode)
+			if result.Err != nil {
+				exit = "-"
+			}
+			cost := "-"
+			if result.Cost != nil {
+				cost = fmt.Sprintf("$%.4f", result.Cost.Cost)
+			}
+			fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%s\t%s\n", targetResult.Target, result.Job.Index, taskId, exit, cost, reason)
+		}
+	}
+	tw.Flush()
+}
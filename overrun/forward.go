@@ -0,0 +1,387 @@
+/*
+ * Copyright 2018 Mark Adamcin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// SSM documents of port forwarding sessions, to a port of the target itself, or to a host reachable from it.
+const (
+	DocumentPortForwarding           = "AWS-StartPortForwardingSession"
+	DocumentPortForwardingRemoteHost = "AWS-StartPortForwardingSessionToRemoteHost"
+)
+
+// agents newer than this version multiplex the connections of a port forwarding session. Older agents forward one
+// connection at a time.
+const MuxAgentVersion = "3.0.196.0"
+
+// the address on which forwarded ports are listened to.
+const ForwardBindAddress = "127.0.0.1"
+
+// PortForward is a [localPort:][host:]port argument of the forward subcommand.
+type PortForward struct {
+	// the local port, or 0 for any free port.
+	LocalPort int
+
+	// the host to connect to, as seen from the task.
+	Host string
+
+	RemotePort int
+}
+
+// ParsePortForward parses a port, localPort:port, or localPort:host:port. The host defaults to localhost, which is the
+// task itself, and the local port defaults to the remote port.
+func ParsePortForward(spec string) (PortForward, error) {
+	parts := strings.Split(spec, ":")
+	if len(parts) > 3 {
+		return PortForward{}, fmt.Errorf("invalid port forward %s, expected [localPort:][host:]port", spec)
+	}
+	ports := make([]int, 0, 2)
+	for i, part := range parts {
+		if i == 1 && len(parts) == 3 {
+			continue
+		}
+		port, err := strconv.Atoi(part)
+		if err != nil || port < 0 || port > 65535 || (port == 0 && i == len(parts)-1) {
+			return PortForward{}, fmt.Errorf("invalid port %s in port forward %s", part, spec)
+		}
+		ports = append(ports, port)
+	}
+	forward := PortForward{LocalPort: ports[0], Host: "localhost", RemotePort: ports[len(ports)-1]}
+	if len(parts) == 3 {
+		if len(parts[1]) == 0 {
+			return PortForward{}, fmt.Errorf("invalid port forward %s, expected a host between the ports", spec)
+		}
+		forward.Host = parts[1]
+	}
+	return forward, nil
+}
+
+// isLocalHost returns true when the host is the target itself.
+func isLocalHost(host string) bool {
+	return host == "localhost" || host == "127.0.0.1" || host == "::1"
+}
+
+// StartSessionInput returns the input of a port forwarding session with the target. Ports of the target itself use
+// the document that older agents support.
+func (f PortForward) StartSessionInput(target string) ssm.StartSessionInput {
+	input := ssm.StartSessionInput{
+		Target: aws.String(target),
+		Parameters: map[string][]string{
+			"portNumber":      {strconv.Itoa(f.RemotePort)},
+			"localPortNumber": {strconv.Itoa(f.LocalPort)}}}
+	if isLocalHost(f.Host) {
+		input.DocumentName = aws.String(DocumentPortForwarding)
+	} else {
+		input.DocumentName = aws.String(DocumentPortForwardingRemoteHost)
+		input.Parameters["host"] = []string{f.Host}
+	}
+	return input
+}
+
+// ExecTarget returns the SSM target of the managed agent in a container of a task, as used by ECS Exec.
+func ExecTarget(clusterArn string, taskArn string, runtimeId string) string {
+	return fmt.Sprintf("ecs:%s_%s_%s", path.Base(clusterArn), path.Base(taskArn), runtimeId)
+}
+
+// ForwardTarget describes a running task and returns the SSM target of the named container, or of its first started
+// container.
+func ForwardTarget(ecss EcsAPI, cluster *string, taskId string, containerName string) (string, string, error) {
+	result, err := ecss.DescribeTasks(&ecs.DescribeTasksInput{Cluster: cluster, Tasks: []string{taskId}})
+	if err != nil {
+		return "", "", err
+	} else if len(result.Tasks) == 0 {
+		return "", "", fmt.Errorf("task %s not found", taskId)
+	}
+	task := &result.Tasks[0]
+	if status := aws.StringValue(task.LastStatus); status != "RUNNING" {
+		return "", "", fmt.Errorf("task %s is %s, not RUNNING", taskId, status)
+	}
+
+	runtimeIds, err := ecss.ContainerRuntimeIds(cluster, *task.TaskArn)
+	if err != nil {
+		return "", "", err
+	}
+	var availNames []string
+	for _, container := range task.Containers {
+		name := aws.StringValue(container.Name)
+		runtimeId, ok := runtimeIds[name]
+		if !ok {
+			continue
+		}
+		availNames = append(availNames, name)
+		if len(containerName) == 0 || containerName == name {
+			return ExecTarget(aws.StringValue(task.ClusterArn), *task.TaskArn, runtimeId), name, nil
+		}
+	}
+	if len(containerName) > 0 && len(availNames) > 0 {
+		return "", "", fmt.Errorf("no started container %s in task %s. Available names: %s", containerName, taskId, availNames)
+	}
+	return "", "", fmt.Errorf("no container of task %s has started", taskId)
+}
+
+// compareVersions compares dotted version numbers, returning -1, 0 or 1.
+func compareVersions(a string, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		if i < len(as) {
+			x, _ = strconv.Atoi(as[i])
+		}
+		if i < len(bs) {
+			y, _ = strconv.Atoi(bs[i])
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// PortForwarder relays the connections accepted by a listener through a port forwarding session. The session's output
+// must be written to the PortForwarder.
+type PortForwarder struct {
+	Session *Session
+
+	Listener net.Listener
+
+	lock sync.Mutex
+
+	// set once the agent supports multiplexing.
+	mux *Mux
+
+	// the connection being forwarded by an agent that does not multiplex.
+	conn net.Conn
+}
+
+// Write delivers output from the agent to the connections being forwarded.
+func (f *PortForwarder) Write(p []byte) (int, error) {
+	f.lock.Lock()
+	mux, conn := f.mux, f.conn
+	f.lock.Unlock()
+	if mux != nil {
+		return mux.Write(p)
+	} else if conn != nil {
+		// a connection that fails is closed by its relay.
+		_, _ = conn.Write(p)
+	}
+	return len(p), nil
+}
+
+// OnFlag handles the flags of the agent, which reports when it failed to connect to the forwarded port.
+func (f *PortForwarder) OnFlag(flag uint32) {
+	if flag != FlagConnectToPortErr {
+		return
+	}
+	log.Println("WARNING: the agent failed to connect to the forwarded port")
+	f.lock.Lock()
+	conn := f.conn
+	f.lock.Unlock()
+	if conn != nil {
+		conn.Close()
+	}
+}
+
+// Serve waits for the session's handshake, then accepts connections until the listener is closed.
+func (f *PortForwarder) Serve() error {
+	if !f.Session.waitReady() {
+		return errors.New("session ended before it was ready")
+	}
+	if compareVersions(f.Session.AgentVersion, MuxAgentVersion) <= 0 {
+		log.Printf("WARNING: agent %s does not multiplex port forwarding, so connections are forwarded one at a time.\n",
+			f.Session.AgentVersion)
+		return f.serveSingle()
+	}
+
+	mux := NewMux(f.Session)
+	f.lock.Lock()
+	f.mux = mux
+	f.lock.Unlock()
+	go mux.KeepAlive(MuxKeepAliveInterval, f.Session.Done())
+	for {
+		conn, err := f.Listener.Accept()
+		if err != nil {
+			return err
+		}
+		stream, err := mux.Open()
+		if err != nil {
+			conn.Close()
+			return err
+		}
+		go relayStream(conn, stream)
+	}
+}
+
+// relayStream copies between a connection and a stream until both have ended, or until the agent closes the stream.
+func relayStream(conn net.Conn, stream *MuxStream) {
+	received := make(chan struct{})
+	go func() {
+		_, _ = io.Copy(conn, stream)
+		conn.Close()
+		close(received)
+	}()
+	_, _ = io.Copy(stream, conn)
+	_ = stream.CloseWrite()
+	<-received
+	_ = stream.Close()
+}
+
+// serveSingle forwards one connection at a time. When a connection ends, the agent is told to disconnect from the
+// port, so that it connects again for the next.
+func (f *PortForwarder) serveSingle() error {
+	for {
+		conn, err := f.Listener.Accept()
+		if err != nil {
+			return err
+		}
+		f.lock.Lock()
+		f.conn = conn
+		f.lock.Unlock()
+		_, _ = io.Copy(f.Session, conn)
+		f.lock.Lock()
+		f.conn = nil
+		f.lock.Unlock()
+		conn.Close()
+		if err := f.Session.SendFlag(FlagDisconnectToPort); err != nil {
+			return err
+		}
+	}
+}
+
+// Close stops accepting connections and closes those being forwarded.
+func (f *PortForwarder) Close() {
+	f.Listener.Close()
+	f.lock.Lock()
+	mux, conn := f.mux, f.conn
+	f.lock.Unlock()
+	if mux != nil {
+		mux.Close()
+	}
+	if conn != nil {
+		conn.Close()
+	}
+}
+
+// forwardCommand runs the forward subcommand, which forwards a local port to a port of a running task, or of a host
+// reachable from it, until interrupted.
+func forwardCommand(args []string) {
+	parser := loadCommandArgs("forward", args)
+	prefs := parser.Args()
+	if len(parser.Positional) != 2 {
+		usage()
+		log.Fatal("Specify the ID or ARN of a single running task, and the [localPort:][host:]port to forward.")
+	} else if len(prefs.Clusters) > 1 || len(prefs.AwsRegions) > 1 {
+		log.Fatal("Specify at most one --cluster and one --region.")
+	}
+	forward, err := ParsePortForward(parser.Positional[1])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	awsCfg := loadAwsConfig(&prefs)
+	if len(prefs.AwsRegions) > 0 {
+		awsCfg.Region = prefs.AwsRegions[0]
+	}
+	var cluster *string
+	if len(prefs.Clusters) > 0 {
+		cluster = &prefs.Clusters[0]
+	}
+
+	backend := AwsBackend{NoWaiterDelay: prefs.NoWaiterDelay}
+	target, containerName, err := ForwardTarget(backend.Ecs(awsCfg), cluster, parser.Positional[0], prefs.ContainerName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	input := forward.StartSessionInput(target)
+	if prefs.DryRun {
+		log.Println(input.String())
+		os.Exit(0)
+	}
+
+	listener, err := net.Listen("tcp", net.JoinHostPort(ForwardBindAddress, strconv.Itoa(forward.LocalPort)))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer listener.Close()
+	forward.LocalPort = listener.Addr().(*net.TCPAddr).Port
+
+	out, err := ssm.New(awsCfg).StartSessionRequest(&input).Send()
+	if err != nil {
+		log.Fatal(err)
+	}
+	sessionId := aws.StringValue(out.SessionId)
+	session, err := OpenSession(aws.StringValue(out.StreamUrl), aws.StringValue(out.TokenValue), sessionId)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer terminateSession(awsCfg, sessionId)
+
+	forwarder := PortForwarder{Session: session, Listener: listener}
+	session.Stdout = &forwarder
+	session.Stderr = os.Stderr
+	session.OnFlag = forwarder.OnFlag
+	log.Printf("Forwarding %s to %s:%d in container %s of task %s, in session %s. Press Ctrl-C to stop.\n",
+		listener.Addr(), forward.Host, forward.RemotePort, containerName, parser.Positional[0], sessionId)
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	runErr := make(chan error, 1)
+	go func() { runErr <- session.Run() }()
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- forwarder.Serve() }()
+
+	select {
+	case <-sigs:
+		log.Printf("Closing session %s.\n", sessionId)
+		forwarder.Close()
+		session.Close()
+	case err = <-runErr:
+		forwarder.Close()
+		if err != nil {
+			log.Printf("ERROR: session %s failed: %s\n", sessionId, err)
+		} else {
+			log.Printf("Session %s ended.\n", sessionId)
+		}
+	case err = <-serveErr:
+		forwarder.Close()
+		session.Close()
+		log.Printf("ERROR: failed to forward connections: %s\n", err)
+	}
+	signal.Stop(sigs)
+	if err != nil {
+		terminateSession(awsCfg, sessionId)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,212 @@
+/*
+ * Copyright 2018 Mark Adamcin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"io"
+	"io/ioutil"
+	"path"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestParsePortForward(t *testing.T) {
+	tests := []struct {
+		spec string
+		want PortForward
+		err  string
+	}{
+		{spec: "5432", want: PortForward{LocalPort: 5432, Host: "localhost", RemotePort: 5432}},
+		{spec: "15432:5432", want: PortForward{LocalPort: 15432, Host: "localhost", RemotePort: 5432}},
+		{spec: "5432:db.internal:5432", want: PortForward{LocalPort: 5432, Host: "db.internal", RemotePort: 5432}},
+		{spec: "0:5432", want: PortForward{LocalPort: 0, Host: "localhost", RemotePort: 5432}},
+		{spec: "5432:0", err: "invalid port 0"},
+		{spec: "pg", err: "invalid port pg"},
+		{spec: "5432::5432", err: "expected a host"},
+		{spec: "1:2:3:4", err: "expected [localPort:][host:]port"},
+	}
+	for _, test := range tests {
+		t.Run(test.spec, func(t *testing.T) {
+			got, err := ParsePortForward(test.spec)
+			if len(test.err) > 0 {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("got error %v, want %q", err, test.err)
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("got %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestStartSessionInput(t *testing.T) {
+	local := PortForward{LocalPort: 15432, Host: "localhost", RemotePort: 5432}.StartSessionInput("ecs:main_1_2")
+	if aws.StringValue(local.DocumentName) != DocumentPortForwarding || len(local.Parameters["host"]) > 0 {
+		t.Errorf("unexpected input for a port of the task: %s", local)
+	}
+	remote := PortForward{LocalPort: 5432, Host: "db.internal", RemotePort: 5432}.StartSessionInput("ecs:main_1_2")
+	want := map[string][]string{"host": {"db.internal"}, "portNumber": {"5432"}, "localPortNumber": {"5432"}}
+	if aws.StringValue(remote.DocumentName) != DocumentPortForwardingRemoteHost || !reflect.DeepEqual(remote.Parameters, want) {
+		t.Errorf("unexpected input for a remote host: %s", remote)
+	}
+}
+
+func TestForwardTarget(t *testing.T) {
+	b := newRunBackend()
+	b.outcomes = []fakeOutcome{{Running: 100, ExitCode: aws.Int64(0)}}
+	result, err := b.RunTask(&ecs.RunTaskInput{Cluster: aws.String("main"), TaskDefinition: aws.String("app")}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	taskArn := *result.Tasks[0].TaskArn
+	taskId := path.Base(taskArn)
+	cluster := aws.String("main")
+	if _, _, err := ForwardTarget(b, cluster, taskArn, ""); err == nil || !strings.Contains(err.Error(), "not RUNNING") {
+		t.Errorf("got error %v for a pending task, want not RUNNING", err)
+	}
+	if err := b.WaitUntilTasksRunning(&ecs.DescribeTasksInput{Cluster: cluster, Tasks: []string{taskArn}}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		container string
+		target    string
+		name      string
+		err       string
+	}{
+		{target: "ecs:main_" + taskId + "_" + taskId + "-web", name: "web"},
+		{container: "sidecar", target: "ecs:main_" + taskId + "_" + taskId + "-sidecar", name: "sidecar"},
+		{container: "db", err: "Available names: [web sidecar]"},
+	}
+	for _, test := range tests {
+		t.Run(test.container, func(t *testing.T) {
+			target, name, err := ForwardTarget(b, cluster, taskArn, test.container)
+			if len(test.err) > 0 {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("got error %v, want %q", err, test.err)
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if target != test.target || name != test.name {
+				t.Errorf("got %s in %s, want %s in %s", target, name, test.target, test.name)
+			}
+		})
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	if compareVersions("3.0.196.0", MuxAgentVersion) != 0 || compareVersions("3.1.1511.0", MuxAgentVersion) != 1 ||
+		compareVersions("2.3.68.0", MuxAgentVersion) != -1 || compareVersions("", MuxAgentVersion) != -1 {
+		t.Error("unexpected version ordering")
+	}
+}
+
+// muxFrame encodes a frame as the agent sends it.
+func muxFrame(cmd byte, id uint32, payload string) []byte {
+	frame := make([]byte, muxHeaderLength, muxHeaderLength+len(payload))
+	frame[0] = MuxVersion
+	frame[1] = cmd
+	binary.LittleEndian.PutUint16(frame[2:4], uint16(len(payload)))
+	binary.LittleEndian.PutUint32(frame[4:8], id)
+	return append(frame, payload...)
+}
+
+// syncBuffer collects the frames written by a Mux.
+type syncBuffer struct {
+	sync.Mutex
+	bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.Buffer.Write(p)
+}
+
+func TestMux(t *testing.T) {
+	var out syncBuffer
+	mux := NewMux(&out)
+	first, err := mux.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := mux.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := first.Write([]byte("SELECT 1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := first.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	var want []byte
+	want = append(want, muxFrame(MuxCmdSyn, first.Id, "")...)
+	want = append(want, muxFrame(MuxCmdSyn, second.Id, "")...)
+	want = append(want, muxFrame(MuxCmdPsh, first.Id, "SELECT 1")...)
+	want = append(want, muxFrame(MuxCmdFin, first.Id, "")...)
+	if !bytes.Equal(out.Bytes(), want) {
+		t.Errorf("got frames %x, want %x", out.Bytes(), want)
+	}
+
+	// output of the agent, split in the middle of a header.
+	var agent []byte
+	agent = append(agent, muxFrame(MuxCmdPsh, first.Id, "one")...)
+	agent = append(agent, muxFrame(MuxCmdPsh, second.Id, "other")...)
+	agent = append(agent, muxFrame(MuxCmdNop, 0, "")...)
+	agent = append(agent, muxFrame(MuxCmdPsh, first.Id, " row")...)
+	agent = append(agent, muxFrame(MuxCmdFin, first.Id, "")...)
+	for _, part := range [][]byte{agent[:5], agent[5:20], agent[20:]} {
+		if _, err := mux.Write(part); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := ioutil.ReadAll(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "one row" {
+		t.Errorf("got %q from the first stream, want %q", data, "one row")
+	}
+	buf := make([]byte, 16)
+	if n, _ := second.Read(buf); string(buf[:n]) != "other" {
+		t.Errorf("got %q from the second stream, want %q", buf[:n], "other")
+	}
+
+	mux.Close()
+	if _, err := second.Read(buf); err != io.EOF {
+		t.Errorf("got %v reading a stream of a closed mux, want EOF", err)
+	}
+	if _, err := mux.Open(); err == nil {
+		t.Error("opened a stream of a closed mux")
+	}
+	if _, err := mux.Write([]byte{2, 0, 0, 0, 0, 0, 0, 0}); err == nil {
+		t.Error("accepted a frame of an unsupported version")
+	}
+}
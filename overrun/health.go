@@ -0,0 +1,269 @@
+/*
+ * Copyright 2018 Mark Adamcin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"strings"
+	"time"
+)
+
+// exit code reported when a task waited on by --wait-healthy became UNHEALTHY.
+const ExitCodeUnhealthy = 43
+
+// how long --wait-healthy waits for a task to become healthy, by default.
+const DefaultHealthTimeout = 5 * time.Minute
+
+// delay between describing a task while waiting for it to become healthy. ECS runs health checks every 30 seconds by
+// default.
+const HealthPollInterval = 5 * time.Second
+
+// HealthCondition is what --wait-healthy waits for to become HEALTHY.
+type HealthCondition struct {
+	// the task, whose health is that of its essential containers with health checks.
+	Task bool
+
+	// the name of a container with a health check, such as the overridden container, which may not be essential.
+	Container string
+}
+
+// healthCondition waits for the task when an essential container has a health check, and for the overridden container
+// when it has one. Without either, the health of the task and of the overridden container remain UNKNOWN.
+func healthCondition(ctx *ExecutionContext) (HealthCondition, error) {
+	condition := HealthCondition{}
+	for _, container := range ctx.TaskDefinition.ContainerDefinitions {
+		if container.HealthCheck != nil && (container.Essential == nil || *container.Essential) {
+			condition.Task = true
+		}
+	}
+	overridden := ctx.ContainerDefinition
+	if overridden != nil && overridden.HealthCheck != nil {
+		condition.Container = aws.StringValue(overridden.Name)
+	}
+	if !condition.Task && len(condition.Container) == 0 {
+		return condition, fmt.Errorf("--wait-healthy requires a health check on an essential container or on container %s "+
+			"in task definition %s", aws.StringValue(overridden.Name), ctx.TaskDef)
+	}
+	return condition, nil
+}
+
+// IsHealthy returns true when the task meets the condition.
+func (c HealthCondition) IsHealthy(task *ecs.Task) bool {
+	if c.Task && task.HealthStatus != ecs.HealthStatusHealthy {
+		return false
+	}
+	if len(c.Container) > 0 {
+		for _, container := range task.Containers {
+			if aws.StringValue(container.Name) == c.Container {
+				return container.HealthStatus == ecs.HealthStatusHealthy
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// Check inspects the tasks described while waiting for them. Returns true once every task is healthy, or true with an
+// error once a task is missing, UNHEALTHY or has stopped.
+func (c HealthCondition) Check(output *ecs.DescribeTasksOutput) (bool, error) {
+	if len(output.Failures) > 0 {
+		return true, fmt.Errorf("failed to describe task %s: %s", aws.StringValue(output.Failures[0].Arn),
+			aws.StringValue(output.Failures[0].Reason))
+	}
+	healthy := true
+	for i := range output.Tasks {
+		task := &output.Tasks[i]
+		if aws.StringValue(task.LastStatus) == "STOPPED" {
+			return true, fmt.Errorf("task %s stopped", aws.StringValue(task.TaskArn))
+		} else if isUnhealthy(task) {
+			return true, errors.New(unhealthyReason(task))
+		}
+		healthy = healthy && c.IsHealthy(task)
+	}
+	return healthy, nil
+}
+
+// waitHealthy waits until the task meets the condition or is UNHEALTHY, or has stopped, and returns the task as last
+// described.
+func waitHealthy(ctx *ExecutionContext, taskArn string, condition HealthCondition, timeout time.Duration) (*ecs.Task, error) {
+	input := ecs.DescribeTasksInput{Cluster: &ctx.Target.Cluster, Tasks: []string{taskArn}}
+	waitErr := ctx.Ecs.WaitUntilTasksHealthy(&input, condition, timeout)
+	result, err := ctx.Ecs.DescribeTasks(&input)
+	if err != nil {
+		return nil, err
+	} else if len(result.Tasks) == 0 {
+		return nil, fmt.Errorf("failed to describe task %s", taskArn)
+	}
+	task := &result.Tasks[0]
+	if aws.StringValue(task.LastStatus) != "STOPPED" && !condition.IsHealthy(task) && !isUnhealthy(task) {
+		if waitErr == nil {
+			waitErr = errors.New("health status " + string(task.HealthStatus))
+		}
+		return nil, fmt.Errorf("task %s did not become healthy within %s: %s", taskArn, timeout, waitErr)
+	}
+	return task, nil
+}
+
+// isUnhealthy returns true when the task, or any of its containers, is UNHEALTHY.
+func isUnhealthy(task *ecs.Task) bool {
+	if task.HealthStatus == ecs.HealthStatusUnhealthy {
+		return true
+	}
+	for _, container := range task.Containers {
+		if container.HealthStatus == ecs.HealthStatusUnhealthy {
+			return true
+		}
+	}
+	return false
+}
+
+// unhealthyReason names the UNHEALTHY containers of the task.
+func unhealthyReason(task *ecs.Task) string {
+	var names []string
+	for _, container := range task.Containers {
+		if container.HealthStatus == ecs.HealthStatusUnhealthy {
+			names = append(names, aws.StringValue(container.Name))
+		}
+	}
+	if len(names) == 0 {
+		return fmt.Sprintf("Task %s is UNHEALTHY", aws.StringValue(task.TaskArn))
+	}
+	return fmt.Sprintf("Task %s is UNHEALTHY: %s", aws.StringValue(task.TaskArn), strings.Join(names, ", "))
+}
+
+// abandonTask handles a task that did not become healthy. It is stopped, unless --wait was given, in which case it is
+// left running for the user to inspect, and its ARN is logged.
+func abandonTask(prefs *ParsedArgs, ctx *ExecutionContext, job *TaskJob, taskArn string) {
+	if prefs.WaitStopped {
+		TaskEvent(ctx, job, "task-left-running", taskArn).Printf("Task %s is not healthy and was left running.", taskArn)
+		return
+	}
+	input := ecs.StopTaskInput{
+		Cluster: &ctx.Target.Cluster,
+		Reason:  aws.String("overrun --wait-healthy"),
+		Task:    &taskArn}
+	if _, err := ctx.Ecs.StopTask(&input); err != nil {
+		TaskEvent(ctx, job, "task-stop-failed", taskArn).Error("Failed to stop task %s, which is not healthy: %s", taskArn,
+			err)
+		return
+	}
+	TaskEvent(ctx, job, "task-stop-requested", taskArn).Printf("Stopped task %s, which is not healthy.", taskArn)
+}
+
+// reportHealthy logs that the task is healthy, with the address of each container.
+func reportHealthy(ctx *ExecutionContext, job *TaskJob, task *ecs.Task) {
+	event := TaskEvent(ctx, job, "task-healthy", aws.StringValue(task.TaskArn))
+	endpoints, err := TaskEndpoints(ctx, task)
+	if err != nil {
+		event.Warning("cannot find task addresses: %s", err)
+	}
+	event.Endpoints = endpoints
+	if len(endpoints) == 0 {
+		event.Printf("Task %s is HEALTHY.", *task.TaskArn)
+	} else {
+		event.Printf("Task %s is HEALTHY at:\n  %s", *task.TaskArn, strings.Join(endpoints, "\n  "))
+	}
+}
+
+// TaskEndpoints returns the addresses at which each container of a running task can be reached. Containers of awsvpc
+// tasks are reached at the private IP of the task's ENI, on the container ports of their port mappings. Otherwise,
+// containers are reached at the private IP of the container instance, on the host ports of their network bindings.
+func TaskEndpoints(ctx *ExecutionContext, task *ecs.Task) ([]string, error) {
+	var hostIp string
+	var endpoints []string
+	for _, container := range task.Containers {
+		name := aws.StringValue(container.Name)
+		for _, eni := range container.NetworkInterfaces {
+			if eni.PrivateIpv4Address == nil {
+				continue
+			}
+			mappings := containerPortMappings(ctx.TaskDefinition, name)
+			if len(mappings) == 0 {
+				endpoints = append(endpoints, fmt.Sprintf("%s %s", name, *eni.PrivateIpv4Address))
+			}
+			for _, mapping := range mappings {
+				endpoints = append(endpoints, fmt.Sprintf("%s %s:%d/%s", name, *eni.PrivateIpv4Address,
+					aws.Int64Value(mapping.ContainerPort), transportProtocol(mapping.Protocol)))
+			}
+		}
+		for _, binding := range container.NetworkBindings {
+			if len(hostIp) == 0 {
+				ip, err := containerInstanceIp(ctx, task)
+				if err != nil {
+					return endpoints, err
+				}
+				hostIp = ip
+			}
+			endpoints = append(endpoints, fmt.Sprintf("%s %s:%d->%d/%s", name, hostIp, aws.Int64Value(binding.HostPort),
+				aws.Int64Value(binding.ContainerPort), transportProtocol(binding.Protocol)))
+		}
+	}
+	return endpoints, nil
+}
+
+func containerPortMappings(def *ecs.TaskDefinition, name string) []ecs.PortMapping {
+	if def == nil {
+		return nil
+	}
+	for _, container := range def.ContainerDefinitions {
+		if aws.StringValue(container.Name) == name {
+			return container.PortMappings
+		}
+	}
+	return nil
+}
+
+func transportProtocol(protocol ecs.TransportProtocol) string {
+	if len(protocol) == 0 {
+		return string(ecs.TransportProtocolTcp)
+	}
+	return string(protocol)
+}
+
+// containerInstanceIp returns the private IP of the EC2 instance on which the task runs.
+func containerInstanceIp(ctx *ExecutionContext, task *ecs.Task) (string, error) {
+	if task.ContainerInstanceArn == nil {
+		return "", fmt.Errorf("task %s has no container instance", aws.StringValue(task.TaskArn))
+	}
+	ciResult, err := ctx.Ecs.DescribeContainerInstances(&ecs.DescribeContainerInstancesInput{
+		Cluster:            &ctx.Target.Cluster,
+		ContainerInstances: []string{*task.ContainerInstanceArn}})
+	if err != nil {
+		return "", err
+	} else if len(ciResult.ContainerInstances) == 0 || ciResult.ContainerInstances[0].Ec2InstanceId == nil {
+		return "", fmt.Errorf("failed to describe container instance %s", *task.ContainerInstanceArn)
+	}
+	instanceId := *ciResult.ContainerInstances[0].Ec2InstanceId
+	input := ec2.DescribeInstancesInput{
+		Filters: []ec2.Filter{{Name: aws.String(FilterInstanceId), Values: []string{instanceId}}}}
+	result, err := ctx.Ec2.DescribeInstances(&input)
+	if err != nil {
+		return "", err
+	}
+	for _, reservation := range result.Reservations {
+		for _, instance := range reservation.Instances {
+			if instance.PrivateIpAddress != nil {
+				return *instance.PrivateIpAddress, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("failed to find the private IP of instance %s", instanceId)
+}
@@ -0,0 +1,189 @@
+/*
+ * Copyright 2018 Mark Adamcin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"strings"
+	"testing"
+)
+
+// newHealthBackend returns a fake with the proxy task definition, which binds its health-checked container to a host
+// port, and the same as proxy-vpc for awsvpc. The probe task definition has a health check only on a container that is
+// not essential.
+func newHealthBackend() *fakeBackend {
+	b := newRunBackend()
+	b.ec2Instances[0].PrivateIpAddress = aws.String("10.0.0.5")
+	for _, family := range []string{"proxy", "proxy-vpc"} {
+		def := ecs.TaskDefinition{
+			Family: aws.String(family),
+			ContainerDefinitions: []ecs.ContainerDefinition{
+				{
+					Name:         aws.String("proxy"),
+					Image:        aws.String("example/proxy:1.0"),
+					HealthCheck:  &ecs.HealthCheck{Command: []string{"CMD-SHELL", "pg_isready"}},
+					PortMappings: []ecs.PortMapping{{ContainerPort: aws.Int64(5432)}}}}}
+		if family == "proxy-vpc" {
+			def.NetworkMode = ecs.NetworkModeAwsvpc
+		}
+		b.addTaskDefinition(def)
+	}
+	b.addTaskDefinition(ecs.TaskDefinition{
+		Family: aws.String("probe"),
+		ContainerDefinitions: []ecs.ContainerDefinition{
+			{Name: aws.String("app"), Image: aws.String("example/app:1.0")},
+			{
+				Name:        aws.String("probe"),
+				Image:       aws.String("example/probe:1.0"),
+				Essential:   aws.Bool(false),
+				HealthCheck: &ecs.HealthCheck{Command: []string{"CMD-SHELL", "probe"}}}}})
+	return b
+}
+
+func TestRunTaskWaitHealthy(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		outcome  fakeOutcome
+		exitCode int
+		reason   string
+		err      string
+		status   string
+		message  string
+	}{
+		{
+			name:    "host port bindings",
+			outcome: fakeOutcome{Health: ecs.HealthStatusHealthy, Running: 1},
+			status:  "RUNNING",
+			message: "HEALTHY at:\n  proxy 10.0.0.5:32768->5432/tcp\n",
+		},
+		{
+			name:    "task ENI",
+			args:    []string{"-t", "proxy-vpc", "--fargate:net", "subnet-a", "--fargate:sg", "sg-1"},
+			outcome: fakeOutcome{Health: ecs.HealthStatusHealthy, Running: 1},
+			status:  "RUNNING",
+			message: "HEALTHY at:\n  proxy 10.0.1.1:5432/tcp\n",
+		},
+		{
+			name:     "wait after healthy",
+			args:     []string{"-w"},
+			outcome:  fakeOutcome{Health: ecs.HealthStatusHealthy, Running: 1, ExitCode: aws.Int64(3)},
+			exitCode: 3,
+			status:   "STOPPED",
+			message:  "HEALTHY at:",
+		},
+		{
+			name:     "unhealthy",
+			outcome:  fakeOutcome{Health: ecs.HealthStatusUnhealthy, Running: 1},
+			exitCode: ExitCodeUnhealthy,
+			reason:   "is UNHEALTHY: proxy",
+			status:   "STOPPED",
+			message:  "Stopped task arn:aws:ecs:us-east-1:123456789012:task/main/",
+		},
+		{
+			name:     "unhealthy left running by --wait",
+			args:     []string{"-w"},
+			outcome:  fakeOutcome{Health: ecs.HealthStatusUnhealthy, Running: 1},
+			exitCode: ExitCodeUnhealthy,
+			reason:   "is UNHEALTHY: proxy",
+			status:   "RUNNING",
+			message:  "is not healthy and was left running.",
+		},
+		{
+			name:     "stopped before healthy",
+			outcome:  fakeOutcome{ExitCode: aws.Int64(2)},
+			exitCode: 2,
+			status:   "STOPPED",
+		},
+		{
+			name:    "timeout",
+			outcome: fakeOutcome{Running: 2 * fakeWaiterAttempts},
+			err:     "did not become healthy within 1m0s",
+			status:  "STOPPED",
+			message: "which is not healthy.",
+		},
+		{
+			name: "no health check",
+			args: []string{"-t", "app"},
+			err:  "--wait-healthy requires a health check on an essential container or on container web in task definition app",
+		},
+		{
+			name: "health check of a container that is not essential",
+			args: []string{"-t", "probe"},
+			err:  "--wait-healthy requires a health check on an essential container or on container app",
+		},
+		{
+			name:    "overridden container",
+			args:    []string{"-t", "probe", "-n", "probe"},
+			outcome: fakeOutcome{Health: ecs.HealthStatusHealthy, Running: 1},
+			status:  "RUNNING",
+			message: "is HEALTHY.",
+		},
+		{
+			name: "overridden container not healthy",
+			args: []string{"-t", "proxy", "-n", "proxy"},
+			outcome: fakeOutcome{Health: ecs.HealthStatusHealthy, Running: 2 * fakeWaiterAttempts,
+				ContainerHealth: map[string]ecs.HealthStatus{"proxy": ecs.HealthStatusUnknown}},
+			err:    "did not become healthy within 1m0s",
+			status: "STOPPED",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := newHealthBackend()
+			b.outcomes = []fakeOutcome{test.outcome}
+			args := append([]string{"-c", "main", "-t", "proxy", "--wait-healthy", "--health-timeout", "60"}, test.args...)
+			prefs := parseTestArgs(nil, args...).Args()
+			ctx, err := newTargetContext(&prefs, aws.Config{Region: "us-east-1"}, &Invocation{Backend: b},
+				Target{Cluster: "main"}, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			jobs, err := buildJobs(&prefs, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var out bytes.Buffer
+			restore := captureLog(&out, false)
+			result := runTask(&prefs, ctx, &jobs[0], NewTaskTracker())
+			restore()
+			if len(test.err) > 0 {
+				if result.Err == nil || !strings.Contains(result.Err.Error(), test.err) {
+					t.Fatalf("got error %v, want %q", result.Err, test.err)
+				}
+			} else if result.Err != nil {
+				t.Fatal(result.Err)
+			}
+			if len(result.TaskArn) == 0 {
+				return
+			}
+			if result.ExitCode != test.exitCode || !strings.Contains(result.Reason, test.reason) {
+				t.Errorf("got %d %q, want %d %q", result.ExitCode, result.Reason, test.exitCode, test.reason)
+			}
+			if got := aws.StringValue(b.task(result.TaskArn).LastStatus); got != test.status {
+				t.Errorf("got task status %s, want %s", got, test.status)
+			}
+			if !strings.Contains(out.String(), test.message) {
+				t.Errorf("got log %q, want %q", out.String(), test.message)
+			}
+		})
+	}
+}
@@ -0,0 +1,180 @@
+/*
+ * Copyright 2018 Mark Adamcin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	LogFormatRaw         = "raw"
+	LogFormatTimestamped = "timestamped"
+	LogFormatJson        = "json"
+)
+
+var LogFormats = []string{LogFormatRaw, LogFormatTimestamped, LogFormatJson}
+
+// the layout of event timestamps in the timestamped and json formats.
+const LogTimestampLayout = "2006-01-02T15:04:05.000Z07:00"
+
+// field names recognized in structured log lines, in order of preference.
+var (
+	logLevelKeys     = []string{"level", "lvl", "severity", "log.level"}
+	logMessageKeys   = []string{"message", "msg", "@message", "log"}
+	logTimestampKeys = []string{"time", "timestamp", "ts", "@timestamp"}
+)
+
+// ANSI escape sequences used when stdout is a terminal.
+const (
+	colorReset  = "\x1b[0m"
+	colorDim    = "\x1b[2m"
+	colorRed    = "\x1b[31m"
+	colorGreen  = "\x1b[32m"
+	colorYellow = "\x1b[33m"
+)
+
+// colors assigned to log line prefixes, so that the lines of concurrent tasks are easier to tell apart.
+var prefixColors = []string{"\x1b[36m", "\x1b[35m", "\x1b[34m", "\x1b[32m", "\x1b[33m", "\x1b[96m", "\x1b[95m", "\x1b[94m"}
+
+func ValidLogFormat(format string) bool {
+	for _, valid := range LogFormats {
+		if format == valid {
+			return true
+		}
+	}
+	return false
+}
+
+// UseColor returns true when log output should be colored: stdout is a terminal and NO_COLOR is not set.
+func UseColor() bool {
+	_, noColor := os.LookupEnv("NO_COLOR")
+	return !noColor && IsTerminal(os.Stdout)
+}
+
+func colorize(color string, text string, enabled bool) string {
+	if !enabled || len(text) == 0 {
+		return text
+	}
+	return color + text + colorReset
+}
+
+// prefixColor picks a stable color for a log line prefix.
+func prefixColor(prefix string) string {
+	sum := 0
+	for _, c := range prefix {
+		sum += int(c)
+	}
+	return prefixColors[sum%len(prefixColors)]
+}
+
+func levelColor(level string) string {
+	switch strings.ToLower(level) {
+	case "error", "err", "fatal", "critical", "crit", "panic", "alert", "emergency":
+		return colorRed
+	case "warn", "warning":
+		return colorYellow
+	case "info", "notice":
+		return colorGreen
+	}
+	return colorDim
+}
+
+// FormatLogEvent renders the message of a log event in the given format. The json format parses structured log lines
+// and renders their level, message and fields, falling back to the timestamped format for lines that are not JSON
+// objects. When fields is empty, every remaining field is rendered.
+func FormatLogEvent(event *cloudwatchlogs.FilteredLogEvent, format string, fields []string, color bool) string {
+	message := strings.TrimRight(*event.Message, "\r\n")
+	if format == LogFormatRaw || len(format) == 0 {
+		return message
+	}
+
+	timestamp := ""
+	if event.Timestamp != nil {
+		timestamp = time.Unix(0, *event.Timestamp*int64(time.Millisecond)).Format(LogTimestampLayout)
+	}
+	timestamp = colorize(colorDim, timestamp, color)
+
+	if format == LogFormatJson {
+		if rendered, ok := formatJsonMessage(message, fields, color); ok {
+			return timestamp + " " + rendered
+		}
+	}
+	return timestamp + " " + message
+}
+
+// popString removes the first of the keys present in the object, returning its value as a string.
+func popString(object map[string]interface{}, keys []string) string {
+	for _, key := range keys {
+		if value, ok := object[key]; ok {
+			delete(object, key)
+			if s, ok := value.(string); ok {
+				return s
+			}
+			data, _ := json.Marshal(value)
+			return string(data)
+		}
+	}
+	return ""
+}
+
+func formatJsonMessage(message string, fields []string, color bool) (string, bool) {
+	if !strings.HasPrefix(strings.TrimSpace(message), "{") {
+		return "", false
+	}
+	object := make(map[string]interface{})
+	if err := json.Unmarshal([]byte(message), &object); err != nil {
+		return "", false
+	}
+
+	level := popString(object, logLevelKeys)
+	text := popString(object, logMessageKeys)
+	popString(object, logTimestampKeys)
+
+	var words []string
+	if len(level) > 0 {
+		words = append(words, colorize(levelColor(level), fmt.Sprintf("%-5s", strings.ToUpper(level)), color))
+	}
+	if len(text) > 0 {
+		words = append(words, text)
+	}
+
+	keys := fields
+	if len(keys) == 0 {
+		for key := range object {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+	}
+	for _, key := range keys {
+		value, ok := object[key]
+		if !ok {
+			continue
+		}
+		rendered, isString := value.(string)
+		if !isString {
+			data, _ := json.Marshal(value)
+			rendered = string(data)
+		}
+		words = append(words, colorize(colorDim, key+"=", color)+rendered)
+	}
+	return strings.Join(words, " "), true
+}
@@ -19,55 +19,147 @@ package main
 import (
 	"errors"
 	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
 	"github.com/aws/aws-sdk-go-v2/service/ecs"
 	"github.com/hashicorp/golang-lru"
+	"io"
 	"log"
+	"os"
 	"strings"
 	"sync"
+	"time"
 )
 
 type AwslogsLocation struct {
 	LogGroupName  *string
 	LogStreamName *string
+
+	// region of the log group, when it differs from the region of the task.
+	Region string
 }
 
 const AwslogsKeyGroup = "awslogs-group"
+const AwslogsKeyRegion = "awslogs-region"
 const AwslogsKeyStreamPrefix = "awslogs-stream-prefix"
 
-func LocateAwslogsForTask(definition *ecs.ContainerDefinition, forTask *ecs.Task) (*AwslogsLocation, error) {
-	if definition != nil && definition.LogConfiguration.LogDriver == ecs.LogDriverAwslogs {
-		input := AwslogsLocation{}
-		options := definition.LogConfiguration.Options
+// the vendored SDK predates FireLens.
+const LogDriverAwsFirelens = ecs.LogDriver("awsfirelens")
 
-		if group, ok := options[AwslogsKeyGroup]; ok {
-			input.LogGroupName = &group
-		} else {
-			return nil, errors.New("container definition log options does not contain key " + AwslogsKeyGroup)
-		}
+// options of the fluent-bit CloudWatch Logs output, given as FireLens log configuration options.
+const FirelensKeyName = "Name"
+const FirelensKeyRegion = "region"
+const FirelensKeyGroup = "log_group_name"
+const FirelensKeyStreamPrefix = "log_stream_prefix"
+const FirelensKeyStreamName = "log_stream_name"
 
-		prefix, ok := options[AwslogsKeyStreamPrefix]
-		if !ok {
-			return nil, errors.New("log streaming requires the container definition to define the " + AwslogsKeyStreamPrefix)
-		}
+// names of the fluent-bit CloudWatch Logs outputs: the C plugin, and the older Go plugin.
+var FirelensCloudwatchOutputs = []string{"cloudwatch_logs", "cloudwatch"}
 
-		if forTask == nil || forTask.TaskArn == nil {
-			return nil, errors.New("failed to locate log stream without task arn")
-		}
+// ErrRuntimeIdRequired is returned for awslogs configurations without a stream prefix, whose streams are named for the
+// Docker ID of the container, until the container has started.
+var ErrRuntimeIdRequired = errors.New("the log stream is named for the container's Docker ID, which is unknown until it starts")
 
-		arnParts := strings.Split(*forTask.TaskArn, "/")
-		taskId := arnParts[len(arnParts)-1]
+// delay between FilterLogEvents requests while tailing a stream.
+const LogPollInterval = time.Second
 
-		if definition.Name == nil {
-			return nil, errors.New("failed to locate log stream without container name")
+// CheckLogConfiguration returns an error if the logs of containers with this definition cannot be located. Supported
+// configurations are the awslogs driver, and the awsfirelens driver with a CloudWatch Logs output.
+func CheckLogConfiguration(definition *ecs.ContainerDefinition) error {
+	if definition == nil || definition.LogConfiguration == nil {
+		return errors.New("no log configuration")
+	}
+	options := definition.LogConfiguration.Options
+	switch definition.LogConfiguration.LogDriver {
+	case ecs.LogDriverAwslogs:
+		if _, ok := options[AwslogsKeyGroup]; !ok {
+			return errors.New("container definition log options does not contain key " + AwslogsKeyGroup)
+		}
+	case LogDriverAwsFirelens:
+		output := options[FirelensKeyName]
+		supported := false
+		for _, name := range FirelensCloudwatchOutputs {
+			supported = supported || output == name
+		}
+		if !supported {
+			return fmt.Errorf("unsupported FireLens output %q, expected one of %s", output, FirelensCloudwatchOutputs)
+		}
+		if _, ok := options[FirelensKeyGroup]; !ok {
+			return errors.New("container definition log options does not contain key " + FirelensKeyGroup)
 		}
+		_, hasPrefix := options[FirelensKeyStreamPrefix]
+		_, hasName := options[FirelensKeyStreamName]
+		if !hasPrefix && !hasName {
+			return errors.New("container definition log options contain neither " + FirelensKeyStreamPrefix + " nor " + FirelensKeyStreamName)
+		}
+	default:
+		return errors.New("cannot stream logs for this log driver: " + string(definition.LogConfiguration.LogDriver))
+	}
+	return nil
+}
+
+// LocateAwslogsForTask names the CloudWatch Logs stream of a container of the task. Streams of awslogs configurations
+// without a stream prefix are named for the container's Docker ID, which must be given in runtimeIds by container name.
+// FireLens streams are named by the fluent-bit output, which tags the records of each container with
+// "<container>-firelens-<task ID>".
+func LocateAwslogsForTask(definition *ecs.ContainerDefinition, forTask *ecs.Task, runtimeIds map[string]string) (*AwslogsLocation, error) {
+	if err := CheckLogConfiguration(definition); err != nil {
+		return nil, err
+	}
+
+	if forTask == nil || forTask.TaskArn == nil {
+		return nil, errors.New("failed to locate log stream without task arn")
+	}
 
-		streamName := fmt.Sprintf("%s/%s/%s", prefix, *definition.Name, taskId)
-		input.LogStreamName = &streamName
+	arnParts := strings.Split(*forTask.TaskArn, "/")
+	taskId := arnParts[len(arnParts)-1]
 
-		return &input, nil
+	if definition.Name == nil {
+		return nil, errors.New("failed to locate log stream without container name")
 	}
-	return nil, errors.New("no awslog stream available")
+
+	input := AwslogsLocation{}
+	options := definition.LogConfiguration.Options
+	var streamName string
+	if definition.LogConfiguration.LogDriver == LogDriverAwsFirelens {
+		group := options[FirelensKeyGroup]
+		input.LogGroupName = &group
+		input.Region = options[FirelensKeyRegion]
+		if name, ok := options[FirelensKeyStreamName]; ok {
+			streamName = strings.Replace(name, "$(ecs_task_id)", taskId, -1)
+			streamName = strings.Replace(streamName, "$(container_name)", *definition.Name, -1)
+		} else {
+			streamName = options[FirelensKeyStreamPrefix] + *definition.Name + "-firelens-" + taskId
+		}
+	} else {
+		group := options[AwslogsKeyGroup]
+		input.LogGroupName = &group
+		input.Region = options[AwslogsKeyRegion]
+		if prefix, ok := options[AwslogsKeyStreamPrefix]; ok {
+			streamName = fmt.Sprintf("%s/%s/%s", prefix, *definition.Name, taskId)
+		} else if runtimeId, ok := runtimeIds[*definition.Name]; ok {
+			streamName = runtimeId
+		} else {
+			return nil, ErrRuntimeIdRequired
+		}
+	}
+	input.LogStreamName = &streamName
+	return &input, nil
+}
+
+// LogsConfig returns the AWS config for the region of the log group.
+func LogsConfig(awsCfg aws.Config, loc *AwslogsLocation) aws.Config {
+	if len(loc.Region) > 0 && loc.Region != awsCfg.Region {
+		cfg := awsCfg.Copy()
+		cfg.Region = loc.Region
+		return cfg
+	}
+	return awsCfg
+}
+
+// LogsClient returns a CloudWatch Logs client of the backend for the region of the log group.
+func LogsClient(backend Backend, awsCfg aws.Config, loc *AwslogsLocation) LogsAPI {
+	return backend.Logs(LogsConfig(awsCfg, loc))
 }
 
 func ErrorIsAlreadyExists(err error) bool {
@@ -78,17 +170,17 @@ func ErrorIsResourceNotFound(err error) bool {
 	return strings.HasPrefix(err.Error(), cloudwatchlogs.ErrCodeResourceNotFoundException)
 }
 
-func GetOrCreateStream(cws *cloudwatchlogs.CloudWatchLogs, loc *AwslogsLocation) (*cloudwatchlogs.LogStream, error) {
+func GetOrCreateStream(cws LogsAPI, loc *AwslogsLocation) (*cloudwatchlogs.LogStream, error) {
 	clgInput := cloudwatchlogs.CreateLogGroupInput{
 		LogGroupName: loc.LogGroupName}
-	if _, err := cws.CreateLogGroupRequest(&clgInput).Send(); err != nil && !ErrorIsAlreadyExists(err) {
+	if _, err := cws.CreateLogGroup(&clgInput); err != nil && !ErrorIsAlreadyExists(err) {
 		return nil, err
 	}
 
 	clsInput := cloudwatchlogs.CreateLogStreamInput{
 		LogGroupName:  loc.LogGroupName,
 		LogStreamName: loc.LogStreamName}
-	if _, err := cws.CreateLogStreamRequest(&clsInput).Send(); err != nil && !ErrorIsAlreadyExists(err) {
+	if _, err := cws.CreateLogStream(&clsInput); err != nil && !ErrorIsAlreadyExists(err) {
 		return nil, err
 	}
 
@@ -96,7 +188,7 @@ func GetOrCreateStream(cws *cloudwatchlogs.CloudWatchLogs, loc *AwslogsLocation)
 	logInput.LogGroupName = loc.LogGroupName
 	logInput.LogStreamNamePrefix = loc.LogStreamName
 
-	result, err := cws.DescribeLogStreamsRequest(&logInput).Send()
+	result, err := cws.DescribeLogStreams(&logInput)
 	if err != nil {
 		return nil, err
 	} else if len(result.LogStreams) > 0 {
@@ -106,41 +198,123 @@ func GetOrCreateStream(cws *cloudwatchlogs.CloudWatchLogs, loc *AwslogsLocation)
 	}
 }
 
-func GoTailLogs(s *cloudwatchlogs.CloudWatchLogs, l *AwslogsLocation, group *sync.WaitGroup) {
-	cache, _ := lru.New(10000)
-	firstRun := true
-	startTime := int64(0)
+// LogSink prints log event messages to stdout in the chosen format. Writes are serialized so that the lines of
+// concurrently tailed streams do not interleave. When Tee is set, the unformatted messages are also written to it.
+type LogSink struct {
+	Prefix string
+
+	// one of LogFormats. The empty string selects LogFormatRaw.
+	Format string
+
+	// fields rendered by LogFormatJson, in order. All fields are rendered when empty.
+	Fields []string
+
+	Color bool
+
+	// destination of formatted messages, which defaults to stdout.
+	Out io.Writer
+
+	Tee io.Writer
+}
+
+var logSinkLock sync.Mutex
+
+func (sink *LogSink) Write(event *cloudwatchlogs.FilteredLogEvent) {
+	logSinkLock.Lock()
+	defer logSinkLock.Unlock()
+	if sink.Tee != nil {
+		fmt.Fprintln(sink.Tee, sink.Prefix+*event.Message)
+	}
+	out := sink.Out
+	if out == nil {
+		out = os.Stdout
+	}
+	prefix := colorize(prefixColor(sink.Prefix), sink.Prefix, sink.Color)
+	fmt.Fprintln(out, prefix+FormatLogEvent(event, sink.Format, sink.Fields, sink.Color))
+}
+
+// LogQuery selects the events of a log stream to tail.
+type LogQuery struct {
+	Location *AwslogsLocation
+
+	// CloudWatch Logs filter pattern applied by FilterLogEvents.
+	FilterPattern string
+
+	// epoch milliseconds of the earliest event.
+	StartTime int64
+
+	// epoch milliseconds after which events are excluded, or 0 for no limit.
+	EndTime int64
+}
+
+// pageLogEvents writes the events selected by the query from startTime onwards to the sink, skipping events already in
+// the cache. Returns the timestamp of the latest event written.
+func pageLogEvents(s LogsAPI, q *LogQuery, startTime int64, cache *lru.Cache, sink *LogSink) (int64, error) {
+	// startTime advances as events are written, but every page must be requested with the same start time.
+	flInput := cloudwatchlogs.FilterLogEventsInput{
+		LogGroupName:   q.Location.LogGroupName,
+		LogStreamNames: []string{*q.Location.LogStreamName},
+		StartTime:      aws.Int64(startTime)}
+	if len(q.FilterPattern) > 0 {
+		flInput.FilterPattern = &q.FilterPattern
+	}
+	if q.EndTime > 0 {
+		flInput.EndTime = &q.EndTime
+	}
 
 	for {
-		flInput := cloudwatchlogs.FilterLogEventsInput{
-			LogGroupName:   l.LogGroupName,
-			LogStreamNames: []string{*l.LogStreamName},
-			StartTime:      &startTime}
-
-		eventsRequest := s.FilterLogEventsRequest(&flInput)
-		events := (&eventsRequest).Paginate()
-		for events.Next() {
-			eventsPage := events.CurrentPage()
-			for _, event := range eventsPage.Events {
-				if event.EventId == nil {
-					continue
-				}
-				if ok, _ := cache.ContainsOrAdd(*event.EventId, *event.EventId); !ok {
-					fmt.Println(*event.Message)
-					if *event.Timestamp > startTime {
-						startTime = *event.Timestamp
-					}
+		eventsPage, err := s.FilterLogEvents(&flInput)
+		if err != nil {
+			return startTime, err
+		}
+		for i, event := range eventsPage.Events {
+			if event.EventId == nil {
+				continue
+			}
+			if ok, _ := cache.ContainsOrAdd(*event.EventId, *event.EventId); !ok {
+				sink.Write(&eventsPage.Events[i])
+				if *event.Timestamp > startTime {
+					startTime = *event.Timestamp
 				}
 			}
 		}
+		if eventsPage.NextToken == nil {
+			return startTime, nil
+		}
+		flInput.NextToken = eventsPage.NextToken
+	}
+}
 
-		if events.Err() != nil {
-			if !ErrorIsResourceNotFound(events.Err()) {
-				log.Printf("WARNING: log stream error: %s\n", events.Err())
-			}
-		} else if firstRun {
-			firstRun = false
-			group.Done()
+// PrintLogs writes every event selected by the query to the sink.
+func PrintLogs(s LogsAPI, q *LogQuery, sink *LogSink) error {
+	cache, _ := lru.New(10000)
+	_, err := pageLogEvents(s, q, q.StartTime, cache, sink)
+	return err
+}
+
+// GoTailLogs pages log events to the sink until stop is closed, then makes one final pass to catch any events written
+// while the task was stopping. The group is notified when tailing is finished.
+func GoTailLogs(s LogsAPI, q *LogQuery, sink *LogSink, group *sync.WaitGroup, stop <-chan struct{}) {
+	defer group.Done()
+	cache, _ := lru.New(10000)
+	stopping := false
+	startTime := q.StartTime
+
+	for {
+		latest, err := pageLogEvents(s, q, startTime, cache, sink)
+		startTime = latest
+		if err != nil && !ErrorIsResourceNotFound(err) {
+			log.Printf("%sWARNING: log stream error: %s\n", sink.Prefix, err)
+		}
+
+		if stopping {
+			return
+		}
+
+		select {
+		case <-stop:
+			stopping = true
+		case <-time.After(LogPollInterval):
 		}
 	}
 }
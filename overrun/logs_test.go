@@ -0,0 +1,132 @@
+/*
+ * Copyright 2018 Mark Adamcin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestPrintLogs(t *testing.T) {
+	b := newFakeBackend()
+	loc := AwslogsLocation{LogGroupName: aws.String("/ecs/app"), LogStreamName: aws.String("app/web/1")}
+	for _, message := range []string{"one", "two", "three", "four", "five"} {
+		b.putLogEvent(*loc.LogGroupName, *loc.LogStreamName, message)
+	}
+	b.putLogEvent(*loc.LogGroupName, "app/web/2", "other")
+
+	tests := []struct {
+		name   string
+		filter string
+		want   string
+	}{
+		{name: "every page", want: "one\ntwo\nthree\nfour\nfive\n"},
+		{name: "filter pattern", filter: "o", want: "one\ntwo\nfour\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var out bytes.Buffer
+			err := PrintLogs(b, &LogQuery{Location: &loc, FilterPattern: test.filter}, &LogSink{Out: &out})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if out.String() != test.want {
+				t.Errorf("got %q, want %q", out.String(), test.want)
+			}
+		})
+	}
+}
+
+func TestGetOrCreateStream(t *testing.T) {
+	b := newFakeBackend()
+	loc := AwslogsLocation{LogGroupName: aws.String("/ecs/app"), LogStreamName: aws.String("app/web/1")}
+	for i := 0; i < 2; i++ {
+		stream, err := GetOrCreateStream(b, &loc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if aws.StringValue(stream.LogStreamName) != *loc.LogStreamName {
+			t.Errorf("got stream %s, want %s", aws.StringValue(stream.LogStreamName), *loc.LogStreamName)
+		}
+	}
+}
+
+func TestLocateTaskLogs(t *testing.T) {
+	b := newRunBackend()
+	b.addTaskDefinition(ecs.TaskDefinition{
+		Family: aws.String("worker"),
+		ContainerDefinitions: []ecs.ContainerDefinition{
+			{
+				Name:  aws.String("worker"),
+				Image: aws.String("example/worker:1.0"),
+				LogConfiguration: &ecs.LogConfiguration{
+					LogDriver: ecs.LogDriverAwslogs,
+					Options:   map[string]string{AwslogsKeyGroup: "/ecs/worker"}}}}})
+	cluster := aws.String("main")
+	started := make(map[string]string)
+	for _, family := range []string{"app", "worker"} {
+		b.outcomes = []fakeOutcome{{Running: 100}}
+		result, err := b.RunTask(&ecs.RunTaskInput{Cluster: cluster, TaskDefinition: aws.String(family)}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		started[family] = *result.Tasks[0].TaskArn
+		if err := b.WaitUntilTasksRunning(&ecs.DescribeTasksInput{Cluster: cluster, Tasks: []string{started[family]}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		task    string
+		taskDef string
+		stream  string
+		err     string
+	}{
+		{name: "stream prefix", task: started["app"], stream: "app/web/" + path.Base(started["app"])},
+		{name: "Docker ID", task: started["worker"], stream: path.Base(started["worker"]) + "-worker"},
+		{name: "forgotten task with a stream prefix", task: "0123abcd", taskDef: "app", stream: "app/web/0123abcd"},
+		{name: "forgotten task without a stream prefix", task: "0123abcd", taskDef: "worker", err: "no logs found"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			task, err := describeTaskForLogs(b, cluster, test.task, test.taskDef)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var out bytes.Buffer
+			restore := captureLog(&out, false)
+			logs, err := LocateTaskLogs(b, cluster, task, "")
+			restore()
+			if len(test.err) > 0 {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("got error %v, want %q", err, test.err)
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if len(logs) != 1 || aws.StringValue(logs[0].Location.LogStreamName) != test.stream {
+				t.Errorf("got logs %+v, want stream %s", logs, test.stream)
+			}
+		})
+	}
+}
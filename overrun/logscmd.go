@@ -0,0 +1,226 @@
+/*
+ * Copyright 2018 Mark Adamcin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// delay between checks of whether a followed task has stopped.
+const LogFollowInterval = 5 * time.Second
+
+// ParseTimeArg parses a --since or --until value, which is either a duration before now, such as 90m, 2h or 3d, or a
+// timestamp in RFC 3339 form, or a date.
+func ParseTimeArg(value string, now time.Time) (time.Time, error) {
+	if strings.HasSuffix(value, "d") {
+		if days, err := strconv.Atoi(strings.TrimSuffix(value, "d")); err == nil {
+			return now.AddDate(0, 0, -days), nil
+		}
+	}
+	if duration, err := time.ParseDuration(value); err == nil {
+		return now.Add(-duration), nil
+	}
+	if timestamp, err := time.Parse(time.RFC3339, value); err == nil {
+		return timestamp, nil
+	}
+	if date, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		return date, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time %s, expected a duration like 90m, 2h or 3d, an RFC 3339 timestamp, or a date", value)
+}
+
+// ContainerLog is the log stream of a single container of a task.
+type ContainerLog struct {
+	Name     string
+	Location *AwslogsLocation
+}
+
+// describeTaskForLogs describes the task, which ECS keeps describable for a while after it stops. Once it is gone, the
+// task definition given by --task-def stands in for it, which suffices for streams named after the task ID. The stand-in
+// has no LastStatus.
+func describeTaskForLogs(ecss EcsAPI, cluster *string, taskId string, taskDef string) (*ecs.Task, error) {
+	input := ecs.DescribeTasksInput{Cluster: cluster, Tasks: []string{taskId}}
+	result, err := ecss.DescribeTasks(&input)
+	if err != nil {
+		return nil, err
+	} else if len(result.Tasks) > 0 {
+		return &result.Tasks[0], nil
+	} else if len(taskDef) > 0 {
+		return &ecs.Task{TaskArn: &taskId, TaskDefinitionArn: &taskDef}, nil
+	}
+	return nil, fmt.Errorf("task %s not found. ECS forgets stopped tasks after a while; specify its --task-def to read its logs anyway", taskId)
+}
+
+// LocateTaskLogs finds the log stream of each container of the task, or only the named container.
+func LocateTaskLogs(ecss EcsAPI, cluster *string, task *ecs.Task, containerName string) ([]ContainerLog, error) {
+	dtdInput := ecs.DescribeTaskDefinitionInput{TaskDefinition: task.TaskDefinitionArn}
+	dtdResult, err := ecss.DescribeTaskDefinition(&dtdInput)
+	if err != nil {
+		return nil, err
+	}
+
+	var logs []ContainerLog
+	var availNames []string
+	var runtimeIds map[string]string
+	for i := range dtdResult.TaskDefinition.ContainerDefinitions {
+		definition := &dtdResult.TaskDefinition.ContainerDefinitions[i]
+		availNames = append(availNames, *definition.Name)
+		if len(containerName) > 0 && containerName != *definition.Name {
+			continue
+		}
+		loc, err := LocateAwslogsForTask(definition, task, runtimeIds)
+		if err == ErrRuntimeIdRequired && runtimeIds == nil {
+			// streams of awslogs configurations without a prefix are named for the Docker ID of each container, which
+			// a task that ECS has forgotten no longer has.
+			runtimeIds = make(map[string]string)
+			if task.LastStatus != nil {
+				if runtimeIds, err = ecss.ContainerRuntimeIds(cluster, *task.TaskArn); err != nil {
+					return nil, err
+				}
+			}
+			loc, err = LocateAwslogsForTask(definition, task, runtimeIds)
+		}
+		if err != nil {
+			log.Printf("WARNING: no logs for container %s: %s\n", *definition.Name, err)
+			continue
+		}
+		logs = append(logs, ContainerLog{Name: *definition.Name, Location: loc})
+	}
+
+	if len(logs) == 0 && len(containerName) > 0 && len(availNames) > 0 {
+		return nil, fmt.Errorf("no logs found for container %s. Available names: %s", containerName, availNames)
+	} else if len(logs) == 0 {
+		return nil, fmt.Errorf("no logs found for task %s", *task.TaskArn)
+	}
+	return logs, nil
+}
+
+// logsCommand runs the logs subcommand, which prints the logs of a task, running or stopped.
+func logsCommand(args []string) {
+	parser := loadCommandArgs("logs", args)
+	prefs := parser.Args()
+	if len(parser.Positional) != 1 {
+		usage()
+		log.Fatal("Specify the ID or ARN of a single task.")
+	} else if len(prefs.Clusters) > 1 || len(prefs.AwsRegions) > 1 {
+		log.Fatal("Specify at most one --cluster and one --region.")
+	}
+
+	awsCfg := loadAwsConfig(&prefs)
+	if len(prefs.AwsRegions) > 0 {
+		awsCfg.Region = prefs.AwsRegions[0]
+	}
+	var cluster *string
+	if len(prefs.Clusters) > 0 {
+		cluster = &prefs.Clusters[0]
+	}
+
+	now := time.Now()
+	query := LogQuery{FilterPattern: prefs.LogFilter}
+	if len(prefs.LogsSince) > 0 {
+		since, err := ParseTimeArg(prefs.LogsSince, now)
+		if err != nil {
+			log.Fatal(err)
+		}
+		query.StartTime = since.UnixNano() / int64(time.Millisecond)
+	}
+	if len(prefs.LogsUntil) > 0 {
+		until, err := ParseTimeArg(prefs.LogsUntil, now)
+		if err != nil {
+			log.Fatal(err)
+		}
+		query.EndTime = until.UnixNano() / int64(time.Millisecond)
+	}
+
+	backend := AwsBackend{NoWaiterDelay: prefs.NoWaiterDelay}
+	ecss := backend.Ecs(awsCfg)
+	task, err := describeTaskForLogs(ecss, cluster, parser.Positional[0], prefs.TaskDef)
+	if err != nil {
+		log.Fatal(err)
+	}
+	logs, err := LocateTaskLogs(ecss, cluster, task, prefs.ContainerName)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	clients := make([]LogsAPI, len(logs))
+	sinks := make([]*LogSink, len(logs))
+	queries := make([]LogQuery, len(logs))
+	for i, containerLog := range logs {
+		prefix := ""
+		if len(logs) > 1 {
+			prefix = "[" + containerLog.Name + "] "
+		}
+		clients[i] = LogsClient(backend, awsCfg, containerLog.Location)
+		sinks[i] = newLogSink(&prefs, prefix)
+		queries[i] = query
+		queries[i].Location = containerLog.Location
+	}
+
+	if prefs.LogsFollow && task.LastStatus == nil {
+		log.Printf("WARNING: task %s is no longer known to ECS, so its logs are not followed\n", *task.TaskArn)
+	}
+	if !prefs.LogsFollow || task.LastStatus == nil {
+		for i := range logs {
+			if err := PrintLogs(clients[i], &queries[i], sinks[i]); err != nil {
+				if ErrorIsResourceNotFound(err) {
+					log.Printf("WARNING: log stream %s not found\n", *logs[i].Location.LogStreamName)
+				} else {
+					log.Fatal(err)
+				}
+			}
+		}
+		return
+	}
+
+	var tailGroup sync.WaitGroup
+	stopTail := make(chan struct{})
+	for i := range logs {
+		tailGroup.Add(1)
+		go GoTailLogs(clients[i], &queries[i], sinks[i], &tailGroup, stopTail)
+	}
+
+	// follow until the task stops, or until interrupted.
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT)
+	describeInput := ecs.DescribeTasksInput{Cluster: cluster, Tasks: []string{*task.TaskArn}}
+FollowLoop:
+	for aws.StringValue(task.LastStatus) != "STOPPED" {
+		select {
+		case <-sigs:
+			break FollowLoop
+		case <-time.After(LogFollowInterval):
+		}
+		result, err := ecss.DescribeTasks(&describeInput)
+		if err != nil {
+			log.Printf("WARNING: %s\n", err)
+		} else if len(result.Tasks) > 0 {
+			task = &result.Tasks[0]
+		}
+	}
+	close(stopTail)
+	tailGroup.Wait()
+}
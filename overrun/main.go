@@ -17,46 +17,144 @@
 package main
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/aws/external"
-	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
 	"github.com/aws/aws-sdk-go-v2/service/ecs"
 	"log"
 	"os"
 	"os/signal"
 	"path/filepath"
-	"runtime"
-	"strconv"
 	"strings"
-	"sync"
 	"syscall"
+	"time"
 )
 
 func usage() {
-	argHelp := `%s -c cluster -t taskDef [ <opt> ... ] -- command [ <arg> ... ]
+	argHelp := `%[1]s [ @preset ... ] -c cluster ( -t taskDef | --task-def-file file ) [ <opt> ... ] -- command [ <arg> ... ]
+%[1]s profiles [ @preset ... ] [ <opt> ... ]
+%[1]s exec [ @preset ... ] -c cluster [ -n container ] <task> [ -- command [ <arg> ... ] ]
+%[1]s logs [ @preset ... ] -c cluster [ -n container ] [ --since t ] [ --until t ] [ -F | --follow ] <task>
+%[1]s forward [ @preset ... ] -c cluster [ -n container ] <task> [ localPort: ][ host: ]port
+%[1]s cp [ @preset ... ] -c cluster [ -n container ] ( <local> <task>:<path> | <task>:<path> <local> )
+%[1]s schedule [ @preset ... ] --name name --cron expr --schedule-role arn -c cluster -t taskDef [ <opt> ... ] -- command [ <arg> ... ]
+%[1]s schedule ls | rm <name>
   -h | --help                   : print this help message
+  @preset                       : Apply the named preset from the nearest .overrun.yml file, searching from the current directory up
+                                  to $HOME. Presets map long option names to values. Options given on the command line override them.
+  profiles                      : List the presets in the nearest .overrun.yml file, or print the effective settings of a preset merged
+                                  with the other options.
+  exec                          : Open an ECS Exec session with a container of a running task, attached to this terminal, and run
+                                  the command, which defaults to /bin/sh. The task must have been run with --enable-execute-command.
+  logs                          : Print the logs of every container of a task, or only the container given by -n, whether the task is
+                                  running or stopped. Once ECS no longer describes a stopped task, give its -t task definition as well.
+       --since | --until <t>    : Limit logs to a range of time, given as a duration before now (90m, 2h, 3d), an RFC 3339 timestamp,
+                                  or a date.
+  -F | --follow                 : Keep printing new log events until the task stops.
+  forward                       : Listen on a local port and forward its connections through a Session Manager session to a port of a
+                                  running task, or of a host reachable from it, until interrupted. The local port defaults to the
+                                  remote port, and the host to the task itself. The task must have been run with
+                                  --enable-execute-command.
+  cp                            : Copy a file or directory into or out of a container of a running task through ECS Exec sessions,
+                                  in chunks checked by sha256. The container needs sh, base64, sha256sum, dd and tar.
+  schedule                      : Create or update an EventBridge rule that runs the task with the same overrides and network
+                                  configuration on a schedule, with a target for each cluster. ls lists the rules created by overrun
+                                  schedule in each --region, and rm deletes a rule and its targets.
+       --name <name>            : Name of the schedule's EventBridge rule.
+       --cron <expr>            : Schedule expression: cron(...), rate(...), or the six fields of a cron expression.
+       --schedule-role <arn>    : Role that EventBridge assumes to run the task. It must allow ecs:RunTask and iam:PassRole.
   -p | --profile                : set AWS profile
-  -r | --region                 : set AWS region
+  -r | --region                 : set AWS region. Accepts a comma-separated list, and may be repeated, to run the task in each region.
+       --role-arn <arn>         : Assume the role with the credentials of the profile, and use its credentials instead. They are
+                                  cached in the user cache directory until they expire.
+       --role-session-name <n>  : Name of the role session, recorded by CloudTrail. (default: overrun-$USER)
+       --external-id <id>       : External ID required by the trust policy of the --role-arn.
+       --mfa-serial <arn>       : Serial number or ARN of the MFA device required by the trust policy of the --role-arn. The token
+                                  code is prompted for on the terminal when there are no cached credentials.
+       --duration <d>           : Lifetime of the role session, as a duration like 1h or a number of seconds. (default: 15m)
+       --endpoint-url <url>     : Send requests for every AWS service to the URL, such as that of a local AWS emulator. S3 buckets
+                                  are then addressed by path.
+       --ecs-endpoint <url>     : Send ECS requests to the URL, instead of --endpoint-url. --ec2-endpoint and --logs-endpoint do the
+                                  same for EC2 and CloudWatch Logs.
+       --no-waiter-delay        : Poll for task state changes without the delays between attempts that suit the ECS API, for
+                                  emulators whose tasks change state at once.
   -t | --task-def               : Base ECS task definition/family/ARN (see aws ecs run-task help for --task-definition)
-  -c | --cluster                : ECS Cluster on which to run the task.
+                                  A revision may also be selected as family@image-tag=<tag>, the newest revision whose container image
+                                  has the tag, family@tag:<key>=<value>, the newest revision with the tag, or family@service=<name>,
+                                  the revision deployed by the service on the cluster. The selected revision is printed.
+       --task-def-file          : Register a task definition from a JSON file in the format of aws ecs register-task-definition
+                                  --cli-input-json, replacing ${VAR} references with values from this command's environment.
+       --deregister             : Deregister the task definition registered from --task-def-file once the task is submitted.
+  -c | --cluster                : ECS Cluster on which to run the task. Accepts a comma-separated list, and may be repeated, to run the task
+                                  on each cluster in each region.
+                                  When -c or -t is omitted in a terminal, the cluster, task definition family and container are chosen
+                                  from lists filtered by typing, and the equivalent command line is printed.
+       --targets <file>         : Run the task on each cluster@region target listed in the file, one per line.
+       --parallel-targets       : Run on all targets at once, rather than one after another. Logs are prefixed by target.
   -n | --container-name         : Specify name of container definition to override. By default, will use the first found in base task definition.
   -x | --dry-run                : Construct aws-cli command but print command instead of running it.
+       --emit docker            : Print an equivalent docker run command for trying the task locally, instead of running it. Features
+                                  of the task definition that do not translate to docker, like awsvpc networking, task roles and
+                                  secrets, are listed as warnings.
   -w | --wait                   : Run task and wait for completion.
   -l | --stream-log             : Run task and begin tailing log stream.
+       --wait-healthy           : Run task and wait until ECS reports it HEALTHY, then print the address of each container: the
+                                  private IP of the task's ENI with its container ports, or the IP of the container instance with the
+                                  host ports bound to the container. overrun then exits with 0, leaving the task running, unless -w
+                                  or -l keeps it waiting. An UNHEALTHY task exits with 43. A task that is not healthy in time is
+                                  stopped, unless -w is given. Requires a container health check.
+       --health-timeout <d>     : How long --wait-healthy waits, as a duration like 90s or 10m, or a number of seconds. (default: 5m)
+       --log-format <format>    : Format of streamed log events: raw (default), timestamped, or json, which renders the level, message and
+                                  fields of structured log lines. Output is colored when stdout is a terminal, unless NO_COLOR is set.
+       --log-fields <f1,f2>     : Fields rendered by --log-format json, in order. All fields are rendered by default.
+       --log-filter <pattern>   : Stream only the log events matching the CloudWatch Logs filter pattern.
+       --log-file <path>        : Also write the complete, unformatted and unfiltered log stream to the file.
+       --log-json               : Write overrun's own messages on stderr as JSON objects, one per line, with the level, event type,
+                                  cluster and task ARN of each. The log stream on stdout is unchanged.
+       --price-table <file>     : JSON file of Fargate prices by region, replacing the embedded prices used to estimate the cost of
+                                  each Fargate task that is waited on. See README.md for the format.
+       --stdin                  : Read this command's stdin and pipe it to the task command, which is wrapped in a shell script to do so.
+                                  Small input is passed in an environment variable. Larger input is uploaded to the --staging location
+                                  and downloaded by the task using curl or wget. The upload is deleted after the task stops.
+       --artifact <path:local>  : After the task command exits, archive the container path and upload it to the --staging location using
+                                  curl, then download it to the local path. May be repeated. The command keeps its exit code.
+       --staging <s3://b/prefix>: S3 location for staging task input and output.
+       --enable-execute-command : Run the task with ECS Exec enabled, so that overrun exec can open sessions with its containers.
+       --interactive            : Run the task with ECS Exec enabled, keep its container alive with "sleep", and open a session
+                                  running the command given after -- (default: /bin/sh) attached to this terminal. The task is
+                                  stopped when the session ends.
   -e | --env <name[=value]>     : Override environment variables. If =value is not specified, the value for the specified name will be read from this
                                   command's environment.
        --env-file               : Override container environment variables using a specifed env-file. 
+       --env-s3 <arn>           : Add an environment file from S3, given as arn:aws:s3:::bucket/key.env, which ECS reads with the task
+                                  execution role. The object is checked with that role when it can be assumed. May be repeated.
+       --resource-requirement <type=value>
+                                : Override a container resource requirement, such as GPU=1. May be repeated.
        --cpu                    : Override container CPU requirement. 
        --mem                    : Override container Memory limit.
        --mem-res                : Override container Memory Reservation.
+       --tag <key=value>        : Tag the task. May be repeated. Tags under the top-level tags key of the nearest .overrun.yml file are
+                                  applied to every task, with ${VAR} references replaced from this command's environment.
+       --propagate-tags <p>     : Propagate the tags of the TASK_DEFINITION to the task, or NONE.
+       --group <group>          : Name of the task group, which defaults to family:<task definition family>.
+       --enable-ecs-managed-tags: Tag the task with its cluster name and task definition family, for cost allocation.
+       --reference-id <id>      : Reference ID of the task, such as a CI job ID, recorded with the task for auditing.
+       --capacity-provider <name[:weight[:base]]>
+                                : Run the task with a capacity provider strategy, such as FARGATE_SPOT, instead of a launch type.
+                                  The weight defaults to 1. May be repeated.
        --exec-role              : Override the associated Execution Role ARN.
        --task-role              : Override the associated Task Role ARN.
        --shell <prefix>         : Specify a shell to use to run the command. Must be a prefix for running a single-quoted string argument as a
                                   command, which will be appended with a leading space after construction.
        --no-shell               : Disable quoting as a shell command. Overrides --shell preference.
+       --count <n>              : Run n copies of the task, each with OVERRUN_INDEX (0 to n-1) and OVERRUN_COUNT set in its environment.
+       --commands-file <file>   : Run one task for each line of the file, which overrides the container command. Lines are quoted
+                                  according to --shell and --no-shell. OVERRUN_INDEX and OVERRUN_COUNT are also set.
+       --parallel <p>           : Run at most p tasks at once when using --count or --commands-file. (default: 1)
+                                  Tasks are submitted as capacity allows, and always waited on. Logs are prefixed by task index.
 
   -- <command> [ <arg> ... ]    : Override the task container command, 
 
@@ -69,8 +167,13 @@ FARGATE                         : Specifying the following arguments implies usi
   -f:host | --fargate:host      : Build network configuration to match a running EC2 instance. This will set desired security groups and subnets based on
                                   the particular configuration of the host.
   -f:sg	  | --fargate:sg        : Specify additional security groups by 'sg-' ID or by tag=value, to be attached to the task.
+
+ENVIRONMENT                     : Each of the following variables supplies a default for an option. Options given on the command line
+                                  override the environment, which overrides presets. Switches accept true or false. Options taking
+                                  several values, like --fargate:net and --env, accept a whitespace-separated list.
 `
 	fmt.Printf(argHelp, filepath.Base(os.Args[0]))
+	PrintEnvOptions(os.Stdout)
 }
 
 const (
@@ -80,20 +183,103 @@ const (
 )
 
 type ParsedArgs struct {
-	AwsProfile, AwsRegion string
+	AwsProfile string
+
+	AwsRegions []string
+
+	// role assumed with the credentials of the profile.
+	RoleArn         string
+	RoleSessionName string
+	ExternalId      string
+	MfaSerial       string
+	RoleDuration    time.Duration
+
+	// endpoint of every AWS service, and of ECS, EC2 and CloudWatch Logs in particular.
+	EndpointUrl  string
+	EcsEndpoint  string
+	Ec2Endpoint  string
+	LogsEndpoint string
+
+	NoWaiterDelay bool
+
+	Clusters []string
+
+	TargetsFile string
 
-	Cluster string
+	ParallelTargets bool
 
 	TaskDef string
 
+	TaskDefFile string
+
+	DeregisterTaskDef bool
+
 	ContainerName string
 
 	Environment map[string]string
 
+	EnvironmentFiles []S3Object
+
+	ResourceRequirements []ResourceRequirement
+
+	// the capacity provider strategy of the task, which replaces its launch type.
+	CapacityProviders []CapacityProvider
+
+	Tags map[string]string
+
+	PropagateTags ecs.PropagateTags
+
+	Group string
+
+	EnableEcsManagedTags bool
+
+	ReferenceId string
+
 	DryRun bool
 
 	WaitStopped, StreamLog bool
 
+	// wait for the task to report HEALTHY, for up to HealthTimeout.
+	WaitHealthy   bool
+	HealthTimeout time.Duration
+
+	EnableExecuteCommand bool
+
+	Interactive bool
+
+	Stdin bool
+
+	StagingUrl string
+
+	Artifacts []ArtifactSpec
+
+	LogFormat string
+
+	LogFields []string
+
+	LogFilter string
+
+	LogFile string
+
+	// write overrun's own diagnostics to stderr as JSON.
+	LogJSON bool
+
+	LogsSince string
+
+	LogsUntil string
+
+	LogsFollow bool
+
+	Emit string
+
+	PriceTable string
+
+	ScheduleName string
+
+	ScheduleExpression string
+
+	ScheduleRoleArn string
+
 	Cpu int64
 
 	Memory int64
@@ -132,443 +318,368 @@ type ParsedArgs struct {
 	OverridesCmd bool
 
 	CmdOverride []string
+
+	Count int
+
+	CommandsFile string
+
+	Parallel int
 }
 
-const NoOptPrefix = "--no-"
-
-func parseArgs() ParsedArgs {
-	awsProfile := ""
-	awsRegion := ""
-	taskDef := ""
-	cluster := ""
-	containerName := ""
-	dryRun := false
-	streamLog := false
-	waitStopped := false
-	execRoleArn := ""
-	taskRoleArn := ""
-	shellPrefix := ""
-	noShell := false
-
-	cpu := int64(0)
-	memory := int64(0)
-	memoryReservation := int64(0)
-
-	var envOverrides []string
-
-	overridesCmd := false
-	var cmdOverride []string
-
-	launchFargate := false
-	netPublicIp := false
-
-	filterMode := FilterModeCluster
-
-	var anyFilters []ec2.Filter
-	var vpcFilters []ec2.Filter
-	doFilterVpc := false
-	var vpcSgFilters []ec2.Filter
-	doFilterSgs := false
-	var vpcNetFilters []ec2.Filter
-	var vpcHostFilters []ec2.Filter
-
-	readFilterArgs := func(defaultFilter *string, optToEnd ...string) (int, []ec2.Filter) {
-		var filters []ec2.Filter
-		for _, optArg := range optToEnd {
-			valid, filter := ParseEc2Filter(optArg, defaultFilter)
-			if valid {
-				filters = append(filters, filter)
-			} else {
-				break
-			}
-		}
-		return len(filters), filters
-	}
-
-ArgLoop:
-	for i := 1; i < len(os.Args); i++ {
-		opt := os.Args[i]
-		isNoOpt := strings.HasPrefix(opt, NoOptPrefix)
-		if isNoOpt {
-			opt = "--" + strings.TrimPrefix(opt, NoOptPrefix)
-		}
-
-		if strings.HasPrefix(opt, "-f:") || strings.HasPrefix(opt, "--fargate:") {
-			launchFargate = true
-		}
-
-		switch opt {
-		case "-p", "--profile":
-			awsProfile = os.Args[i+1]
-			i++
-		case "-r", "--region":
-			awsRegion = os.Args[i+1]
-			i++
-		case "-t", "--task-def", "--task-definition":
-			taskDef = os.Args[i+1]
-			i++
-		case "-c", "--cluster":
-			cluster = os.Args[i+1]
-			i++
-		case "-n", "--container-name":
-			containerName = os.Args[i+1]
-			i++
-		case "--cpu":
-			ival, ierr := strconv.ParseInt(os.Args[i+1], 10, 64)
-			if ierr != nil {
-				log.Fatalf("Invalid CPU value: %s", ierr)
-			} else {
-				cpu = ival
-			}
-			i++
-		case "--mem":
-			ival, ierr := strconv.ParseInt(os.Args[i+1], 10, 64)
-			if ierr != nil {
-				log.Fatalf("Invalid Memory value: %s", ierr)
-			} else {
-				memory = ival
-			}
-			i++
-		case "--mem-res":
-			ival, ierr := strconv.ParseInt(os.Args[i+1], 10, 64)
-			if ierr != nil {
-				log.Fatalf("Invalid Memory value: %s", ierr)
-			} else {
-				memoryReservation = ival
-			}
-			i++
-		case "-e", "--env":
-			val, err := ValidateEnv(os.Args[i+1])
-			i++
-			if err != nil {
-				log.Fatal(err)
-			} else {
-				envOverrides = append(envOverrides, val)
-			}
-		case "--env-file":
-			vals, err := ParseEnvFile(os.Args[i+1])
-			i++
-			if err != nil {
-				log.Fatal(err)
-			} else {
-				envOverrides = append(envOverrides, vals...)
-			}
-		case "-x", "--dry-run":
-			dryRun = !isNoOpt
-		case "-l", "--stream-log":
-			streamLog = !isNoOpt
-		case "-w", "--wait":
-			waitStopped = !isNoOpt
-		case "-h", "--help":
-			usage()
-			os.Exit(0)
-		case "--exec-role":
-			execRoleArn = os.Args[i+1]
-			i++
-		case "--task-role":
-			taskRoleArn = os.Args[i+1]
-			i++
-		case "--shell":
-			noShell = isNoOpt
-			if !isNoOpt {
-				shellPrefix = os.Args[i+1]
-				i++
-			}
-		case "-f", "--fargate":
-			launchFargate = !isNoOpt
-			parsed, filters := readFilterArgs(nil, os.Args[i+1:]...)
-			anyFilters = append(anyFilters, filters...)
-			i = i + parsed
-		case "-f:sg", "--fargate:sg":
-			doFilterSgs = !isNoOpt
-			parsed, filters := readFilterArgs(aws.String(FilterTagName), os.Args[i+1:]...)
-			vpcSgFilters = append(vpcSgFilters, filters...)
-			i = i + parsed
-		case "-f:vpc", "--fargate:vpc":
-			doFilterVpc = !isNoOpt
-			parsed, filters := readFilterArgs(aws.String(FilterTagName), os.Args[i+1:]...)
-			vpcFilters = append(vpcFilters, filters...)
-			i = i + parsed
-		case "-f:ip", "--fargate:ip":
-			netPublicIp = !isNoOpt
-		case "-f:net", "--fargate:net":
-			filterMode = FilterModeNetwork
-			parsed, filters := readFilterArgs(aws.String(FilterTagName), os.Args[i+1:]...)
-			vpcNetFilters = append(vpcNetFilters, filters...)
-			i = i + parsed
-		case "-f:host", "--fargate:host":
-			filterMode = FilterModeHost
-			parsed, filters := readFilterArgs(aws.String(FilterTagName), os.Args[i+1:]...)
-			vpcHostFilters = append(vpcHostFilters, filters...)
-			i = i + parsed
-		case "--":
-			overridesCmd = true
-			cmdOverride = append(cmdOverride, os.Args[i+1:]...)
-			break ArgLoop
-		default:
-			usage()
-			log.Fatalf("Invalid option: \"%s\"", opt)
-		}
-	}
-
-	return ParsedArgs{
-		AwsProfile:        awsProfile,
-		AwsRegion:         awsRegion,
-		TaskDef:           taskDef,
-		Cluster:           cluster,
-		ContainerName:     containerName,
-		DryRun:            dryRun,
-		StreamLog:         streamLog,
-		WaitStopped:       waitStopped,
-		Cpu:               cpu,
-		Memory:            memory,
-		MemoryReservation: memoryReservation,
-		Environment:       ConvertKVStringsToMap(envOverrides),
-		ExecRoleArn:       execRoleArn,
-		TaskRoleArn:       taskRoleArn,
-		ShellPrefix:       shellPrefix,
-		NoShell:           noShell,
-		LaunchFargate:     launchFargate,
-		FilterMode:        filterMode,
-		AnyFilters:        anyFilters,
-		VpcFilters:        vpcFilters,
-		DoFilterVpc:       doFilterVpc,
-		VpcSgFilters:      vpcSgFilters,
-		DoFilterSgs:       doFilterSgs,
-		VpcNetFilters:     vpcNetFilters,
-		VpcHostFilters:    vpcHostFilters,
-		NetPublicIp:       netPublicIp,
-		OverridesCmd:      overridesCmd,
-		CmdOverride:       cmdOverride}
+// IsFanOut returns true when more than one task may be run by this invocation.
+func (prefs *ParsedArgs) IsFanOut() bool {
+	return prefs.Count > 0 || len(prefs.CommandsFile) > 0
 }
 
-func sigintStopTask(sigs chan os.Signal, s *ecs.ECS, taskArn *string, cluster *string) {
-	// create the stop-task input before waiting on sigs, so that it is ready to send ASAP.
-	stopInput := ecs.StopTaskInput{
-		Cluster: cluster,
-		Reason:  aws.String("overrun SIGINT"),
-		Task:    taskArn}
+func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "profiles":
+			profilesCommand(os.Args[2:])
+			return
+		case "exec":
+			execCommand(os.Args[2:])
+			return
+		case "logs":
+			logsCommand(os.Args[2:])
+			return
+		case "forward":
+			forwardCommand(os.Args[2:])
+			return
+		case "cp":
+			cpCommand(os.Args[2:])
+			return
+		case "schedule":
+			scheduleCommand(os.Args[2:])
+			return
+		}
+	}
+
+	parser := loadArgs("", os.Args[1:])
+	prefs := parser.Args()
+	if prefs.DryRun {
+		var settings bytes.Buffer
+		PrintEffectiveArgs(&settings, parser)
+		log.Print("Effective settings\n" + settings.String())
+	}
+
+	if err := applyDefaultTags(&prefs); err != nil {
+		log.Fatal(err)
+	}
 
-SignalLoop:
-	for {
-		req := s.StopTaskRequest(&stopInput)
+	awsCfg := loadAwsConfig(&prefs)
 
-		sig, ok := <-sigs
-		if !ok {
-			break SignalLoop
+	missingTaskDef := len(prefs.TaskDef) == 0 && len(prefs.TaskDefFile) == 0
+	missingCluster := len(prefs.Clusters) == 0 && len(prefs.TargetsFile) == 0
+	if (missingTaskDef || missingCluster) && CanPick() {
+		if err := pickMissingArgs(&prefs, awsCfg, os.Args[1:]); err != nil {
+			log.Fatal(err)
 		}
+	}
 
-		if sig == syscall.SIGINT {
-			if _, err := req.Send(); err != nil {
-				// sigint
-				log.Printf("ERROR: SIGINT failed to stop task %s! keep mashing that ctrl-c!\n", *taskArn)
-			} else {
-				// detach from SIGINT.
-				signal.Stop(sigs)
-				log.Printf("user requested to stop task %s using ctrl-c/SIGINT\n", *taskArn)
-			}
+	if len(prefs.TaskDef) == 0 && len(prefs.TaskDefFile) == 0 {
+		log.Fatal("You must specify a --task-def or a --task-def-file.")
+	} else if len(prefs.TaskDef) > 0 && len(prefs.TaskDefFile) > 0 {
+		log.Fatal("Specify only one of --task-def or --task-def-file.")
+	}
+
+	targets, targetsErr := buildTargets(&prefs)
+	if targetsErr != nil {
+		log.Fatal(targetsErr)
+	} else if len(targets) == 0 {
+		log.Fatal("No --cluster specified. Specify 'default' to run on the the default cluster.")
+	}
+
+	if prefs.IsFanOut() {
+		if prefs.Count > 0 && len(prefs.CommandsFile) > 0 {
+			log.Fatal("Specify only one of --count or --commands-file.")
 		}
+		// bounded concurrency depends on knowing when each task stops.
+		prefs.WaitStopped = true
 	}
-}
 
-func main() {
-	prefs := parseArgs()
+	if prefs.Interactive {
+		if prefs.IsFanOut() || len(targets) > 1 {
+			log.Fatal("--interactive runs a single task on a single target.")
+		} else if prefs.WaitHealthy {
+			log.Fatal("--wait-healthy cannot be used with --interactive.")
+		}
+		prefs.EnableExecuteCommand = true
+	}
 
-	if len(prefs.TaskDef) == 0 {
-		log.Fatal("You must specify a --task-def.")
+	if len(prefs.Emit) > 0 {
+		emitCommand(&prefs, awsCfg, targets)
+		return
 	}
 
-	var awsCfg aws.Config
-	if len(prefs.AwsProfile) > 0 {
-		cfg, err := external.LoadDefaultAWSConfig(
-			external.WithSharedConfigProfile(prefs.AwsProfile))
+	var staging *StagingRun
+	if len(prefs.StagingUrl) > 0 {
+		location, err := ParseStagingUrl(prefs.StagingUrl)
 		if err != nil {
 			log.Fatal(err)
 		}
-		awsCfg = cfg
-	} else {
-		cfg, err := external.LoadDefaultAWSConfig()
+		staging = NewStagingRun(awsCfg, location)
+	}
+
+	var stdin *StdinInput
+	if prefs.Stdin {
+		if prefs.Interactive {
+			log.Fatal("--stdin cannot be used with --interactive.")
+		}
+		input, err := prepareStdin(&prefs, staging)
 		if err != nil {
 			log.Fatal(err)
 		}
-		awsCfg = cfg
+		stdin = input
+		if stdin.Staged {
+			// the upload is deleted once the tasks have stopped.
+			prefs.WaitStopped = true
+		}
 	}
 
-	if len(prefs.AwsRegion) > 0 {
-		awsCfg.Region = prefs.AwsRegion
+	if len(prefs.Artifacts) > 0 {
+		if staging == nil {
+			log.Fatal("--artifact requires a --staging location.")
+		} else if prefs.Interactive {
+			log.Fatal("--artifact cannot be used with --interactive.")
+		}
+		// artifacts are fetched once each task has stopped.
+		prefs.WaitStopped = true
 	}
 
-	dtdInput := ecs.DescribeTaskDefinitionInput{TaskDefinition: &prefs.TaskDef}
-	ecss := ecs.New(awsCfg)
-	dtdResult, dtdErr := ecss.DescribeTaskDefinitionRequest(&dtdInput).Send()
-	if dtdErr != nil {
-		log.Fatal(dtdErr)
+	jobs, jobsErr := buildJobs(&prefs, stdin)
+	if jobsErr != nil {
+		log.Fatal(jobsErr)
 	}
 
-	taskDefinition := dtdResult.TaskDefinition
-	var containerDef *ecs.ContainerDefinition
-	if len(prefs.ContainerName) == 0 {
-		if len(taskDefinition.ContainerDefinitions) > 0 {
-			containerDef = &dtdResult.TaskDefinition.ContainerDefinitions[0]
-			prefs.ContainerName = *containerDef.Name
-		} else {
-			log.Fatalf("No container definitions found for task def %s\n", prefs.TaskDef)
-		}
-	} else {
-		matched := false
-		var availNames []string
-		for _, contDef := range taskDefinition.ContainerDefinitions {
-			availNames = append(availNames, *contDef.Name)
-			if prefs.ContainerName == *contDef.Name {
-				containerDef = &contDef
-				matched = true
-			}
-		}
-		if !matched {
-			log.Fatalf("No container definition found with specified image name %s. Available names: %s\n", prefs.ContainerName, availNames)
-		}
+	tracker := NewTaskTracker()
+	if !prefs.DryRun && (prefs.WaitStopped || prefs.StreamLog || prefs.Interactive) {
+		// attach sigint handler to stop submitted tasks
+		sigs := make(chan os.Signal, 1)
+		go sigintStopTasks(sigs, tracker)
+		signal.Notify(sigs, syscall.SIGINT)
 	}
 
-	if containerDef == nil {
-		log.Fatal("Failed to retrieve a container definition.")
+	prices, pricesErr := LoadPriceTable(prefs.PriceTable)
+	if pricesErr != nil {
+		log.Fatal(pricesErr)
 	}
 
-	if containerDef.LogConfiguration != nil {
-		driver := (*containerDef.LogConfiguration).LogDriver
-		if prefs.StreamLog && driver != ecs.LogDriverAwslogs {
-			log.Printf("WARNING: Cannot stream logs for this log driver: %s\n", driver)
-			prefs.StreamLog = false
+	inv := Invocation{Staging: staging, Prices: prices, Backend: AwsBackend{NoWaiterDelay: prefs.NoWaiterDelay}}
+	if len(prefs.LogFile) > 0 {
+		logFile, err := os.Create(prefs.LogFile)
+		if err != nil {
+			log.Fatal(err)
 		}
+		defer logFile.Close()
+		inv.LogFile = logFile
 	}
 
-	if len(prefs.Cluster) == 0 {
-		log.Fatal("No --cluster specified. Specify 'default' to run on the the default cluster.")
+	targetResults := runTargets(&prefs, awsCfg, &inv, targets, jobs, tracker)
+	if staging != nil {
+		staging.Cleanup()
 	}
 
-	ctx := ExecutionContext{
-		AwsConfig:           &awsCfg,
-		TaskDefinition:      taskDefinition,
-		ContainerDefinition: containerDef,
-		AnyFilters:          prefs.AnyFilters}
-
-	if prefs.DryRun {
-		log.Println("ANY Filters")
-		for _, filter := range prefs.AnyFilters {
-			log.Println(filter)
-		}
-		log.Println("VPC Filters")
-		for _, filter := range prefs.VpcFilters {
-			log.Println(filter)
-		}
-		log.Println("SG Filters")
-		for _, filter := range prefs.VpcSgFilters {
-			log.Println(filter)
+	if len(targets) == 1 && !prefs.IsFanOut() {
+		targetResult := targetResults[0]
+		if targetResult.Err != nil {
+			log.Fatal(targetResult.Err)
+		} else if prefs.DryRun {
+			os.Exit(0)
 		}
-		log.Println("NET Filters")
-		for _, filter := range prefs.VpcNetFilters {
-			log.Println(filter)
+		result := targetResult.Results[0]
+		if result.Err != nil {
+			log.Fatal(result.Err)
 		}
-		log.Println("HOST Filters")
-		for _, filter := range prefs.VpcHostFilters {
-			log.Println(filter)
+		if len(result.Reason) > 0 && jsonLog == nil {
+			// the task-stopped event has the reason in JSON.
+			log.Println(result.Reason)
 		}
+		os.Exit(result.ExitCode)
 	}
 
-	runTaskInput, taskInputErr := buildRunTaskInput(&prefs, &ctx)
-	if taskInputErr != nil {
-		log.Fatal(taskInputErr)
+	if prefs.DryRun {
+		for _, targetResult := range targetResults {
+			if targetResult.Err != nil {
+				log.Printf("%s: %s\n", targetResult.Target, targetResult.Err)
+			}
+		}
+	} else if jsonLog == nil {
+		// each task-stopped event stands in for its row in JSON.
+		PrintSummary(os.Stderr, targetResults)
+	}
+	for _, targetResult := range targetResults {
+		if targetResult.Failed() {
+			os.Exit(1)
+		}
 	}
+}
 
-	if prefs.DryRun {
-		log.Println(runTaskInput.String())
+func loadAwsConfig(prefs *ParsedArgs) aws.Config {
+	var awsCfg aws.Config
+	if len(prefs.AwsProfile) > 0 {
+		cfg, err := external.LoadDefaultAWSConfig(
+			external.WithSharedConfigProfile(prefs.AwsProfile))
+		if err != nil {
+			log.Fatal(err)
+		}
+		awsCfg = cfg
 	} else {
-		out, err := ecss.RunTaskRequest(runTaskInput).Send()
+		cfg, err := external.LoadDefaultAWSConfig()
 		if err != nil {
 			log.Fatal(err)
 		}
+		awsCfg = cfg
+	}
+	resolver, err := NewEndpointResolver(prefs, awsCfg.EndpointResolver)
+	if err != nil {
+		log.Fatal(err)
+	} else if resolver != nil {
+		awsCfg.EndpointResolver = resolver
+	}
+	if len(prefs.RoleArn) > 0 {
+		awsCfg.Credentials = AssumeRoleCredentials(prefs, awsCfg)
+		// assume the role now, so that the MFA prompt comes before any output and a failure ends the command.
+		if _, err := awsCfg.Credentials.Retrieve(); err != nil {
+			log.Fatalf("failed to assume role %s: %s", prefs.RoleArn, err)
+		}
+	} else if len(prefs.RoleSessionName) > 0 || len(prefs.ExternalId) > 0 || len(prefs.MfaSerial) > 0 ||
+		prefs.RoleDuration > 0 {
+		log.Fatal("--role-session-name, --external-id, --mfa-serial and --duration require --role-arn.")
+	}
+	return awsCfg
+}
 
-		task := out.Tasks[0]
-		log.Printf("Submitted task %s on cluster %s.\n", *task.TaskArn, prefs.Cluster)
-		taskArnInput := ecs.DescribeTasksInput{Cluster: &prefs.Cluster, Tasks: []string{*task.TaskArn}}
-
-		if prefs.WaitStopped || prefs.StreamLog {
-
-			runtime.GOMAXPROCS(3) // signal + log stream + wait stopped (main)
-
-			// attach sigint handler to
-			sigs := make(chan os.Signal, 1)
-			go sigintStopTask(sigs, ecss, task.TaskArn, &prefs.Cluster)
-			signal.Notify(sigs, syscall.SIGINT)
+// resolveTaskDefinition describes the task definition, or registers it from the --task-def-file, and selects the
+// container definition to override.
+func resolveTaskDefinition(prefs *ParsedArgs, ctx *ExecutionContext) error {
+	if len(prefs.TaskDefFile) > 0 {
+		rtdInput, rtdErr := LoadTaskDefinitionFile(prefs.TaskDefFile)
+		if rtdErr != nil {
+			return rtdErr
+		}
 
-			if prefs.WaitStopped {
-				err := ecss.WaitUntilTasksStopped(&taskArnInput)
-				if err != nil {
-					log.Fatal(err)
-				}
+		if prefs.DryRun || len(prefs.Emit) > 0 {
+			if prefs.DryRun {
+				log.Println(rtdInput.String())
 			}
+			ctx.TaskDefinition = TaskDefinitionFromInput(rtdInput)
+			ctx.TaskDef = *rtdInput.Family
+		} else {
+			rtdResult, err := ctx.Ecs.RegisterTaskDefinition(rtdInput)
+			if err != nil {
+				return err
+			}
+			ctx.TaskDefinition = rtdResult.TaskDefinition
+			ctx.TaskDef = *ctx.TaskDefinition.TaskDefinitionArn
+			registered := TaskEvent(ctx, nil, "task-definition-registered", "")
+			registered.TaskDefinition = ctx.TaskDef
+			registered.Printf("Registered task definition %s.", ctx.TaskDef)
+		}
+	} else {
+		selector, err := ParseTaskDefSelector(prefs.TaskDef)
+		if err != nil {
+			return err
+		} else if selector != nil {
+			arn, err := SelectTaskDefinition(ctx.Ecs, ctx.Target.Cluster, selector, prefs.ContainerName)
+			if err != nil {
+				return err
+			}
+			ctx.TaskDef = arn
+			selected := TaskEvent(ctx, nil, "task-definition-selected", "")
+			selected.TaskDefinition = arn
+			selected.Printf("Selected task definition %s for %s.", arn, selector)
+		}
 
-			if prefs.StreamLog {
-				// extrapolate the cloudwatch stream name
-				loc, locErr := LocateAwslogsForTask(containerDef, &task)
-				if locErr != nil {
-					log.Fatal(locErr)
-				}
-
-				// attempt to pre-create the log stream to avoid missing resource failures
-				cws := cloudwatchlogs.New(*ctx.AwsConfig)
-				_, streamErr := GetOrCreateStream(cws, loc)
-				if streamErr != nil {
-					log.Printf("WARNING: %s\n", streamErr)
-				}
-
-				// start paging events to standard out in separate thread.
-				// use the wait group to notify when at least one getLogEvents
-				// response has been received.
-				var wg sync.WaitGroup
-				wg.Add(1)
-				go GoTailLogs(cws, loc, &wg)
-
-				// wait for task to stop for good
-				err := ecss.WaitUntilTasksStopped(&taskArnInput)
-				if err != nil {
-					log.Fatal(err)
-				}
+		dtdInput := ecs.DescribeTaskDefinitionInput{TaskDefinition: &ctx.TaskDef}
+		dtdResult, dtdErr := ctx.Ecs.DescribeTaskDefinition(&dtdInput)
+		if dtdErr != nil {
+			return dtdErr
+		}
+		ctx.TaskDefinition = dtdResult.TaskDefinition
+	}
 
-				// now wait for the GoTailLogs routine to notify completion of at least one filter-log-events request
-				wg.Wait()
-
-				// describe task final state to report reason and exit code of primary container
-				describeResult, describeErr := ecss.DescribeTasksRequest(&taskArnInput).Send()
-				if describeErr != nil {
-					log.Fatal(describeErr)
-				} else {
-					finalTask := describeResult.Tasks[0]
-					for _, cnt := range finalTask.Containers {
-						if *cnt.Name == prefs.ContainerName {
-							exitCode := 0
-							if cnt.Reason != nil {
-								exitCode = 42
-								log.Println(*cnt.Reason)
-							}
-							if cnt.ExitCode != nil && int(*cnt.ExitCode) > 0 {
-								os.Exit(int(*cnt.ExitCode))
-							} else {
-								os.Exit(exitCode)
-							}
-						}
-					}
-					log.Fatalln(finalTask.StoppedReason)
-				}
+	taskDefinition := ctx.TaskDefinition
+	if len(prefs.ContainerName) == 0 {
+		if len(taskDefinition.ContainerDefinitions) > 0 {
+			ctx.ContainerDefinition = &taskDefinition.ContainerDefinitions[0]
+		} else {
+			return fmt.Errorf("no container definitions found for task def %s", ctx.TaskDef)
+		}
+	} else {
+		var availNames []string
+		for i, contDef := range taskDefinition.ContainerDefinitions {
+			availNames = append(availNames, *contDef.Name)
+			if prefs.ContainerName == *contDef.Name {
+				ctx.ContainerDefinition = &taskDefinition.ContainerDefinitions[i]
 			}
 		}
+		if ctx.ContainerDefinition == nil {
+			return fmt.Errorf("no container definition found with specified image name %s. Available names: %s", prefs.ContainerName, availNames)
+		}
+	}
+	return nil
+}
+
+func logDryRunFilters(prefs *ParsedArgs) {
+	log.Println("ANY Filters")
+	for _, filter := range prefs.AnyFilters {
+		log.Println(filter)
+	}
+	log.Println("VPC Filters")
+	for _, filter := range prefs.VpcFilters {
+		log.Println(filter)
+	}
+	log.Println("SG Filters")
+	for _, filter := range prefs.VpcSgFilters {
+		log.Println(filter)
+	}
+	log.Println("NET Filters")
+	for _, filter := range prefs.VpcNetFilters {
+		log.Println(filter)
+	}
+	log.Println("HOST Filters")
+	for _, filter := range prefs.VpcHostFilters {
+		log.Println(filter)
+	}
+}
+
+func deregisterTaskDef(s EcsAPI, taskDef string) {
+	input := ecs.DeregisterTaskDefinitionInput{TaskDefinition: &taskDef}
+	if _, err := s.DeregisterTaskDefinition(&input); err != nil {
+		log.Printf("WARNING: failed to deregister task definition %s: %s\n", taskDef, err)
+	} else {
+		log.Printf("Deregistered task definition %s.\n", taskDef)
 	}
 }
 
 type ExecutionContext struct {
 	AwsConfig           *aws.Config
+	Target              Target
+	Label               string
+	TaskDef             string
 	TaskDefinition      *ecs.TaskDefinition
 	ContainerDefinition *ecs.ContainerDefinition
+	StreamLog           bool
 	AnyFilters          []ec2.Filter
+	RunTaskInput        *ecs.RunTaskInput
+
+	// clients for the region of the target, created by the Backend of the invocation.
+	Ecs EcsAPI
+	Ec2 Ec2API
+
+	// RunTask request members that the vendored SDK cannot express.
+	RunTaskExtras JSONMembers
+
+	*Invocation
+}
+
+// queryFilters returns a new slice of the filters followed by the filters of the context, so that concurrent targets
+// never append to the spare capacity of the slices in ParsedArgs.
+func queryFilters(ctx *ExecutionContext, filters []ec2.Filter) []ec2.Filter {
+	query := make([]ec2.Filter, 0, len(filters)+len(ctx.AnyFilters))
+	query = append(query, filters...)
+	return append(query, ctx.AnyFilters...)
 }
 
 func restrictToVpcs(prefs *ParsedArgs, ctx *ExecutionContext) (*ec2.Filter, error) {
@@ -576,9 +687,8 @@ func restrictToVpcs(prefs *ParsedArgs, ctx *ExecutionContext) (*ec2.Filter, erro
 		if len(prefs.VpcFilters) > 0 && *prefs.VpcFilters[0].Name == FilterVpcId {
 			return &prefs.VpcFilters[0], nil
 		}
-		ec2s := ec2.New(*ctx.AwsConfig)
-		input := ec2.DescribeVpcsInput{Filters: append(prefs.VpcFilters, ctx.AnyFilters...)}
-		result, err := ec2s.DescribeVpcsRequest(&input).Send()
+		input := ec2.DescribeVpcsInput{Filters: queryFilters(ctx, prefs.VpcFilters)}
+		result, err := ctx.Ec2.DescribeVpcs(&input)
 		if err != nil {
 			return nil, err
 		} else if len(result.Vpcs) > 0 {
@@ -604,10 +714,9 @@ func constructFargateVpcConfig(prefs *ParsedArgs, ctx *ExecutionContext) (ecs.Ne
 }
 
 func secGroupsQuery(ctx *ExecutionContext, filters []ec2.Filter) ([]string, error) {
-	ec2s := ec2.New(*ctx.AwsConfig)
-	input := ec2.DescribeSecurityGroupsInput{Filters: append(filters, ctx.AnyFilters...)}
+	input := ec2.DescribeSecurityGroupsInput{Filters: queryFilters(ctx, filters)}
 
-	result, err := ec2s.DescribeSecurityGroupsRequest(&input).Send()
+	result, err := ctx.Ec2.DescribeSecurityGroups(&input)
 	if err != nil {
 		return nil, err
 	} else {
@@ -620,14 +729,13 @@ func secGroupsQuery(ctx *ExecutionContext, filters []ec2.Filter) ([]string, erro
 }
 
 func vpcConfigForCluster(prefs *ParsedArgs, ctx *ExecutionContext) (ecs.NetworkConfiguration, error) {
-	ecss := ecs.New(*ctx.AwsConfig)
-	ciInput := ecs.ListContainerInstancesInput{Cluster: &prefs.Cluster}
-	ciResult, ciErr := ecss.ListContainerInstancesRequest(&ciInput).Send()
+	ciInput := ecs.ListContainerInstancesInput{Cluster: &ctx.Target.Cluster}
+	ciResult, ciErr := ctx.Ecs.ListContainerInstances(&ciInput)
 	if ciErr != nil {
 		return ecs.NetworkConfiguration{}, ciErr
 	} else if len(ciResult.ContainerInstanceArns) > 0 {
-		input := ecs.DescribeContainerInstancesInput{Cluster: &prefs.Cluster, ContainerInstances: ciResult.ContainerInstanceArns}
-		result, err := ecss.DescribeContainerInstancesRequest(&input).Send()
+		input := ecs.DescribeContainerInstancesInput{Cluster: &ctx.Target.Cluster, ContainerInstances: ciResult.ContainerInstanceArns}
+		result, err := ctx.Ecs.DescribeContainerInstances(&input)
 		if err != nil {
 			return ecs.NetworkConfiguration{}, err
 		} else if len(result.ContainerInstances) > 0 {
@@ -643,16 +751,14 @@ func vpcConfigForCluster(prefs *ParsedArgs, ctx *ExecutionContext) (ecs.NetworkC
 	}
 	return ecs.NetworkConfiguration{}, errors.New(
 		fmt.Sprintf("no describable container instances running in cluster %s. please specify --fargate:net or --fargate:host",
-			prefs.Cluster))
+			ctx.Target.Cluster))
 }
 
 func vpcConfigForNet(prefs *ParsedArgs, ctx *ExecutionContext, filters []ec2.Filter) (ecs.NetworkConfiguration, error) {
-	ec2s := ec2.New(*ctx.AwsConfig)
 	dsInput := ec2.DescribeSubnetsInput{}
-	dsInput.Filters = filters
-	dsInput.Filters = append(dsInput.Filters, ctx.AnyFilters...)
+	dsInput.Filters = queryFilters(ctx, filters)
 
-	dsResult, dsErr := ec2s.DescribeSubnetsRequest(&dsInput).Send()
+	dsResult, dsErr := ctx.Ec2.DescribeSubnets(&dsInput)
 	if dsErr != nil {
 		log.Println(dsInput.Filters[0].String())
 		return ecs.NetworkConfiguration{}, dsErr
@@ -691,12 +797,10 @@ func vpcConfigForNet(prefs *ParsedArgs, ctx *ExecutionContext, filters []ec2.Fil
 }
 
 func vpcConfigForHost(prefs *ParsedArgs, ctx *ExecutionContext, filters []ec2.Filter) (ecs.NetworkConfiguration, error) {
-	ec2s := ec2.New(*ctx.AwsConfig)
 	diInput := ec2.DescribeInstancesInput{}
-	diInput.Filters = filters
-	diInput.Filters = append(diInput.Filters, ctx.AnyFilters...)
+	diInput.Filters = queryFilters(ctx, filters)
 
-	diResult, diErr := ec2s.DescribeInstancesRequest(&diInput).Send()
+	diResult, diErr := ctx.Ec2.DescribeInstances(&diInput)
 	if diErr != nil {
 		return ecs.NetworkConfiguration{}, diErr
 	}
@@ -745,39 +849,73 @@ func constructCommand(prefs *ParsedArgs) []string {
 	if prefs.NoShell {
 		return prefs.CmdOverride
 	} else {
-		escaped := make([]string, len(prefs.CmdOverride))
-		for i, arg := range prefs.CmdOverride {
-			if strings.ContainsRune(arg, ' ') {
-				arg = fmt.Sprintf("\"%s\"", strings.Replace(arg, "\"", "\\\"", -1))
-			}
-			escaped[i] = arg
-		}
-		escapedStr := strings.Join(escaped, " ")
-		if len(prefs.ShellPrefix) > 0 && prefs.ShellPrefix != " " {
-			return []string{fmt.Sprintf("%s '%s'", prefs.ShellPrefix,
-				strings.Replace(escapedStr, "'", "'\"'\"'", -1))}
-		} else {
-			return []string{escapedStr}
-		}
+		return wrapShell(prefs, commandScript(prefs))
+	}
+}
+
+// commandScript joins the command given after -- into a single line for the shell. With --no-shell, each argument is
+// quoted so that the line can still be wrapped by features such as --stdin.
+func commandScript(prefs *ParsedArgs) string {
+	escaped := make([]string, len(prefs.CmdOverride))
+	for i, arg := range prefs.CmdOverride {
+		if prefs.NoShell {
+			arg = ShellQuote(arg)
+		} else if strings.ContainsRune(arg, ' ') {
+			arg = fmt.Sprintf("\"%s\"", strings.Replace(arg, "\"", "\\\"", -1))
+		}
+		escaped[i] = arg
 	}
+	return strings.Join(escaped, " ")
 }
 
-func buildOverrides(prefs *ParsedArgs) *ecs.TaskOverride {
+// shellCommand builds the command for a script that overrun has wrapped, which needs a shell even with --no-shell.
+func shellCommand(prefs *ParsedArgs, script string) []string {
+	if prefs.NoShell {
+		return []string{"sh", "-c", script}
+	}
+	return wrapShell(prefs, script)
+}
+
+// constructCommandLine builds a command from a line of text that is already escaped for the shell, such as a line of a
+// --commands-file. With --no-shell, the line is split on whitespace instead.
+func constructCommandLine(prefs *ParsedArgs, line string) []string {
+	if prefs.NoShell {
+		return strings.Fields(line)
+	} else {
+		return wrapShell(prefs, line)
+	}
+}
+
+func wrapShell(prefs *ParsedArgs, escapedStr string) []string {
+	if len(prefs.ShellPrefix) > 0 && prefs.ShellPrefix != " " {
+		return []string{fmt.Sprintf("%s '%s'", prefs.ShellPrefix,
+			strings.Replace(escapedStr, "'", "'\"'\"'", -1))}
+	} else {
+		return []string{escapedStr}
+	}
+}
+
+func buildOverrides(prefs *ParsedArgs, ctx *ExecutionContext, job *TaskJob) *ecs.TaskOverride {
 	tsk := ecs.TaskOverride{}
 	if len(prefs.ExecRoleArn) > 0 {
 		tsk.ExecutionRoleArn = &prefs.ExecRoleArn
 	}
 	if len(prefs.TaskRoleArn) > 0 {
-		tsk.TaskRoleArn = &prefs.ExecRoleArn
+		tsk.TaskRoleArn = &prefs.TaskRoleArn
 	}
 
-	cnt := ecs.ContainerOverride{Name: &prefs.ContainerName}
-	if prefs.OverridesCmd {
-		cnt.Command = constructCommand(prefs)
-	}
+	cnt := ecs.ContainerOverride{Name: ctx.ContainerDefinition.Name}
+	cnt.Command = job.Command
 
+	environment := make(map[string]string, len(prefs.Environment)+len(job.Environment))
 	for key, val := range prefs.Environment {
-		cnt.Environment = append(cnt.Environment, ecs.KeyValuePair{Name: &key, Value: &val})
+		environment[key] = val
+	}
+	for key, val := range job.Environment {
+		environment[key] = val
+	}
+	for key, val := range environment {
+		cnt.Environment = append(cnt.Environment, ecs.KeyValuePair{Name: aws.String(key), Value: aws.String(val)})
 	}
 
 	if prefs.Cpu > int64(0) {
@@ -796,8 +934,8 @@ func buildOverrides(prefs *ParsedArgs) *ecs.TaskOverride {
 
 func buildRunTaskInput(prefs *ParsedArgs, ctx *ExecutionContext) (*ecs.RunTaskInput, error) {
 	input := ecs.RunTaskInput{}
-	input.Cluster = &prefs.Cluster
-	input.TaskDefinition = &prefs.TaskDef
+	input.Cluster = &ctx.Target.Cluster
+	input.TaskDefinition = &ctx.TaskDef
 
 	if prefs.LaunchFargate {
 		vpcsFilter, err := restrictToVpcs(prefs, ctx)
@@ -818,7 +956,33 @@ func buildRunTaskInput(prefs *ParsedArgs, ctx *ExecutionContext) (*ecs.RunTaskIn
 	} else {
 		input.LaunchType = ecs.LaunchTypeEc2
 	}
+	if len(prefs.CapacityProviders) > 0 {
+		// RunTask rejects a launch type alongside a capacity provider strategy.
+		input.LaunchType = ""
+		ctx.RunTaskExtras = ctx.RunTaskExtras.Merge(capacityProviderStrategy(prefs.CapacityProviders))
+	}
+
+	if len(prefs.Tags) > 0 {
+		input.Tags = EcsTags(prefs.Tags)
+	}
+	input.PropagateTags = prefs.PropagateTags
+	if len(prefs.Group) > 0 {
+		input.Group = &prefs.Group
+	}
+	if prefs.EnableEcsManagedTags {
+		input.EnableECSManagedTags = aws.Bool(true)
+	}
+	if len(prefs.ReferenceId) > 0 {
+		ctx.RunTaskExtras = ctx.RunTaskExtras.Merge(JSONMembers{"referenceId": prefs.ReferenceId})
+	}
+
+	if prefs.EnableExecuteCommand {
+		ctx.RunTaskExtras = ctx.RunTaskExtras.Merge(JSONMembers{"enableExecuteCommand": true})
+	}
+
+	if extras := containerOverrideExtras(prefs); extras != nil {
+		ctx.RunTaskExtras = ctx.RunTaskExtras.Merge(extras)
+	}
 
-	input.Overrides = buildOverrides(prefs)
 	return &input, nil
 }
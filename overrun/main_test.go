@@ -0,0 +1,417 @@
+/*
+ * Copyright 2018 Mark Adamcin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func ec2Tags(kvs ...string) []ec2.Tag {
+	var tags []ec2.Tag
+	for i := 0; i+1 < len(kvs); i += 2 {
+		tags = append(tags, ec2.Tag{Key: aws.String(kvs[i]), Value: aws.String(kvs[i+1])})
+	}
+	return tags
+}
+
+// newNetworkBackend returns a fake with two VPCs. The main VPC has two private subnets and a public one, and the
+// other VPC a single private subnet. Cluster main has one container instance, in the first private subnet.
+func newNetworkBackend() *fakeBackend {
+	b := newFakeBackend()
+	b.vpcs = []ec2.Vpc{
+		{VpcId: aws.String("vpc-1"), Tags: ec2Tags("Name", "main")},
+		{VpcId: aws.String("vpc-2"), Tags: ec2Tags("Name", "other")}}
+	b.subnets = []ec2.Subnet{
+		{SubnetId: aws.String("subnet-a"), VpcId: aws.String("vpc-1"), AvailabilityZone: aws.String("us-east-1a"),
+			Tags: ec2Tags("Name", "private-a", "tier", "private")},
+		{SubnetId: aws.String("subnet-b"), VpcId: aws.String("vpc-1"), AvailabilityZone: aws.String("us-east-1b"),
+			Tags: ec2Tags("Name", "private-b", "tier", "private")},
+		{SubnetId: aws.String("subnet-c"), VpcId: aws.String("vpc-1"), AvailabilityZone: aws.String("us-east-1c"),
+			Tags: ec2Tags("Name", "public-c", "tier", "public")},
+		{SubnetId: aws.String("subnet-x"), VpcId: aws.String("vpc-2"), AvailabilityZone: aws.String("us-east-1a"),
+			Tags: ec2Tags("Name", "private-x", "tier", "private")}}
+	b.groups = []ec2.SecurityGroup{
+		{GroupId: aws.String("sg-1"), GroupName: aws.String("app"), VpcId: aws.String("vpc-1"), Tags: ec2Tags("Name", "app")},
+		{GroupId: aws.String("sg-2"), GroupName: aws.String("db"), VpcId: aws.String("vpc-1"), Tags: ec2Tags("Name", "db")},
+		{GroupId: aws.String("sg-9"), GroupName: aws.String("app"), VpcId: aws.String("vpc-2"), Tags: ec2Tags("Name", "app")}}
+	b.ec2Instances = []ec2.Instance{
+		{InstanceId: aws.String("i-1"), SubnetId: aws.String("subnet-a"), VpcId: aws.String("vpc-1"),
+			SecurityGroups: []ec2.GroupIdentifier{{GroupId: aws.String("sg-1")}}, Tags: ec2Tags("Name", "worker")},
+		{InstanceId: aws.String("i-2"), SubnetId: aws.String("subnet-x"), VpcId: aws.String("vpc-2"),
+			SecurityGroups: []ec2.GroupIdentifier{{GroupId: aws.String("sg-9")}}, Tags: ec2Tags("Name", "other-worker")}}
+	b.instances["main"] = []ecs.ContainerInstance{
+		{ContainerInstanceArn: aws.String(fakeAccountArn + "container-instance/main/1"), Ec2InstanceId: aws.String("i-1")}}
+	return b
+}
+
+// newTestContext returns a context for the cluster whose clients are those of the fake.
+func newTestContext(b *fakeBackend, prefs *ParsedArgs, cluster string) *ExecutionContext {
+	ctx := ExecutionContext{
+		AwsConfig:  &aws.Config{Region: "us-east-1"},
+		Target:     Target{Cluster: cluster},
+		TaskDef:    prefs.TaskDef,
+		StreamLog:  prefs.StreamLog,
+		AnyFilters: append([]ec2.Filter(nil), prefs.AnyFilters...),
+		Invocation: &Invocation{Backend: b}}
+	ctx.connect()
+	return &ctx
+}
+
+func TestConstructFargateVpcConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		cluster  string
+		args     []string
+		subnets  []string
+		groups   []string
+		publicIp bool
+		err      string
+	}{
+		{
+			name:    "cluster mode uses a container instance",
+			cluster: "main",
+			args:    []string{"--fargate"},
+			subnets: []string{"subnet-a"},
+			groups:  []string{"sg-1"},
+		},
+		{
+			name:    "cluster mode without container instances",
+			cluster: "empty",
+			args:    []string{"--fargate"},
+			err:     "no describable container instances running in cluster empty",
+		},
+		{
+			name:    "host mode by name tag",
+			args:    []string{"--fargate:host", "worker"},
+			subnets: []string{"subnet-a"},
+			groups:  []string{"sg-1"},
+		},
+		{
+			name:    "host mode adds filtered security groups",
+			args:    []string{"--fargate:host", "i-2", "--fargate:sg", "Name=group-name,Values=app"},
+			subnets: []string{"subnet-x"},
+			groups:  []string{"sg-1", "sg-9"},
+		},
+		{
+			name: "host mode without a match",
+			args: []string{"--fargate:host", "missing"},
+			err:  "failed to find instance matching filter",
+		},
+		{
+			name:    "net mode restricted to a vpc",
+			args:    []string{"--fargate:net", "tag:tier=private", "--fargate:vpc", "main"},
+			subnets: []string{"subnet-a", "subnet-b"},
+			groups:  []string{"sg-1", "sg-2"},
+		},
+		{
+			name:    "net mode uses the vpc of the first subnet",
+			args:    []string{"--fargate:net", "tag:tier=private", "--fargate:sg", "app"},
+			subnets: []string{"subnet-a", "subnet-b"},
+			groups:  []string{"sg-1", "sg-9"},
+		},
+		{
+			name:    "net mode with wildcards",
+			args:    []string{"--fargate:net", "Name=tag:Name,Values=private-*", "--fargate:vpc", "vpc-1", "--fargate:sg", "db"},
+			subnets: []string{"subnet-a", "subnet-b"},
+			groups:  []string{"sg-2"},
+		},
+		{
+			name:    "any filters apply to every query",
+			args:    []string{"--fargate", "vpc-id=vpc-2", "--fargate:net", "tag:tier=private"},
+			subnets: []string{"subnet-x"},
+			groups:  []string{"sg-9"},
+		},
+		{
+			name:     "public ip",
+			args:     []string{"--fargate:net", "subnet-c", "--fargate:sg", "sg-1", "--fargate:ip"},
+			subnets:  []string{"subnet-c"},
+			groups:   []string{"sg-1"},
+			publicIp: true,
+		},
+		{
+			name: "net mode without a match",
+			args: []string{"--fargate:net", "tag:tier=isolated"},
+			err:  "failed to find subnet matching filters: ",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			prefs := parseTestArgs(nil, test.args...).Args()
+			ctx := newTestContext(newNetworkBackend(), &prefs, test.cluster)
+			input, err := buildRunTaskInput(&prefs, ctx)
+			if len(test.err) > 0 {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("got error %v, want %q", err, test.err)
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			if input.LaunchType != ecs.LaunchTypeFargate {
+				t.Errorf("got launch type %s, want %s", input.LaunchType, ecs.LaunchTypeFargate)
+			}
+			awsvpc := input.NetworkConfiguration.AwsvpcConfiguration
+			subnets := append([]string{}, awsvpc.Subnets...)
+			groups := append([]string{}, awsvpc.SecurityGroups...)
+			sort.Strings(subnets)
+			sort.Strings(groups)
+			if !reflect.DeepEqual(subnets, test.subnets) {
+				t.Errorf("got subnets %q, want %q", subnets, test.subnets)
+			}
+			if !reflect.DeepEqual(groups, test.groups) {
+				t.Errorf("got security groups %q, want %q", groups, test.groups)
+			}
+			wantIp := ecs.AssignPublicIpDisabled
+			if test.publicIp {
+				wantIp = ecs.AssignPublicIpEnabled
+			}
+			if awsvpc.AssignPublicIp != wantIp {
+				t.Errorf("got assign public ip %s, want %s", awsvpc.AssignPublicIp, wantIp)
+			}
+		})
+	}
+}
+
+// barrierBackend holds every target in DescribeVpcs until all have reached it, so that the race detector sees what the
+// targets do next as concurrent, rather than ordered by the lock of the fake.
+type barrierBackend struct {
+	*fakeBackend
+
+	arrived *sync.WaitGroup
+}
+
+func (b barrierBackend) Ec2(cfg aws.Config) Ec2API {
+	return b
+}
+
+func (b barrierBackend) DescribeVpcs(input *ec2.DescribeVpcsInput) (*ec2.DescribeVpcsOutput, error) {
+	output, err := b.fakeBackend.DescribeVpcs(input)
+	b.arrived.Done()
+	b.arrived.Wait()
+	return output, err
+}
+
+// TestParallelTargetFilters builds the network configuration of several targets at once from filters given more than
+// once, whose slices have spare capacity that the targets must not share.
+func TestParallelTargetFilters(t *testing.T) {
+	b := newNetworkBackend()
+	b.addTaskDefinition(ecs.TaskDefinition{
+		Family:               aws.String("app"),
+		NetworkMode:          ecs.NetworkModeAwsvpc,
+		ContainerDefinitions: []ecs.ContainerDefinition{{Name: aws.String("web"), Image: aws.String("example/web:1.0")}}})
+	prefs := parseTestArgs(nil, "-t", "app", "--parallel-targets",
+		"--fargate", "vpc-1", "vpc-id=vpc-1,vpc-2", "--fargate", "vpc-id=vpc-1", "--fargate:vpc", "main",
+		"--fargate:net", "tag:tier=private", "private-*", "--fargate:net", "vpc-id=vpc-1", "--fargate:sg", "group-name=app,db").Args()
+	var targets []Target
+	for _, region := range []string{"us-east-1", "us-east-2", "us-west-1", "us-west-2"} {
+		targets = append(targets, Target{Cluster: "main", Region: region})
+	}
+	jobs, err := buildJobs(&prefs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var arrived sync.WaitGroup
+	arrived.Add(len(targets))
+	inv := Invocation{Backend: barrierBackend{b, &arrived}}
+	results := runTargets(&prefs, aws.Config{Region: "us-east-1"}, &inv, targets, jobs, NewTaskTracker())
+	for _, result := range results {
+		if result.Failed() {
+			t.Errorf("%s failed: %v", result.Target, result.Err)
+		}
+	}
+	if len(b.runTasks) != len(targets) {
+		t.Fatalf("got %d RunTask requests, want %d", len(b.runTasks), len(targets))
+	}
+	for _, run := range b.runTasks {
+		awsvpc := run.Input.NetworkConfiguration.AwsvpcConfiguration
+		subnets := append([]string{}, awsvpc.Subnets...)
+		groups := append([]string{}, awsvpc.SecurityGroups...)
+		sort.Strings(subnets)
+		sort.Strings(groups)
+		if !reflect.DeepEqual(subnets, []string{"subnet-a", "subnet-b"}) || !reflect.DeepEqual(groups, []string{"sg-1", "sg-2"}) {
+			t.Errorf("got subnets %q and security groups %q", subnets, groups)
+		}
+	}
+	if want := []ec2.Filter{filter("vpc-id", "vpc-1"), filter("vpc-id", "vpc-1", "vpc-2"), filter("vpc-id", "vpc-1")}; !reflect.DeepEqual(prefs.AnyFilters, want) {
+		t.Errorf("got filters %s, want %s", prefs.AnyFilters, want)
+	}
+}
+
+func keyValuePairs(kvs ...string) []ecs.KeyValuePair {
+	var pairs []ecs.KeyValuePair
+	for i := 0; i+1 < len(kvs); i += 2 {
+		pairs = append(pairs, ecs.KeyValuePair{Name: aws.String(kvs[i]), Value: aws.String(kvs[i+1])})
+	}
+	return pairs
+}
+
+func TestBuildOverrides(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		job  TaskJob
+		want ecs.TaskOverride
+	}{
+		{
+			name: "container only",
+			want: ecs.TaskOverride{ContainerOverrides: []ecs.ContainerOverride{{Name: aws.String("web")}}},
+		},
+		{
+			name: "job command",
+			job:  TaskJob{Command: []string{"echo hello"}},
+			want: ecs.TaskOverride{ContainerOverrides: []ecs.ContainerOverride{
+				{Name: aws.String("web"), Command: []string{"echo hello"}}}},
+		},
+		{
+			name: "job environment overrides prefs",
+			args: []string{"-e", "A=1", "-e", "B=2"},
+			job:  TaskJob{Environment: map[string]string{"B": "3", "OVERRUN_INDEX": "0"}},
+			want: ecs.TaskOverride{ContainerOverrides: []ecs.ContainerOverride{
+				{Name: aws.String("web"), Environment: keyValuePairs("A", "1", "B", "3", "OVERRUN_INDEX", "0")}}},
+		},
+		{
+			name: "sizes",
+			args: []string{"--cpu", "256", "--mem", "512", "--mem-res", "128"},
+			want: ecs.TaskOverride{ContainerOverrides: []ecs.ContainerOverride{
+				{Name: aws.String("web"), Cpu: aws.Int64(256), Memory: aws.Int64(512), MemoryReservation: aws.Int64(128)}}},
+		},
+		{
+			name: "roles",
+			args: []string{"--exec-role", "arn:aws:iam::123456789012:role/exec", "--task-role", "arn:aws:iam::123456789012:role/task"},
+			want: ecs.TaskOverride{
+				ExecutionRoleArn:   aws.String("arn:aws:iam::123456789012:role/exec"),
+				TaskRoleArn:        aws.String("arn:aws:iam::123456789012:role/task"),
+				ContainerOverrides: []ecs.ContainerOverride{{Name: aws.String("web")}}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			prefs := parseTestArgs(nil, test.args...).Args()
+			ctx := ExecutionContext{ContainerDefinition: &ecs.ContainerDefinition{Name: aws.String("web")}}
+			got := buildOverrides(&prefs, &ctx, &test.job)
+			for _, cnt := range got.ContainerOverrides {
+				sort.Slice(cnt.Environment, func(i, j int) bool {
+					return *cnt.Environment[i].Name < *cnt.Environment[j].Name
+				})
+			}
+			if !reflect.DeepEqual(*got, test.want) {
+				t.Errorf("got\n%s\nwant\n%s", got, test.want)
+			}
+		})
+	}
+}
+
+// jsonEqual compares the JSON encodings of the values, ignoring the order of object members.
+func jsonEqual(t *testing.T, got interface{}, want string) bool {
+	data, err := json.Marshal(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var gotValue, wantValue interface{}
+	if err := json.Unmarshal(data, &gotValue); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(want), &wantValue); err != nil {
+		t.Fatal(err)
+	}
+	return reflect.DeepEqual(gotValue, wantValue)
+}
+
+func TestBuildRunTaskInput(t *testing.T) {
+	tests := []struct {
+		name   string
+		args   []string
+		check  func(input *ecs.RunTaskInput) bool
+		extras string
+	}{
+		{
+			name: "ec2 launch type",
+			check: func(input *ecs.RunTaskInput) bool {
+				return input.LaunchType == ecs.LaunchTypeEc2 && *input.Cluster == "main" && *input.TaskDefinition == "app" &&
+					input.NetworkConfiguration == nil && input.Tags == nil
+			},
+			extras: "null",
+		},
+		{
+			name: "tags sorted by key",
+			args: []string{"--tag", "b=2", "--tag", "a=1", "--propagate-tags", "TASK_DEFINITION", "--group", "batch"},
+			check: func(input *ecs.RunTaskInput) bool {
+				return reflect.DeepEqual(input.Tags, EcsTags(map[string]string{"a": "1", "b": "2"})) &&
+					*input.Tags[0].Key == "a" && input.PropagateTags == ecs.PropagateTagsTaskDefinition &&
+					aws.StringValue(input.Group) == "batch"
+			},
+			extras: "null",
+		},
+		{
+			name: "members the SDK cannot express",
+			args: []string{"--reference-id", "deploy-42", "--enable-execute-command", "--enable-ecs-managed-tags"},
+			check: func(input *ecs.RunTaskInput) bool {
+				return aws.BoolValue(input.EnableECSManagedTags)
+			},
+			extras: `{"referenceId": "deploy-42", "enableExecuteCommand": true}`,
+		},
+		{
+			name: "container override members",
+			args: []string{"--env-s3", "arn:aws:s3:::config/app.env", "--resource-requirement", "GPU=1"},
+			check: func(input *ecs.RunTaskInput) bool {
+				return input.Overrides == nil
+			},
+			extras: `{"overrides": {"containerOverrides": [{
+				"environmentFiles": [{"value": "arn:aws:s3:::config/app.env", "type": "s3"}],
+				"resourceRequirements": [{"type": "GPU", "value": "1"}]}]}}`,
+		},
+		{
+			name: "capacity provider strategy",
+			args: []string{"--capacity-provider", "FARGATE_SPOT:3", "--capacity-provider", "FARGATE:1:2"},
+			check: func(input *ecs.RunTaskInput) bool {
+				return len(input.LaunchType) == 0
+			},
+			extras: `{"capacityProviderStrategy": [
+				{"capacityProvider": "FARGATE_SPOT", "weight": 3},
+				{"capacityProvider": "FARGATE", "weight": 1, "base": 2}]}`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			prefs := parseTestArgs(nil, append([]string{"-t", "app"}, test.args...)...).Args()
+			ctx := newTestContext(newNetworkBackend(), &prefs, "main")
+			input, err := buildRunTaskInput(&prefs, ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !test.check(input) {
+				t.Errorf("unexpected input:\n%s", input)
+			}
+			if !jsonEqual(t, ctx.RunTaskExtras, test.extras) {
+				t.Errorf("got extras %s, want %s", ctx.RunTaskExtras, test.extras)
+			}
+		})
+	}
+}
@@ -0,0 +1,282 @@
+/*
+ * Copyright 2018 Mark Adamcin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Agents that multiplex port forwarding sessions carry many TCP connections over one data channel, framed by the
+// smux protocol (github.com/xtaci/smux), as the session-manager-plugin does. The client opens a stream for each
+// connection it accepts, and the agent dials the forwarded port for each stream. This file implements version 1 of
+// that framing, which is the version both ends use.
+
+const MuxVersion = 1
+
+// commands of mux frames.
+const (
+	MuxCmdSyn = 0
+	MuxCmdFin = 1
+	MuxCmdPsh = 2
+	MuxCmdNop = 3
+)
+
+// the layout of a mux frame header: version, command, little-endian payload length and stream ID.
+const (
+	muxHeaderLength  = 8
+	muxMaxFrameBytes = 32768
+)
+
+// how often a NOP frame is sent, which keeps agents that time out idle mux sessions from closing them.
+const MuxKeepAliveInterval = 10 * time.Second
+
+// Mux multiplexes streams over the input of a session. The session's output is written to the Mux, which splits it
+// into frames for each stream.
+type Mux struct {
+	// where frames are written, usually a Session.
+	Out io.Writer
+
+	writeLock sync.Mutex
+
+	lock sync.Mutex
+
+	streams map[uint32]*MuxStream
+
+	nextId uint32
+
+	closed bool
+
+	// the incomplete frame at the end of the last output written.
+	partial []byte
+}
+
+func NewMux(out io.Writer) *Mux {
+	return &Mux{Out: out, streams: make(map[uint32]*MuxStream), nextId: 1}
+}
+
+// writeFrame writes a whole frame at once, so that the frames of concurrent streams are not interleaved.
+func (m *Mux) writeFrame(cmd byte, id uint32, payload []byte) error {
+	frame := make([]byte, muxHeaderLength+len(payload))
+	frame[0] = MuxVersion
+	frame[1] = cmd
+	binary.LittleEndian.PutUint16(frame[2:4], uint16(len(payload)))
+	binary.LittleEndian.PutUint32(frame[4:8], id)
+	copy(frame[muxHeaderLength:], payload)
+	m.writeLock.Lock()
+	defer m.writeLock.Unlock()
+	_, err := m.Out.Write(frame)
+	return err
+}
+
+// Open starts a new stream.
+func (m *Mux) Open() (*MuxStream, error) {
+	m.lock.Lock()
+	if m.closed {
+		m.lock.Unlock()
+		return nil, io.ErrClosedPipe
+	}
+	m.nextId += 2
+	stream := &MuxStream{Id: m.nextId, mux: m}
+	stream.cond = sync.NewCond(&stream.lock)
+	m.streams[stream.Id] = stream
+	m.lock.Unlock()
+
+	if err := m.writeFrame(MuxCmdSyn, stream.Id, nil); err != nil {
+		m.remove(stream.Id)
+		return nil, err
+	}
+	return stream, nil
+}
+
+func (m *Mux) remove(id uint32) {
+	m.lock.Lock()
+	delete(m.streams, id)
+	m.lock.Unlock()
+}
+
+func (m *Mux) stream(id uint32) *MuxStream {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.streams[id]
+}
+
+// Write accepts output from the agent, delivering the payload of each complete frame to its stream. Frames may span
+// writes.
+func (m *Mux) Write(p []byte) (int, error) {
+	data := append(m.partial, p...)
+	for len(data) >= muxHeaderLength {
+		if data[0] != MuxVersion {
+			return 0, fmt.Errorf("unsupported mux frame version: %d", data[0])
+		}
+		length := int(binary.LittleEndian.Uint16(data[2:4]))
+		if len(data) < muxHeaderLength+length {
+			break
+		}
+		cmd, id := data[1], binary.LittleEndian.Uint32(data[4:8])
+		payload := data[muxHeaderLength : muxHeaderLength+length]
+		data = data[muxHeaderLength+length:]
+
+		stream := m.stream(id)
+		if stream == nil {
+			// frames of streams that were already closed locally.
+			continue
+		}
+		switch cmd {
+		case MuxCmdPsh:
+			stream.push(payload)
+		case MuxCmdFin:
+			stream.finish()
+		}
+	}
+	m.partial = append([]byte{}, data...)
+	return len(p), nil
+}
+
+// KeepAlive sends a NOP frame at the interval until done is closed or a write fails.
+func (m *Mux) KeepAlive(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if m.writeFrame(MuxCmdNop, 0, nil) != nil {
+				return
+			}
+		}
+	}
+}
+
+// Close ends every stream, without waiting for the agent, and refuses to open more.
+func (m *Mux) Close() {
+	m.lock.Lock()
+	m.closed = true
+	streams := m.streams
+	m.streams = make(map[uint32]*MuxStream)
+	m.lock.Unlock()
+	for _, stream := range streams {
+		stream.abort()
+	}
+}
+
+// MuxStream is a single stream of a Mux. Reads return what the agent sent until it closes the stream.
+type MuxStream struct {
+	Id uint32
+
+	mux *Mux
+
+	lock sync.Mutex
+
+	// signaled when data arrives, and when the stream is finished or closed.
+	cond *sync.Cond
+
+	buffer bytes.Buffer
+
+	// set when the agent has closed its end of the stream.
+	finished bool
+
+	// set once a FIN has been sent.
+	closedWrite bool
+
+	closed bool
+}
+
+func (s *MuxStream) push(payload []byte) {
+	s.lock.Lock()
+	if !s.closed {
+		s.buffer.Write(payload)
+	}
+	s.lock.Unlock()
+	s.cond.Broadcast()
+}
+
+func (s *MuxStream) finish() {
+	s.lock.Lock()
+	s.finished = true
+	s.lock.Unlock()
+	s.cond.Broadcast()
+}
+
+func (s *MuxStream) abort() {
+	s.lock.Lock()
+	s.closed = true
+	s.buffer.Reset()
+	s.lock.Unlock()
+	s.cond.Broadcast()
+}
+
+// Read blocks until the agent sends data. Returns io.EOF once the agent has closed the stream and its data has been
+// read.
+func (s *MuxStream) Read(p []byte) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for s.buffer.Len() == 0 && !s.finished && !s.closed {
+		s.cond.Wait()
+	}
+	if s.buffer.Len() > 0 {
+		return s.buffer.Read(p)
+	}
+	return 0, io.EOF
+}
+
+// Write sends data to the agent in frames.
+func (s *MuxStream) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		s.lock.Lock()
+		closed := s.closed || s.closedWrite
+		s.lock.Unlock()
+		if closed {
+			return written, io.ErrClosedPipe
+		}
+		end := written + muxMaxFrameBytes
+		if end > len(p) {
+			end = len(p)
+		}
+		if err := s.mux.writeFrame(MuxCmdPsh, s.Id, p[written:end]); err != nil {
+			return written, err
+		}
+		written = end
+	}
+	return written, nil
+}
+
+// CloseWrite sends a FIN, which tells the agent that no more data follows. Data from the agent can still be read.
+func (s *MuxStream) CloseWrite() error {
+	s.lock.Lock()
+	if s.closedWrite || s.closed {
+		s.lock.Unlock()
+		return nil
+	}
+	s.closedWrite = true
+	s.lock.Unlock()
+	return s.mux.writeFrame(MuxCmdFin, s.Id, nil)
+}
+
+// Close sends a FIN, if none was sent yet, and discards whatever else the agent sends.
+func (s *MuxStream) Close() error {
+	err := s.CloseWrite()
+	s.mux.remove(s.Id)
+	s.abort()
+	return err
+}
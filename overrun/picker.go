@@ -0,0 +1,356 @@
+/*
+ * Copyright 2018 Mark Adamcin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// the most items that the picker lists at once.
+const PickerMaxRows = 10
+
+var ErrPickCanceled = errors.New("selection canceled")
+
+// keys handled by the picker, as read from a terminal in raw mode.
+const (
+	keyCtrlC     = 0x03
+	keyCtrlN     = 0x0e
+	keyCtrlP     = 0x10
+	keyCtrlU     = 0x15
+	keyEnter     = '\r'
+	keyNewline   = '\n'
+	keyEscape    = 0x1b
+	keyBackspace = 0x7f
+	keyCtrlH     = 0x08
+)
+
+// CanPick returns true if the missing arguments can be chosen interactively, which requires a terminal for both
+// keystrokes and the picker itself.
+func CanPick() bool {
+	return IsTerminal(os.Stdin) && IsTerminal(os.Stderr)
+}
+
+// FuzzyScore matches the query against the item as a case-insensitive subsequence. Lower scores are better matches:
+// the score counts the characters skipped between matched characters, and the characters before the first match.
+func FuzzyScore(query string, item string) (int, bool) {
+	score := 0
+	runes := []rune(strings.ToLower(item))
+	pos := 0
+	for _, q := range strings.ToLower(query) {
+		skipped := 0
+		for pos < len(runes) && runes[pos] != q {
+			pos++
+			skipped++
+		}
+		if pos == len(runes) {
+			return 0, false
+		}
+		score += skipped
+		pos++
+	}
+	return score, true
+}
+
+// FuzzyFilter returns the items matching the query, best matches first, otherwise in their original order.
+func FuzzyFilter(query string, items []string) []string {
+	type match struct {
+		item  string
+		score int
+		index int
+	}
+	var matches []match
+	for i, item := range items {
+		if score, ok := FuzzyScore(query, item); ok {
+			matches = append(matches, match{item, score, i})
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].score < matches[j].score
+	})
+	filtered := make([]string, len(matches))
+	for i, m := range matches {
+		filtered[i] = m.item
+	}
+	return filtered
+}
+
+// picker draws a filterable list on a terminal in raw mode, redrawing it in place after each keystroke.
+type picker struct {
+	out      io.Writer
+	title    string
+	items    []string
+	query    []rune
+	matches  []string
+	selected int
+	drawn    int
+}
+
+func (p *picker) filter() {
+	p.matches = FuzzyFilter(string(p.query), p.items)
+	if p.selected >= len(p.matches) {
+		p.selected = len(p.matches) - 1
+	}
+	if p.selected < 0 {
+		p.selected = 0
+	}
+}
+
+func (p *picker) draw() {
+	var b strings.Builder
+	if p.drawn > 0 {
+		// return to the title line and clear the previous drawing.
+		fmt.Fprintf(&b, "\r\x1b[%dA", p.drawn)
+	}
+	b.WriteString("\r\x1b[J")
+
+	width := 80
+	if cols, _, err := GetTerminalSize(os.Stderr); err == nil && cols > 4 {
+		width = cols
+	}
+	fmt.Fprintf(&b, "%s (%d/%d)\r\n", p.title, len(p.matches), len(p.items))
+
+	// scroll the list so that the selected item is visible.
+	first := 0
+	if p.selected >= PickerMaxRows {
+		first = p.selected - PickerMaxRows + 1
+	}
+	lines := 1
+	for i := first; i < len(p.matches) && i < first+PickerMaxRows; i++ {
+		item := p.matches[i]
+		if len(item) > width-4 {
+			item = item[:width-4]
+		}
+		if i == p.selected {
+			fmt.Fprintf(&b, "\x1b[7m> %s\x1b[0m\r\n", item)
+		} else {
+			fmt.Fprintf(&b, "  %s\r\n", item)
+		}
+		lines++
+	}
+	fmt.Fprintf(&b, "? %s", string(p.query))
+	p.drawn = lines
+	io.WriteString(p.out, b.String())
+}
+
+// clear removes the drawing from the terminal.
+func (p *picker) clear() {
+	if p.drawn > 0 {
+		fmt.Fprintf(p.out, "\r\x1b[%dA\x1b[J", p.drawn)
+	} else {
+		io.WriteString(p.out, "\r\x1b[J")
+	}
+	p.drawn = 0
+}
+
+// handle applies the keystrokes read from the terminal. Returns true once an item is chosen.
+func (p *picker) handle(keys []byte) (bool, error) {
+	for i := 0; i < len(keys); i++ {
+		switch key := keys[i]; key {
+		case keyCtrlC:
+			return false, ErrPickCanceled
+		case keyEnter, keyNewline:
+			if len(p.matches) > 0 {
+				return true, nil
+			}
+		case keyEscape:
+			if i+2 < len(keys) && keys[i+1] == '[' {
+				switch keys[i+2] {
+				case 'A':
+					p.selected--
+				case 'B':
+					p.selected++
+				}
+				i += 2
+			} else {
+				return false, ErrPickCanceled
+			}
+		case keyCtrlP:
+			p.selected--
+		case keyCtrlN:
+			p.selected++
+		case keyCtrlU:
+			p.query = nil
+		case keyBackspace, keyCtrlH:
+			if len(p.query) > 0 {
+				p.query = p.query[:len(p.query)-1]
+			}
+		default:
+			if key >= ' ' {
+				// read the rest of a multi-byte character along with it.
+				end := i + 1
+				for end < len(keys) && keys[end] >= 0x80 && keys[end] < 0xc0 {
+					end++
+				}
+				for _, r := range string(keys[i:end]) {
+					if unicode.IsPrint(r) {
+						p.query = append(p.query, r)
+					}
+				}
+				i = end - 1
+			}
+		}
+	}
+	p.filter()
+	return false, nil
+}
+
+// Pick lets the user choose one of the items by typing part of it, moving through the matches with the arrow keys,
+// and pressing enter. Returns ErrPickCanceled for ctrl-c and escape.
+func Pick(title string, items []string) (string, error) {
+	if len(items) == 0 {
+		return "", fmt.Errorf("no choices for %s", strings.ToLower(title))
+	}
+	restore, err := MakeRaw(os.Stdin)
+	if err != nil {
+		return "", err
+	}
+	defer restore()
+
+	p := picker{out: os.Stderr, title: title, items: items}
+	p.filter()
+	buf := make([]byte, 64)
+	for {
+		p.draw()
+		n, err := os.Stdin.Read(buf)
+		if err != nil {
+			p.clear()
+			return "", err
+		}
+		done, err := p.handle(buf[:n])
+		if err != nil || done {
+			p.clear()
+			if err != nil {
+				return "", err
+			}
+			return p.matches[p.selected], nil
+		}
+	}
+}
+
+func listClusterNames(ecss *ecs.ECS) ([]string, error) {
+	var names []string
+	input := ecs.ListClustersInput{}
+	for {
+		result, err := ecss.ListClustersRequest(&input).Send()
+		if err != nil {
+			return nil, err
+		}
+		for _, arn := range result.ClusterArns {
+			names = append(names, path.Base(arn))
+		}
+		if result.NextToken == nil {
+			break
+		}
+		input.NextToken = result.NextToken
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func listTaskDefinitionFamilies(ecss *ecs.ECS) ([]string, error) {
+	var families []string
+	input := ecs.ListTaskDefinitionFamiliesInput{Status: ecs.TaskDefinitionFamilyStatusActive}
+	for {
+		result, err := ecss.ListTaskDefinitionFamiliesRequest(&input).Send()
+		if err != nil {
+			return nil, err
+		}
+		families = append(families, result.Families...)
+		if result.NextToken == nil {
+			break
+		}
+		input.NextToken = result.NextToken
+	}
+	return families, nil
+}
+
+// pickMissingArgs lets the user choose the cluster and task definition when they are missing from the arguments, and
+// then the container, when the chosen task definition has more than one. The equivalent command line is printed, so
+// that it can be used without the pickers next time.
+func pickMissingArgs(prefs *ParsedArgs, awsCfg aws.Config, args []string) error {
+	cfg := awsCfg.Copy()
+	if len(prefs.AwsRegions) > 0 {
+		cfg.Region = prefs.AwsRegions[0]
+	}
+	ecss := ecs.New(cfg)
+
+	var picked []string
+	if len(prefs.Clusters) == 0 && len(prefs.TargetsFile) == 0 {
+		clusters, err := listClusterNames(ecss)
+		if err != nil {
+			return err
+		}
+		cluster, err := Pick("Cluster", clusters)
+		if err != nil {
+			return err
+		}
+		prefs.Clusters = []string{cluster}
+		picked = append(picked, "-c", cluster)
+	}
+
+	if len(prefs.TaskDef) == 0 && len(prefs.TaskDefFile) == 0 {
+		families, err := listTaskDefinitionFamilies(ecss)
+		if err != nil {
+			return err
+		}
+		family, err := Pick("Task definition family (latest revision)", families)
+		if err != nil {
+			return err
+		}
+		prefs.TaskDef = family
+		picked = append(picked, "-t", family)
+
+		if len(prefs.ContainerName) == 0 {
+			dtdInput := ecs.DescribeTaskDefinitionInput{TaskDefinition: &family}
+			dtdResult, err := ecss.DescribeTaskDefinitionRequest(&dtdInput).Send()
+			if err != nil {
+				return err
+			}
+			var names []string
+			for _, container := range dtdResult.TaskDefinition.ContainerDefinitions {
+				names = append(names, aws.StringValue(container.Name))
+			}
+			if len(names) > 1 {
+				name, err := Pick("Container", names)
+				if err != nil {
+					return err
+				}
+				prefs.ContainerName = name
+				picked = append(picked, "-n", name)
+			}
+		}
+	}
+
+	if len(picked) > 0 {
+		words := []string{filepath.Base(os.Args[0])}
+		for _, word := range append(picked, args...) {
+			words = append(words, ShellQuote(word))
+		}
+		fmt.Fprintf(os.Stderr, "Equivalent command:\n  %s\n", strings.Join(words, " "))
+	}
+	return nil
+}
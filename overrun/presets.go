@@ -0,0 +1,240 @@
+/*
+ * Copyright 2018 Mark Adamcin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+const PresetsFileName = ".overrun.yml"
+
+// the preset key holding the container command, which is appended to the preset arguments after --.
+const PresetKeyCommand = "command"
+
+// Presets holds named profiles read from a .overrun.yml file. Each profile maps long option names, without the leading
+// dashes, to option values. Booleans become switches (false selects the --no- form), lists repeat the option once per
+// element, and maps repeat the option once per key=value pair, which suits --env.
+//
+//	profiles:
+//	  migrate:
+//	    profile: prod
+//	    cluster: main
+//	    task-def: app
+//	    fargate:net: [ subnet-0a1b2c3d ]
+//	    env:
+//	      RAILS_ENV: production
+//	    stream-log: true
+type Presets struct {
+	Path string `yaml:"-"`
+
+	Profiles map[string]map[string]interface{} `yaml:"profiles"`
+
+	// tags applied to every task. See LoadDefaultTags.
+	Tags map[string]string `yaml:"tags"`
+}
+
+// FindPresetsFile searches for a .overrun.yml file starting in the current directory and moving up through its parents,
+// stopping at $HOME. If the current directory is not below $HOME, $HOME is checked last.
+func FindPresetsFile() (string, error) {
+	home := os.Getenv("HOME")
+	dir, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+
+	for {
+		candidate := filepath.Join(dir, PresetsFileName)
+		if _, err := os.Stat(candidate); err == nil {
+			return candidate, nil
+		}
+		parent := filepath.Dir(dir)
+		if dir == home || parent == dir {
+			break
+		}
+		dir = parent
+	}
+
+	if len(home) > 0 && dir != home {
+		candidate := filepath.Join(home, PresetsFileName)
+		if _, err := os.Stat(candidate); err == nil {
+			return candidate, nil
+		}
+	}
+	return "", errors.New("no " + PresetsFileName + " file found in the current directory, its parents, or $HOME")
+}
+
+func LoadPresets() (*Presets, error) {
+	path, err := FindPresetsFile()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	presets := Presets{Path: path}
+	if err := yaml.Unmarshal(data, &presets); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return &presets, nil
+}
+
+func (p *Presets) Names() []string {
+	var names []string
+	for name := range p.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Args converts the named profile into command line arguments.
+func (p *Presets) Args(name string) ([]string, error) {
+	profile, ok := p.Profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("%s: no preset named %s. Available presets: %s", p.Path, name, p.Names())
+	}
+
+	var keys []string
+	for key := range profile {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var args []string
+	for _, key := range keys {
+		if key == PresetKeyCommand {
+			continue
+		}
+		opt := "--" + key
+		switch value := profile[key].(type) {
+		case nil:
+			args = append(args, opt)
+		case bool:
+			if value {
+				args = append(args, opt)
+			} else {
+				args = append(args, NoOptPrefix+key)
+			}
+		case []interface{}:
+			for _, elem := range value {
+				args = append(args, opt, fmt.Sprintf("%v", elem))
+			}
+		case map[interface{}]interface{}:
+			var pairs []string
+			for k, v := range value {
+				pairs = append(pairs, fmt.Sprintf("%v=%v", k, v))
+			}
+			sort.Strings(pairs)
+			for _, pair := range pairs {
+				args = append(args, opt, pair)
+			}
+		default:
+			args = append(args, opt, fmt.Sprintf("%v", value))
+		}
+	}
+
+	if command, ok := profile[PresetKeyCommand]; ok {
+		args = append(args, "--")
+		switch value := command.(type) {
+		case []interface{}:
+			for _, elem := range value {
+				args = append(args, fmt.Sprintf("%v", elem))
+			}
+		default:
+			args = append(args, fmt.Sprintf("%v", value))
+		}
+	}
+	return args, nil
+}
+
+// ShellQuote single-quotes an argument for display when it contains characters that are significant to the shell.
+func ShellQuote(arg string) string {
+	if len(arg) > 0 && !strings.ContainsAny(arg, " \t\n'\"$&;|<>()*?!`\\{}[]#~") {
+		return arg
+	}
+	return "'" + strings.Replace(arg, "'", "'\"'\"'", -1) + "'"
+}
+
+// PrintEffectiveArgs prints each option given to the parser with its effective values and the source of those values.
+func PrintEffectiveArgs(w io.Writer, parser *ArgParser) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, opt := range parser.Order {
+		if opt == "--" {
+			continue
+		}
+		var words []string
+		if repeatedOptions[opt] {
+			// repeat the option for each value, which may have accumulated across layers.
+			for _, value := range parser.Values[opt] {
+				words = append(words, opt, ShellQuote(value))
+			}
+		} else {
+			words = append(words, parser.Spelling[opt])
+			for _, value := range parser.Values[opt] {
+				words = append(words, ShellQuote(value))
+			}
+		}
+		fmt.Fprintf(tw, "%s\t# %s\n", strings.Join(words, " "), parser.Sources[opt])
+	}
+	if cmd, ok := parser.Values["--"]; ok {
+		words := []string{"--"}
+		for _, value := range cmd {
+			words = append(words, ShellQuote(value))
+		}
+		fmt.Fprintf(tw, "%s\t# %s\n", strings.Join(words, " "), parser.Sources["--"])
+	}
+	tw.Flush()
+}
+
+// profilesCommand lists the available presets, or prints the effective settings for the referenced presets merged
+// with any other arguments.
+func profilesCommand(args []string) {
+	presets, err := LoadPresets()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") && !strings.HasPrefix(args[0], "@") {
+		// allow the preset to be named without the @ prefix.
+		args = append([]string{"@" + args[0]}, args[1:]...)
+	}
+
+	names, _ := SplitPresetNames(args)
+	if len(names) == 0 {
+		fmt.Printf("# %s\n", presets.Path)
+		for _, name := range presets.Names() {
+			fmt.Println("@" + name)
+		}
+		return
+	}
+
+	fmt.Printf("# %s\n", presets.Path)
+	PrintEffectiveArgs(os.Stdout, loadArgs("", args))
+}
@@ -0,0 +1,425 @@
+/*
+ * Copyright 2018 Mark Adamcin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/awserr"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// exit code reported when the primary container stopped with a reason, but without an exit code of its own.
+const ExitCodeContainerReason = 42
+
+// delay between RunTask attempts when the cluster lacks the resources to place another task.
+const CapacityRetryDelay = 15 * time.Second
+
+// Invocation holds the resources shared by every target of a single invocation.
+type Invocation struct {
+	// S3 location for staging task input and output, when --staging is given.
+	Staging *StagingRun
+
+	// destination of the unformatted log stream, when --log-file is given.
+	LogFile io.Writer
+
+	// Fargate prices used to estimate the cost of each task once it stops.
+	Prices PriceTable
+
+	// creates the API clients for each target. nil selects AwsBackend.
+	Backend Backend
+}
+
+// TaskJob describes a single task submission. A normal invocation runs one job. Fan-out invocations run one job per
+// --count index or --commands-file line.
+type TaskJob struct {
+	Index int
+
+	// prefix for log lines streamed from this job's task.
+	Label string
+
+	// environment overrides applied on top of ParsedArgs.Environment.
+	Environment map[string]string
+
+	// command override constructed for this job, in place of ParsedArgs.CmdOverride.
+	Command []string
+
+	// the shell script from which Command was built, for wrapping by features such as --stdin.
+	Script string
+
+	// command run by the ECS Exec session of an --interactive job.
+	ExecCommand string
+}
+
+type TaskResult struct {
+	Job *TaskJob
+
+	TaskArn string
+
+	ExitCode int
+
+	Reason string
+
+	// estimated cost of a Fargate task that was waited on, or nil.
+	Cost *CostEstimate
+
+	Err error
+}
+
+func (r *TaskResult) Failed() bool {
+	return r.Err != nil || r.ExitCode != 0
+}
+
+// TaskTracker remembers submitted tasks so that SIGINT can stop all of them, and refuses new submissions after that.
+type TaskTracker struct {
+	sync.Mutex
+	tasks    map[string]*ExecutionContext
+	stopping bool
+}
+
+func NewTaskTracker() *TaskTracker {
+	return &TaskTracker{tasks: make(map[string]*ExecutionContext)}
+}
+
+func (t *TaskTracker) Stopping() bool {
+	t.Lock()
+	defer t.Unlock()
+	return t.stopping
+}
+
+// Add tracks a submitted task, stopping it immediately if SIGINT was received while it was being submitted.
+func (t *TaskTracker) Add(taskArn string, ctx *ExecutionContext) {
+	t.Lock()
+	t.tasks[taskArn] = ctx
+	stopping := t.stopping
+	t.Unlock()
+	if stopping {
+		stopTask(ctx, taskArn)
+	}
+}
+
+func (t *TaskTracker) Remove(taskArn string) {
+	t.Lock()
+	defer t.Unlock()
+	delete(t.tasks, taskArn)
+}
+
+// StopAll stops every tracked task. Returns false if any StopTask request failed.
+func (t *TaskTracker) StopAll() bool {
+	t.Lock()
+	t.stopping = true
+	tasks := make(map[string]*ExecutionContext, len(t.tasks))
+	for arn, ctx := range t.tasks {
+		tasks[arn] = ctx
+	}
+	t.Unlock()
+
+	ok := true
+	for arn, ctx := range tasks {
+		ok = stopTask(ctx, arn) && ok
+	}
+	return ok
+}
+
+func stopTask(ctx *ExecutionContext, taskArn string) bool {
+	stopInput := ecs.StopTaskInput{
+		Cluster: &ctx.Target.Cluster,
+		Reason:  aws.String("overrun SIGINT"),
+		Task:    &taskArn}
+	if _, err := ctx.Ecs.StopTask(&stopInput); err != nil {
+		TaskEvent(ctx, nil, "task-stop-failed", taskArn).Error("SIGINT failed to stop task %s! keep mashing that ctrl-c!",
+			taskArn)
+		return false
+	}
+	TaskEvent(ctx, nil, "task-stop-requested", taskArn).Printf("user requested to stop task %s using ctrl-c/SIGINT",
+		taskArn)
+	return true
+}
+
+func sigintStopTasks(sigs chan os.Signal, tracker *TaskTracker) {
+	for sig := range sigs {
+		if sig == syscall.SIGINT && tracker.StopAll() {
+			// detach from SIGINT.
+			signal.Stop(sigs)
+		}
+	}
+}
+
+// waitRunning waits for the task to reach the RUNNING state, failing if it stops first.
+func waitRunning(ecss EcsAPI, input *ecs.DescribeTasksInput) error {
+	for {
+		err := ecss.WaitUntilTasksRunning(input)
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == aws.WaiterResourceNotReadyErrorCode {
+			describeResult, describeErr := ecss.DescribeTasks(input)
+			if describeErr == nil && len(describeResult.Tasks) > 0 && aws.StringValue(describeResult.Tasks[0].LastStatus) == "STOPPED" {
+				return fmt.Errorf("task stopped before it was running: %s", aws.StringValue(describeResult.Tasks[0].StoppedReason))
+			}
+			continue
+		}
+		return err
+	}
+}
+
+// waitStopped waits for the task to stop, for however long that takes, rather than giving up when the waiter exhausts
+// its attempts.
+func waitStopped(ecss EcsAPI, input *ecs.DescribeTasksInput) error {
+	for {
+		err := ecss.WaitUntilTasksStopped(input)
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == aws.WaiterResourceNotReadyErrorCode {
+			continue
+		}
+		return err
+	}
+}
+
+func isCapacityFailure(failure ecs.Failure) bool {
+	return failure.Reason != nil && strings.HasPrefix(*failure.Reason, "RESOURCE")
+}
+
+// submitTask sends the RunTask request. When retryCapacity is true, placement failures caused by insufficient cluster
+// resources are retried until capacity is available or SIGINT is received.
+func submitTask(ecss EcsAPI, input *ecs.RunTaskInput, extras JSONMembers, tracker *TaskTracker, retryCapacity bool) (*ecs.Task, error) {
+	for {
+		out, err := ecss.RunTask(input, extras)
+		if err != nil {
+			return nil, err
+		}
+		if len(out.Tasks) > 0 {
+			return &out.Tasks[0], nil
+		}
+
+		var reasons []string
+		retry := retryCapacity
+		for _, failure := range out.Failures {
+			reasons = append(reasons, aws.StringValue(failure.Reason))
+			retry = retry && isCapacityFailure(failure)
+		}
+		if !retry || len(out.Failures) == 0 || tracker.Stopping() {
+			return nil, errors.New("failed to run task: " + strings.Join(reasons, ", "))
+		}
+		time.Sleep(CapacityRetryDelay)
+		if tracker.Stopping() {
+			return nil, errors.New("failed to run task: " + strings.Join(reasons, ", "))
+		}
+	}
+}
+
+// containerExitCode reports the exit code and reason for the named container of a stopped task.
+func containerExitCode(task *ecs.Task, containerName string) (int, string) {
+	for _, cnt := range task.Containers {
+		if *cnt.Name == containerName {
+			exitCode := 0
+			reason := ""
+			if cnt.Reason != nil {
+				exitCode = ExitCodeContainerReason
+				reason = *cnt.Reason
+			}
+			if cnt.ExitCode != nil && int(*cnt.ExitCode) > 0 {
+				exitCode = int(*cnt.ExitCode)
+			}
+			return exitCode, reason
+		}
+	}
+	return 1, aws.StringValue(task.StoppedReason)
+}
+
+func newLogSink(prefs *ParsedArgs, prefix string) *LogSink {
+	return &LogSink{Prefix: prefix, Format: prefs.LogFormat, Fields: prefs.LogFields, Color: UseColor()}
+}
+
+// goTailTask locates the log stream of the task's container and tails it until stop is closed. Streams named for the
+// container's Docker ID are located once the container has started. The group is notified when tailing is finished.
+func goTailTask(prefs *ParsedArgs, ctx *ExecutionContext, task *ecs.Task, label string, group *sync.WaitGroup, stop <-chan struct{}) {
+	defer group.Done()
+
+	// extrapolate the cloudwatch stream name
+	loc, err := LocateAwslogsForTask(ctx.ContainerDefinition, task, nil)
+	for err == ErrRuntimeIdRequired {
+		select {
+		case <-stop:
+			// the container stopped without starting, so there is nothing to tail.
+			return
+		case <-time.After(LogPollInterval):
+		}
+		runtimeIds, idErr := ctx.Ecs.ContainerRuntimeIds(&ctx.Target.Cluster, *task.TaskArn)
+		if idErr != nil {
+			log.Printf("%sWARNING: %s\n", label, idErr)
+		}
+		loc, err = LocateAwslogsForTask(ctx.ContainerDefinition, task, runtimeIds)
+	}
+	if err != nil {
+		log.Printf("%sWARNING: cannot stream logs: %s\n", label, err)
+		return
+	}
+
+	// attempt to pre-create the log stream to avoid missing resource failures
+	cws := ctx.LogsClient(loc)
+	if _, streamErr := GetOrCreateStream(cws, loc); streamErr != nil {
+		log.Printf("%sWARNING: %s\n", label, streamErr)
+	}
+
+	var tails sync.WaitGroup
+	sink := newLogSink(prefs, label)
+	if ctx.LogFile != nil {
+		if len(prefs.LogFilter) > 0 {
+			// the filter only applies to stdout, so the file receives the complete stream from a query of its own.
+			tails.Add(1)
+			go GoTailLogs(cws, &LogQuery{Location: loc}, &LogSink{Prefix: label, Out: ctx.LogFile}, &tails, stop)
+		} else {
+			sink.Tee = ctx.LogFile
+		}
+	}
+	tails.Add(1)
+	GoTailLogs(cws, &LogQuery{Location: loc, FilterPattern: prefs.LogFilter}, sink, &tails, stop)
+	tails.Wait()
+}
+
+// runTask submits a single job and, if requested, waits for it to stop while streaming its logs.
+func runTask(prefs *ParsedArgs, ctx *ExecutionContext, job *TaskJob, tracker *TaskTracker) TaskResult {
+	result := TaskResult{Job: job}
+	ecss := ctx.Ecs
+	label := ctx.Label + job.Label
+
+	var artifactKey string
+	if len(prefs.Artifacts) > 0 {
+		wrapped, key, err := prepareArtifacts(prefs, ctx, job)
+		if err != nil {
+			result.Err = err
+			return result
+		}
+		job, artifactKey = wrapped, key
+	}
+
+	var health HealthCondition
+	if prefs.WaitHealthy {
+		condition, err := healthCondition(ctx)
+		if err != nil {
+			result.Err = err
+			return result
+		}
+		health = condition
+	}
+
+	input := *ctx.RunTaskInput
+	input.Overrides = buildOverrides(prefs, ctx, job)
+
+	task, err := submitTask(ecss, &input, ctx.RunTaskExtras, tracker, prefs.IsFanOut())
+	if err != nil {
+		result.Err = err
+		return result
+	}
+
+	result.TaskArn = *task.TaskArn
+	tracker.Add(result.TaskArn, ctx)
+	defer tracker.Remove(result.TaskArn)
+	submitted := TaskEvent(ctx, job, "task-submitted", result.TaskArn)
+	submitted.TaskDefinition = aws.StringValue(task.TaskDefinitionArn)
+	submitted.Printf("Submitted task %s on cluster %s.", result.TaskArn, ctx.Target.Cluster)
+
+	if prefs.Interactive {
+		result.ExitCode, result.Err = interactWithTask(ctx, task, job)
+		return result
+	}
+
+	if !prefs.WaitStopped && !ctx.StreamLog && !prefs.WaitHealthy {
+		return result
+	}
+
+	taskArnInput := ecs.DescribeTasksInput{Cluster: &ctx.Target.Cluster, Tasks: []string{result.TaskArn}}
+
+	var tailGroup sync.WaitGroup
+	stopTail := make(chan struct{})
+	if ctx.StreamLog {
+		// start paging events to standard out in separate thread.
+		// use the wait group to notify when the final getLogEvents
+		// request has completed after the task has stopped.
+		tailGroup.Add(1)
+		go goTailTask(prefs, ctx, task, label, &tailGroup, stopTail)
+	}
+
+	if prefs.WaitHealthy {
+		done, failed := true, true
+		healthy, err := waitHealthy(ctx, result.TaskArn, health, prefs.HealthTimeout)
+		if err != nil {
+			result.Err = err
+		} else if isUnhealthy(healthy) {
+			result.ExitCode, result.Reason = ExitCodeUnhealthy, unhealthyReason(healthy)
+		} else if aws.StringValue(healthy.LastStatus) == "STOPPED" {
+			// report the exit code of a task that stopped before it was healthy, as --wait does.
+			done, failed = false, false
+		} else {
+			reportHealthy(ctx, job, healthy)
+			done, failed = !prefs.WaitStopped && !ctx.StreamLog, false
+		}
+		if failed {
+			abandonTask(prefs, ctx, job, result.TaskArn)
+		}
+		if done {
+			close(stopTail)
+			tailGroup.Wait()
+			return result
+		}
+	}
+
+	// wait for task to stop for good
+	err = waitStopped(ecss, &taskArnInput)
+	close(stopTail)
+	tailGroup.Wait()
+	if err != nil {
+		result.Err = err
+		return result
+	}
+
+	// describe task final state to report reason and exit code of primary container
+	describeResult, describeErr := ecss.DescribeTasks(&taskArnInput)
+	if describeErr != nil {
+		result.Err = describeErr
+	} else if len(describeResult.Tasks) == 0 {
+		result.Err = fmt.Errorf("failed to describe task %s", result.TaskArn)
+	} else {
+		result.ExitCode, result.Reason = containerExitCode(&describeResult.Tasks[0], *ctx.ContainerDefinition.Name)
+		if cost, err := estimateTaskCost(ctx, &describeResult.Tasks[0]); err != nil {
+			TaskEvent(ctx, job, "cost-estimate", result.TaskArn).Warning("cannot estimate cost: %s", err)
+		} else if cost != nil {
+			result.Cost = cost
+			estimated := TaskEvent(ctx, job, "cost-estimate", result.TaskArn)
+			estimated.Cost = cost
+			estimated.Printf("Estimated cost: %s", cost)
+		}
+		stopped := TaskEvent(ctx, job, "task-stopped", result.TaskArn)
+		stopped.ExitCode, stopped.Reason, stopped.Cost = &result.ExitCode, result.Reason, result.Cost
+		stopped.Message = "Task stopped."
+		stopped.Emit()
+	}
+
+	if len(artifactKey) > 0 {
+		// the task's exit code stands, whether or not its artifacts could be fetched.
+		if err := fetchArtifacts(prefs, ctx, job, artifactKey); err != nil {
+			TaskEvent(ctx, job, "artifacts-failed", result.TaskArn).Warning("failed to fetch artifacts: %s", err)
+		}
+	}
+	return result
+}
@@ -0,0 +1,305 @@
+/*
+ * Copyright 2018 Mark Adamcin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"strings"
+	"testing"
+)
+
+func TestContainerExitCode(t *testing.T) {
+	tests := []struct {
+		name       string
+		containers []ecs.Container
+		exitCode   int
+		reason     string
+	}{
+		{
+			name:       "exit code",
+			containers: []ecs.Container{{Name: aws.String("web"), ExitCode: aws.Int64(3)}},
+			exitCode:   3,
+		},
+		{
+			name:       "success",
+			containers: []ecs.Container{{Name: aws.String("web"), ExitCode: aws.Int64(0)}},
+			exitCode:   0,
+		},
+		{
+			name:       "reason without exit code",
+			containers: []ecs.Container{{Name: aws.String("web"), Reason: aws.String("CannotPullContainerError")}},
+			exitCode:   ExitCodeContainerReason,
+			reason:     "CannotPullContainerError",
+		},
+		{
+			name: "exit code takes precedence over reason",
+			containers: []ecs.Container{
+				{Name: aws.String("web"), ExitCode: aws.Int64(137), Reason: aws.String("OutOfMemoryError")}},
+			exitCode: 137,
+			reason:   "OutOfMemoryError",
+		},
+		{
+			name: "other containers are ignored",
+			containers: []ecs.Container{
+				{Name: aws.String("sidecar"), ExitCode: aws.Int64(1)},
+				{Name: aws.String("web"), ExitCode: aws.Int64(0)}},
+			exitCode: 0,
+		},
+		{
+			name:       "missing container",
+			containers: []ecs.Container{{Name: aws.String("sidecar"), ExitCode: aws.Int64(0)}},
+			exitCode:   1,
+			reason:     "Task stopped",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			task := ecs.Task{Containers: test.containers, StoppedReason: aws.String("Task stopped")}
+			exitCode, reason := containerExitCode(&task, "web")
+			if exitCode != test.exitCode || reason != test.reason {
+				t.Errorf("got %d %q, want %d %q", exitCode, reason, test.exitCode, test.reason)
+			}
+		})
+	}
+}
+
+// newRunBackend returns a fake with the app task definition, whose web container logs to CloudWatch Logs, and the job
+// task definition for Fargate.
+func newRunBackend() *fakeBackend {
+	b := newNetworkBackend()
+	b.addTaskDefinition(ecs.TaskDefinition{
+		Family: aws.String("app"),
+		ContainerDefinitions: []ecs.ContainerDefinition{
+			{
+				Name:  aws.String("web"),
+				Image: aws.String("example/web:1.0"),
+				LogConfiguration: &ecs.LogConfiguration{
+					LogDriver: ecs.LogDriverAwslogs,
+					Options: map[string]string{
+						AwslogsKeyGroup:        "/ecs/app",
+						AwslogsKeyStreamPrefix: "app"}}},
+			{
+				Name:  aws.String("sidecar"),
+				Image: aws.String("example/sidecar:1.0")}}})
+	b.addTaskDefinition(ecs.TaskDefinition{
+		Family:      aws.String("job"),
+		Cpu:         aws.String("512"),
+		Memory:      aws.String("1024"),
+		NetworkMode: ecs.NetworkModeAwsvpc,
+		ContainerDefinitions: []ecs.ContainerDefinition{
+			{Name: aws.String("job"), Image: aws.String("example/job:1.0")}}})
+	return b
+}
+
+func TestRunTask(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		outcome  fakeOutcome
+		failures []ecs.Failure
+		exitCode int
+		reason   string
+		err      string
+		logs     string
+		cost     bool
+	}{
+		{
+			name:    "success",
+			outcome: fakeOutcome{ExitCode: aws.Int64(0)},
+		},
+		{
+			name:     "container exit code",
+			outcome:  fakeOutcome{ExitCode: aws.Int64(3)},
+			exitCode: 3,
+		},
+		{
+			name:     "container reason",
+			outcome:  fakeOutcome{Reason: "OutOfMemoryError: Container killed due to memory usage"},
+			exitCode: ExitCodeContainerReason,
+			reason:   "OutOfMemoryError: Container killed due to memory usage",
+		},
+		{
+			name: "stopped before running",
+			outcome: fakeOutcome{StopBeforeRunning: true, Reason: "CannotPullContainerError",
+				StoppedReason: "Task failed to start"},
+			exitCode: ExitCodeContainerReason,
+			reason:   "CannotPullContainerError",
+		},
+		{
+			name:     "placement failure",
+			failures: []ecs.Failure{{Reason: aws.String("RESOURCE:MEMORY")}},
+			err:      "failed to run task: RESOURCE:MEMORY",
+		},
+		{
+			name:    "stream logs",
+			args:    []string{"-l"},
+			outcome: fakeOutcome{ExitCode: aws.Int64(0), Logs: []string{"one", "two", "three"}},
+			logs:    "one\ntwo\nthree\n",
+		},
+		{
+			name:     "stream logs of a failed task",
+			args:     []string{"-l", "--log-filter", "error"},
+			outcome:  fakeOutcome{ExitCode: aws.Int64(2), Logs: []string{"starting", "error: no input"}},
+			exitCode: 2,
+			logs:     "starting\nerror: no input\n",
+		},
+		{
+			name:    "fargate cost",
+			args:    []string{"-t", "job", "--fargate:net", "subnet-a", "--fargate:sg", "sg-1"},
+			outcome: fakeOutcome{ExitCode: aws.Int64(0)},
+			cost:    true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := newRunBackend()
+			b.outcomes = []fakeOutcome{test.outcome}
+			if test.failures != nil {
+				b.runFailures = [][]ecs.Failure{test.failures}
+			}
+			prefs := parseTestArgs(nil, append([]string{"-c", "main", "-t", "app", "-w"}, test.args...)...).Args()
+			prices, err := LoadPriceTable("")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var logFile bytes.Buffer
+			inv := Invocation{Backend: b, Prices: prices, LogFile: &logFile}
+			ctx, err := newTargetContext(&prefs, aws.Config{Region: "us-east-1"}, &inv, Target{Cluster: "main"}, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			jobs, err := buildJobs(&prefs, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			result := runTask(&prefs, ctx, &jobs[0], NewTaskTracker())
+			if len(test.err) > 0 {
+				if result.Err == nil || !strings.Contains(result.Err.Error(), test.err) {
+					t.Fatalf("got error %v, want %q", result.Err, test.err)
+				}
+				return
+			} else if result.Err != nil {
+				t.Fatal(result.Err)
+			}
+			if result.ExitCode != test.exitCode || result.Reason != test.reason {
+				t.Errorf("got %d %q, want %d %q", result.ExitCode, result.Reason, test.exitCode, test.reason)
+			}
+			if got := b.task(result.TaskArn); aws.StringValue(got.LastStatus) != "STOPPED" {
+				t.Errorf("got task status %s, want STOPPED", aws.StringValue(got.LastStatus))
+			}
+			if logFile.String() != test.logs {
+				t.Errorf("got logs %q, want %q", logFile.String(), test.logs)
+			}
+			if (result.Cost != nil) != test.cost {
+				t.Errorf("got cost %v, want cost %t", result.Cost, test.cost)
+			}
+		})
+	}
+}
+
+func TestRunTaskWithoutWait(t *testing.T) {
+	b := newRunBackend()
+	prefs := parseTestArgs(nil, "-c", "main", "-t", "app", "--tag", "team=data", "--", "echo", "hello").Args()
+	ctx, err := newTargetContext(&prefs, aws.Config{Region: "us-east-1"}, &Invocation{Backend: b}, Target{Cluster: "main"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	jobs, err := buildJobs(&prefs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := runTask(&prefs, ctx, &jobs[0], NewTaskTracker())
+	if result.Err != nil || result.ExitCode != 0 || len(result.TaskArn) == 0 {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+	if got := b.task(result.TaskArn); aws.StringValue(got.LastStatus) != "PROVISIONING" {
+		t.Errorf("got task status %s, want PROVISIONING", aws.StringValue(got.LastStatus))
+	}
+	if len(b.runTasks) != 1 {
+		t.Fatalf("got %d RunTask requests, want 1", len(b.runTasks))
+	}
+	input := b.runTasks[0].Input
+	override := input.Overrides.ContainerOverrides[0]
+	if aws.StringValue(override.Name) != "web" || strings.Join(override.Command, " ") != "echo hello" {
+		t.Errorf("unexpected container override: %s", override)
+	}
+	if len(input.Tags) != 1 || aws.StringValue(input.Tags[0].Key) != "team" {
+		t.Errorf("unexpected tags: %s", input.Tags)
+	}
+}
+
+func TestWaitRunning(t *testing.T) {
+	tests := []struct {
+		name    string
+		outcome fakeOutcome
+		err     string
+	}{
+		{
+			name:    "running",
+			outcome: fakeOutcome{ExitCode: aws.Int64(0)},
+		},
+		{
+			name:    "stopped first",
+			outcome: fakeOutcome{StopBeforeRunning: true, StoppedReason: "Task failed to start"},
+			err:     "task stopped before it was running: Task failed to start",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := newRunBackend()
+			b.outcomes = []fakeOutcome{test.outcome}
+			out, err := b.RunTask(&ecs.RunTaskInput{Cluster: aws.String("main"), TaskDefinition: aws.String("app")}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			input := ecs.DescribeTasksInput{Cluster: aws.String("main"), Tasks: []string{*out.Tasks[0].TaskArn}}
+			err = waitRunning(b, &input)
+			if len(test.err) == 0 && err != nil {
+				t.Fatal(err)
+			} else if len(test.err) > 0 && (err == nil || err.Error() != test.err) {
+				t.Fatalf("got error %v, want %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestStopTask(t *testing.T) {
+	b := newRunBackend()
+	prefs := parseTestArgs(nil, "-t", "app").Args()
+	ctx := newTestContext(b, &prefs, "main")
+	out, err := b.RunTask(&ecs.RunTaskInput{Cluster: aws.String("main"), TaskDefinition: aws.String("app")}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	arn := *out.Tasks[0].TaskArn
+	if !stopTask(ctx, arn) {
+		t.Fatal("stopTask failed")
+	}
+	if got := b.task(arn); aws.StringValue(got.StoppedReason) != "overrun SIGINT" {
+		t.Errorf("got stopped reason %q, want %q", aws.StringValue(got.StoppedReason), "overrun SIGINT")
+	}
+	if stopTask(ctx, "arn:aws:ecs:us-east-1:123456789012:task/main/missing") {
+		t.Error("stopTask succeeded for a missing task")
+	}
+}
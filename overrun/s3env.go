@@ -0,0 +1,149 @@
+/*
+ * Copyright 2018 Mark Adamcin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/awserr"
+	"github.com/aws/aws-sdk-go-v2/aws/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"log"
+	"path"
+	"strings"
+)
+
+// the only type of environment file supported by ECS.
+const EnvironmentFileTypeS3 = "s3"
+
+// S3Object identifies an environment file by the ARN of its S3 object.
+type S3Object struct {
+	Arn string
+
+	Bucket string
+
+	Key string
+}
+
+// ParseS3ObjectArn parses an S3 object ARN, such as arn:aws:s3:::bucket/path/app.env. ECS requires environment files
+// to have the .env extension.
+func ParseS3ObjectArn(arn string) (S3Object, error) {
+	parts := strings.SplitN(arn, ":", 6)
+	if len(parts) != 6 || parts[0] != "arn" || parts[2] != "s3" {
+		return S3Object{}, fmt.Errorf("invalid S3 object ARN %s. Expected arn:aws:s3:::bucket/key.env", arn)
+	}
+	resource := strings.SplitN(parts[5], "/", 2)
+	if len(resource) != 2 || len(resource[0]) == 0 || len(resource[1]) == 0 {
+		return S3Object{}, fmt.Errorf("invalid S3 object ARN %s. Expected arn:aws:s3:::bucket/key.env", arn)
+	} else if path.Ext(resource[1]) != ".env" {
+		return S3Object{}, fmt.Errorf("environment file %s must have the .env extension", arn)
+	}
+	return S3Object{Arn: arn, Bucket: resource[0], Key: resource[1]}, nil
+}
+
+// ResourceRequirement is a container resource, such as a number of GPUs, given as type=value.
+type ResourceRequirement struct {
+	Type string
+
+	Value string
+}
+
+func ParseResourceRequirement(spec string) (ResourceRequirement, error) {
+	parts := strings.SplitN(spec, "=", 2)
+	if len(parts) != 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+		return ResourceRequirement{}, fmt.Errorf("invalid resource requirement %s. Expected type=value, such as GPU=1", spec)
+	}
+	return ResourceRequirement{Type: parts[0], Value: parts[1]}, nil
+}
+
+// containerOverrideExtras returns the members of the container override for the environment files and resource
+// requirements, which the vendored SDK cannot express.
+func containerOverrideExtras(prefs *ParsedArgs) JSONMembers {
+	override := JSONMembers{}
+	if len(prefs.EnvironmentFiles) > 0 {
+		var files []interface{}
+		for _, file := range prefs.EnvironmentFiles {
+			files = append(files, JSONMembers{"value": file.Arn, "type": EnvironmentFileTypeS3})
+		}
+		override["environmentFiles"] = files
+	}
+	if len(prefs.ResourceRequirements) > 0 {
+		var requirements []interface{}
+		for _, requirement := range prefs.ResourceRequirements {
+			requirements = append(requirements, JSONMembers{"type": requirement.Type, "value": requirement.Value})
+		}
+		override["resourceRequirements"] = requirements
+	}
+	if len(override) == 0 {
+		return nil
+	}
+	// buildOverrides overrides a single container, so these members merge into the first container override.
+	return JSONMembers{"overrides": JSONMembers{"containerOverrides": []interface{}{override}}}
+}
+
+// headObject checks that the object exists, returning true if it exists, or false if access to it was denied.
+func headObject(awsCfg aws.Config, object S3Object) (bool, error) {
+	s3s, err := bucketClient(awsCfg, object.Bucket)
+	if err != nil {
+		return false, err
+	}
+	input := s3.HeadObjectInput{Bucket: &object.Bucket, Key: &object.Key}
+	if _, err := s3s.HeadObjectRequest(&input).Send(); err != nil {
+		if aerr, ok := err.(awserr.RequestFailure); ok {
+			switch aerr.StatusCode() {
+			case 403:
+				return false, nil
+			case 404:
+				return false, fmt.Errorf("environment file %s does not exist", object.Arn)
+			}
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// checkEnvironmentFiles checks that each environment file exists. ECS reads them with the task execution role, so the
+// check uses that role when it can be assumed, and otherwise the caller's own credentials. Files that the caller is not
+// allowed to read are reported, but not treated as errors, since the execution role may still be able to read them.
+func checkEnvironmentFiles(prefs *ParsedArgs, ctx *ExecutionContext) error {
+	execRoleArn := prefs.ExecRoleArn
+	if len(execRoleArn) == 0 {
+		execRoleArn = aws.StringValue(ctx.TaskDefinition.ExecutionRoleArn)
+	}
+	if len(execRoleArn) == 0 {
+		return errors.New("--env-s3 requires a task execution role, which ECS uses to read the environment files")
+	}
+
+	cfg := ctx.AwsConfig.Copy()
+	provider := stscreds.NewAssumeRoleProvider(sts.New(*ctx.AwsConfig), execRoleArn)
+	provider.RoleSessionName = "overrun-env-s3"
+	if _, err := provider.Retrieve(); err == nil {
+		cfg.Credentials = provider
+	}
+
+	for _, file := range prefs.EnvironmentFiles {
+		readable, err := headObject(cfg, file)
+		if err != nil {
+			return err
+		} else if !readable {
+			log.Printf("%sWARNING: Cannot check environment file %s: access denied\n", ctx.Label, file.Arn)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,519 @@
+/*
+ * Copyright 2018 Mark Adamcin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/private/protocol/json/jsonutil"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchevents"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"log"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"unicode/utf8"
+)
+
+// rules created by overrun are recognized by the prefix of their description, which is followed by the command line.
+const ScheduleDescriptionPrefix = "overrun schedule: "
+
+// the prefix of the IDs of the ECS targets that overrun adds to a rule, which is followed by the cluster name.
+const ScheduleTargetIdPrefix = "overrun-"
+
+const scheduleDescriptionLimit = 512
+
+// characters that are not allowed in the ID of a rule target.
+var invalidTargetIdChars = regexp.MustCompile(`[^.\-_A-Za-z0-9]`)
+
+// ScheduleExpression accepts cron(...) and rate(...) expressions as they are, and wraps the six fields of a bare cron
+// expression in cron().
+func ScheduleExpression(value string) string {
+	value = strings.TrimSpace(value)
+	if strings.HasPrefix(value, "cron(") || strings.HasPrefix(value, "rate(") {
+		return value
+	}
+	return "cron(" + value + ")"
+}
+
+func scheduleTargetId(cluster string) string {
+	id := ScheduleTargetIdPrefix + invalidTargetIdChars.ReplaceAllString(path.Base(cluster), "_")
+	if len(id) > 64 {
+		id = id[:64]
+	}
+	return id
+}
+
+// the options whose values are replaced in the description of a rule, which is visible to anyone who can list rules.
+var redactedScheduleOptions = map[string]bool{
+	"--env":      true,
+	"--env-file": true,
+}
+
+// the placeholder for a redacted value in the description of a rule.
+const scheduleRedacted = "<redacted>"
+
+// redactScheduleArg replaces the value of an environment variable, keeping its name, and the whole value of any other
+// redacted option.
+func redactScheduleArg(opt string, value string) string {
+	if opt == "--env" {
+		if eq := strings.Index(value, "="); eq >= 0 {
+			return value[:eq+1] + scheduleRedacted
+		}
+		return value
+	}
+	return scheduleRedacted
+}
+
+// scheduleDescription records the command line that created the rule, with the values of environment options redacted.
+func scheduleDescription(args []string) string {
+	words := []string{"overrun", "schedule"}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		words = append(words, ShellQuote(arg))
+		if arg == "--" {
+			for _, rest := range args[i+1:] {
+				words = append(words, ShellQuote(rest))
+			}
+			break
+		}
+		opt := arg
+		if alias, ok := optionAliases[opt]; ok {
+			opt = alias
+		}
+		if redactedScheduleOptions[opt] && i+1 < len(args) {
+			i++
+			words = append(words, ShellQuote(redactScheduleArg(opt, args[i])))
+		}
+	}
+	description := ScheduleDescriptionPrefix + strings.Join(words, " ")
+	if len(description) > scheduleDescriptionLimit {
+		cut := scheduleDescriptionLimit - 3
+		for cut > 0 && !utf8.RuneStart(description[cut]) {
+			cut--
+		}
+		description = description[:cut] + "..."
+	}
+	return description
+}
+
+// scheduledTaskDefinition returns the task definition ARN for the rule. A task definition given as a family, without a
+// revision or selector, is scheduled by its family ARN, so that each run uses the latest revision, as overrun would. A
+// task definition file is not registered during a dry-run, so its family is shown instead.
+func scheduledTaskDefinition(prefs *ParsedArgs, ctx *ExecutionContext) string {
+	if ctx.TaskDefinition.TaskDefinitionArn == nil {
+		return aws.StringValue(ctx.TaskDefinition.Family)
+	}
+	arn := *ctx.TaskDefinition.TaskDefinitionArn
+	selector, _ := ParseTaskDefSelector(prefs.TaskDef)
+	if len(prefs.TaskDefFile) == 0 && selector == nil && !strings.Contains(path.Base(prefs.TaskDef), ":") {
+		if i := strings.LastIndex(arn, ":"); i > strings.LastIndex(arn, "/") {
+			arn = arn[:i]
+		}
+	}
+	return arn
+}
+
+// scheduleClusterArn returns the ARN of the target's cluster, which must exist. A dry-run shows the cluster as given,
+// without looking it up.
+func scheduleClusterArn(prefs *ParsedArgs, ctx *ExecutionContext) (*string, error) {
+	if prefs.DryRun {
+		return aws.String(ctx.Target.Cluster), nil
+	}
+	dcInput := ecs.DescribeClustersInput{Clusters: []string{ctx.Target.Cluster}}
+	dcResult, err := ctx.Ecs.DescribeClusters(&dcInput)
+	if err != nil {
+		return nil, err
+	} else if len(dcResult.Clusters) == 0 || dcResult.Clusters[0].ClusterArn == nil {
+		return nil, fmt.Errorf("cluster %s not found", ctx.Target.Cluster)
+	}
+	return dcResult.Clusters[0].ClusterArn, nil
+}
+
+// buildScheduleTarget translates the RunTask input and overrides of a target into an EventBridge ECS target. Returns
+// the RunTask members that the vendored SDK cannot express, converted for the target's EcsParameters.
+func buildScheduleTarget(prefs *ParsedArgs, ctx *ExecutionContext, job *TaskJob) (*cloudwatchevents.Target, JSONMembers, error) {
+	clusterArn, err := scheduleClusterArn(prefs, ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	overrides, err := jsonutil.BuildJSON(buildOverrides(prefs, ctx, job))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// the target input holds the task overrides, so additional override members belong there.
+	extras := JSONMembers{}.Merge(ctx.RunTaskExtras)
+	if extraOverrides, ok := extras["overrides"]; ok {
+		var generic map[string]interface{}
+		if err := json.Unmarshal(overrides, &generic); err != nil {
+			return nil, nil, err
+		}
+		if overrides, err = json.Marshal(mergeJSON(generic, extraOverrides)); err != nil {
+			return nil, nil, err
+		}
+		delete(extras, "overrides")
+	}
+	// EventBridge names the members of capacity provider strategy items as ECS does, so they are not converted.
+	strategy, hasStrategy := extras["capacityProviderStrategy"]
+	delete(extras, "capacityProviderStrategy")
+
+	input := ctx.RunTaskInput
+	params := cloudwatchevents.EcsParameters{
+		Group:             input.Group,
+		PlatformVersion:   input.PlatformVersion,
+		TaskCount:         aws.Int64(1),
+		TaskDefinitionArn: aws.String(scheduledTaskDefinition(prefs, ctx))}
+	if !hasStrategy {
+		params.LaunchType = cloudwatchevents.LaunchType(input.LaunchType)
+	}
+	if input.NetworkConfiguration != nil && input.NetworkConfiguration.AwsvpcConfiguration != nil {
+		awsvpc := input.NetworkConfiguration.AwsvpcConfiguration
+		params.NetworkConfiguration = &cloudwatchevents.NetworkConfiguration{
+			AwsvpcConfiguration: &cloudwatchevents.AwsVpcConfiguration{
+				Subnets:        awsvpc.Subnets,
+				SecurityGroups: awsvpc.SecurityGroups,
+				AssignPublicIp: cloudwatchevents.AssignPublicIp(awsvpc.AssignPublicIp)}}
+	}
+
+	// the vendored SDK's EcsParameters lack the tagging members.
+	if len(input.Tags) > 0 {
+		tags := make([]interface{}, len(input.Tags))
+		for i, tag := range input.Tags {
+			tags[i] = JSONMembers{"key": aws.StringValue(tag.Key), "value": aws.StringValue(tag.Value)}
+		}
+		extras["tags"] = tags
+	}
+	if len(input.PropagateTags) > 0 {
+		extras["propagateTags"] = string(input.PropagateTags)
+	}
+	if aws.BoolValue(input.EnableECSManagedTags) {
+		extras["enableECSManagedTags"] = true
+	}
+
+	target := cloudwatchevents.Target{
+		Id:            aws.String(scheduleTargetId(ctx.Target.Cluster)),
+		Arn:           clusterArn,
+		RoleArn:       aws.String(prefs.ScheduleRoleArn),
+		EcsParameters: &params,
+		Input:         aws.String(string(overrides))}
+	members := extras.PascalCase()
+	if hasStrategy {
+		members["CapacityProviderStrategy"] = strategy
+	}
+	return &target, members, nil
+}
+
+// putSchedule creates or updates the rule and its targets in one region, and removes targets for clusters that are no
+// longer part of the schedule.
+func putSchedule(awsCfg aws.Config, rule *cloudwatchevents.PutRuleInput, targets []cloudwatchevents.Target, extras []JSONMembers) error {
+	events := cloudwatchevents.New(awsCfg)
+	if _, err := events.PutRuleRequest(rule).Send(); err != nil {
+		return err
+	}
+
+	ptInput := cloudwatchevents.PutTargetsInput{Rule: rule.Name, Targets: targets}
+	targetExtras := make([]interface{}, len(extras))
+	for i, members := range extras {
+		targetExtras[i] = JSONMembers{"EcsParameters": members}
+	}
+	req := events.PutTargetsRequest(&ptInput)
+	req.ApplyOptions(WithJSONMembers(JSONMembers{"Targets": targetExtras}))
+	ptResult, err := req.Send()
+	if err != nil {
+		return err
+	}
+	if len(ptResult.FailedEntries) > 0 {
+		failed := ptResult.FailedEntries[0]
+		return fmt.Errorf("failed to put target %s: %s", aws.StringValue(failed.TargetId), aws.StringValue(failed.ErrorMessage))
+	}
+
+	current := make(map[string]bool, len(targets))
+	for _, target := range targets {
+		current[*target.Id] = true
+	}
+	existing, err := listScheduleTargets(events, *rule.Name)
+	if err != nil {
+		return err
+	}
+	var stale []string
+	for _, target := range existing {
+		if strings.HasPrefix(*target.Id, ScheduleTargetIdPrefix) && !current[*target.Id] {
+			stale = append(stale, *target.Id)
+		}
+	}
+	if len(stale) > 0 {
+		rtInput := cloudwatchevents.RemoveTargetsInput{Rule: rule.Name, Ids: stale}
+		if _, err := events.RemoveTargetsRequest(&rtInput).Send(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func listScheduleTargets(events *cloudwatchevents.CloudWatchEvents, rule string) ([]cloudwatchevents.Target, error) {
+	var targets []cloudwatchevents.Target
+	input := cloudwatchevents.ListTargetsByRuleInput{Rule: &rule}
+	for {
+		result, err := events.ListTargetsByRuleRequest(&input).Send()
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, result.Targets...)
+		if result.NextToken == nil {
+			return targets, nil
+		}
+		input.NextToken = result.NextToken
+	}
+}
+
+// listSchedules returns the rules created by overrun.
+func listSchedules(events *cloudwatchevents.CloudWatchEvents) ([]cloudwatchevents.Rule, error) {
+	var rules []cloudwatchevents.Rule
+	input := cloudwatchevents.ListRulesInput{}
+	for {
+		result, err := events.ListRulesRequest(&input).Send()
+		if err != nil {
+			return nil, err
+		}
+		for _, rule := range result.Rules {
+			if strings.HasPrefix(aws.StringValue(rule.Description), ScheduleDescriptionPrefix) {
+				rules = append(rules, rule)
+			}
+		}
+		if result.NextToken == nil {
+			return rules, nil
+		}
+		input.NextToken = result.NextToken
+	}
+}
+
+// scheduleRegions returns the regions given by --region, or the default region.
+func scheduleRegions(prefs *ParsedArgs, awsCfg aws.Config) []string {
+	if len(prefs.AwsRegions) > 0 {
+		return prefs.AwsRegions
+	}
+	return []string{awsCfg.Region}
+}
+
+// scheduleCommand runs the schedule subcommand, which creates or updates an EventBridge rule that runs the task
+// described by the remaining arguments on a schedule.
+func scheduleCommand(args []string) {
+	if len(args) > 0 {
+		switch args[0] {
+		case "ls":
+			scheduleListCommand(args[1:])
+			return
+		case "rm":
+			scheduleRemoveCommand(args[1:])
+			return
+		}
+	}
+
+	parser := loadArgs("schedule", args)
+	prefs := parser.Args()
+	if len(prefs.ScheduleName) == 0 || len(prefs.ScheduleExpression) == 0 {
+		log.Fatal("Specify the --name of the schedule and its --cron expression.")
+	} else if len(prefs.ScheduleRoleArn) == 0 {
+		log.Fatal("Specify the --schedule-role that EventBridge assumes to run the task.")
+	} else if len(prefs.TaskDef) == 0 && len(prefs.TaskDefFile) == 0 {
+		log.Fatal("You must specify a --task-def or a --task-def-file.")
+	} else if len(prefs.TaskDef) > 0 && len(prefs.TaskDefFile) > 0 {
+		log.Fatal("Specify only one of --task-def or --task-def-file.")
+	} else if prefs.IsFanOut() || prefs.Interactive || prefs.DeregisterTaskDef || len(prefs.Artifacts) > 0 {
+		log.Fatal("Scheduled tasks cannot use --count, --commands-file, --interactive, --deregister or --artifact.")
+	}
+
+	if err := applyDefaultTags(&prefs); err != nil {
+		log.Fatal(err)
+	}
+
+	awsCfg := loadAwsConfig(&prefs)
+	targets, err := buildTargets(&prefs)
+	if err != nil {
+		log.Fatal(err)
+	} else if len(targets) == 0 {
+		log.Fatal("No --cluster specified. Specify 'default' to run on the the default cluster.")
+	}
+
+	var stdin *StdinInput
+	if prefs.Stdin {
+		// staged input would outlive its presigned URL, so only inline input can be scheduled.
+		if stdin, err = prepareStdin(&prefs, nil); err != nil {
+			log.Fatal(err)
+		}
+	}
+	jobs, err := buildJobs(&prefs, stdin)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	rule := cloudwatchevents.PutRuleInput{
+		Name:               aws.String(prefs.ScheduleName),
+		ScheduleExpression: aws.String(ScheduleExpression(prefs.ScheduleExpression)),
+		Description:        aws.String(scheduleDescription(args)),
+		State:              cloudwatchevents.RuleStateEnabled}
+
+	// rules are regional, so each region gets a rule with a target for each of its clusters.
+	var regions []string
+	regionCfgs := make(map[string]aws.Config)
+	regionTargets := make(map[string][]cloudwatchevents.Target)
+	regionExtras := make(map[string][]JSONMembers)
+	inv := Invocation{}
+	for _, target := range targets {
+		label := ""
+		if len(targets) > 1 {
+			label = target.String() + " "
+		}
+		ctx, err := newTargetContext(&prefs, awsCfg, &inv, target, label)
+		if err != nil {
+			log.Fatalf("%s%s", label, err)
+		}
+		eventTarget, extras, err := buildScheduleTarget(&prefs, ctx, &jobs[0])
+		if err != nil {
+			log.Fatalf("%s%s", label, err)
+		}
+		region := ctx.AwsConfig.Region
+		if _, ok := regionCfgs[region]; !ok {
+			regions = append(regions, region)
+			regionCfgs[region] = *ctx.AwsConfig
+		}
+		regionTargets[region] = append(regionTargets[region], *eventTarget)
+		regionExtras[region] = append(regionExtras[region], extras)
+	}
+
+	for _, region := range regions {
+		if prefs.DryRun {
+			log.Printf("%s: %s\n", region, rule.String())
+			for i, target := range regionTargets[region] {
+				log.Printf("%s: %s\n", region, target.String())
+				if len(regionExtras[region][i]) > 0 {
+					log.Printf("%s: Additional EcsParameters members: %s\n", region, regionExtras[region][i].String())
+				}
+			}
+			continue
+		}
+		if err := putSchedule(regionCfgs[region], &rule, regionTargets[region], regionExtras[region]); err != nil {
+			log.Fatalf("%s: %s", region, err)
+		}
+		log.Printf("Scheduled %s in %s: %s\n", prefs.ScheduleName, region, *rule.ScheduleExpression)
+	}
+}
+
+// scheduleListCommand lists the schedules created by overrun in each region.
+func scheduleListCommand(args []string) {
+	parser := loadCommandArgs("schedule", args)
+	prefs := parser.Args()
+	awsCfg := loadAwsConfig(&prefs)
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "REGION\tNAME\tSCHEDULE\tSTATE\tCLUSTERS\tCOMMAND")
+	for _, region := range scheduleRegions(&prefs, awsCfg) {
+		cfg := awsCfg.Copy()
+		cfg.Region = region
+		events := cloudwatchevents.New(cfg)
+		rules, err := listSchedules(events)
+		if err != nil {
+			log.Fatalf("%s: %s", region, err)
+		}
+		for _, rule := range rules {
+			targets, err := listScheduleTargets(events, *rule.Name)
+			if err != nil {
+				log.Fatalf("%s: %s", region, err)
+			}
+			var clusters []string
+			for _, target := range targets {
+				if target.EcsParameters != nil && target.Arn != nil {
+					clusters = append(clusters, path.Base(*target.Arn))
+				}
+			}
+			sort.Strings(clusters)
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", region, *rule.Name, aws.StringValue(rule.ScheduleExpression), rule.State,
+				strings.Join(clusters, ","), strings.TrimPrefix(*rule.Description, ScheduleDescriptionPrefix))
+		}
+	}
+	tw.Flush()
+}
+
+// scheduleRemoveCommand deletes the named schedules and their targets from each region.
+func scheduleRemoveCommand(args []string) {
+	parser := loadCommandArgs("schedule", args)
+	prefs := parser.Args()
+	names := parser.Positional
+	if len(prefs.ScheduleName) > 0 {
+		names = append(names, prefs.ScheduleName)
+	}
+	if len(names) == 0 {
+		log.Fatal("Specify the name of the schedule to remove.")
+	}
+	awsCfg := loadAwsConfig(&prefs)
+
+	failed := false
+	for _, region := range scheduleRegions(&prefs, awsCfg) {
+		cfg := awsCfg.Copy()
+		cfg.Region = region
+		events := cloudwatchevents.New(cfg)
+		for _, name := range names {
+			if err := removeSchedule(events, name, prefs.DryRun); err != nil {
+				log.Printf("%s: %s\n", region, err)
+				failed = true
+			} else if prefs.DryRun {
+				log.Printf("Would remove %s from %s.\n", name, region)
+			} else {
+				log.Printf("Removed %s from %s.\n", name, region)
+			}
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func removeSchedule(events *cloudwatchevents.CloudWatchEvents, name string, dryRun bool) error {
+	drInput := cloudwatchevents.DescribeRuleInput{Name: &name}
+	drResult, err := events.DescribeRuleRequest(&drInput).Send()
+	if err != nil {
+		return err
+	} else if !strings.HasPrefix(aws.StringValue(drResult.Description), ScheduleDescriptionPrefix) {
+		return errors.New("refusing to remove rule " + name + ", which was not created by overrun schedule")
+	}
+
+	targets, err := listScheduleTargets(events, name)
+	if err != nil {
+		return err
+	}
+	if dryRun {
+		return nil
+	}
+	if len(targets) > 0 {
+		ids := make([]string, len(targets))
+		for i, target := range targets {
+			ids[i] = *target.Id
+		}
+		rtInput := cloudwatchevents.RemoveTargetsInput{Rule: &name, Ids: ids}
+		if _, err := events.RemoveTargetsRequest(&rtInput).Send(); err != nil {
+			return err
+		}
+	}
+	_, err = events.DeleteRuleRequest(&cloudwatchevents.DeleteRuleInput{Name: &name}).Send()
+	return err
+}
@@ -0,0 +1,145 @@
+/*
+ * Copyright 2018 Mark Adamcin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchevents"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestBuildScheduleTarget(t *testing.T) {
+	dir, err := ioutil.TempDir("", "overrun-schedule-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	taskDefFile := filepath.Join(dir, "report.json")
+	taskDef := `{"family": "report", "containerDefinitions": [{"name": "report", "image": "example/report:1.0"}]}`
+	if err := ioutil.WriteFile(taskDefFile, []byte(taskDef), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		args       []string
+		clusterArn string
+		taskDef    string
+		launchType cloudwatchevents.LaunchType
+		extras     string
+	}{
+		{
+			name:       "latest revision of a family",
+			args:       []string{"-t", "app"},
+			clusterArn: fakeAccountArn + "cluster/main",
+			taskDef:    fakeAccountArn + "task-definition/app",
+			launchType: cloudwatchevents.LaunchTypeEc2,
+			extras:     "{}",
+		},
+		{
+			name:       "capacity provider strategy",
+			args:       []string{"-t", "app:1", "--capacity-provider", "FARGATE_SPOT:3", "--tag", "team=data"},
+			clusterArn: fakeAccountArn + "cluster/main",
+			taskDef:    fakeAccountArn + "task-definition/app:1",
+			extras: `{"CapacityProviderStrategy": [{"capacityProvider": "FARGATE_SPOT", "weight": 3}],
+				"Tags": [{"Key": "team", "Value": "data"}]}`,
+		},
+		{
+			name:       "dry-run",
+			args:       []string{"-t", "app", "--dry-run"},
+			clusterArn: "main",
+			taskDef:    fakeAccountArn + "task-definition/app",
+			launchType: cloudwatchevents.LaunchTypeEc2,
+			extras:     "{}",
+		},
+		{
+			name:       "dry-run of a task definition file",
+			args:       []string{"--task-def-file", taskDefFile, "--dry-run"},
+			clusterArn: "main",
+			taskDef:    "report",
+			launchType: cloudwatchevents.LaunchTypeEc2,
+			extras:     "{}",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := newRunBackend()
+			args := append([]string{"-c", "main", "--name", "nightly", "--cron", "0 3 * * ? *"}, test.args...)
+			prefs := parseCommandTestArgs("schedule", nil, args...).Args()
+			ctx, err := newTargetContext(&prefs, aws.Config{Region: "us-east-1"}, &Invocation{Backend: b},
+				Target{Cluster: "main"}, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			jobs, err := buildJobs(&prefs, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			target, extras, err := buildScheduleTarget(&prefs, ctx, &jobs[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if prefs.DryRun && b.clusterCalls > 0 {
+				t.Error("described the cluster during a dry-run")
+			}
+			params := target.EcsParameters
+			if aws.StringValue(target.Arn) != test.clusterArn || aws.StringValue(params.TaskDefinitionArn) != test.taskDef ||
+				params.LaunchType != test.launchType {
+				t.Errorf("unexpected target:\n%s", target)
+			}
+			if !jsonEqual(t, extras, test.extras) {
+				t.Errorf("got extras %s, want %s", extras, test.extras)
+			}
+		})
+	}
+}
+
+func TestScheduleDescription(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{"plain", []string{"-t", "report", "--cron", "0 3 * * ? *"},
+			"overrun schedule -t report --cron '0 3 * * ? *'"},
+		{"env values", []string{"-e", "TOKEN=s3cret", "--env", "REGION", "--env", "EMPTY=", "-t", "report"},
+			"overrun schedule -e 'TOKEN=<redacted>' --env REGION --env 'EMPTY=<redacted>' -t report"},
+		{"env file", []string{"--env-file", "secrets.env", "-t", "report"},
+			"overrun schedule --env-file '<redacted>' -t report"},
+		{"command", []string{"-t", "report", "--", "report", "-e", "x=1"},
+			"overrun schedule -t report -- report -e x=1"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := scheduleDescription(test.args); got != ScheduleDescriptionPrefix+test.want {
+				t.Errorf("got %q, want %q", got, ScheduleDescriptionPrefix+test.want)
+			}
+		})
+	}
+
+	long := scheduleDescription([]string{"-t", "report", "--", strings.Repeat("é", scheduleDescriptionLimit)})
+	if len(long) > scheduleDescriptionLimit || !strings.HasSuffix(long, "...") || !utf8.ValidString(long) {
+		t.Errorf("unexpected truncated description %q", long)
+	}
+}
@@ -0,0 +1,614 @@
+/*
+ * Copyright 2018 Mark Adamcin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// An ECS Exec session is an SSM Session Manager session. Once ExecuteCommand returns a stream URL and token, the client
+// opens a websocket to the stream URL and exchanges binary messages on it, which is what the session-manager-plugin
+// does for the AWS CLI. This file implements the subset of that data channel protocol needed for shell and port
+// forwarding sessions without KMS encryption.
+
+const SessionClientVersion = "1.2.0.0"
+
+// message types of the data channel.
+const (
+	MessageTypeInputStream      = "input_stream_data"
+	MessageTypeOutputStream     = "output_stream_data"
+	MessageTypeAcknowledge      = "acknowledge"
+	MessageTypeChannelClosed    = "channel_closed"
+	MessageTypeStartPublication = "start_publication"
+	MessageTypePausePublication = "pause_publication"
+)
+
+// payload types of input and output stream messages.
+const (
+	PayloadTypeOutput               = 1
+	PayloadTypeError                = 2
+	PayloadTypeSize                 = 3
+	PayloadTypeParameter            = 4
+	PayloadTypeHandshakeRequest     = 5
+	PayloadTypeHandshakeResponse    = 6
+	PayloadTypeHandshakeComplete    = 7
+	PayloadTypeEncChallengeRequest  = 8
+	PayloadTypeEncChallengeResponse = 9
+	PayloadTypeFlag                 = 10
+	PayloadTypeStdErr               = 11
+	PayloadTypeExitCode             = 12
+)
+
+// handshake action statuses.
+const (
+	ActionStatusSuccess     = 1
+	ActionStatusFailed      = 2
+	ActionStatusUnsupported = 3
+)
+
+// flags sent with PayloadTypeFlag by port forwarding sessions.
+const (
+	FlagDisconnectToPort = 1
+	FlagTerminateSession = 2
+	FlagConnectToPortErr = 3
+)
+
+// the layout of the message header. The header length field counts the bytes that follow it up to the payload length.
+const (
+	messageHeaderLength    = 116
+	messageTypeLength      = 32
+	messagePayloadOffset   = 4 + messageHeaderLength
+	sessionResendTimeout   = 3 * time.Second
+	sessionPingInterval    = 5 * time.Minute
+	sessionInputChunkBytes = 1024
+)
+
+// SessionMessage is a single data channel message.
+type SessionMessage struct {
+	MessageType    string
+	SchemaVersion  uint32
+	CreatedDate    uint64
+	SequenceNumber int64
+	Flags          uint64
+	MessageId      [16]byte
+	PayloadType    uint32
+	Payload        []byte
+}
+
+// NewMessageId returns a random UUID for identifying messages, requests and clients.
+func NewMessageId() [16]byte {
+	var id [16]byte
+	_, _ = rand.Read(id[:])
+	id[6] = (id[6] & 0x0f) | 0x40
+	id[8] = (id[8] & 0x3f) | 0x80
+	return id
+}
+
+func FormatUUID(id [16]byte) string {
+	return fmt.Sprintf("%x-%x-%x-%x-%x", id[0:4], id[4:6], id[6:8], id[8:10], id[10:16])
+}
+
+// MarshalBinary encodes the message. The message ID is written with its least significant half first, as the agent
+// expects.
+func (m *SessionMessage) MarshalBinary() ([]byte, error) {
+	if len(m.MessageType) > messageTypeLength {
+		return nil, errors.New("message type too long: " + m.MessageType)
+	}
+	var buf bytes.Buffer
+	_ = binary.Write(&buf, binary.BigEndian, uint32(messageHeaderLength))
+	buf.WriteString(m.MessageType)
+	buf.WriteString(strings.Repeat(" ", messageTypeLength-len(m.MessageType)))
+	_ = binary.Write(&buf, binary.BigEndian, m.SchemaVersion)
+	_ = binary.Write(&buf, binary.BigEndian, m.CreatedDate)
+	_ = binary.Write(&buf, binary.BigEndian, m.SequenceNumber)
+	_ = binary.Write(&buf, binary.BigEndian, m.Flags)
+	buf.Write(m.MessageId[8:16])
+	buf.Write(m.MessageId[0:8])
+	digest := sha256.Sum256(m.Payload)
+	buf.Write(digest[:])
+	_ = binary.Write(&buf, binary.BigEndian, m.PayloadType)
+	_ = binary.Write(&buf, binary.BigEndian, uint32(len(m.Payload)))
+	buf.Write(m.Payload)
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary decodes the message, verifying the payload digest.
+func (m *SessionMessage) UnmarshalBinary(data []byte) error {
+	if len(data) < messagePayloadOffset {
+		return fmt.Errorf("message too short: %d bytes", len(data))
+	}
+	headerLength := binary.BigEndian.Uint32(data[0:4])
+	if headerLength != messageHeaderLength {
+		return fmt.Errorf("unexpected message header length: %d", headerLength)
+	}
+	m.MessageType = strings.TrimRight(string(data[4:36]), " \x00")
+	m.SchemaVersion = binary.BigEndian.Uint32(data[36:40])
+	m.CreatedDate = binary.BigEndian.Uint64(data[40:48])
+	m.SequenceNumber = int64(binary.BigEndian.Uint64(data[48:56]))
+	m.Flags = binary.BigEndian.Uint64(data[56:64])
+	copy(m.MessageId[8:16], data[64:72])
+	copy(m.MessageId[0:8], data[72:80])
+	m.PayloadType = binary.BigEndian.Uint32(data[112:116])
+	payloadLength := binary.BigEndian.Uint32(data[116:120])
+	if uint32(len(data)-messagePayloadOffset) < payloadLength {
+		return fmt.Errorf("message payload truncated: expected %d bytes, got %d", payloadLength, len(data)-messagePayloadOffset)
+	}
+	m.Payload = data[messagePayloadOffset : messagePayloadOffset+int(payloadLength)]
+	if digest := sha256.Sum256(m.Payload); !bytes.Equal(digest[:], data[80:112]) {
+		return errors.New("message payload digest mismatch")
+	}
+	return nil
+}
+
+type openDataChannelInput struct {
+	MessageSchemaVersion string
+	RequestId            string
+	TokenValue           string
+	ClientId             string
+	ClientVersion        string
+}
+
+type acknowledgeContent struct {
+	AcknowledgedMessageType           string
+	AcknowledgedMessageId             string
+	AcknowledgedMessageSequenceNumber int64
+	IsSequentialMessage               bool
+}
+
+type handshakeAction struct {
+	ActionType       string
+	ActionParameters json.RawMessage
+}
+
+type handshakeRequest struct {
+	AgentVersion           string
+	RequestedClientActions []handshakeAction
+}
+
+type processedClientAction struct {
+	ActionType   string
+	ActionStatus int
+	ActionResult json.RawMessage `json:",omitempty"`
+	Error        string
+}
+
+type handshakeResponse struct {
+	ClientVersion          string
+	ProcessedClientActions []processedClientAction
+	Errors                 []string
+}
+
+type channelClosed struct {
+	MessageId     string
+	CreatedDate   string
+	SessionId     string
+	SchemaVersion int
+	Output        string
+}
+
+// TerminalSize is the payload of PayloadTypeSize messages.
+type TerminalSize struct {
+	Cols int `json:"cols"`
+	Rows int `json:"rows"`
+}
+
+// Session is an open data channel. Output payloads are written to Stdout, and stderr payloads to Stderr.
+type Session struct {
+	SessionId string
+
+	// the session type requested by the agent during the handshake, such as InteractiveCommands or Port.
+	SessionType string
+
+	// the version of the agent, reported by its handshake request.
+	AgentVersion string
+
+	Stdout io.Writer
+	Stderr io.Writer
+
+	// set when the agent reports the exit code of a non-interactive command.
+	ExitCode *int
+
+	// OnFlag is called for each flag payload received, such as FlagConnectToPortErr from port forwarding sessions.
+	OnFlag func(flag uint32)
+
+	conn *websocket.Conn
+
+	writeLock sync.Mutex
+
+	lock sync.Mutex
+
+	// signaled when the handshake completes, when publication resumes, and when the session ends.
+	cond *sync.Cond
+
+	ready bool
+
+	paused bool
+
+	closed bool
+
+	err error
+
+	outSeq int64
+
+	unacked map[int64]*sentMessage
+
+	inSeq int64
+
+	pending map[int64]*SessionMessage
+
+	done chan struct{}
+}
+
+type sentMessage struct {
+	data   []byte
+	sentAt time.Time
+}
+
+// OpenSession dials the stream URL and opens the data channel with the session token.
+func OpenSession(streamUrl string, token string, sessionId string) (*Session, error) {
+	conn, _, err := websocket.DefaultDialer.Dial(streamUrl, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to session %s: %s", sessionId, err)
+	}
+
+	s := &Session{
+		SessionId: sessionId,
+		conn:      conn,
+		unacked:   make(map[int64]*sentMessage),
+		pending:   make(map[int64]*SessionMessage),
+		done:      make(chan struct{})}
+	s.cond = sync.NewCond(&s.lock)
+
+	open := openDataChannelInput{
+		MessageSchemaVersion: "1.0",
+		RequestId:            FormatUUID(NewMessageId()),
+		TokenValue:           token,
+		ClientId:             FormatUUID(NewMessageId()),
+		ClientVersion:        SessionClientVersion}
+	data, _ := json.Marshal(open)
+	if err := s.write(websocket.TextMessage, data); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to open session %s: %s", sessionId, err)
+	}
+	return s, nil
+}
+
+func (s *Session) write(messageType int, data []byte) error {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	return s.conn.WriteMessage(messageType, data)
+}
+
+func (s *Session) writeMessage(msg *SessionMessage) ([]byte, error) {
+	msg.SchemaVersion = 1
+	msg.CreatedDate = uint64(time.Now().UnixNano() / int64(time.Millisecond))
+	msg.MessageId = NewMessageId()
+	data, err := msg.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return data, s.write(websocket.BinaryMessage, data)
+}
+
+// send writes an input_stream_data message with the next sequence number, keeping it for resending until it is
+// acknowledged.
+func (s *Session) send(payloadType uint32, payload []byte) error {
+	s.lock.Lock()
+	seq := s.outSeq
+	s.outSeq++
+	s.lock.Unlock()
+
+	msg := SessionMessage{MessageType: MessageTypeInputStream, SequenceNumber: seq, PayloadType: payloadType, Payload: payload}
+	data, err := s.writeMessage(&msg)
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	s.unacked[seq] = &sentMessage{data: data, sentAt: time.Now()}
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *Session) acknowledge(msg *SessionMessage) error {
+	content, _ := json.Marshal(acknowledgeContent{
+		AcknowledgedMessageType:           msg.MessageType,
+		AcknowledgedMessageId:             FormatUUID(msg.MessageId),
+		AcknowledgedMessageSequenceNumber: msg.SequenceNumber,
+		IsSequentialMessage:               true})
+	ack := SessionMessage{MessageType: MessageTypeAcknowledge, Flags: 3, PayloadType: 0, Payload: content}
+	_, err := s.writeMessage(&ack)
+	return err
+}
+
+// waitReady blocks until the handshake is complete and publication is not paused. Returns false if the session ended.
+func (s *Session) waitReady() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for !s.closed && (!s.ready || s.paused) {
+		s.cond.Wait()
+	}
+	return !s.closed
+}
+
+func (s *Session) setReady() {
+	s.lock.Lock()
+	s.ready = true
+	s.lock.Unlock()
+	s.cond.Broadcast()
+}
+
+// Write sends input to the session in chunks, once the session is ready to accept it.
+func (s *Session) Write(data []byte) (int, error) {
+	written := 0
+	for written < len(data) {
+		if !s.waitReady() {
+			return written, io.ErrClosedPipe
+		}
+		end := written + sessionInputChunkBytes
+		if end > len(data) {
+			end = len(data)
+		}
+		chunk := append([]byte{}, data[written:end]...)
+		if err := s.send(PayloadTypeOutput, chunk); err != nil {
+			return written, err
+		}
+		written = end
+	}
+	return written, nil
+}
+
+// SetSize reports the dimensions of the local terminal.
+func (s *Session) SetSize(cols int, rows int) error {
+	if !s.waitReady() {
+		return io.ErrClosedPipe
+	}
+	payload, _ := json.Marshal(TerminalSize{Cols: cols, Rows: rows})
+	return s.send(PayloadTypeSize, payload)
+}
+
+// SendFlag sends a flag payload, such as FlagTerminateSession.
+func (s *Session) SendFlag(flag uint32) error {
+	if !s.waitReady() {
+		return io.ErrClosedPipe
+	}
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, flag)
+	return s.send(PayloadTypeFlag, payload)
+}
+
+// Done is closed when the session ends.
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+// Close ends the session and closes the websocket.
+func (s *Session) Close() error {
+	s.finish(nil)
+	return s.conn.Close()
+}
+
+func (s *Session) finish(err error) {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return
+	}
+	s.closed = true
+	s.err = err
+	s.lock.Unlock()
+	s.cond.Broadcast()
+	close(s.done)
+}
+
+// Run reads messages until the agent closes the channel or the connection fails.
+func (s *Session) Run() error {
+	go s.keepAlive()
+	for {
+		messageType, data, err := s.conn.ReadMessage()
+		if err != nil {
+			s.lock.Lock()
+			closed := s.closed
+			s.lock.Unlock()
+			if closed {
+				return s.err
+			}
+			s.finish(err)
+			return err
+		}
+		if messageType != websocket.BinaryMessage {
+			continue
+		}
+
+		msg := SessionMessage{}
+		if err := msg.UnmarshalBinary(data); err != nil {
+			// unacknowledged messages are resent by the agent.
+			continue
+		}
+		if done, err := s.receive(&msg); done {
+			s.finish(err)
+			s.conn.Close()
+			return err
+		}
+	}
+}
+
+// keepAlive pings the websocket and resends unacknowledged input until the session ends.
+func (s *Session) keepAlive() {
+	resend := time.NewTicker(time.Second)
+	ping := time.NewTicker(sessionPingInterval)
+	defer resend.Stop()
+	defer ping.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ping.C:
+			s.writeLock.Lock()
+			_ = s.conn.WriteControl(websocket.PingMessage, []byte("keepalive"), time.Now().Add(10*time.Second))
+			s.writeLock.Unlock()
+		case now := <-resend.C:
+			var stale [][]byte
+			s.lock.Lock()
+			for _, sent := range s.unacked {
+				if now.Sub(sent.sentAt) > sessionResendTimeout {
+					stale = append(stale, sent.data)
+					sent.sentAt = now
+				}
+			}
+			s.lock.Unlock()
+			for _, data := range stale {
+				_ = s.write(websocket.BinaryMessage, data)
+			}
+		}
+	}
+}
+
+// receive handles a single message. Returns true when the session is over.
+func (s *Session) receive(msg *SessionMessage) (bool, error) {
+	switch msg.MessageType {
+	case MessageTypeAcknowledge:
+		ack := acknowledgeContent{}
+		if err := json.Unmarshal(msg.Payload, &ack); err == nil {
+			s.lock.Lock()
+			delete(s.unacked, ack.AcknowledgedMessageSequenceNumber)
+			s.lock.Unlock()
+		}
+	case MessageTypePausePublication:
+		s.lock.Lock()
+		s.paused = true
+		s.lock.Unlock()
+	case MessageTypeStartPublication:
+		s.lock.Lock()
+		s.paused = false
+		s.lock.Unlock()
+		s.cond.Broadcast()
+	case MessageTypeChannelClosed:
+		closed := channelClosed{}
+		_ = json.Unmarshal(msg.Payload, &closed)
+		if len(closed.Output) > 0 && s.Stderr != nil {
+			fmt.Fprintln(s.Stderr, closed.Output)
+		}
+		return true, nil
+	case MessageTypeOutputStream:
+		if err := s.acknowledge(msg); err != nil {
+			return true, err
+		}
+		if msg.SequenceNumber < s.inSeq {
+			// a duplicate of a message that was already processed.
+			return false, nil
+		}
+		s.pending[msg.SequenceNumber] = msg
+		for {
+			next, ok := s.pending[s.inSeq]
+			if !ok {
+				break
+			}
+			delete(s.pending, s.inSeq)
+			s.inSeq++
+			if err := s.process(next); err != nil {
+				return true, err
+			}
+		}
+	}
+	return false, nil
+}
+
+// process handles an output stream message in sequence.
+func (s *Session) process(msg *SessionMessage) error {
+	switch msg.PayloadType {
+	case PayloadTypeOutput:
+		// agents that predate the handshake send output immediately.
+		s.setReady()
+		if s.Stdout != nil {
+			if _, err := s.Stdout.Write(msg.Payload); err != nil {
+				return err
+			}
+		}
+	case PayloadTypeStdErr:
+		if s.Stderr != nil {
+			if _, err := s.Stderr.Write(msg.Payload); err != nil {
+				return err
+			}
+		}
+	case PayloadTypeHandshakeRequest:
+		return s.handshake(msg.Payload)
+	case PayloadTypeHandshakeComplete:
+		s.setReady()
+	case PayloadTypeExitCode:
+		if code, err := parseExitCode(msg.Payload); err == nil {
+			s.ExitCode = &code
+		}
+	case PayloadTypeFlag:
+		if len(msg.Payload) >= 4 && s.OnFlag != nil {
+			s.OnFlag(binary.BigEndian.Uint32(msg.Payload))
+		}
+	}
+	return nil
+}
+
+func parseExitCode(payload []byte) (int, error) {
+	var code int
+	if len(payload) == 4 {
+		return int(int32(binary.BigEndian.Uint32(payload))), nil
+	}
+	_, err := fmt.Sscanf(strings.TrimSpace(string(payload)), "%d", &code)
+	return code, err
+}
+
+// handshake answers the agent's handshake request. KMS encryption is declined, which makes the agent end the session
+// with an explanation, since it cannot continue without it.
+func (s *Session) handshake(payload []byte) error {
+	request := handshakeRequest{}
+	if err := json.Unmarshal(payload, &request); err != nil {
+		return fmt.Errorf("invalid session handshake: %s", err)
+	}
+
+	s.AgentVersion = request.AgentVersion
+	response := handshakeResponse{ClientVersion: SessionClientVersion, Errors: []string{}}
+	for _, action := range request.RequestedClientActions {
+		processed := processedClientAction{ActionType: action.ActionType}
+		switch action.ActionType {
+		case "SessionType":
+			params := struct{ SessionType string }{}
+			_ = json.Unmarshal(action.ActionParameters, &params)
+			s.SessionType = params.SessionType
+			processed.ActionStatus = ActionStatusSuccess
+		case "KMSEncryption":
+			processed.ActionStatus = ActionStatusFailed
+			processed.Error = "KMS encryption of session data is not supported by overrun"
+			response.Errors = append(response.Errors, processed.Error)
+		default:
+			processed.ActionStatus = ActionStatusUnsupported
+			processed.Error = "unsupported action " + action.ActionType
+		}
+		response.ProcessedClientActions = append(response.ProcessedClientActions, processed)
+	}
+
+	data, _ := json.Marshal(response)
+	return s.send(PayloadTypeHandshakeResponse, data)
+}
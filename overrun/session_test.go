@@ -0,0 +1,234 @@
+/*
+ * Copyright 2018 Mark Adamcin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSessionMessageBinary(t *testing.T) {
+	var id [16]byte
+	for i := range id {
+		id[i] = byte(i)
+	}
+	msg := SessionMessage{
+		MessageType:    MessageTypeInputStream,
+		SchemaVersion:  1,
+		CreatedDate:    1528459200000,
+		SequenceNumber: 42,
+		Flags:          3,
+		MessageId:      id,
+		PayloadType:    PayloadTypeOutput,
+		Payload:        []byte("ls -l\n")}
+	data, err := msg.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 4+messageHeaderLength+len(msg.Payload) {
+		t.Errorf("got %d bytes, want %d", len(data), 4+messageHeaderLength+len(msg.Payload))
+	}
+	if length := binary.BigEndian.Uint32(data[0:4]); length != 116 {
+		t.Errorf("got header length %d, want 116", length)
+	}
+	if !bytes.Equal(data[64:72], id[8:16]) || !bytes.Equal(data[72:80], id[0:8]) {
+		t.Errorf("got message ID %x, want its least significant half first", data[64:80])
+	}
+
+	decoded := SessionMessage{}
+	if err := decoded.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, msg) {
+		t.Errorf("got %+v, want %+v", decoded, msg)
+	}
+
+	corrupt := append([]byte{}, data...)
+	corrupt[len(corrupt)-1] ^= 1
+	if err := decoded.UnmarshalBinary(corrupt); err == nil || !strings.Contains(err.Error(), "digest mismatch") {
+		t.Errorf("got error %v for a corrupt payload, want digest mismatch", err)
+	}
+	if err := decoded.UnmarshalBinary(data[:len(data)-1]); err == nil || !strings.Contains(err.Error(), "truncated") {
+		t.Errorf("got error %v for a truncated payload, want truncated", err)
+	}
+	if _, err := (&SessionMessage{MessageType: strings.Repeat("x", 33)}).MarshalBinary(); err == nil {
+		t.Error("marshaled a message type longer than 32 bytes")
+	}
+}
+
+// agentStandIn plays the agent's end of a data channel on a websocket.
+type agentStandIn struct {
+	t    *testing.T
+	conn *websocket.Conn
+
+	// the open data channel request.
+	open openDataChannelInput
+
+	// the payloads of the input messages received, by sequence number, including resent copies.
+	input map[int64][]string
+
+	// the sequence numbers of the output messages acknowledged by the client.
+	acked map[int64]int
+
+	response handshakeResponse
+
+	nextSeq int64
+}
+
+func (a *agentStandIn) send(messageType string, seq int64, payloadType uint32, payload string) {
+	msg := SessionMessage{MessageType: messageType, SchemaVersion: 1, SequenceNumber: seq, MessageId: NewMessageId(),
+		PayloadType: payloadType, Payload: []byte(payload)}
+	data, _ := msg.MarshalBinary()
+	if err := a.conn.WriteMessage(websocket.BinaryMessage, data); err != nil {
+		a.t.Error(err)
+	}
+}
+
+func (a *agentStandIn) output(payloadType uint32, payload string) {
+	a.send(MessageTypeOutputStream, a.nextSeq, payloadType, payload)
+	a.nextSeq++
+}
+
+// serve requests a shell session, ignores the first copy of the client's command, and answers the copy that is resent
+// with output sent out of order, and then closes the channel.
+func (a *agentStandIn) serve() {
+	if _, data, err := a.conn.ReadMessage(); err != nil {
+		a.t.Error(err)
+		return
+	} else if err := json.Unmarshal(data, &a.open); err != nil {
+		a.t.Error(err)
+	}
+
+	a.output(PayloadTypeHandshakeRequest, `{"AgentVersion": "3.1.1511.0", "RequestedClientActions": [
+		{"ActionType": "SessionType", "ActionParameters": {"SessionType": "InteractiveCommands"}},
+		{"ActionType": "KMSEncryption", "ActionParameters": {"KMSKeyId": "alias/session"}}]}`)
+	for {
+		_, data, err := a.conn.ReadMessage()
+		if err != nil {
+			// the client closes the connection once the channel is closed.
+			return
+		}
+		msg := SessionMessage{}
+		if err := msg.UnmarshalBinary(data); err != nil {
+			a.t.Error(err)
+			return
+		}
+		if msg.MessageType == MessageTypeAcknowledge {
+			ack := acknowledgeContent{}
+			if err := json.Unmarshal(msg.Payload, &ack); err != nil {
+				a.t.Error(err)
+			}
+			a.acked[ack.AcknowledgedMessageSequenceNumber]++
+			continue
+		}
+
+		a.input[msg.SequenceNumber] = append(a.input[msg.SequenceNumber], string(msg.Payload))
+		if msg.PayloadType == PayloadTypeOutput && len(a.input[msg.SequenceNumber]) == 1 {
+			continue
+		}
+		ack, _ := json.Marshal(acknowledgeContent{AcknowledgedMessageType: msg.MessageType,
+			AcknowledgedMessageId: FormatUUID(msg.MessageId), AcknowledgedMessageSequenceNumber: msg.SequenceNumber})
+		a.send(MessageTypeAcknowledge, 0, 0, string(ack))
+
+		switch msg.PayloadType {
+		case PayloadTypeHandshakeResponse:
+			if err := json.Unmarshal(msg.Payload, &a.response); err != nil {
+				a.t.Error(err)
+			}
+			a.output(PayloadTypeHandshakeComplete, `{"HandshakeTimeToComplete": 1000000}`)
+		case PayloadTypeOutput:
+			a.send(MessageTypeOutputStream, a.nextSeq+1, PayloadTypeOutput, "world")
+			a.send(MessageTypeOutputStream, a.nextSeq, PayloadTypeOutput, "hello ")
+			a.send(MessageTypeOutputStream, a.nextSeq, PayloadTypeOutput, "hello ")
+			a.nextSeq += 2
+			a.output(PayloadTypeExitCode, "7")
+			a.send(MessageTypeChannelClosed, 0, 0, `{"SessionId": "session-1", "Output": "Exiting session"}`)
+		}
+	}
+}
+
+func TestSession(t *testing.T) {
+	agent := agentStandIn{t: t, input: make(map[int64][]string), acked: make(map[int64]int)}
+	served := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(served)
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		agent.conn = conn
+		agent.serve()
+	}))
+	defer server.Close()
+
+	session, err := OpenSession("ws"+strings.TrimPrefix(server.URL, "http"), "token-1", "session-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stdout, stderr bytes.Buffer
+	session.Stdout = &stdout
+	session.Stderr = &stderr
+	go func() {
+		if _, err := session.Write([]byte("ls\n")); err != nil {
+			t.Error(err)
+		}
+	}()
+	if err := session.Run(); err != nil {
+		t.Fatal(err)
+	}
+	<-served
+
+	if agent.open.TokenValue != "token-1" || agent.open.ClientVersion != SessionClientVersion {
+		t.Errorf("unexpected open data channel request: %+v", agent.open)
+	}
+	if session.SessionType != "InteractiveCommands" || session.AgentVersion != "3.1.1511.0" {
+		t.Errorf("got session type %s of agent %s", session.SessionType, session.AgentVersion)
+	}
+	var statuses []int
+	for _, action := range agent.response.ProcessedClientActions {
+		statuses = append(statuses, action.ActionStatus)
+	}
+	if !reflect.DeepEqual(statuses, []int{ActionStatusSuccess, ActionStatusFailed}) || len(agent.response.Errors) != 1 {
+		t.Errorf("unexpected handshake response: %+v", agent.response)
+	}
+	if !reflect.DeepEqual(agent.input[1], []string{"ls\n", "ls\n"}) {
+		t.Errorf("got input %q, want the unacknowledged command resent", agent.input[1])
+	}
+	for seq := int64(0); seq < agent.nextSeq; seq++ {
+		if agent.acked[seq] == 0 {
+			t.Errorf("output %d was not acknowledged", seq)
+		}
+	}
+	if stdout.String() != "hello world" {
+		t.Errorf("got output %q, want %q", stdout.String(), "hello world")
+	}
+	if session.ExitCode == nil || *session.ExitCode != 7 {
+		t.Errorf("got exit code %v, want 7", session.ExitCode)
+	}
+	if stderr.String() != "Exiting session\n" {
+		t.Errorf("got %q when the channel closed, want %q", stderr.String(), "Exiting session\n")
+	}
+}
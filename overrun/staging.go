@@ -0,0 +1,222 @@
+/*
+ * Copyright 2018 Mark Adamcin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+const StagingUrlScheme = "s3://"
+
+// StagingLocation is the S3 bucket and key prefix under which overrun stages input and output for tasks.
+type StagingLocation struct {
+	Bucket string
+	Prefix string
+}
+
+func (l StagingLocation) String() string {
+	return StagingUrlScheme + l.Bucket + "/" + l.Prefix
+}
+
+// ParseStagingUrl parses a --staging value in the form s3://bucket/prefix. The prefix may be omitted.
+func ParseStagingUrl(url string) (StagingLocation, error) {
+	if !strings.HasPrefix(url, StagingUrlScheme) {
+		return StagingLocation{}, errors.New("staging location must be an s3://bucket/prefix URL: " + url)
+	}
+	parts := strings.SplitN(strings.TrimPrefix(url, StagingUrlScheme), "/", 2)
+	location := StagingLocation{Bucket: parts[0]}
+	if len(parts) > 1 {
+		location.Prefix = strings.Trim(parts[1], "/")
+	}
+	if len(location.Bucket) == 0 {
+		return location, errors.New("staging location is missing a bucket: " + url)
+	}
+	return location, nil
+}
+
+// StagingRun tracks the objects staged by a single invocation, which are kept under a key prefix unique to the
+// invocation, so that they can all be deleted once the tasks have stopped.
+type StagingRun struct {
+	sync.Mutex
+
+	Location StagingLocation
+
+	Id string
+
+	awsCfg aws.Config
+
+	s3s *s3.S3
+
+	keys []string
+}
+
+func NewStagingRun(awsCfg aws.Config, location StagingLocation) *StagingRun {
+	suffix := make([]byte, 4)
+	_, _ = rand.Read(suffix)
+	return &StagingRun{
+		Location: location,
+		Id:       fmt.Sprintf("overrun-%s-%x", time.Now().UTC().Format("20060102T150405Z"), suffix),
+		awsCfg:   awsCfg}
+}
+
+// client returns an S3 client for the bucket's region, which is looked up on first use.
+func (r *StagingRun) client() (*s3.S3, error) {
+	r.Lock()
+	defer r.Unlock()
+	if r.s3s != nil {
+		return r.s3s, nil
+	}
+
+	s3s, err := bucketClient(r.awsCfg, r.Location.Bucket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to locate staging bucket %s: %s", r.Location.Bucket, err)
+	}
+	r.s3s = s3s
+	return r.s3s, nil
+}
+
+// bucketClient returns an S3 client for the region of the bucket.
+func bucketClient(awsCfg aws.Config, bucket string) (*s3.S3, error) {
+	input := s3.GetBucketLocationInput{Bucket: &bucket}
+	result, err := newS3Client(awsCfg).GetBucketLocationRequest(&input).Send()
+	if err != nil {
+		return nil, err
+	}
+	cfg := awsCfg.Copy()
+	switch result.LocationConstraint {
+	case "":
+		cfg.Region = "us-east-1"
+	case s3.BucketLocationConstraintEu:
+		cfg.Region = "eu-west-1"
+	default:
+		cfg.Region = string(result.LocationConstraint)
+	}
+	return newS3Client(cfg), nil
+}
+
+// newS3Client returns an S3 client that addresses buckets by path when S3 is reached through --endpoint-url, since
+// emulators seldom resolve bucket names as subdomains.
+func newS3Client(cfg aws.Config) *s3.S3 {
+	client := s3.New(cfg)
+	client.ForcePathStyle = HasCustomEndpoint(cfg, s3.EndpointsID)
+	return client
+}
+
+// ObjectKey returns the key of a named object staged by this invocation, without remembering it for Cleanup, as a
+// dry-run shows it.
+func (r *StagingRun) ObjectKey(name string) string {
+	key := r.Id + "/" + name
+	if len(r.Location.Prefix) > 0 {
+		key = r.Location.Prefix + "/" + key
+	}
+	return key
+}
+
+// Key returns the key of a named object staged by this invocation, and remembers it for Cleanup.
+func (r *StagingRun) Key(name string) string {
+	key := r.ObjectKey(name)
+	r.Lock()
+	defer r.Unlock()
+	for _, existing := range r.keys {
+		if existing == key {
+			return key
+		}
+	}
+	r.keys = append(r.keys, key)
+	return key
+}
+
+func (r *StagingRun) Url(key string) string {
+	return StagingUrlScheme + r.Location.Bucket + "/" + key
+}
+
+// Upload stages the data under the named key.
+func (r *StagingRun) Upload(name string, data []byte) (string, error) {
+	s3s, err := r.client()
+	if err != nil {
+		return "", err
+	}
+	key := r.Key(name)
+	input := s3.PutObjectInput{Bucket: &r.Location.Bucket, Key: &key, Body: bytes.NewReader(data)}
+	if _, err := s3s.PutObjectRequest(&input).Send(); err != nil {
+		return "", fmt.Errorf("failed to upload %s: %s", r.Url(key), err)
+	}
+	return key, nil
+}
+
+// PresignGet returns a URL that allows the object to be downloaded without credentials until it expires.
+func (r *StagingRun) PresignGet(key string, expiry time.Duration) (string, error) {
+	s3s, err := r.client()
+	if err != nil {
+		return "", err
+	}
+	return s3s.GetObjectRequest(&s3.GetObjectInput{Bucket: &r.Location.Bucket, Key: &key}).Presign(expiry)
+}
+
+// PresignPut returns a URL that allows the object to be uploaded without credentials until it expires.
+func (r *StagingRun) PresignPut(key string, expiry time.Duration) (string, error) {
+	s3s, err := r.client()
+	if err != nil {
+		return "", err
+	}
+	return s3s.PutObjectRequest(&s3.PutObjectInput{Bucket: &r.Location.Bucket, Key: &key}).Presign(expiry)
+}
+
+// Download opens a staged object for reading.
+func (r *StagingRun) Download(key string) (io.ReadCloser, error) {
+	s3s, err := r.client()
+	if err != nil {
+		return nil, err
+	}
+	result, err := s3s.GetObjectRequest(&s3.GetObjectInput{Bucket: &r.Location.Bucket, Key: &key}).Send()
+	if err != nil {
+		return nil, fmt.Errorf("failed to download %s: %s", r.Url(key), err)
+	}
+	return result.Body, nil
+}
+
+// Cleanup deletes every object staged by this invocation, whether or not it was uploaded.
+func (r *StagingRun) Cleanup() {
+	r.Lock()
+	keys := r.keys
+	r.keys = nil
+	r.Unlock()
+	if len(keys) == 0 {
+		return
+	}
+
+	s3s, err := r.client()
+	if err != nil {
+		log.Printf("WARNING: %s\n", err)
+		return
+	}
+	for i := range keys {
+		input := s3.DeleteObjectInput{Bucket: &r.Location.Bucket, Key: &keys[i]}
+		if _, err := s3s.DeleteObjectRequest(&input).Send(); err != nil {
+			log.Printf("WARNING: failed to delete staged object %s: %s\n", r.Url(keys[i]), err)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+/*
+ * Copyright 2018 Mark Adamcin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/defaults"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeS3 records the requests sent to it, answering GetBucketLocation and DeleteObject.
+type fakeS3 struct {
+	sync.Mutex
+	requests []string
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	s.requests = append(s.requests, r.Method+" "+r.URL.RequestURI())
+	s.Unlock()
+	if _, ok := r.URL.Query()["location"]; ok {
+		w.Write([]byte(`<LocationConstraint xmlns="http://s3.amazonaws.com/doc/2006-03-01/"></LocationConstraint>`))
+	} else if r.Method == http.MethodDelete {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// newStagingTestRun returns a staging run whose S3 requests are sent to the fake.
+func newStagingTestRun(t *testing.T, s3s *fakeS3) (*StagingRun, func()) {
+	server := httptest.NewServer(s3s)
+	cfg := defaults.Config()
+	cfg.Region = "us-east-1"
+	cfg.Credentials = aws.NewStaticCredentialsProvider("AKID", "SECRET", "")
+	cfg.EndpointResolver = &EndpointResolver{URL: server.URL, Fallback: cfg.EndpointResolver}
+	location, err := ParseStagingUrl("s3://staging/overrun")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewStagingRun(cfg, location), server.Close
+}
+
+// withStdin replaces os.Stdin with a file holding the data.
+func withStdin(t *testing.T, data []byte) func() {
+	fh, err := ioutil.TempFile("", "overrun-stdin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fh.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fh.Seek(0, 0); err != nil {
+		t.Fatal(err)
+	}
+	stdin := os.Stdin
+	os.Stdin = fh
+	return func() {
+		os.Stdin = stdin
+		fh.Close()
+		os.Remove(fh.Name())
+	}
+}
+
+func TestDryRunStaging(t *testing.T) {
+	s3s := &fakeS3{}
+	staging, closeS3 := newStagingTestRun(t, s3s)
+	defer closeS3()
+	prefs := parseTestArgs(nil, "-c", "main", "-t", "app", "--stdin", "--staging", "s3://staging/overrun", "--dry-run",
+		"--", "psql").Args()
+
+	restoreStdin := withStdin(t, bytes.Repeat([]byte("x"), StdinInlineLimit))
+	var out bytes.Buffer
+	restore := captureLog(&out, false)
+	stdin, err := prepareStdin(&prefs, staging)
+	restore()
+	restoreStdin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stdin.Staged || !strings.Contains(out.String(), "Would upload") {
+		t.Errorf("got %+v, want input that would be staged: %s", stdin, out.String())
+	}
+
+	ctx := ExecutionContext{Target: Target{Cluster: "main"}, Invocation: &Invocation{Staging: staging}}
+	jobs, err := buildJobs(&prefs, stdin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefs.Artifacts = []ArtifactSpec{{ContainerPath: "/srv/out", LocalPath: "out"}}
+	if _, key, err := prepareArtifacts(&prefs, &ctx, &jobs[0]); err != nil {
+		t.Fatal(err)
+	} else if !strings.HasSuffix(key, "/artifacts/main/0.tar.gz") {
+		t.Errorf("got artifact key %s", key)
+	}
+
+	staging.Cleanup()
+	if len(s3s.requests) > 0 {
+		t.Errorf("dry-run sent S3 requests: %s", s3s.requests)
+	}
+
+	// staged objects are deleted once the tasks have stopped.
+	key := staging.Key("stdin")
+	staging.Cleanup()
+	if want := "DELETE /staging/" + key; len(s3s.requests) != 2 || s3s.requests[1] != want {
+		t.Errorf("got S3 requests %s, want %s after the bucket location", s3s.requests, want)
+	}
+}
@@ -0,0 +1,118 @@
+/*
+ * Copyright 2018 Mark Adamcin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+)
+
+const EnvOverrunStdin = "OVERRUN_STDIN"
+const EnvOverrunStdinUrl = "OVERRUN_STDIN_URL"
+
+// the largest base64-encoded stdin passed inline in an environment override. ECS limits the size of a task's
+// overrides to 8 KiB, which must also hold the command and other environment variables.
+const StdinInlineLimit = 6 * 1024
+
+// how long the presigned URL of staged stdin remains valid, which must cover the time taken to place the task and
+// pull its image.
+const StdinUrlExpiry = time.Hour
+
+// StdinInput feeds this process's stdin to the command of each job.
+type StdinInput struct {
+	// environment overrides carrying the input, or its location.
+	Environment map[string]string
+
+	// shell command that writes the input to stdout inside the container.
+	source string
+
+	// true when the input was uploaded to the staging location.
+	Staged bool
+}
+
+// Wrap pipes the input into a shell script.
+func (in *StdinInput) Wrap(script string) string {
+	return in.source + " | ( " + script + " )"
+}
+
+// prepareStdin reads stdin to its end. Small input is passed to the task as a base64-encoded environment variable.
+// Larger input is uploaded to the staging location, and the task downloads it from a presigned URL using curl or wget.
+func prepareStdin(prefs *ParsedArgs, staging *StagingRun) (*StdinInput, error) {
+	if IsTerminal(os.Stdin) {
+		log.Println("Reading task input from the terminal. Press ctrl-d to end it.")
+	}
+	data, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		return nil, err
+	}
+
+	encoded := base64.StdEncoding.EncodeToString(data)
+	if len(encoded) <= StdinInlineLimit {
+		return &StdinInput{
+			Environment: map[string]string{EnvOverrunStdin: encoded},
+			source:      `printf '%s' "$` + EnvOverrunStdin + `" | base64 -d`}, nil
+	}
+
+	if staging == nil {
+		return nil, fmt.Errorf("stdin is %d bytes, which is too large to pass inline; specify --staging s3://bucket/prefix to upload it", len(data))
+	}
+
+	input := StdinInput{
+		Environment: map[string]string{},
+		source:      `{ curl -fsS "$` + EnvOverrunStdinUrl + `" || wget -qO- "$` + EnvOverrunStdinUrl + `"; }`,
+		Staged:      true}
+	if prefs.DryRun {
+		log.Printf("Would upload %d bytes of stdin to %s.\n", len(data), staging.Url(staging.ObjectKey("stdin")))
+		input.Environment[EnvOverrunStdinUrl] = "<presigned url>"
+		return &input, nil
+	}
+
+	key, err := staging.Upload("stdin", data)
+	if err != nil {
+		return nil, err
+	}
+	url, err := staging.PresignGet(key, StdinUrlExpiry)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Uploaded %d bytes of stdin to %s.\n", len(data), staging.Url(key))
+	input.Environment[EnvOverrunStdinUrl] = url
+	return &input, nil
+}
+
+// wrapStdin pipes the input into the command of each job, which must be given after -- or by a --commands-file.
+func wrapStdin(prefs *ParsedArgs, jobs []TaskJob, stdin *StdinInput) error {
+	for i := range jobs {
+		job := &jobs[i]
+		if len(job.Script) == 0 {
+			return errors.New("--stdin requires a command after -- or a --commands-file")
+		}
+		job.Script = stdin.Wrap(job.Script)
+		job.Command = shellCommand(prefs, job.Script)
+		if job.Environment == nil {
+			job.Environment = make(map[string]string, len(stdin.Environment))
+		}
+		for key, val := range stdin.Environment {
+			job.Environment[key] = val
+		}
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+/*
+ * Copyright 2018 Mark Adamcin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"log"
+	"sort"
+	"strings"
+)
+
+// RunTask accepts NONE to disable tag propagation, which the vendored SDK does not define.
+const PropagateTagsNone = ecs.PropagateTags("NONE")
+
+// ValidateTag checks that a --tag value has the form key=value. The value may be empty.
+func ValidateTag(spec string) (string, error) {
+	kv := strings.SplitN(spec, "=", 2)
+	if len(kv) != 2 || len(kv[0]) == 0 {
+		return "", fmt.Errorf("invalid tag %s. Expected key=value", spec)
+	}
+	return spec, nil
+}
+
+// ParsePropagateTags accepts the values of --propagate-tags that are valid for RunTask.
+func ParsePropagateTags(value string) (ecs.PropagateTags, error) {
+	switch propagate := ecs.PropagateTags(strings.ToUpper(value)); propagate {
+	case ecs.PropagateTagsTaskDefinition, PropagateTagsNone:
+		return propagate, nil
+	}
+	return "", fmt.Errorf("invalid --propagate-tags value: %s. Valid values: %s, %s", value,
+		ecs.PropagateTagsTaskDefinition, PropagateTagsNone)
+}
+
+// LoadDefaultTags returns the tags under the top-level tags key of the nearest .overrun.yml file, which are applied to
+// every task, with ${VAR} references replaced from the environment. Tags that reference undefined variables are left
+// out, so that a tag such as the URL of a CI job is only applied where the variable is defined.
+//
+//	tags:
+//	  team: data
+//	  ci-job: ${CI_JOB_URL}
+func LoadDefaultTags(dryRun bool) (map[string]string, error) {
+	if _, err := FindPresetsFile(); err != nil {
+		return nil, nil
+	}
+	presets, err := LoadPresets()
+	if err != nil {
+		return nil, err
+	}
+	tags := make(map[string]string, len(presets.Tags))
+	for key, value := range presets.Tags {
+		expanded, err := SubstituteVars(value)
+		if err != nil {
+			if dryRun {
+				log.Printf("Skipping default tag %s: %s\n", key, err)
+			}
+			continue
+		}
+		tags[key] = expanded
+	}
+	return tags, nil
+}
+
+// applyDefaultTags adds the default tags from the config file to the tags given by --tag, which take precedence.
+func applyDefaultTags(prefs *ParsedArgs) error {
+	defaults, err := LoadDefaultTags(prefs.DryRun)
+	if err != nil {
+		return err
+	}
+	if len(defaults) == 0 {
+		return nil
+	}
+	tags := make(map[string]string, len(defaults)+len(prefs.Tags))
+	for key, value := range defaults {
+		tags[key] = value
+	}
+	for key, value := range prefs.Tags {
+		tags[key] = value
+	}
+	prefs.Tags = tags
+	return nil
+}
+
+// EcsTags converts tags to the RunTask form, sorted by key.
+func EcsTags(tags map[string]string) []ecs.Tag {
+	var keys []string
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	ecsTags := make([]ecs.Tag, len(keys))
+	for i, key := range keys {
+		ecsTags[i] = ecs.Tag{Key: aws.String(key), Value: aws.String(tags[key])}
+	}
+	return ecsTags
+}
@@ -0,0 +1,245 @@
+/*
+ * Copyright 2018 Mark Adamcin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"log"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Target identifies a cluster, and optionally a region, on which to run the job.
+type Target struct {
+	Cluster string
+	Region  string
+}
+
+func (t Target) String() string {
+	if len(t.Region) == 0 {
+		return t.Cluster
+	}
+	return t.Cluster + "@" + t.Region
+}
+
+// ParseTarget parses a target in the form cluster@region. The region may be omitted to use the default region.
+func ParseTarget(spec string) (Target, error) {
+	parts := strings.SplitN(strings.TrimSpace(spec), "@", 2)
+	target := Target{Cluster: parts[0]}
+	if len(parts) > 1 {
+		target.Region = parts[1]
+	}
+	if len(target.Cluster) == 0 {
+		return target, errors.New("invalid target, cluster is required: " + spec)
+	}
+	return target, nil
+}
+
+// ReadTargetsFile reads one cluster@region target per line, skipping blank lines and lines starting with '#'.
+func ReadTargetsFile(filename string) ([]Target, error) {
+	fh, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+
+	var targets []Target
+	scanner := bufio.NewScanner(fh)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) > 0 && !strings.HasPrefix(line, "#") {
+			target, err := ParseTarget(line)
+			if err != nil {
+				return nil, fmt.Errorf("targets file %s: %s", filename, err)
+			}
+			targets = append(targets, target)
+		}
+	}
+	return targets, scanner.Err()
+}
+
+// buildTargets combines each --cluster with each --region, followed by any targets listed in the --targets file.
+func buildTargets(prefs *ParsedArgs) ([]Target, error) {
+	var targets []Target
+	regions := prefs.AwsRegions
+	if len(regions) == 0 {
+		regions = []string{""}
+	}
+	for _, cluster := range prefs.Clusters {
+		for _, region := range regions {
+			targets = append(targets, Target{Cluster: cluster, Region: region})
+		}
+	}
+
+	if len(prefs.TargetsFile) > 0 {
+		fileTargets, err := ReadTargetsFile(prefs.TargetsFile)
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, fileTargets...)
+	}
+	return targets, nil
+}
+
+// SplitList splits a comma-separated option value, ignoring empty elements.
+func SplitList(value string) []string {
+	var values []string
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); len(v) > 0 {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+type TargetResult struct {
+	Target Target
+
+	Results []TaskResult
+
+	Err error
+}
+
+func (r *TargetResult) Failed() bool {
+	if r.Err != nil {
+		return true
+	}
+	for _, result := range r.Results {
+		if result.Failed() {
+			return true
+		}
+	}
+	return false
+}
+
+// newTargetContext resolves the task definition, container definition and RunTask input for a single target, using an
+// AWS config derived from the base config for the target's region.
+func newTargetContext(prefs *ParsedArgs, baseCfg aws.Config, inv *Invocation, target Target, label string) (*ExecutionContext, error) {
+	awsCfg := baseCfg.Copy()
+	if len(target.Region) > 0 {
+		awsCfg.Region = target.Region
+	}
+
+	ctx := ExecutionContext{
+		AwsConfig:  &awsCfg,
+		Target:     target,
+		Label:      label,
+		TaskDef:    prefs.TaskDef,
+		StreamLog:  prefs.StreamLog,
+		AnyFilters: append([]ec2.Filter(nil), prefs.AnyFilters...),
+		Invocation: inv}
+	ctx.connect()
+
+	if err := resolveTaskDefinition(prefs, &ctx); err != nil {
+		return nil, err
+	}
+
+	if len(prefs.EnvironmentFiles) > 0 {
+		if err := checkEnvironmentFiles(prefs, &ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	if ctx.StreamLog {
+		if err := CheckLogConfiguration(ctx.ContainerDefinition); err != nil {
+			log.Printf("%sWARNING: Cannot stream logs: %s\n", label, err)
+			ctx.StreamLog = false
+		}
+	}
+
+	if prefs.DryRun {
+		logDryRunFilters(prefs)
+	}
+
+	runTaskInput, err := buildRunTaskInput(prefs, &ctx)
+	if err != nil {
+		return nil, err
+	}
+	ctx.RunTaskInput = runTaskInput
+	return &ctx, nil
+}
+
+// runTarget runs every job on a single target. Task definitions registered from --task-def-file are deregistered
+// afterwards if requested.
+func runTarget(prefs *ParsedArgs, baseCfg aws.Config, inv *Invocation, target Target, label string, jobs []TaskJob,
+	tracker *TaskTracker) TargetResult {
+	result := TargetResult{Target: target}
+	ctx, err := newTargetContext(prefs, baseCfg, inv, target, label)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+
+	if prefs.DryRun {
+		for i := range jobs {
+			job := &jobs[i]
+			if len(prefs.Artifacts) > 0 {
+				if job, _, err = prepareArtifacts(prefs, ctx, job); err != nil {
+					result.Err = err
+					return result
+				}
+			}
+			ctx.RunTaskInput.Overrides = buildOverrides(prefs, ctx, job)
+			log.Println(ctx.RunTaskInput.String())
+			if len(ctx.RunTaskExtras) > 0 {
+				log.Println("Additional RunTask members: " + ctx.RunTaskExtras.String())
+			}
+		}
+		return result
+	}
+
+	result.Results = runJobs(prefs, ctx, jobs, tracker)
+
+	if prefs.DeregisterTaskDef && len(prefs.TaskDefFile) > 0 {
+		// tasks continue to run after their task definition becomes INACTIVE.
+		deregisterTaskDef(ctx.Ecs, ctx.TaskDef)
+	}
+	return result
+}
+
+// runTargets runs the jobs on each target, either in sequence or all at once.
+func runTargets(prefs *ParsedArgs, baseCfg aws.Config, inv *Invocation, targets []Target, jobs []TaskJob,
+	tracker *TaskTracker) []TargetResult {
+	results := make([]TargetResult, len(targets))
+	var group sync.WaitGroup
+	for i, target := range targets {
+		label := ""
+		if len(targets) > 1 {
+			label = target.String() + " "
+		}
+		if !prefs.ParallelTargets {
+			if tracker.Stopping() {
+				results[i] = TargetResult{Target: target, Err: errors.New("skipped after SIGINT")}
+			} else {
+				results[i] = runTarget(prefs, baseCfg, inv, target, label, jobs, tracker)
+			}
+			continue
+		}
+		group.Add(1)
+		go func(i int, target Target, label string) {
+			defer group.Done()
+			results[i] = runTarget(prefs, baseCfg, inv, target, label, jobs, tracker)
+		}(i, target, label)
+	}
+	group.Wait()
+	return results
+}
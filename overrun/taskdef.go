@@ -0,0 +1,257 @@
+/*
+ * Copyright 2018 Mark Adamcin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/private/protocol/json/jsonutil"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+const MatchVarReference = `\$\{([A-Za-z_][A-Za-z0-9_]*)\}`
+
+// SubstituteVars replaces each ${VAR} reference in text with the value of the named environment variable. Bare $VAR
+// references are left alone so that shell syntax in container commands survives. Referencing an unset variable is an
+// error, since silently registering an empty value is rarely what was intended.
+func SubstituteVars(text string) (string, error) {
+	varPat := regexp.MustCompile(MatchVarReference)
+	var missing []string
+	result := varPat.ReplaceAllStringFunc(text, func(ref string) string {
+		name := varPat.FindStringSubmatch(ref)[1]
+		if val, ok := os.LookupEnv(name); ok {
+			return val
+		}
+		missing = append(missing, name)
+		return ref
+	})
+	if len(missing) > 0 {
+		return "", errors.New("undefined variables referenced: " + strings.Join(missing, ", "))
+	}
+	return result, nil
+}
+
+// LoadTaskDefinitionFile reads a task definition in the format accepted by
+// aws ecs register-task-definition --cli-input-json, after substituting ${VAR} references.
+func LoadTaskDefinitionFile(filename string) (*ecs.RegisterTaskDefinitionInput, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	text, err := SubstituteVars(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("task definition file %s: %s", filename, err)
+	}
+
+	input := ecs.RegisterTaskDefinitionInput{}
+	if err := jsonutil.UnmarshalJSON(&input, bytes.NewBufferString(text)); err != nil {
+		return nil, fmt.Errorf("task definition file %s: %s", filename, err)
+	}
+
+	if err := input.Validate(); err != nil {
+		return nil, fmt.Errorf("task definition file %s: %s", filename, err)
+	}
+
+	return &input, nil
+}
+
+// TaskDefinitionFromInput mirrors an unregistered task definition so that overrides can be constructed during a dry-run.
+func TaskDefinitionFromInput(input *ecs.RegisterTaskDefinitionInput) *ecs.TaskDefinition {
+	return &ecs.TaskDefinition{
+		ContainerDefinitions:    input.ContainerDefinitions,
+		Cpu:                     input.Cpu,
+		ExecutionRoleArn:        input.ExecutionRoleArn,
+		Family:                  input.Family,
+		IpcMode:                 input.IpcMode,
+		Memory:                  input.Memory,
+		NetworkMode:             input.NetworkMode,
+		PidMode:                 input.PidMode,
+		PlacementConstraints:    input.PlacementConstraints,
+		RequiresCompatibilities: input.RequiresCompatibilities,
+		TaskRoleArn:             input.TaskRoleArn,
+		Volumes:                 input.Volumes}
+}
+
+// the kinds of task definition selectors, given as family@kind=value.
+const (
+	SelectImageTag = "image-tag"
+	SelectTag      = "tag:"
+	SelectService  = "service"
+)
+
+// TaskDefSelector selects a revision of a task definition family by the tag of its container image, by one of its own
+// tags, or by the ECS service that currently deploys it.
+type TaskDefSelector struct {
+	Family string
+
+	Kind string
+
+	// the tag key of a SelectTag selector.
+	Key string
+
+	Value string
+}
+
+func (s *TaskDefSelector) String() string {
+	if s.Kind == SelectTag {
+		return fmt.Sprintf("%s@%s%s=%s", s.Family, SelectTag, s.Key, s.Value)
+	}
+	return fmt.Sprintf("%s@%s=%s", s.Family, s.Kind, s.Value)
+}
+
+// ParseTaskDefSelector parses a --task-def value of the form family@image-tag=v1.4.2, family@tag:release=stable or
+// family@service=api. Returns nil if the value is not a selector.
+func ParseTaskDefSelector(value string) (*TaskDefSelector, error) {
+	at := strings.Index(value, "@")
+	if at < 0 {
+		return nil, nil
+	}
+	selector := TaskDefSelector{Family: value[:at]}
+	spec := value[at+1:]
+	if strings.HasPrefix(spec, SelectTag) {
+		selector.Kind = SelectTag
+		spec = strings.TrimPrefix(spec, SelectTag)
+		kv := strings.SplitN(spec, "=", 2)
+		if len(kv) != 2 || len(kv[0]) == 0 {
+			return nil, fmt.Errorf("invalid task definition selector %s. Expected family@tag:key=value", value)
+		}
+		selector.Key, selector.Value = kv[0], kv[1]
+	} else {
+		kv := strings.SplitN(spec, "=", 2)
+		if len(kv) != 2 || (kv[0] != SelectImageTag && kv[0] != SelectService) || len(kv[1]) == 0 {
+			return nil, fmt.Errorf("invalid task definition selector %s. Expected family@image-tag=tag, "+
+				"family@tag:key=value or family@service=name", value)
+		}
+		selector.Kind, selector.Value = kv[0], kv[1]
+	}
+	if len(selector.Family) == 0 {
+		return nil, fmt.Errorf("invalid task definition selector %s: missing family", value)
+	}
+	return &selector, nil
+}
+
+// ImageTag returns the tag of a container image reference, such as v1.4.2 for repo/app:v1.4.2, or latest when the
+// reference has no tag.
+func ImageTag(image string) string {
+	if at := strings.Index(image, "@"); at >= 0 {
+		image = image[:at]
+	}
+	if colon := strings.LastIndex(image, ":"); colon > strings.LastIndex(image, "/") {
+		return image[colon+1:]
+	}
+	return "latest"
+}
+
+// taskDefinitionFamily returns the family of a task definition ARN, such as app for
+// arn:aws:ecs:us-east-1:123456789012:task-definition/app:12.
+func taskDefinitionFamily(arn string) string {
+	name := path.Base(arn)
+	if colon := strings.LastIndex(name, ":"); colon >= 0 {
+		return name[:colon]
+	}
+	return name
+}
+
+// matches returns true if the described revision matches an image-tag or tag selector. Image tags are only
+// matched against the named container, when one is given.
+func (s *TaskDefSelector) matches(described *ecs.DescribeTaskDefinitionOutput, containerName string) bool {
+	switch s.Kind {
+	case SelectImageTag:
+		for _, container := range described.TaskDefinition.ContainerDefinitions {
+			if len(containerName) > 0 && aws.StringValue(container.Name) != containerName {
+				continue
+			}
+			if ImageTag(aws.StringValue(container.Image)) == s.Value {
+				return true
+			}
+		}
+	case SelectTag:
+		for _, tag := range described.Tags {
+			if aws.StringValue(tag.Key) == s.Key && aws.StringValue(tag.Value) == s.Value {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// SelectTaskDefinition returns the ARN of the revision chosen by the selector. For image-tag and tag selectors, this is
+// the newest ACTIVE revision that matches. For service selectors, this is the revision of the service's primary
+// deployment on the cluster.
+func SelectTaskDefinition(ecss EcsAPI, cluster string, selector *TaskDefSelector, containerName string) (string, error) {
+	if selector.Kind == SelectService {
+		dsInput := ecs.DescribeServicesInput{Cluster: &cluster, Services: []string{selector.Value}}
+		dsResult, err := ecss.DescribeServices(&dsInput)
+		if err != nil {
+			return "", err
+		} else if len(dsResult.Services) == 0 {
+			return "", fmt.Errorf("service %s not found on cluster %s", selector.Value, cluster)
+		}
+		service := dsResult.Services[0]
+		arn := aws.StringValue(service.TaskDefinition)
+		for _, deployment := range service.Deployments {
+			if aws.StringValue(deployment.Status) == "PRIMARY" {
+				arn = aws.StringValue(deployment.TaskDefinition)
+			}
+		}
+		if taskDefinitionFamily(arn) != selector.Family {
+			return "", fmt.Errorf("service %s runs task definition %s, which is not of family %s", selector.Value, arn,
+				selector.Family)
+		}
+		return arn, nil
+	}
+
+	ltdInput := ecs.ListTaskDefinitionsInput{
+		FamilyPrefix: &selector.Family,
+		Status:       ecs.TaskDefinitionStatusActive,
+		Sort:         ecs.SortOrderDesc}
+	for {
+		ltdResult, err := ecss.ListTaskDefinitions(&ltdInput)
+		if err != nil {
+			return "", err
+		}
+		for _, arn := range ltdResult.TaskDefinitionArns {
+			// the prefix also matches longer family names.
+			if taskDefinitionFamily(arn) != selector.Family {
+				continue
+			}
+			dtdInput := ecs.DescribeTaskDefinitionInput{TaskDefinition: aws.String(arn)}
+			if selector.Kind == SelectTag {
+				dtdInput.Include = []ecs.TaskDefinitionField{ecs.TaskDefinitionFieldTags}
+			}
+			dtdResult, err := ecss.DescribeTaskDefinition(&dtdInput)
+			if err != nil {
+				return "", err
+			}
+			if selector.matches(dtdResult, containerName) {
+				return arn, nil
+			}
+		}
+		if ltdResult.NextToken == nil {
+			return "", fmt.Errorf("no active revision of %s matches %s", selector.Family, selector)
+		}
+		ltdInput.NextToken = ltdResult.NextToken
+	}
+}
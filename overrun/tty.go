@@ -0,0 +1,44 @@
+/*
+ * Copyright 2018 Mark Adamcin
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"golang.org/x/crypto/ssh/terminal"
+	"os"
+)
+
+// IsTerminal returns true if the file is attached to a terminal.
+func IsTerminal(f *os.File) bool {
+	return terminal.IsTerminal(int(f.Fd()))
+}
+
+// MakeRaw puts the terminal into raw mode, so that keystrokes such as ctrl-c are passed through to a remote session
+// rather than interpreted locally. The returned function restores the previous mode.
+func MakeRaw(f *os.File) (func(), error) {
+	state, err := terminal.MakeRaw(int(f.Fd()))
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		_ = terminal.Restore(int(f.Fd()), state)
+	}, nil
+}
+
+// GetTerminalSize returns the columns and rows of the terminal.
+func GetTerminalSize(f *os.File) (int, int, error) {
+	return terminal.GetSize(int(f.Fd()))
+}